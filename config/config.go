@@ -1,6 +1,7 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"strconv"
 	"strings"
@@ -21,6 +22,142 @@ type ConsulConfig struct {
 	HealthCheckId string // 心跳检查的Check ID
 }
 
+// disable plugin rule, also used by dashboard api to edit rules at runtime
+type DisableRuleConfig struct {
+	Id           string                      `json:"id,omitempty"`
+	Methods      []string                    `json:"methods,omitempty"`      // exact names or globs like "admin_*"
+	MethodRegex  string                      `json:"method_regex,omitempty"` // regex of method names
+	Params       []ValueMatcherConfig    `json:"params,omitempty"`       // all params matchers must match
+	Schedules    []DisableScheduleConfig `json:"schedules,omitempty"`    // rule only works in one of these time windows, empty means always
+	Clients      []string                `json:"clients,omitempty"`      // client ip CIDR ranges, empty means all clients
+	ApiKeys      []string                `json:"api_keys,omitempty"`     // client api keys, empty means all keys
+	ErrorCode    int                     `json:"error_code,omitempty"`
+	ErrorMessage string                  `json:"error_message,omitempty"`
+}
+
+// matcher of a value in rpc params or result, all conditions set must match
+type ValueMatcherConfig struct {
+	Path   string      `json:"path"`             // json path in params or result, eg. "0", "0.to" or "address". empty means the whole value
+	Equals interface{} `json:"equals,omitempty"` // value equals to
+	Regex  string      `json:"regex,omitempty"`  // string value matches the regex
+	Null   bool        `json:"null,omitempty"`   // value is null or missing
+	Empty  bool        `json:"empty,omitempty"`  // value is null, missing, "", "0x", [] or {}
+}
+
+type DisableScheduleConfig struct {
+	Start      string `json:"start,omitempty"`       // RFC3339 time, empty means no start limit
+	End        string `json:"end,omitempty"`         // RFC3339 time, empty means no end limit
+	DailyStart string `json:"daily_start,omitempty"` // "HH:MM", greater than daily_end means crossing midnight
+	DailyEnd   string `json:"daily_end,omitempty"`
+	Timezone   string `json:"timezone,omitempty"` // IANA timezone name of daily window, UTC by default
+}
+
+// cache plugin config of a method
+type CacheItemConfig struct {
+	Name           string        `json:"name"`
+	ParamsForCache []interface{} `json:"paramsForCache"`
+	ExpireSeconds  int64         `json:"expire_seconds"`
+	StaleSeconds   int64         `json:"stale_seconds,omitempty"` // serve the expired value for this grace period while refreshing it in background
+
+	TtlRules           []*CacheTtlRuleConfig `json:"ttl_rules,omitempty"`            // the first rule matching the params decides the TTL
+	CacheErrors        bool                  `json:"cache_errors,omitempty"`         // also cache jsonrpc error responses(negative caching)
+	ErrorExpireSeconds int64                 `json:"error_expire_seconds,omitempty"` // TTL of cached error responses, 1 by default
+	NoCacheResults     []ValueMatcherConfig  `json:"no_cache_results,omitempty"`     // responses whose result matches any of them are not cached
+}
+
+// TTL of the cache item's requests whose params match the rule
+type CacheTtlRuleConfig struct {
+	Params        []ValueMatcherConfig `json:"params"`         // all params matchers must match
+	ExpireSeconds int64                `json:"expire_seconds"` // 0 means not cached
+	StaleSeconds  int64                `json:"stale_seconds,omitempty"`
+}
+
+// a method+params combination refreshed by cache plugin before it expires
+type CacheKeepWarmConfig struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// cache plugin config. the legacy format, an array of CacheItemConfig, is also supported
+type CachesConfig struct {
+	Backend struct {
+		Type      string `json:"type,omitempty"`       // "memory"(default) or "redis"
+		Url       string `json:"url,omitempty"`        // redis url, eg. redis://:password@127.0.0.1:6379/2
+		KeyPrefix string `json:"key_prefix,omitempty"` // prefix of keys in the shared backend, "jsonrpc_proxygo:cache:" by default
+
+		// limits of memory backend, 0 means the default limits
+		MaxItems       int64            `json:"max_items,omitempty"`
+		MaxBytes       int64            `json:"max_bytes,omitempty"`
+		Eviction       string           `json:"eviction,omitempty"`         // "lru"(default) or "lfu"
+		MethodMaxBytes map[string]int64 `json:"method_max_bytes,omitempty"` // memory quota of rpc methods
+	} `json:"backend,omitempty"`
+	// request coalescing: only one replica requests upstream for a missed key, others wait for its response in the backend
+	Coalesce struct {
+		Start      bool  `json:"start,omitempty"`
+		LockMillis int64 `json:"lock_ms,omitempty"` // max time a replica holds the key lock, 5000 by default
+		WaitMillis int64 `json:"wait_ms,omitempty"` // max time to wait for the lock holder's response, 3000 by default
+	} `json:"coalesce,omitempty"`
+	// broadcast purges by dashboard apis to other replicas by redis pub/sub
+	PurgeBroadcast struct {
+		Start   bool   `json:"start,omitempty"`
+		Url     string `json:"url,omitempty"`     // redis url, backend.url by default
+		Channel string `json:"channel,omitempty"` // backend.key_prefix + "purge" by default
+	} `json:"purge_broadcast,omitempty"`
+	// snapshot of memory backend, restored on start and saved periodically and on graceful shutdown
+	Snapshot struct {
+		File            string `json:"file,omitempty"`             // empty means no snapshot
+		IntervalSeconds int64  `json:"interval_seconds,omitempty"` // 0 means only saved on shutdown
+	} `json:"snapshot,omitempty"`
+	Items    []*CacheItemConfig     `json:"items,omitempty"`
+	KeepWarm []*CacheKeepWarmConfig `json:"keep_warm,omitempty"`
+}
+
+func (c *CachesConfig) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(trimmed, &c.Items)
+	}
+	type cachesConfigAlias CachesConfig
+	return json.Unmarshal(data, (*cachesConfigAlias)(c))
+}
+
+// limits of client connections and messages, 0 means no limit
+type LimitsConfig struct {
+	MaxRequestSize                   int64  `json:"max_request_size,omitempty"`  // max bytes of a request message
+	MaxResponseSize                  int64  `json:"max_response_size,omitempty"` // max bytes of a response message, larger responses are replaced by error
+	MaxConnections                   int64  `json:"max_connections,omitempty"`
+	MaxConnectionsPerIp              int64  `json:"max_connections_per_ip,omitempty"`
+	MaxInflightRequestsPerConnection int64  `json:"max_inflight_requests_per_connection,omitempty"`
+	SlowClientTimeoutMillis          int64  `json:"slow_client_timeout_ms,omitempty"` // max time to write or queue a response to a client
+	SlowClientPolicy                 string `json:"slow_client_policy,omitempty"`     // "disconnect"(default) or "drop" the response of slow clients
+}
+
+// prometheus metrics endpoint config
+type MetricsConfig struct {
+	Start    bool   `json:"start,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"` // separate listen address of metrics, "127.0.0.1:9091" by default
+	Path     string `json:"path,omitempty"`     // "/metrics" by default
+	// serve metrics on the public proxy endpoint instead, they bypass ip_acl there and expose upstream urls and methods
+	ShareProxyEndpoint bool `json:"share_proxy_endpoint,omitempty"`
+}
+
+// distributed tracing config, spans are exported to an OpenTelemetry collector by OTLP/HTTP(JSON)
+type TracingConfig struct {
+	Start           bool              `json:"start,omitempty"`
+	CollectorUrl    string            `json:"collector_url,omitempty"` // "http://127.0.0.1:4318/v1/traces" by default
+	ServiceName     string            `json:"service_name,omitempty"`  // "jsonrpc_proxygo" by default
+	Headers         map[string]string `json:"headers,omitempty"`       // extra http headers sent to the collector, eg. auth tokens
+	BatchSize       int               `json:"batch_size,omitempty"`    // max spans of an export request, 512 by default
+	FlushIntervalMs int64             `json:"flush_interval_ms,omitempty"`
+	QueueSize       int               `json:"queue_size,omitempty"` // spans are dropped if the export queue is full
+	TimeoutMs       int64             `json:"timeout_ms,omitempty"` // timeout of an export request, 10000 by default
+}
+
+const (
+	SLOW_CLIENT_POLICY_DISCONNECT = "disconnect"
+	SLOW_CLIENT_POLICY_DROP       = "drop"
+)
+
 // 本服务的配置信息
 type ServerConfig struct {
 	Resolver *ConsulConfig `json:"resolver,omitempty"` // consul agent配置
@@ -38,6 +175,12 @@ type ServerConfig struct {
 		Url string `json:"url"`
 	} `json:"registry,omitempty"`
 
+	Limits LimitsConfig `json:"limits,omitempty"`
+
+	Metrics MetricsConfig `json:"metrics,omitempty"`
+
+	Tracing TracingConfig `json:"tracing,omitempty"`
+
 	Plugins struct {
 		// upstream plugin config
 		Upstream struct {
@@ -54,40 +197,148 @@ type ServerConfig struct {
 		} `json:"http_upstream,omitempty"`
 
 		// cache plugin config
-		Caches []struct {
-			Name           string        `json:"name"`
-			ParamsForCache []interface{} `json:"paramsForCache"`
-			ExpireSeconds  int64         `json:"expire_seconds"`
-		} `json:"caches,omitempty"`
+		Caches CachesConfig `json:"caches,omitempty"`
 
 		BeforeCacheConfigs []struct {
-			MethodName                   string `json:"method"`
-			FetchCacheKeyFromParamsCount int    `json:"fetch_cache_key_from_params_count"`
+			MethodName                   string   `json:"method"`
+			FetchCacheKeyFromParamsCount int      `json:"fetch_cache_key_from_params_count"`
+			MethodKeyPaths               []string `json:"method_key_paths,omitempty"` // json paths of params appended to method name for cache, works for named params
+			KeyPaths                     []string `json:"key_paths,omitempty"`        // only these json paths of params are used in cache key
+			IgnorePaths                  []string `json:"ignore_paths,omitempty"`     // json paths of volatile params(eg. nonce) excluded from cache key
 		} `json:"before_cache_configs,omitempty"`
 
 		Statistic struct {
 			Start bool `json:"start,omitempty"`
 			Store struct {
-				Type               string `json:"type,omitempty"`
-				DbUrl              string `json:"dbUrl,omitempty"`
+				Type               string `json:"type,omitempty"`  // "memory", "mysql"("db"), "sqlite", "postgres" or a registered store type, "memory" if not set
+				DbUrl              string `json:"dbUrl,omitempty"` // DSN of the db driver, a local file by default for sqlite
 				DumpIntervalOpened bool   `json:"dumpIntervalOpened,omitempty"`
+				// request spans are buffered and inserted in batches by the db store
+				BatchSize       int   `json:"batch_size,omitempty"`        // max rows of an insert, 200 by default
+				FlushIntervalMs int64 `json:"flush_interval_ms,omitempty"` // max time a span is buffered, 1000 by default
+				QueueSize       int   `json:"queue_size,omitempty"`        // max spans buffered, more are dropped. 10000 by default
+				MaxRetries      *int  `json:"max_retries,omitempty"`       // retries after transient db errors, 3 by default
+				// ring buffer sizes of the memory store
+				Capacity      int `json:"capacity,omitempty"`       // last request spans kept, 10000 by default
+				EventCapacity int `json:"event_capacity,omitempty"` // last service down logs and health results kept, 1000 by default
 			} `json:"store,omitempty"`
+			// which requests are logged to the store with payloads, all requests are logged if not set
+			Sampling *struct {
+				Percentage      *float64 `json:"percentage,omitempty"`        // 0 ~ 100 of requests head sampled by trace id, 100 by default
+				AlwaysLogErrors bool     `json:"always_log_errors,omitempty"`
+				SlowThresholdMs int64    `json:"slow_threshold_ms,omitempty"` // requests slower than it are always logged if > 0
+				Methods         []struct {
+					Methods    []string `json:"methods"` // exact names or globs
+					Percentage float64  `json:"percentage"`
+				} `json:"methods,omitempty"` // per-method percentages, the first matched is used
+				MaxPayloadBytes int `json:"max_payload_bytes,omitempty"` // params and results longer than it are truncated if > 0
+			} `json:"sampling,omitempty"`
+			// retention of per-minute rollups by method and upstream and their hourly and daily downsamples
+			Rollup struct {
+				MinuteRetentionHours int `json:"minute_retention_hours,omitempty"` // 48 by default
+				HourRetentionDays    int `json:"hour_retention_days,omitempty"`    // 30 by default
+				DayRetentionDays     int `json:"day_retention_days,omitempty"`     // 365 by default
+			} `json:"rollup,omitempty"`
+			// daily calls, errors, bytes and rate limit denials of each client by method
+			Usage struct {
+				Start         bool     `json:"start,omitempty"`
+				Identities    []string `json:"identities,omitempty"`     // api_key, jwt_subject(verified by an auth plugin), ip tried in order, api_key and ip by default
+				ApiKeyHeader  string   `json:"api_key_header,omitempty"` // header of client api key, X-Api-Key by default
+				MaskApiKey    bool     `json:"mask_api_key,omitempty"`   // track only the last 4 chars of api keys
+				RetentionDays int      `json:"retention_days,omitempty"` // 400 by default
+			} `json:"usage,omitempty"`
 		} `json:"statistic,omitempty"`
 
+		// one json line per completed request, lines have request_id/title/body like requests.jsonl to be replayed
+		AccessLog struct {
+			Start        bool   `json:"start,omitempty"`
+			File         string `json:"file,omitempty"`           // access.log by default
+			LogPayloads  bool   `json:"log_payloads,omitempty"`   // log the request and response payloads
+			ApiKeyHeader string `json:"api_key_header,omitempty"` // header of client api key, X-Api-Key by default
+			MaskApiKey   bool   `json:"mask_api_key,omitempty"`   // log only the last 4 chars of api keys
+			Redact       []struct {
+				Methods []string `json:"methods,omitempty"` // exact names or globs, empty means all methods
+				Paths   []string `json:"paths,omitempty"`   // json paths of params or "result...", empty means the whole payloads
+			} `json:"redact,omitempty"`
+			MaxSizeMb             int   `json:"max_size_mb,omitempty"`             // rotate when the file reaches the size, 100 by default
+			MaxBackups            int   `json:"max_backups,omitempty"`             // rotated files kept, 0 means all
+			MaxAgeDays            int   `json:"max_age_days,omitempty"`            // days to keep rotated files, 0 means forever
+			Compress              bool  `json:"compress,omitempty"`                // gzip rotated files
+			RotateIntervalSeconds int64 `json:"rotate_interval_seconds,omitempty"` // also rotate periodically if > 0
+		} `json:"access_log,omitempty"`
+
+		// alert rules evaluated periodically by metrics and registry events, notified to webhooks
+		Alert struct {
+			Start           bool   `json:"start,omitempty"`
+			IntervalSeconds int64  `json:"interval_seconds,omitempty"` // evaluation interval, 30 by default
+			HistorySize     int    `json:"history_size,omitempty"`     // alert events kept, 1000 by default
+			HistoryFile     string `json:"history_file,omitempty"`     // json lines file of alert events and states restored on start, compacted automatically. memory only if empty
+			Rules           []struct {
+				Name            string   `json:"name,omitempty"` // the type by default
+				Type            string   `json:"type"`           // upstream_removed, upstream_unhealthy, error_rate, p99_latency, rate_limit_rejections or cache_hit_ratio
+				Severity        string   `json:"severity,omitempty"`
+				Methods         []string `json:"methods,omitempty"` // exact names or globs of methods, all if empty
+				Threshold       float64  `json:"threshold,omitempty"`
+				WindowSeconds   int64    `json:"window_seconds,omitempty"`   // 300 by default
+				MinRequests     int64    `json:"min_requests,omitempty"`     // methods with fewer requests in the window are ignored
+				CooldownSeconds int64    `json:"cooldown_seconds,omitempty"` // 600 by default
+			} `json:"rules,omitempty"`
+			Webhooks []struct {
+				Url          string            `json:"url"`
+				Headers      map[string]string `json:"headers,omitempty"`
+				BodyTemplate string            `json:"body_template,omitempty"` // text/template of the json body, slack compatible by default
+				TimeoutMs    int64             `json:"timeout_ms,omitempty"`
+			} `json:"webhooks,omitempty"`
+		} `json:"alert,omitempty"`
+
 		Disable struct {
-			Start              bool     `json:"start,omitempty"`
-			DisabledRpcMethods []string `json:"disabled_rpc_methods"`
+			Start              bool                 `json:"start,omitempty"`
+			DisabledRpcMethods []string             `json:"disabled_rpc_methods"`
+			ApiKeyHeader       string               `json:"api_key_header,omitempty"` // header of client api key, X-Api-Key by default
+			Rules              []*DisableRuleConfig `json:"rules,omitempty"`
 		} `json:"disable,omitempty"`
 
+		// collapse identical concurrent requests into one upstream call
+		Coalesce struct {
+			Start      bool     `json:"start,omitempty"`
+			Methods    []string `json:"methods,omitempty"` // exact names or globs of methods to coalesce, eg. "eth_blockNumber", "eth_get*"
+			WaitMillis int64    `json:"wait_ms,omitempty"` // max time to wait for the identical in-flight request, 5000 by default
+		} `json:"coalesce,omitempty"`
+
 		RateLimit struct {
 			Start          bool `json:"start,omitempty"`
 			ConnectionRate int  `json:"connection_rate,omitempty"`
 			RpcRate        int  `json:"rpc_rate,omitempty"`
 		} `json:"rate_limit,omitempty"`
 
+		IpAcl struct {
+			Start          bool     `json:"start,omitempty"`
+			Allow          []string `json:"allow,omitempty"`           // CIDR ranges or ips allowed to connect, empty means all
+			Deny           []string `json:"deny,omitempty"`            // CIDR ranges or ips denied to connect, checked before allow
+			TrustedProxies []string `json:"trusted_proxies,omitempty"` // peers whose X-Forwarded-For/X-Real-IP headers are trusted
+			MethodRules    []struct {
+				Methods []string `json:"methods"`
+				Allow   []string `json:"allow"`
+			} `json:"method_rules,omitempty"` // rpc methods only callable from some ranges, eg. admin methods
+		} `json:"ip_acl,omitempty"`
+
+		Validator struct {
+			Start       bool   `json:"start,omitempty"`
+			OpenRpcFile string `json:"openrpc_file,omitempty"` // load params schemas of methods from an OpenRPC document
+			Methods     []struct {
+				Method         string        `json:"method"`
+				ParamStructure string        `json:"param_structure,omitempty"` // 'either'(default), 'by-position' or 'by-name'
+				ParamsSchema   interface{}   `json:"params_schema,omitempty"`   // JSON Schema of the whole params value
+				SchemaFile     string        `json:"schema_file,omitempty"`     // file of params_schema
+				Params         []interface{} `json:"params,omitempty"`          // OpenRPC style param descriptors
+			} `json:"methods,omitempty"`
+		} `json:"validator,omitempty"`
+
 		Dashboard struct {
 			Start bool `json:"start,omitempty"`
 			Endpoint string `json:"endpoint"`
+			// bearer token of the admin apis(editing disable rules, listing and purging cache entries, client usage), only loopback clients can call them if empty
+			ApiToken string `json:"api_token,omitempty"`
 		} `json:"dashboard,omitempty"`
 	} `json:"plugins,omitempty"`
 }
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalCachesConfig(t *testing.T) {
+	legacy := &ServerConfig{}
+	err := UnmarshalServerConfigFromJson([]byte(`{"plugins": {"caches": [{"name": "dummyMethod", "expire_seconds": 5}]}}`), legacy)
+	assert.True(t, err == nil)
+	assert.Equal(t, 1, len(legacy.Plugins.Caches.Items))
+	assert.Equal(t, "dummyMethod", legacy.Plugins.Caches.Items[0].Name)
+
+	withBackend := &ServerConfig{}
+	err = UnmarshalServerConfigFromJson([]byte(`{"plugins": {"caches": {
+		"backend": {"type": "redis", "url": "redis://127.0.0.1:6379/2"},
+		"coalesce": {"start": true},
+		"items": [{"name": "dummyMethod", "expire_seconds": 5}]}}}`), withBackend)
+	assert.True(t, err == nil)
+	assert.Equal(t, "redis", withBackend.Plugins.Caches.Backend.Type)
+	assert.True(t, withBackend.Plugins.Caches.Coalesce.Start)
+	assert.Equal(t, int64(5), withBackend.Plugins.Caches.Items[0].ExpireSeconds)
+}
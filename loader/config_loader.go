@@ -2,20 +2,29 @@ package loader
 
 import (
 	"context"
+	"github.com/zoowii/jsonrpc_proxygo/common"
 	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/access_log"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/alert"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/cache"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/coalesce"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/dashboard"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/disable"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/http_upstream"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/ip_acl"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/load_balancer"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/rate_limit"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/statistic"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/validator"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/ws_upstream"
 	"github.com/zoowii/jsonrpc_proxygo/providers"
 	"github.com/zoowii/jsonrpc_proxygo/proxy"
 	"github.com/zoowii/jsonrpc_proxygo/registry/redis"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"strconv"
 	"time"
@@ -122,16 +131,22 @@ func LoadProviderFromConfig(configInfo *config.ServerConfig) providers.RpcProvid
 	addr := configInfo.Endpoint
 	log.Info("to start proxy server on " + addr)
 
+	limits := configInfo.Limits
+	wsOptions := &providers.WebSocketJsonRpcProviderOptions{
+		MaxRequestSize: limits.MaxRequestSize,
+		WriteTimeout:   time.Duration(limits.SlowClientTimeoutMillis) * time.Millisecond,
+	}
 	var provider providers.RpcProvider
 	switch configInfo.Provider {
 	case "http":
 		provider = providers.NewHttpJsonRpcProvider(addr, "/", &providers.HttpJsonRpcProviderOptions{
 			TimeoutSeconds: 30,
+			MaxRequestSize: limits.MaxRequestSize,
 		})
 	case "websocket":
-		provider = providers.NewWebSocketJsonRpcProvider(addr, "/")
+		provider = providers.NewWebSocketJsonRpcProvider(addr, "/", wsOptions)
 	default:
-		provider = providers.NewWebSocketJsonRpcProvider(addr, "/")
+		provider = providers.NewWebSocketJsonRpcProvider(addr, "/", wsOptions)
 	}
 	return provider
 }
@@ -174,14 +189,74 @@ func loadRegistryFromConfig(server *proxy.ProxyServer, configInfo *config.Server
 	}
 }
 
+// loadMetricsFromConfig serve the metrics of all middlewares in prometheus text format
+func loadMetricsFromConfig(configInfo *config.ServerConfig) {
+	metricsConf := configInfo.Metrics
+	if !metricsConf.Start {
+		return
+	}
+	path := metricsConf.Path
+	if len(path) < 1 {
+		path = "/metrics"
+	}
+	if metricsConf.ShareProxyEndpoint {
+		// providers serve on http.DefaultServeMux, so metrics are served on the proxy endpoint.
+		// the middlewares(eg. ip_acl) don't protect it
+		http.Handle(path, metrics.Handler())
+		log.Warnf("metrics served on path %s of the public proxy endpoint", path)
+		return
+	}
+	endpoint := utils.StringOrElse(metricsConf.Endpoint, "127.0.0.1:9091")
+	mux := http.NewServeMux()
+	mux.Handle(path, metrics.Handler())
+	log.Infof("metrics listening endpoint %s%s", endpoint, path)
+	go func() {
+		err := http.ListenAndServe(endpoint, mux)
+		if err != nil {
+			log.Fatalf("metrics server error %s", err.Error())
+		}
+	}()
+}
+
+// loadTracingFromConfig export spans of requests to the OpenTelemetry collector
+func loadTracingFromConfig(configInfo *config.ServerConfig) {
+	tracingConf := configInfo.Tracing
+	if !tracingConf.Start {
+		return
+	}
+	collectorUrl := tracingConf.CollectorUrl
+	if len(collectorUrl) < 1 {
+		collectorUrl = "http://127.0.0.1:4318/v1/traces"
+	}
+	serviceName := tracingConf.ServiceName
+	if len(serviceName) < 1 {
+		serviceName = "jsonrpc_proxygo"
+	}
+	timeout := time.Duration(tracingConf.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	exporter := tracing.NewOtlpHttpExporter(collectorUrl, serviceName, tracingConf.Headers, timeout)
+	processor := tracing.NewBatchSpanProcessor(exporter, tracingConf.BatchSize,
+		time.Duration(tracingConf.FlushIntervalMs)*time.Millisecond, tracingConf.QueueSize)
+	tracing.SetDefaultTracer(tracing.NewTracer(processor))
+	log.Infof("tracing spans exported to %s", collectorUrl)
+}
+
 func LoadPluginsFromConfig(server *proxy.ProxyServer, configInfo *config.ServerConfig) {
+	server.SetLimits(configInfo.Limits)
+	loadMetricsFromConfig(configInfo)
+	loadTracingFromConfig(configInfo)
 	loadRegistryFromConfig(server, configInfo)
 
 	ws_upstream.LoadWsUpstreamPluginConfig(server.MiddlewareChain, configInfo)
 	http_upstream.LoadHttpUpstreamPluginConfig(server.MiddlewareChain, configInfo)
 	load_balancer.LoadLoadBalancePluginConfig(server.MiddlewareChain, configInfo, server.Registry)
-	disable.LoadDisablePluginConfig(server.MiddlewareChain, configInfo)
-	cache.LoadCachePluginConfig(server.MiddlewareChain, configInfo)
+	// loaded before disable so it runs after disable, requests are checked by disable rules of their own clients
+	coalesce.LoadCoalescePluginConfig(server.MiddlewareChain, configInfo)
+	disablePlugin := disable.LoadDisablePluginConfig(server.MiddlewareChain, configInfo)
+	cachePlugin := cache.LoadCachePluginConfig(server.MiddlewareChain, configInfo)
+	validator.LoadValidatorPluginConfig(server.MiddlewareChain, configInfo)
 	cache.LoadBeforeCachePluginConfig(server.MiddlewareChain, configInfo)
 	rate_limit.LoadRateLimitPluginConfig(server.MiddlewareChain, configInfo)
 	statisticPlugin := statistic.LoadStatisticPluginConfig(server.MiddlewareChain, configInfo, server.Registry)
@@ -191,5 +266,18 @@ func LoadPluginsFromConfig(server *proxy.ProxyServer, configInfo *config.ServerC
 	} else {
 		store = statistic.NewDefaultMetricStore()
 	}
-	dashboard.LoadDashboardPluginConfig(server.MiddlewareChain, configInfo, server.Registry, store)
+	access_log.LoadAccessLogPluginConfig(server.MiddlewareChain, configInfo)
+	alertPlugin := alert.LoadAlertPluginConfig(server.MiddlewareChain, configInfo, server.Registry)
+	ip_acl.LoadIpAclPluginConfig(server.MiddlewareChain, configInfo)
+	var dashboardOptions []common.Option
+	if disablePlugin != nil {
+		dashboardOptions = append(dashboardOptions, dashboard.WithDisableMiddleware(disablePlugin))
+	}
+	if cachePlugin != nil {
+		dashboardOptions = append(dashboardOptions, dashboard.WithCacheMiddleware(cachePlugin))
+	}
+	if alertPlugin != nil {
+		dashboardOptions = append(dashboardOptions, dashboard.WithAlertMiddleware(alertPlugin))
+	}
+	dashboard.LoadDashboardPluginConfig(server.MiddlewareChain, configInfo, server.Registry, store, dashboardOptions...)
 }
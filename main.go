@@ -5,6 +5,9 @@ import (
 	"github.com/zoowii/jsonrpc_proxygo/loader"
 	"github.com/zoowii/jsonrpc_proxygo/proxy"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -37,5 +40,16 @@ func main() {
 	for _, middleware := range server.MiddlewareChain.Middlewares {
 		log.Printf("\t- middleware %s\n", middleware.Name())
 	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Infof("receive signal %s, stopping", sig.String())
+		if stopErr := server.StopMiddlewares(); stopErr != nil {
+			log.Error("stop middlewares error", stopErr.Error())
+		}
+		server.Close()
+		os.Exit(0)
+	}()
 	server.Start()
 }
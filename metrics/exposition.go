@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TextContentType is the content type of prometheus text exposition format
+const TextContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatSampleValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeSampleLabels(w *bufio.Writer, labels map[string]string) {
+	if len(labels) < 1 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	_ = w.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			_ = w.WriteByte(',')
+		}
+		_, _ = w.WriteString(name)
+		_, _ = w.WriteString(`="`)
+		_, _ = w.WriteString(labelValueEscaper.Replace(labels[name]))
+		_ = w.WriteByte('"')
+	}
+	_ = w.WriteByte('}')
+}
+
+// WriteText write the metric families in prometheus text exposition format
+func WriteText(out io.Writer, families []*MetricFamily) error {
+	w := bufio.NewWriter(out)
+	for _, family := range families {
+		_, _ = w.WriteString("# HELP " + family.Name + " " + helpEscaper.Replace(family.Help) + "\n")
+		_, _ = w.WriteString("# TYPE " + family.Name + " " + family.Type + "\n")
+		for _, sample := range family.Samples {
+			_, _ = w.WriteString(family.Name + sample.Suffix)
+			writeSampleLabels(w, sample.Labels)
+			_, _ = w.WriteString(" " + formatSampleValue(sample.Value) + "\n")
+		}
+	}
+	return w.Flush()
+}
+
+// Handler returns the http handler serving the metrics of the registry in prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", TextContentType)
+		_ = WriteText(writer, r.Gather())
+	})
+}
+
+func Handler() http.Handler {
+	return DefaultRegistry.Handler()
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefBuckets are the default upper bounds(in seconds) of latency histograms
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/**
+ * Histogram counts observed values in buckets, collected as cumulative _bucket, _sum and _count samples
+ */
+type Histogram struct {
+	desc        *Desc
+	upperBounds []float64
+	counts      []uint64 // counts of each bucket, the last one is +Inf
+	count       uint64
+	sum         atomicFloat
+}
+
+// NewHistogram create a histogram with the sorted bucket upper bounds, DefBuckets if buckets is empty
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	upperBounds := normalizeBuckets(buckets)
+	return &Histogram{
+		desc:        &Desc{Name: name, Help: help, Type: HISTOGRAM},
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+func normalizeBuckets(buckets []float64) []float64 {
+	if len(buckets) < 1 {
+		buckets = DefBuckets
+	}
+	result := make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		if math.IsInf(b, 1) {
+			continue
+		}
+		result = append(result, b)
+	}
+	sort.Float64s(result)
+	return result
+}
+
+func (h *Histogram) Observe(value float64) {
+	// index of the first bucket whose upper bound >= value
+	i := sort.SearchFloat64s(h.upperBounds, value)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(value)
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) Sum() float64 {
+	return h.sum.load()
+}
+
+func (h *Histogram) Describe() *Desc {
+	return h.desc
+}
+
+func (h *Histogram) Collect() []*Sample {
+	samples := make([]*Sample, 0, len(h.counts)+2)
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		samples = append(samples, &Sample{
+			Suffix: "_bucket",
+			Labels: map[string]string{"le": strconv.FormatFloat(upperBound, 'g', -1, 64)},
+			Value:  float64(cumulative),
+		})
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.upperBounds)])
+	samples = append(samples, &Sample{
+		Suffix: "_bucket",
+		Labels: map[string]string{"le": "+Inf"},
+		Value:  float64(cumulative),
+	}, &Sample{
+		Suffix: "_sum",
+		Value:  h.Sum(),
+	}, &Sample{
+		Suffix: "_count",
+		Value:  float64(cumulative),
+	})
+	return samples
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// metric types, same as prometheus
+const (
+	COUNTER   = "counter"
+	GAUGE     = "gauge"
+	HISTOGRAM = "histogram"
+)
+
+// Desc describes a metric family
+type Desc struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+	Type string `json:"type"`
+}
+
+// Sample is a value of a metric family with labels
+type Sample struct {
+	Suffix string            `json:"suffix,omitempty"` // appended to the metric name, eg. "_bucket" of histograms
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// Collector provides samples of a metric family. middlewares register collectors to a Registry
+type Collector interface {
+	Describe() *Desc
+	Collect() []*Sample
+}
+
+// atomicFloat is a float64 value updated atomically
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		oldBits := atomic.LoadUint64(&f.bits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(value float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(value))
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+/**
+ * Counter is a metric which only goes up
+ */
+type Counter struct {
+	desc  *Desc
+	value atomicFloat
+}
+
+func NewCounter(name string, help string) *Counter {
+	return &Counter{
+		desc: &Desc{Name: name, Help: help, Type: COUNTER},
+	}
+}
+
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+// Add increase the counter by {delta}, negative delta is ignored
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.value.add(delta)
+}
+
+func (c *Counter) Value() float64 {
+	return c.value.load()
+}
+
+func (c *Counter) Describe() *Desc {
+	return c.desc
+}
+
+func (c *Counter) Collect() []*Sample {
+	return []*Sample{{Value: c.Value()}}
+}
+
+/**
+ * Gauge is a metric which can go up and down
+ */
+type Gauge struct {
+	desc  *Desc
+	value atomicFloat
+}
+
+func NewGauge(name string, help string) *Gauge {
+	return &Gauge{
+		desc: &Desc{Name: name, Help: help, Type: GAUGE},
+	}
+}
+
+func (g *Gauge) Inc() {
+	g.value.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.value.add(-1)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.value.add(delta)
+}
+
+func (g *Gauge) Set(value float64) {
+	g.value.set(value)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.value.load()
+}
+
+func (g *Gauge) Describe() *Desc {
+	return g.desc
+}
+
+func (g *Gauge) Collect() []*Sample {
+	return []*Sample{{Value: g.Value()}}
+}
+
+/**
+ * GaugeFunc is a gauge whose value is read from a function when collected
+ */
+type GaugeFunc struct {
+	desc     *Desc
+	function func() float64
+}
+
+func NewGaugeFunc(name string, help string, function func() float64) *GaugeFunc {
+	return &GaugeFunc{
+		desc:     &Desc{Name: name, Help: help, Type: GAUGE},
+		function: function,
+	}
+}
+
+func (g *GaugeFunc) Describe() *Desc {
+	return g.desc
+}
+
+func (g *GaugeFunc) Collect() []*Sample {
+	return []*Sample{{Value: g.function()}}
+}
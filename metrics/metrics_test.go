@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryGather(t *testing.T) {
+	r := NewRegistry()
+	counter := NewCounter("test_requests_total", "requests count")
+	gauge := NewGauge("test_connections", "open connections")
+	r.MustRegister(counter, gauge, NewGaugeFunc("test_limit", "configured limit", func() float64 {
+		return 100
+	}))
+	assert.True(t, r.Register(NewCounter("test_requests_total", "duplicated")) != nil)
+
+	counter.Inc()
+	counter.Add(2.5)
+	counter.Add(-1)
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	families := r.Gather()
+	assert.Equal(t, 3, len(families))
+	assert.Equal(t, "test_connections", families[0].Name)
+	assert.Equal(t, GAUGE, families[0].Type)
+	assert.Equal(t, float64(1), families[0].Samples[0].Value)
+	assert.Equal(t, float64(100), families[1].Samples[0].Value)
+	assert.Equal(t, float64(3.5), families[2].Samples[0].Value)
+
+	assert.True(t, r.Unregister("test_limit"))
+	assert.Equal(t, 2, len(r.Gather()))
+}
+
+func TestHistogramAndVecs(t *testing.T) {
+	r := NewRegistry()
+	requests := NewCounterVec("test_rpc_requests_total", "rpc requests count", "method", "status")
+	latency := NewHistogramVec("test_rpc_duration_seconds", "rpc latency", []float64{0.1, 1}, "method")
+	r.MustRegister(requests, latency)
+
+	requests.WithLabelValues("eth_call", "ok").Inc()
+	requests.WithLabelValues("eth_call", "ok").Inc()
+	requests.WithLabelValues("eth_call", "error").Inc()
+	latency.WithLabelValues("eth_call").Observe(0.05)
+	latency.WithLabelValues("eth_call").Observe(0.5)
+	latency.WithLabelValues("eth_call").Observe(3)
+
+	families := r.Gather()
+	assert.Equal(t, 2, len(families))
+	assert.Equal(t, HISTOGRAM, families[0].Type)
+	histogramSamples := families[0].Samples
+	assert.Equal(t, 5, len(histogramSamples))
+	assert.Equal(t, "_bucket", histogramSamples[0].Suffix)
+	assert.Equal(t, "0.1", histogramSamples[0].Labels["le"])
+	assert.Equal(t, "eth_call", histogramSamples[0].Labels["method"])
+	assert.Equal(t, float64(1), histogramSamples[0].Value)
+	assert.Equal(t, float64(2), histogramSamples[1].Value)
+	assert.Equal(t, "+Inf", histogramSamples[2].Labels["le"])
+	assert.Equal(t, float64(3), histogramSamples[2].Value)
+	assert.Equal(t, float64(3.55), histogramSamples[3].Value)
+	assert.Equal(t, float64(3), histogramSamples[4].Value)
+
+	counterSamples := families[1].Samples
+	assert.Equal(t, 2, len(counterSamples))
+	assert.Equal(t, "error", counterSamples[0].Labels["status"])
+	assert.Equal(t, float64(1), counterSamples[0].Value)
+	assert.Equal(t, float64(2), counterSamples[1].Value)
+
+	assert.True(t, requests.Delete("eth_call", "error"))
+	assert.Equal(t, 1, len(requests.Collect()))
+}
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	connections := NewGaugeVec("test_open_connections", "open connections\nby provider", "provider")
+	latency := NewHistogram("test_duration_seconds", "latency", []float64{1})
+	r.MustRegister(connections, latency)
+	connections.WithLabelValues(`web"socket`).Set(2)
+	latency.Observe(0.5)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, WriteText(buf, r.Gather()))
+	assert.Equal(t, `# HELP test_duration_seconds latency
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="1"} 1
+test_duration_seconds_bucket{le="+Inf"} 1
+test_duration_seconds_sum 0.5
+test_duration_seconds_count 1
+# HELP test_open_connections open connections\nby provider
+# TYPE test_open_connections gauge
+test_open_connections{provider="web\"socket"} 2
+`, buf.String())
+}
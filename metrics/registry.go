@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MetricFamily is the collected samples of a collector
+type MetricFamily struct {
+	Desc
+	Samples []*Sample `json:"samples"`
+}
+
+/**
+ * Registry holds collectors by metric name
+ */
+type Registry struct {
+	lock       sync.RWMutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]Collector),
+	}
+}
+
+// DefaultRegistry is the registry shared by the proxy server and middlewares
+var DefaultRegistry = NewRegistry()
+
+// Register add a collector, returns error if a collector with the same metric name registered
+func (r *Registry) Register(c Collector) error {
+	name := c.Describe().Name
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.collectors[name]; ok {
+		return fmt.Errorf("metric %s registered before", name)
+	}
+	r.collectors[name] = c
+	return nil
+}
+
+// MustRegister register collectors and panic if any error
+func (r *Registry) MustRegister(collectors ...Collector) {
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister remove the collector of metric {name}, returns false if not found
+func (r *Registry) Unregister(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.collectors[name]; !ok {
+		return false
+	}
+	delete(r.collectors, name)
+	return true
+}
+
+// Gather collect samples of all collectors sorted by metric name
+func (r *Registry) Gather() []*MetricFamily {
+	r.lock.RLock()
+	collectors := make([]Collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.lock.RUnlock()
+	result := make([]*MetricFamily, 0, len(collectors))
+	for _, c := range collectors {
+		result = append(result, &MetricFamily{
+			Desc:    *c.Describe(),
+			Samples: c.Collect(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func Register(c Collector) error {
+	return DefaultRegistry.Register(c)
+}
+
+func MustRegister(collectors ...Collector) {
+	DefaultRegistry.MustRegister(collectors...)
+}
@@ -0,0 +1,172 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const labelValuesSeparator = "\xff"
+
+// metricVec holds the children metrics of a family partitioned by label values
+type metricVec struct {
+	desc       *Desc
+	labelNames []string
+	newChild   func() Collector
+
+	lock        sync.RWMutex
+	children    map[string]Collector
+	labelValues map[string][]string
+}
+
+func newMetricVec(desc *Desc, labelNames []string, newChild func() Collector) *metricVec {
+	return &metricVec{
+		desc:        desc,
+		labelNames:  labelNames,
+		newChild:    newChild,
+		children:    make(map[string]Collector),
+		labelValues: make(map[string][]string),
+	}
+}
+
+func (v *metricVec) withLabelValues(labelValues ...string) Collector {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Errorf("metric %s expects %d label values but got %d",
+			v.desc.Name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, labelValuesSeparator)
+	v.lock.RLock()
+	child, ok := v.children[key]
+	v.lock.RUnlock()
+	if ok {
+		return child
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if child, ok = v.children[key]; ok {
+		return child
+	}
+	child = v.newChild()
+	v.children[key] = child
+	v.labelValues[key] = append([]string(nil), labelValues...)
+	return child
+}
+
+// Delete remove the child of the label values, returns false if not found
+func (v *metricVec) Delete(labelValues ...string) bool {
+	key := strings.Join(labelValues, labelValuesSeparator)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.children[key]; !ok {
+		return false
+	}
+	delete(v.children, key)
+	delete(v.labelValues, key)
+	return true
+}
+
+// Reset remove all children
+func (v *metricVec) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.children = make(map[string]Collector)
+	v.labelValues = make(map[string][]string)
+}
+
+func (v *metricVec) Describe() *Desc {
+	return v.desc
+}
+
+// Collect returns samples of children sorted by label values, labels of the vec are merged into each sample
+func (v *metricVec) Collect() []*Sample {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]Collector, 0, len(keys))
+	labelValues := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		children = append(children, v.children[key])
+		labelValues = append(labelValues, v.labelValues[key])
+	}
+	v.lock.RUnlock()
+
+	var result []*Sample
+	for i, child := range children {
+		for _, sample := range child.Collect() {
+			labels := make(map[string]string, len(v.labelNames)+len(sample.Labels))
+			for j, name := range v.labelNames {
+				labels[name] = labelValues[i][j]
+			}
+			for name, value := range sample.Labels {
+				labels[name] = value
+			}
+			sample.Labels = labels
+			result = append(result, sample)
+		}
+	}
+	return result
+}
+
+/**
+ * CounterVec is a family of counters partitioned by label values
+ */
+type CounterVec struct {
+	*metricVec
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{
+		metricVec: newMetricVec(&Desc{Name: name, Help: help, Type: COUNTER}, labelNames, func() Collector {
+			return NewCounter(name, help)
+		}),
+	}
+}
+
+// WithLabelValues returns the counter of the label values, created if not exist
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.withLabelValues(labelValues...).(*Counter)
+}
+
+/**
+ * GaugeVec is a family of gauges partitioned by label values
+ */
+type GaugeVec struct {
+	*metricVec
+}
+
+func NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{
+		metricVec: newMetricVec(&Desc{Name: name, Help: help, Type: GAUGE}, labelNames, func() Collector {
+			return NewGauge(name, help)
+		}),
+	}
+}
+
+// WithLabelValues returns the gauge of the label values, created if not exist
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.withLabelValues(labelValues...).(*Gauge)
+}
+
+/**
+ * HistogramVec is a family of histograms with the same buckets partitioned by label values
+ */
+type HistogramVec struct {
+	*metricVec
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{
+		metricVec: newMetricVec(&Desc{Name: name, Help: help, Type: HISTOGRAM}, labelNames, func() Collector {
+			return NewHistogram(name, help, buckets)
+		}),
+	}
+}
+
+// WithLabelValues returns the histogram of the label values, created if not exist
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.withLabelValues(labelValues...).(*Histogram)
+}
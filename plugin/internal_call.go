@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+var internalRequestIdSeq uint64
+
+// NewInternalRequestId returns an unique id of rpc requests sent by middlewares themselves
+func NewInternalRequestId() uint64 {
+	return atomic.AddUint64(&internalRequestIdSeq, 1)
+}
+
+// NewInternalConnection creates a connection session for rpc requests sent by middlewares themselves(eg. cache refresh).
+// like providers, it dispatches the requests and responses of the connection until connSession.Close()
+func NewInternalConnection() *rpc.ConnectionSession {
+	connSession := rpc.NewConnectionSession()
+	connSession.Info.ProviderType = rpc.PROVIDER_INTERNAL
+	connSession.Info.ListenerName = rpc.PROVIDER_INTERNAL
+	connectionDone := connSession.ConnectionDone
+	dispatchChannel := connSession.RpcRequestsDispatchChannel
+	writeChan := connSession.RequestConnectionWriteChan
+	go func() {
+		for {
+			select {
+			case <-connectionDone:
+				return
+			case rpcDispatch := <-dispatchChannel:
+				if rpcDispatch == nil {
+					return
+				}
+				rpcRequestSession := rpcDispatch.Data
+				rpcRequestId := rpcRequestSession.Request.Id
+				switch rpcDispatch.Type {
+				case rpc.RPC_REQUEST_CHANGE_TYPE_ADD_REQUEST:
+					if old, ok := connSession.RpcRequestsMap[rpcRequestId]; ok {
+						close(old)
+					}
+					connSession.RpcRequestsMap[rpcRequestId] = rpcRequestSession.RpcResponseFutureChan
+				case rpc.RPC_REQUEST_CHANGE_TYPE_ADD_RESPONSE:
+					rpcRequestSession.RpcResponseFutureChan = nil
+					if resChan, ok := connSession.RpcRequestsMap[rpcRequestId]; ok {
+						close(resChan)
+						delete(connSession.RpcRequestsMap, rpcRequestId)
+					}
+				}
+			case pack := <-writeChan:
+				if pack == nil {
+					return
+				}
+				// no client of internal connection, messages pushed by upstream are dropped
+			}
+		}
+	}()
+	return connSession
+}
+
+// CallNextMiddlewares sends the rpc request through the middlewares after {middleware} and returns the response.
+// {connSession} should be an internal connection notified to the next middlewares by OnConnection
+func CallNextMiddlewares(middleware Middleware, connSession *rpc.ConnectionSession, request *rpc.JSONRpcRequest) (response *rpc.JSONRpcResponse, err error) {
+	next := middleware.NextMiddleware()
+	if next == nil {
+		err = errors.New("no next middleware of " + middleware.Name())
+		return
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	session := rpc.NewJSONRpcRequestSession(connSession)
+	session.FillRpcRequest(request, requestBytes)
+	if err = next.OnWebSocketFrame(session, websocket.TextMessage, requestBytes); err != nil {
+		return
+	}
+	if err = next.OnRpcRequest(session); err != nil {
+		return
+	}
+	if err = next.ProcessRpcRequest(session); err != nil {
+		return
+	}
+	if session.Response == nil {
+		err = errors.New("empty jsonrpc response of internal call " + request.Method)
+		return
+	}
+	if err = next.OnRpcResponse(session); err != nil {
+		return
+	}
+	response = session.Response
+	// the response is "written" to the middleware calling
+	session.ResponseWrittenAt = time.Now()
+	for m := next; m != nil; m = m.NextMiddleware() {
+		notifyRpcResponseWritten(m, session)
+	}
+	return
+}
@@ -10,6 +10,23 @@ type OnConnectionClosedCont interface {
 	OnConnectionClosed(session *rpc.ConnectionSession) error
 }
 
+// OnStopCont is implemented by middlewares which need to release resources or save state on graceful shutdown
+type OnStopCont interface {
+	OnStop() error
+}
+
+// OnRpcResponseWrittenCont is implemented by middlewares which need the response after it's written to the client,
+// eg. to measure the whole latency of the request
+type OnRpcResponseWrittenCont interface {
+	OnRpcResponseWritten(session *rpc.JSONRpcRequestSession)
+}
+
+// ClientIpResolverCont is implemented by middlewares resolving the real client ip of connections(eg. behind trusted proxies).
+// it's called before OnConnection of all middlewares, so connection limits count the real client ip
+type ClientIpResolverCont interface {
+	ResolveClientIp(session *rpc.ConnectionSession)
+}
+
 type Middleware interface {
 	Name() string
 
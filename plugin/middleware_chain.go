@@ -1,6 +1,10 @@
 package plugin
 
-import "github.com/zoowii/jsonrpc_proxygo/rpc"
+import (
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
 
 type MiddlewareChain struct {
 	Middlewares []Middleware
@@ -45,6 +49,43 @@ func (chain *MiddlewareChain) OnStart() (err error) {
 	return
 }
 
+// OnStop notify middlewares implementing OnStopCont to stop, all of them are stopped even if some failed
+func (chain *MiddlewareChain) OnStop() (err error) {
+	for _, m := range chain.Middlewares {
+		stoppable, ok := m.(OnStopCont)
+		if !ok {
+			continue
+		}
+		if stopErr := stoppable.OnStop(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}
+	return
+}
+
+// OnRpcResponseWritten set the written time of session and notify middlewares implementing OnRpcResponseWrittenCont
+func (chain *MiddlewareChain) OnRpcResponseWritten(session *rpc.JSONRpcRequestSession) {
+	session.ResponseWrittenAt = time.Now()
+	for _, m := range chain.Middlewares {
+		notifyRpcResponseWritten(m, session)
+	}
+}
+
+func notifyRpcResponseWritten(m Middleware, session *rpc.JSONRpcRequestSession) {
+	if cont, ok := m.(OnRpcResponseWrittenCont); ok {
+		cont.OnRpcResponseWritten(session)
+	}
+}
+
+// ResolveClientIp let middlewares implementing ClientIpResolverCont resolve the client ip of the new connection
+func (chain *MiddlewareChain) ResolveClientIp(session *rpc.ConnectionSession) {
+	for _, m := range chain.Middlewares {
+		if resolver, ok := m.(ClientIpResolverCont); ok {
+			resolver.ResolveClientIp(session)
+		}
+	}
+}
+
 func (chain *MiddlewareChain) First() Middleware {
 	if len(chain.Middlewares) > 0 {
 		return chain.Middlewares[0]
@@ -0,0 +1,345 @@
+package access_log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+var log = utils.GetLogger("access_log")
+
+const defaultQueueSize = 10000
+
+const (
+	STATUS_OK    = "ok"
+	STATUS_ERROR = "error"
+)
+
+var (
+	droppedEntriesCounter = metrics.NewCounter("jsonrpc_proxy_access_log_dropped_total",
+		"access log entries dropped because the write queue is full")
+	writeErrorsCounter = metrics.NewCounter("jsonrpc_proxy_access_log_write_errors_total",
+		"failed writes of access log entries")
+)
+
+func init() {
+	metrics.MustRegister(droppedEntriesCounter, writeErrorsCounter)
+}
+
+/**
+ * AccessLogEntry is a line of the access log.
+ * request_id, title and body are the same fields as requests.jsonl, so the log can be replayed by tools reading that format
+ */
+type AccessLogEntry struct {
+	RequestId string `json:"request_id"` // trace id of the request, or connection id with rpc id if not traced
+	Title     string `json:"title"`      // rpc method
+	Body      string `json:"body"`       // the redacted rpc request, empty if payloads are not logged
+
+	Timestamp         string      `json:"timestamp"` // time the request received, RFC3339 with nanoseconds
+	TraceId           string      `json:"trace_id,omitempty"`
+	ConnectionId      string      `json:"connection_id"`
+	ClientIp          string      `json:"client_ip,omitempty"`
+	ApiKey            string      `json:"api_key,omitempty"`
+	Method            string      `json:"method"`
+	RpcId             uint64      `json:"rpc_id"`
+	ParamsSize        int         `json:"params_size"` // bytes of the params json
+	Upstream          string      `json:"upstream,omitempty"`
+	CacheHit          bool        `json:"cache_hit"`
+	Status            string      `json:"status"` // STATUS_OK or STATUS_ERROR
+	ErrorCode         int         `json:"error_code,omitempty"`
+	LatencyMs         float64     `json:"latency_ms"`
+	UpstreamLatencyMs float64     `json:"upstream_latency_ms,omitempty"`
+	Response          interface{} `json:"response,omitempty"` // the redacted result or error, only if payloads are logged
+}
+
+// rotator is implemented by writers supporting rotation on demand, eg. *lumberjack.Logger
+type rotator interface {
+	Rotate() error
+}
+
+/**
+ * AccessLogMiddleware writes one json line per completed request in background.
+ * entries are dropped if the write queue is full, so slow disks never block requests
+ */
+type AccessLogMiddleware struct {
+	plugin.MiddlewareAdapter
+	writer         io.Writer
+	logPayloads    bool
+	redactRules    []*RedactRule
+	apiKeyHeader   string
+	maskApiKey     bool
+	rotateInterval time.Duration // rotate the log file periodically if > 0 and the writer supports rotation
+
+	queue     chan *rpc.JSONRpcRequestSession
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func NewAccessLogMiddleware(writer io.Writer) *AccessLogMiddleware {
+	return &AccessLogMiddleware{
+		writer:    writer,
+		queue:     make(chan *rpc.JSONRpcRequestSession, defaultQueueSize),
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+}
+
+// SetLogPayloads log the redacted request and response payloads
+func (middleware *AccessLogMiddleware) SetLogPayloads(logPayloads bool) *AccessLogMiddleware {
+	middleware.logPayloads = logPayloads
+	return middleware
+}
+
+func (middleware *AccessLogMiddleware) SetApiKeyHeader(headerName string) *AccessLogMiddleware {
+	middleware.apiKeyHeader = headerName
+	return middleware
+}
+
+// SetMaskApiKey log only the last 4 chars of api keys
+func (middleware *AccessLogMiddleware) SetMaskApiKey(mask bool) *AccessLogMiddleware {
+	middleware.maskApiKey = mask
+	return middleware
+}
+
+func (middleware *AccessLogMiddleware) SetRotateInterval(interval time.Duration) *AccessLogMiddleware {
+	middleware.rotateInterval = interval
+	return middleware
+}
+
+func (middleware *AccessLogMiddleware) AddRedactRule(rule *RedactRule) (err error) {
+	if err = rule.validate(); err != nil {
+		return
+	}
+	middleware.redactRules = append(middleware.redactRules, rule)
+	return
+}
+
+func (middleware *AccessLogMiddleware) Name() string {
+	return "access_log"
+}
+
+func (middleware *AccessLogMiddleware) OnStart() (err error) {
+	middleware.startOnce.Do(func() {
+		go middleware.loop()
+	})
+	return middleware.NextOnStart()
+}
+
+// OnStop write the queued entries and close the writer
+func (middleware *AccessLogMiddleware) OnStop() (err error) {
+	middleware.startOnce.Do(func() {
+		go middleware.loop()
+	})
+	middleware.stopOnce.Do(func() {
+		close(middleware.stopCh)
+	})
+	<-middleware.stoppedCh
+	if closer, ok := middleware.writer.(io.Closer); ok {
+		err = closer.Close()
+	}
+	return
+}
+
+func (middleware *AccessLogMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnection(session)
+}
+
+func (middleware *AccessLogMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnectionClosed(session)
+}
+
+func (middleware *AccessLogMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession,
+	messageType int, message []byte) (err error) {
+	return middleware.NextOnWebSocketFrame(session, messageType, message)
+}
+
+func (middleware *AccessLogMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextOnJSONRpcRequest(session)
+}
+
+func (middleware *AccessLogMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextOnJSONRpcResponse(session)
+}
+
+// OnRpcResponseWritten queue the completed request to be logged
+func (middleware *AccessLogMiddleware) OnRpcResponseWritten(session *rpc.JSONRpcRequestSession) {
+	if session.Request == nil {
+		return
+	}
+	select {
+	case middleware.queue <- session:
+	default:
+		droppedEntriesCounter.Inc()
+	}
+}
+
+func (middleware *AccessLogMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextProcessJSONRpcRequest(session)
+}
+
+func (middleware *AccessLogMiddleware) write(session *rpc.JSONRpcRequestSession) {
+	line, err := json.Marshal(middleware.newEntry(session))
+	if err != nil {
+		writeErrorsCounter.Inc()
+		log.Warnln("encode access log entry error", err)
+		return
+	}
+	line = append(line, '\n')
+	if _, err = middleware.writer.Write(line); err != nil {
+		writeErrorsCounter.Inc()
+		log.Warnln("write access log error", err)
+	}
+}
+
+func (middleware *AccessLogMiddleware) rotate() {
+	r, ok := middleware.writer.(rotator)
+	if !ok {
+		return
+	}
+	if err := r.Rotate(); err != nil {
+		log.Warnln("rotate access log error", err)
+	}
+}
+
+func (middleware *AccessLogMiddleware) loop() {
+	defer close(middleware.stoppedCh)
+	var rotateTick <-chan time.Time
+	if middleware.rotateInterval > 0 {
+		ticker := time.NewTicker(middleware.rotateInterval)
+		defer ticker.Stop()
+		rotateTick = ticker.C
+	}
+	for {
+		select {
+		case session := <-middleware.queue:
+			middleware.write(session)
+		case <-rotateTick:
+			middleware.rotate()
+		case <-middleware.stopCh:
+			// drain the queued entries before stopped
+			for {
+				select {
+				case session := <-middleware.queue:
+					middleware.write(session)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// copyJsonValue returns a deep copy of the json value, so redaction never changes the shared responses(eg. in cache)
+func copyJsonValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	result, err := utils.DecodeJsonUseNumber(data)
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+// requestParams returns the raw params json of the request
+func requestParams(session *rpc.JSONRpcRequestSession) json.RawMessage {
+	var raw struct {
+		Params json.RawMessage `json:"params"`
+	}
+	if len(session.RequestBytes) > 0 && json.Unmarshal(session.RequestBytes, &raw) == nil {
+		return raw.Params
+	}
+	if session.Request.Params == nil {
+		return nil
+	}
+	data, err := json.Marshal(session.Request.Params)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (middleware *AccessLogMiddleware) newEntry(session *rpc.JSONRpcRequestSession) *AccessLogEntry {
+	request := session.Request
+	entry := &AccessLogEntry{
+		Title:             request.Method,
+		Timestamp:         session.ReceivedAt.UTC().Format(time.RFC3339Nano),
+		Method:            request.Method,
+		RpcId:             request.Id,
+		Upstream:          session.TargetServer,
+		CacheHit:          session.ResponseSetByCache,
+		Status:            STATUS_OK,
+		LatencyMs:         durationMs(session.Latency()),
+		UpstreamLatencyMs: durationMs(session.UpstreamLatency()),
+	}
+	if conn := session.Conn; conn != nil {
+		if conn.Info != nil {
+			entry.ConnectionId = conn.Info.Id
+		}
+		entry.ClientIp = pluginsCommon.GetClientIp(conn)
+		entry.ApiKey = pluginsCommon.GetApiKey(conn, middleware.apiKeyHeader)
+		if middleware.maskApiKey && len(entry.ApiKey) > 0 {
+			entry.ApiKey = pluginsCommon.MaskApiKey(entry.ApiKey)
+		}
+	}
+	if traceId := session.Span.SpanContext().TraceId; traceId.IsValid() {
+		entry.TraceId = traceId.String()
+		entry.RequestId = entry.TraceId
+	} else {
+		entry.RequestId = fmt.Sprintf("%s-%d", entry.ConnectionId, request.Id)
+	}
+	response := session.Response
+	if response == nil {
+		entry.Status = STATUS_ERROR
+	} else if response.Error != nil {
+		entry.Status = STATUS_ERROR
+		entry.ErrorCode = response.Error.Code
+	}
+	params := requestParams(session)
+	entry.ParamsSize = len(params)
+	if !middleware.logPayloads {
+		return entry
+	}
+	var paramsValue interface{}
+	if len(params) > 0 {
+		paramsValue, _ = utils.DecodeJsonUseNumber(params)
+	}
+	var resultValue interface{}
+	if response != nil && response.Error == nil {
+		resultValue = copyJsonValue(response.Result)
+	}
+	paramsValue, resultValue = redact(middleware.redactRules, request.Method, paramsValue, resultValue)
+	body := &rpc.JSONRpcRequest{
+		Id:      request.Id,
+		JSONRpc: utils.StringOrElse(request.JSONRpc, "2.0"),
+		Method:  request.Method,
+		Params:  paramsValue,
+	}
+	entry.Body = utils.JsonDumpsToStringSilently(body, "")
+	if response != nil {
+		if response.Error != nil {
+			entry.Response = map[string]interface{}{"error": response.Error}
+		} else {
+			entry.Response = map[string]interface{}{"result": resultValue}
+		}
+	}
+	return entry
+}
@@ -0,0 +1,121 @@
+package access_log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// lockedBuffer is a writer safe to read while the middleware writes in background
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func newTestSession(requestJson string, response *rpc.JSONRpcResponse) *rpc.JSONRpcRequestSession {
+	connSession := rpc.NewConnectionSession()
+	connSession.Info.RemoteAddr = "10.0.0.1:5000"
+	connSession.Info.Headers.Set("X-Api-Key", "secret-api-key")
+	session := rpc.NewJSONRpcRequestSession(connSession)
+	request := &rpc.JSONRpcRequest{}
+	_ = json.Unmarshal([]byte(requestJson), request)
+	session.FillRpcRequest(request, []byte(requestJson))
+	session.FillRpcResponse(response)
+	session.TargetServer = "ws://127.0.0.1:8545"
+	session.UpstreamSentAt = session.ReceivedAt.Add(time.Millisecond)
+	session.UpstreamRecvAt = session.ReceivedAt.Add(11 * time.Millisecond)
+	session.ResponseWrittenAt = session.ReceivedAt.Add(12 * time.Millisecond)
+	return session
+}
+
+func readEntries(t *testing.T, content string) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		entry := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLogEntries(t *testing.T) {
+	out := &lockedBuffer{}
+	middleware := NewAccessLogMiddleware(out).SetMaskApiKey(true)
+	assert.Nil(t, middleware.OnStart())
+
+	middleware.OnRpcResponseWritten(newTestSession(`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0xabc","latest"]}`,
+		&rpc.JSONRpcResponse{Id: 1, JSONRpc: "2.0", Result: "0x1"}))
+	middleware.OnRpcResponseWritten(newTestSession(`{"jsonrpc":"2.0","id":2,"method":"eth_call","params":[]}`,
+		&rpc.JSONRpcResponse{Id: 2, JSONRpc: "2.0", Error: rpc.NewJSONRpcResponseError(-32000, "execution reverted", nil)}))
+	assert.Nil(t, middleware.OnStop())
+
+	entries := readEntries(t, out.String())
+	assert.Equal(t, 2, len(entries))
+	first := entries[0]
+	assert.Equal(t, "eth_getBalance", first["title"])
+	assert.Equal(t, "", first["body"]) // payloads are not logged by default
+	assert.Nil(t, first["response"])
+	assert.Equal(t, "eth_getBalance", first["method"])
+	assert.Equal(t, "10.0.0.1", first["client_ip"])
+	assert.Equal(t, "**********-key", first["api_key"])
+	assert.Equal(t, float64(len(`["0xabc","latest"]`)), first["params_size"])
+	assert.Equal(t, "ws://127.0.0.1:8545", first["upstream"])
+	assert.Equal(t, false, first["cache_hit"])
+	assert.Equal(t, STATUS_OK, first["status"])
+	assert.Equal(t, float64(12), first["latency_ms"])
+	assert.Equal(t, float64(10), first["upstream_latency_ms"])
+	assert.True(t, strings.HasSuffix(first["request_id"].(string), "-1"))
+
+	second := entries[1]
+	assert.Equal(t, STATUS_ERROR, second["status"])
+	assert.Equal(t, float64(-32000), second["error_code"])
+}
+
+func TestAccessLogPayloadsRedacted(t *testing.T) {
+	out := &lockedBuffer{}
+	middleware := NewAccessLogMiddleware(out).SetLogPayloads(true)
+	assert.Nil(t, middleware.AddRedactRule(&RedactRule{Methods: []string{"personal_*"}, Paths: []string{"1", "result.token"}}))
+	assert.Nil(t, middleware.AddRedactRule(&RedactRule{Methods: []string{"eth_sendRawTransaction"}}))
+	assert.NotNil(t, middleware.AddRedactRule(&RedactRule{Methods: []string{"["}}))
+	assert.Nil(t, middleware.OnStart())
+
+	result := map[string]interface{}{"token": "abc", "ok": true}
+	middleware.OnRpcResponseWritten(newTestSession(`{"jsonrpc":"2.0","id":1,"method":"personal_unlockAccount","params":["0xabc","password",100]}`,
+		&rpc.JSONRpcResponse{Id: 1, JSONRpc: "2.0", Result: result}))
+	middleware.OnRpcResponseWritten(newTestSession(`{"jsonrpc":"2.0","id":2,"method":"eth_sendRawTransaction","params":["0xf86b"]}`,
+		&rpc.JSONRpcResponse{Id: 2, JSONRpc: "2.0", Result: "0xhash"}))
+	assert.Nil(t, middleware.OnStop())
+	// the shared response must not be changed by redaction
+	assert.Equal(t, "abc", result["token"])
+
+	entries := readEntries(t, out.String())
+	assert.Equal(t, 2, len(entries))
+	// body is a replayable rpc request
+	body := &rpc.JSONRpcRequest{}
+	assert.Nil(t, json.Unmarshal([]byte(entries[0]["body"].(string)), body))
+	assert.Equal(t, "personal_unlockAccount", body.Method)
+	assert.Equal(t, []interface{}{"0xabc", RedactedValue, float64(100)}, body.Params)
+	assert.Equal(t, map[string]interface{}{"result": map[string]interface{}{"token": RedactedValue, "ok": true}}, entries[0]["response"])
+
+	assert.Nil(t, json.Unmarshal([]byte(entries[1]["body"].(string)), body))
+	assert.Equal(t, RedactedValue, body.Params)
+	assert.Equal(t, map[string]interface{}{"result": RedactedValue}, entries[1]["response"])
+}
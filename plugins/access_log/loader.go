@@ -0,0 +1,51 @@
+package access_log
+
+import (
+	"time"
+
+	"github.com/natefinch/lumberjack"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+)
+
+const (
+	defaultFile      = "access.log"
+	defaultMaxSizeMb = 100
+)
+
+func LoadAccessLogPluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
+	accessLogPluginConf := configInfo.Plugins.AccessLog
+	if !accessLogPluginConf.Start {
+		return
+	}
+	maxSizeMb := accessLogPluginConf.MaxSizeMb
+	if maxSizeMb <= 0 {
+		maxSizeMb = defaultMaxSizeMb
+	}
+	writer := &lumberjack.Logger{
+		Filename:   accessLogPluginConf.File,
+		MaxSize:    maxSizeMb,
+		MaxBackups: accessLogPluginConf.MaxBackups,
+		MaxAge:     accessLogPluginConf.MaxAgeDays,
+		Compress:   accessLogPluginConf.Compress,
+	}
+	if len(writer.Filename) < 1 {
+		writer.Filename = defaultFile
+	}
+	accessLogMiddleware := NewAccessLogMiddleware(writer).
+		SetLogPayloads(accessLogPluginConf.LogPayloads).
+		SetApiKeyHeader(accessLogPluginConf.ApiKeyHeader).
+		SetMaskApiKey(accessLogPluginConf.MaskApiKey).
+		SetRotateInterval(time.Duration(accessLogPluginConf.RotateIntervalSeconds) * time.Second)
+	for _, ruleConf := range accessLogPluginConf.Redact {
+		rule := &RedactRule{
+			Methods: ruleConf.Methods,
+			Paths:   ruleConf.Paths,
+		}
+		if err := accessLogMiddleware.AddRedactRule(rule); err != nil {
+			log.Fatalln("invalid access_log redact rule", err)
+			return
+		}
+	}
+	chain.InsertHead(accessLogMiddleware)
+}
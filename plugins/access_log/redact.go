@@ -0,0 +1,106 @@
+package access_log
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+// RedactedValue replaces the redacted values in logged payloads
+const RedactedValue = "[REDACTED]"
+
+/**
+ * RedactRule hides sensitive values in logged payloads of some rpc methods.
+ * paths are json paths of params like "0.password" or "params[1]", paths starting with "result" are in the response result.
+ * the whole params and result are hidden if no paths
+ */
+type RedactRule struct {
+	Methods []string // exact names or globs of methods, empty means all methods
+	Paths   []string
+}
+
+func (rule *RedactRule) matchMethod(methodName string) bool {
+	if len(rule.Methods) < 1 {
+		return true
+	}
+	for _, pattern := range rule.Methods {
+		if matched, _ := path.Match(pattern, methodName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *RedactRule) validate() error {
+	for _, pattern := range rule.Methods {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultPathTokens returns tokens of the path in response result, false if it's a params path
+func resultPathTokens(jsonPath string) ([]string, bool) {
+	jsonPath = strings.TrimPrefix(strings.TrimSpace(jsonPath), "$")
+	jsonPath = strings.TrimPrefix(jsonPath, ".")
+	if !strings.HasPrefix(jsonPath, "result") {
+		return nil, false
+	}
+	rest := jsonPath[len("result"):]
+	if len(rest) > 0 && rest[0] != '.' && rest[0] != '[' {
+		return nil, false
+	}
+	return utils.ParseJsonPath(rest), true
+}
+
+// redactByTokens replace the value at tokens in place, returns the new value if tokens is empty
+func redactByTokens(value interface{}, tokens []string) interface{} {
+	if len(tokens) < 1 {
+		if value == nil {
+			return nil
+		}
+		return RedactedValue
+	}
+	parent, ok := utils.JsonPathGetByTokens(value, tokens[:len(tokens)-1])
+	if !ok {
+		return value
+	}
+	last := tokens[len(tokens)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		if _, found := v[last]; found {
+			v[last] = RedactedValue
+		}
+	case []interface{}:
+		index, err := strconv.Atoi(last)
+		if err == nil && index >= 0 && index < len(v) {
+			v[index] = RedactedValue
+		}
+	}
+	return value
+}
+
+// redact apply the matched rules to decoded params and result in place and returns them
+func redact(rules []*RedactRule, methodName string, params interface{}, result interface{}) (interface{}, interface{}) {
+	for _, rule := range rules {
+		if !rule.matchMethod(methodName) {
+			continue
+		}
+		if len(rule.Paths) < 1 {
+			params = redactByTokens(params, nil)
+			result = redactByTokens(result, nil)
+			continue
+		}
+		for _, jsonPath := range rule.Paths {
+			if tokens, isResult := resultPathTokens(jsonPath); isResult {
+				result = redactByTokens(result, tokens)
+			} else {
+				params = redactByTokens(params, utils.ParseJsonPath(jsonPath))
+			}
+		}
+	}
+	return params, result
+}
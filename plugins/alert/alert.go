@@ -0,0 +1,390 @@
+package alert
+
+/**
+ * alert middleware
+ * evaluates alert rules periodically by the metrics of other plugins and registry events,
+ * and notifies webhooks when alerts fire and resolve
+ */
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+var log = utils.GetLogger("alert")
+
+const defaultEvaluationInterval = 30 * time.Second
+
+// results of notifications
+const (
+	notificationResultSent   = "sent"
+	notificationResultFailed = "failed"
+)
+
+var notificationsCounter = metrics.NewCounterVec("jsonrpc_proxy_alert_notifications_total",
+	"alert notifications sent to webhooks by result(sent or failed)", "result")
+
+func init() {
+	metrics.MustRegister(notificationsCounter)
+}
+
+// alertState is the state of an alert of a rule and key
+type alertState struct {
+	firing         *AlertEvent // nil if not firing
+	notified       bool        // the firing event is notified, so its resolve is notified too
+	lastNotifiedAt time.Time
+}
+
+type AlertMiddleware struct {
+	plugin.MiddlewareAdapter
+	rules     []*Rule
+	notifiers []*webhookNotifier
+	r         registry.Registry
+	interval  time.Duration
+	window    *metricsWindow
+	history   *alertHistory
+
+	lock   sync.Mutex
+	states map[string]*alertState // by rule name and key
+	// alerts of metric rules are not resolved by missing data until a window of metrics is recorded
+	firstEvaluatedAt time.Time
+
+	started   bool
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+	notifyWg  sync.WaitGroup
+}
+
+func NewAlertMiddleware() *AlertMiddleware {
+	history, _ := newAlertHistory(defaultHistorySize, "")
+	return &AlertMiddleware{
+		interval:  defaultEvaluationInterval,
+		window:    newMetricsWindow(metrics.DefaultRegistry.Gather, 0),
+		history:   history,
+		states:    make(map[string]*alertState),
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+}
+
+func (middleware *AlertMiddleware) SetInterval(interval time.Duration) *AlertMiddleware {
+	if interval > 0 {
+		middleware.interval = interval
+	}
+	return middleware
+}
+
+// SetRegistry watch services removed from the registry for upstream_removed rules
+func (middleware *AlertMiddleware) SetRegistry(r registry.Registry) *AlertMiddleware {
+	middleware.r = r
+	return middleware
+}
+
+// SetHistory keeps the last {size} alert events, and appends them to {filename} if not empty.
+// the firing and cooldown states of alerts in the file are restored on start
+func (middleware *AlertMiddleware) SetHistory(size int, filename string) (err error) {
+	history, err := newAlertHistory(size, filename)
+	if err != nil {
+		return
+	}
+	middleware.history = history
+	return
+}
+
+func (middleware *AlertMiddleware) AddRule(rule *Rule) (err error) {
+	if err = rule.Validate(); err != nil {
+		return
+	}
+	for _, existed := range middleware.rules {
+		if existed.Name == rule.Name {
+			return fmt.Errorf("duplicate alert rule name %s", rule.Name)
+		}
+	}
+	middleware.rules = append(middleware.rules, rule)
+	if rule.Window > middleware.window.maxWindow {
+		middleware.window.maxWindow = rule.Window
+	}
+	return
+}
+
+func (middleware *AlertMiddleware) AddWebhook(webhook *Webhook) (err error) {
+	notifier, err := newWebhookNotifier(webhook)
+	if err != nil {
+		return
+	}
+	middleware.notifiers = append(middleware.notifiers, notifier)
+	return
+}
+
+func (middleware *AlertMiddleware) Name() string {
+	return "alert"
+}
+
+// ListHistory returns alert events newest first
+func (middleware *AlertMiddleware) ListHistory(offset int, limit int) *AlertEventListVo {
+	return middleware.history.list(offset, limit)
+}
+
+// ActiveAlerts returns the firing alerts, oldest first
+func (middleware *AlertMiddleware) ActiveAlerts() []*AlertEvent {
+	middleware.lock.Lock()
+	defer middleware.lock.Unlock()
+	result := make([]*AlertEvent, 0)
+	for _, state := range middleware.states {
+		if state.firing != nil {
+			event := *state.firing
+			result = append(result, &event)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartsAt.Before(result[j].StartsAt)
+	})
+	return result
+}
+
+func (middleware *AlertMiddleware) notify(event *AlertEvent) {
+	for _, notifier := range middleware.notifiers {
+		middleware.notifyWg.Add(1)
+		go func(notifier *webhookNotifier) {
+			defer middleware.notifyWg.Done()
+			if err := notifier.notify(event); err != nil {
+				notificationsCounter.WithLabelValues(notificationResultFailed).Inc()
+				log.Warnf("notify alert %s of %s error %s", event.Rule, event.Key, err.Error())
+				return
+			}
+			notificationsCounter.WithLabelValues(notificationResultSent).Inc()
+		}(notifier)
+	}
+}
+
+// transition updates the alert of the rule and key, and notifies when it starts firing or resolves.
+// a firing alert is notified once, and not again if it fires again in the rule's cooldown.
+// events saved to the history and notified are never changed, the state keeps its own copy of the firing event
+func (middleware *AlertMiddleware) transition(rule *Rule, cond *condition, now time.Time) {
+	stateKey := alertStateKey(rule.Name, cond.key)
+	middleware.lock.Lock()
+	state, ok := middleware.states[stateKey]
+	if !ok {
+		state = &alertState{}
+		middleware.states[stateKey] = state
+	}
+	var event *AlertEvent
+	notify := false
+	switch {
+	case cond.firing && state.firing != nil:
+		// already notified, only the latest value is updated
+		state.firing.Value = cond.value
+		state.firing.Message = cond.message
+	case cond.firing:
+		event = &AlertEvent{
+			Rule:      rule.Name,
+			Type:      rule.Type,
+			Severity:  rule.Severity,
+			Key:       cond.key,
+			Status:    STATUS_FIRING,
+			Value:     cond.value,
+			Threshold: rule.Threshold,
+			Message:   cond.message,
+			StartsAt:  now,
+			Time:      now,
+		}
+		notify = state.lastNotifiedAt.IsZero() || now.Sub(state.lastNotifiedAt) >= rule.Cooldown
+		state.firing = event
+		state.notified = notify
+	case state.firing != nil:
+		resolved := *state.firing
+		endsAt := now
+		resolved.Status = STATUS_RESOLVED
+		resolved.Value = cond.value
+		resolved.Message = cond.message
+		resolved.EndsAt = &endsAt
+		resolved.Time = now
+		event = &resolved
+		notify = state.notified
+		state.firing = nil
+	}
+	if notify {
+		state.lastNotifiedAt = now
+	}
+	if event != nil {
+		event.Notified = notify && len(middleware.notifiers) > 0
+		middleware.history.add(event)
+		if state.firing == event {
+			firing := *event
+			state.firing = &firing
+		}
+	}
+	middleware.lock.Unlock()
+	if event == nil {
+		return
+	}
+	log.Infof("alert %s of %s %s: %s", event.Rule, event.Key, event.Status, event.Message)
+	if notify {
+		middleware.notify(event)
+	}
+}
+
+// restoreStates restores the firing alerts and the last notified times of the rules from the history,
+// so alerts still firing after a restart are not notified again, and the cooldowns go on
+func (middleware *AlertMiddleware) restoreStates() {
+	latest, lastNotified := middleware.history.lastStates()
+	middleware.lock.Lock()
+	defer middleware.lock.Unlock()
+	for _, rule := range middleware.rules {
+		for stateKey, event := range latest {
+			if event.Rule != rule.Name {
+				continue
+			}
+			state := &alertState{}
+			if event.Status == STATUS_FIRING {
+				state.firing = event
+				state.notified = event.Notified
+			}
+			if notified, ok := lastNotified[stateKey]; ok {
+				state.lastNotifiedAt = notified.Time
+			}
+			middleware.states[stateKey] = state
+		}
+	}
+}
+
+// evaluate takes a snapshot of metrics and updates alerts of the metric rules,
+// alerts without data in the window(eg. no requests of the method) are resolved
+func (middleware *AlertMiddleware) evaluate(now time.Time) {
+	middleware.window.record(now)
+	if middleware.firstEvaluatedAt.IsZero() {
+		middleware.firstEvaluatedAt = now
+	}
+	for _, rule := range middleware.rules {
+		if rule.Type == RULE_UPSTREAM_REMOVED {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, cond := range rule.evaluate(middleware.window, now) {
+			seen[cond.key] = true
+			middleware.transition(rule, cond, now)
+		}
+		if now.Sub(middleware.firstEvaluatedAt) < rule.Window {
+			// eg. alerts restored after a restart, the window has no data yet
+			continue
+		}
+		for _, event := range middleware.ActiveAlerts() {
+			if event.Rule != rule.Name || seen[event.Key] {
+				continue
+			}
+			middleware.transition(rule, &condition{
+				key:     event.Key,
+				value:   event.Value,
+				message: fmt.Sprintf("no data of %s in the last %s", event.Key, rule.Window),
+			}, now)
+		}
+	}
+}
+
+// onRegistryEvent fires upstream_removed alerts when services are removed, and resolves them when added back
+func (middleware *AlertMiddleware) onRegistryEvent(event *registry.Event, now time.Time) {
+	service := event.ServiceInfo
+	if service == nil {
+		return
+	}
+	for _, rule := range middleware.rules {
+		if rule.Type != RULE_UPSTREAM_REMOVED {
+			continue
+		}
+		switch event.Type {
+		case registry.SERVICE_REMOVE:
+			middleware.transition(rule, &condition{
+				key:     service.Url,
+				firing:  true,
+				message: fmt.Sprintf("service %s %s removed from registry", service.Name, service.Url),
+			}, now)
+		case registry.SERVICE_ADD:
+			middleware.transition(rule, &condition{
+				key:     service.Url,
+				message: fmt.Sprintf("service %s %s added to registry", service.Name, service.Url),
+			}, now)
+		}
+	}
+}
+
+func (middleware *AlertMiddleware) loop() {
+	defer close(middleware.stoppedCh)
+	var registryEventChan chan *registry.Event
+	if middleware.r != nil {
+		watcher, err := middleware.r.Watch()
+		if err != nil {
+			log.Error("watch registry error", err)
+		} else {
+			defer watcher.Close()
+			registryEventChan = watcher.C()
+		}
+	}
+	ticker := time.NewTicker(middleware.interval)
+	defer ticker.Stop()
+	middleware.evaluate(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			middleware.evaluate(time.Now())
+		case event, ok := <-registryEventChan:
+			if !ok {
+				registryEventChan = nil
+				continue
+			}
+			middleware.onRegistryEvent(event, time.Now())
+		case <-middleware.stopCh:
+			return
+		}
+	}
+}
+
+func (middleware *AlertMiddleware) OnStart() (err error) {
+	middleware.restoreStates()
+	middleware.started = true
+	go middleware.loop()
+	return middleware.NextOnStart()
+}
+
+// OnStop waits the pending notifications and closes the history file
+func (middleware *AlertMiddleware) OnStop() (err error) {
+	if middleware.started {
+		middleware.started = false
+		close(middleware.stopCh)
+		<-middleware.stoppedCh
+	}
+	middleware.notifyWg.Wait()
+	return middleware.history.close()
+}
+
+func (middleware *AlertMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnection(session)
+}
+
+func (middleware *AlertMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnectionClosed(session)
+}
+
+func (middleware *AlertMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession,
+	messageType int, message []byte) (err error) {
+	return middleware.NextOnWebSocketFrame(session, messageType, message)
+}
+
+func (middleware *AlertMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextOnJSONRpcRequest(session)
+}
+
+func (middleware *AlertMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextOnJSONRpcResponse(session)
+}
+
+func (middleware *AlertMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextProcessJSONRpcRequest(session)
+}
@@ -0,0 +1,327 @@
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+)
+
+// testMetrics are metrics of the same names as the proxy's, in a registry of the test
+type testMetrics struct {
+	registry   *metrics.Registry
+	requests   *metrics.CounterVec
+	duration   *metrics.HistogramVec
+	cache      *metrics.CounterVec
+	rejected   *metrics.Counter
+	upstreamUp *metrics.GaugeVec
+}
+
+func newTestMetrics() *testMetrics {
+	m := &testMetrics{
+		registry:   metrics.NewRegistry(),
+		requests:   metrics.NewCounterVec(rpcRequestsMetric, "", "method", "upstream", "status"),
+		duration:   metrics.NewHistogramVec(rpcRequestDurationMetric, "", metrics.DefBuckets, "method"),
+		cache:      metrics.NewCounterVec(cacheRequestsMetric, "", "method", "result"),
+		rejected:   metrics.NewCounter(rateLimitRejectedMetric, ""),
+		upstreamUp: metrics.NewGaugeVec(upstreamUpMetric, "", "upstream"),
+	}
+	m.registry.MustRegister(m.requests, m.duration, m.cache, m.rejected, m.upstreamUp)
+	return m
+}
+
+// webhookRecorder is a webhook server recording the bodies received
+type webhookRecorder struct {
+	lock   sync.Mutex
+	bodies []map[string]interface{}
+}
+
+func (recorder *webhookRecorder) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	bytes, _ := ioutil.ReadAll(request.Body)
+	var body map[string]interface{}
+	_ = json.Unmarshal(bytes, &body)
+	recorder.lock.Lock()
+	recorder.bodies = append(recorder.bodies, body)
+	recorder.lock.Unlock()
+}
+
+func (recorder *webhookRecorder) received() []map[string]interface{} {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	return append([]map[string]interface{}{}, recorder.bodies...)
+}
+
+// newTestAlertMiddleware creates the middleware evaluating the test metrics, notifying {webhookUrl} if not empty
+func newTestAlertMiddleware(t *testing.T, m *testMetrics, webhookUrl string, rules ...*Rule) *AlertMiddleware {
+	middleware := NewAlertMiddleware()
+	middleware.window.gather = m.registry.Gather
+	for _, rule := range rules {
+		assert.Nil(t, middleware.AddRule(rule))
+	}
+	if len(webhookUrl) > 0 {
+		assert.Nil(t, middleware.AddWebhook(&Webhook{Url: webhookUrl}))
+	}
+	return middleware
+}
+
+func TestAlertErrorRateFiresAndResolves(t *testing.T) {
+	m := newTestMetrics()
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	middleware := newTestAlertMiddleware(t, m, server.URL, &Rule{
+		Name:        "eth errors",
+		Type:        RULE_ERROR_RATE,
+		Methods:     []string{"eth_*"},
+		Threshold:   0.1,
+		Window:      time.Minute,
+		MinRequests: 10,
+		Cooldown:    time.Hour,
+	})
+	now := time.Now()
+	middleware.evaluate(now)
+
+	m.requests.WithLabelValues("eth_call", "u1", "ok").Add(80)
+	m.requests.WithLabelValues("eth_call", "u1", "error").Add(20)
+	m.requests.WithLabelValues("net_version", "u1", "error").Add(100)
+	middleware.evaluate(now.Add(30 * time.Second))
+	// evaluated again while firing, notified only once
+	m.requests.WithLabelValues("eth_call", "u1", "error").Add(20)
+	middleware.evaluate(now.Add(40 * time.Second))
+
+	active := middleware.ActiveAlerts()
+	assert.Equal(t, 1, len(active))
+	assert.Equal(t, "eth_call", active[0].Key)
+	assert.InDelta(t, 40.0/120, active[0].Value, 0.001)
+
+	// no errors in the last minute
+	m.requests.WithLabelValues("eth_call", "u1", "ok").Add(100)
+	middleware.evaluate(now.Add(100 * time.Second))
+	m.requests.WithLabelValues("eth_call", "u1", "ok").Add(100)
+	middleware.evaluate(now.Add(170 * time.Second))
+	assert.Equal(t, 0, len(middleware.ActiveAlerts()))
+	middleware.notifyWg.Wait()
+
+	bodies := recorder.received()
+	assert.Equal(t, 2, len(bodies))
+	texts := []string{bodies[0]["text"].(string), bodies[1]["text"].(string)}
+	assert.Contains(t, texts[0]+texts[1], "[FIRING] warning eth errors: error rate of eth_call")
+	assert.Contains(t, texts[0]+texts[1], "[RESOLVED] warning eth errors")
+
+	history := middleware.ListHistory(0, 10)
+	assert.Equal(t, uint(2), history.Total)
+	assert.Equal(t, STATUS_RESOLVED, history.Items[0].Status)
+	assert.NotNil(t, history.Items[0].EndsAt)
+	assert.Equal(t, STATUS_FIRING, history.Items[1].Status)
+	assert.True(t, history.Items[1].Notified)
+}
+
+func TestAlertCooldown(t *testing.T) {
+	middleware := newTestAlertMiddleware(t, newTestMetrics(), "", &Rule{
+		Type:     RULE_UPSTREAM_REMOVED,
+		Cooldown: 10 * time.Minute,
+	})
+	service := &registry.Service{Name: "upstream", Url: "ws://127.0.0.1:3000"}
+	now := time.Now()
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, service), now)
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, service), now.Add(time.Second))
+	assert.Equal(t, 1, len(middleware.ActiveAlerts()))
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_ADD, service), now.Add(time.Minute))
+	assert.Equal(t, 0, len(middleware.ActiveAlerts()))
+	// flapping in the cooldown is recorded but not notified
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, service), now.Add(2*time.Minute))
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_ADD, service), now.Add(3*time.Minute))
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, service), now.Add(20*time.Minute))
+
+	state := middleware.states["upstream_removed\x00ws://127.0.0.1:3000"]
+	assert.True(t, state.notified)
+	assert.Equal(t, now.Add(20*time.Minute), state.lastNotifiedAt)
+	history := middleware.ListHistory(0, 10)
+	assert.Equal(t, uint(5), history.Total)
+	var statuses []string
+	for _, event := range history.Items {
+		statuses = append(statuses, event.Status)
+	}
+	assert.Equal(t, []string{STATUS_FIRING, STATUS_RESOLVED, STATUS_FIRING, STATUS_RESOLVED, STATUS_FIRING}, statuses)
+}
+
+func TestAlertMetricRules(t *testing.T) {
+	m := newTestMetrics()
+	middleware := newTestAlertMiddleware(t, m, "",
+		&Rule{Name: "slow", Type: RULE_P99_LATENCY, Threshold: 500, MinRequests: 1},
+		&Rule{Name: "cache", Type: RULE_CACHE_HIT_RATIO, Threshold: 0.5, MinRequests: 1},
+		&Rule{Name: "rejections", Type: RULE_RATE_LIMIT_REJECTIONS, Threshold: 1},
+		&Rule{Name: "unhealthy", Type: RULE_UPSTREAM_UNHEALTHY},
+	)
+	now := time.Now()
+	middleware.evaluate(now)
+	for i := 0; i < 100; i++ {
+		m.duration.WithLabelValues("eth_call").Observe(0.002)
+		m.duration.WithLabelValues("eth_getLogs").Observe(2)
+	}
+	m.cache.WithLabelValues("eth_blockNumber", "hit").Add(1)
+	m.cache.WithLabelValues("eth_blockNumber", "miss").Add(9)
+	m.cache.WithLabelValues("eth_chainId", "stale").Add(9)
+	m.cache.WithLabelValues("eth_chainId", "miss").Add(1)
+	m.rejected.Add(100)
+	m.upstreamUp.WithLabelValues("ws://u1").Set(0)
+	m.upstreamUp.WithLabelValues("ws://u2").Set(1)
+	middleware.evaluate(now.Add(10 * time.Second))
+
+	firing := make(map[string]string)
+	for _, event := range middleware.ActiveAlerts() {
+		firing[event.Rule] = event.Key
+	}
+	assert.Equal(t, map[string]string{
+		"slow":       "eth_getLogs",
+		"cache":      "eth_blockNumber",
+		"rejections": "rate_limit",
+		"unhealthy":  "ws://u1",
+	}, firing)
+
+	assert.NotNil(t, (&Rule{Type: RULE_ERROR_RATE, Threshold: 2}).Validate())
+	assert.NotNil(t, (&Rule{Type: "unknown"}).Validate())
+	assert.NotNil(t, middleware.AddRule(&Rule{Name: "slow", Type: RULE_P99_LATENCY, Threshold: 1}))
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	histogram := &latencyHistogram{
+		upperBounds: []float64{0.1, 0.5, 1},
+		counts:      []float64{50, 90, 100},
+	}
+	assert.InDelta(t, 0.1, histogram.quantile(0.5), 0.0001)
+	assert.InDelta(t, 0.3, histogram.quantile(0.7), 0.0001)
+	assert.InDelta(t, 0.95, histogram.quantile(0.99), 0.0001)
+}
+
+func TestWebhookBodyTemplate(t *testing.T) {
+	notifier, err := newWebhookNotifier(&Webhook{
+		Url:          "http://127.0.0.1:1/hook",
+		BodyTemplate: `{"status": {{ json .Status }}, "summary": {{ json .Message }}, "value": {{ .Value }}}`,
+	})
+	assert.Nil(t, err)
+	body, err := notifier.render(&AlertEvent{Status: STATUS_FIRING, Message: `quote " in message`, Value: 0.5})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"status": "firing", "summary": "quote \" in message", "value": 0.5}`, string(body))
+
+	notifier, err = newWebhookNotifier(&Webhook{Url: "http://127.0.0.1:1/hook", BodyTemplate: `{"text": {{ .Message }}}`})
+	assert.Nil(t, err)
+	_, err = notifier.render(&AlertEvent{Message: "not quoted"})
+	assert.NotNil(t, err)
+
+	_, err = newWebhookNotifier(&Webhook{Url: "http://127.0.0.1:1/hook", BodyTemplate: `{{ .Message`})
+	assert.NotNil(t, err)
+}
+
+func TestAlertHistoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert_history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "alerts.jsonl")
+
+	history, err := newAlertHistory(2, filename)
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		history.add(&AlertEvent{Rule: "rule", Key: key, Status: STATUS_FIRING})
+	}
+	assert.Nil(t, history.close())
+
+	// the last events are loaded after restarts, and ids continue
+	history, err = newAlertHistory(2, filename)
+	assert.Nil(t, err)
+	defer history.close()
+	list := history.list(0, 10)
+	assert.Equal(t, uint(2), list.Total)
+	assert.Equal(t, "c", list.Items[0].Key)
+	assert.Equal(t, "b", list.Items[1].Key)
+	history.add(&AlertEvent{Rule: "rule", Key: "d"})
+	assert.Equal(t, uint64(4), history.list(0, 1).Items[0].Id)
+}
+
+func TestAlertHistoryFileCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert_history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "alerts.jsonl")
+
+	history, err := newAlertHistory(3, filename)
+	assert.Nil(t, err)
+	history.add(&AlertEvent{Rule: "rule", Key: "firing", Status: STATUS_FIRING, Notified: true})
+	for i := 0; i < 100; i++ {
+		history.add(&AlertEvent{Rule: "rule", Key: "flapping", Status: STATUS_RESOLVED})
+	}
+	assert.Nil(t, history.close())
+
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	lines := strings.Count(string(data), "\n")
+	// the last 3 events and the states of 2 keys are kept
+	assert.True(t, lines <= 2*(3+2+1)+1)
+	history, err = newAlertHistory(3, filename)
+	assert.Nil(t, err)
+	defer history.close()
+	assert.Equal(t, uint64(101), history.list(0, 1).Items[0].Id)
+	latest, lastNotified := history.lastStates()
+	assert.Equal(t, STATUS_FIRING, latest[alertStateKey("rule", "firing")].Status)
+	assert.Equal(t, uint64(1), lastNotified[alertStateKey("rule", "firing")].Id)
+}
+
+func TestAlertRestartKeepsStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert_history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "alerts.jsonl")
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	newMiddleware := func(m *testMetrics) *AlertMiddleware {
+		middleware := newTestAlertMiddleware(t, m, server.URL,
+			&Rule{Type: RULE_UPSTREAM_REMOVED, Cooldown: time.Hour},
+			&Rule{Name: "eth errors", Type: RULE_ERROR_RATE, Threshold: 0.1, Window: time.Minute, MinRequests: 10, Cooldown: time.Hour})
+		assert.Nil(t, middleware.SetHistory(10, filename))
+		middleware.restoreStates()
+		return middleware
+	}
+	removed := &registry.Service{Name: "removed", Url: "ws://127.0.0.1:3000"}
+	flapping := &registry.Service{Name: "flapping", Url: "ws://127.0.0.1:3001"}
+	now := time.Now()
+
+	m := newTestMetrics()
+	middleware := newMiddleware(m)
+	middleware.evaluate(now)
+	m.requests.WithLabelValues("eth_call", "u1", "error").Add(100)
+	middleware.evaluate(now.Add(10 * time.Second))
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, removed), now)
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, flapping), now)
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_ADD, flapping), now.Add(time.Minute))
+	assert.Nil(t, middleware.OnStop())
+	assert.Equal(t, 4, len(recorder.received()))
+
+	// restarted with fresh metrics
+	m = newTestMetrics()
+	middleware = newMiddleware(m)
+	assert.Equal(t, 2, len(middleware.ActiveAlerts()))
+	middleware.evaluate(now.Add(2 * time.Minute))
+	m.requests.WithLabelValues("eth_call", "u1", "error").Add(100)
+	middleware.evaluate(now.Add(2*time.Minute + 10*time.Second))
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, removed), now.Add(3*time.Minute))
+	// fires again in the cooldown
+	middleware.onRegistryEvent(registry.NewEvent(registry.SERVICE_REMOVE, flapping), now.Add(4*time.Minute))
+	assert.Equal(t, 3, len(middleware.ActiveAlerts()))
+	assert.Nil(t, middleware.OnStop())
+	assert.Equal(t, 4, len(recorder.received()))
+	history := middleware.ListHistory(0, 10)
+	assert.Equal(t, uint(5), history.Total)
+	assert.Equal(t, "ws://127.0.0.1:3001", history.Items[0].Key)
+	assert.False(t, history.Items[0].Notified)
+}
@@ -0,0 +1,254 @@
+package alert
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statuses of alert events
+const (
+	STATUS_FIRING   = "firing"
+	STATUS_RESOLVED = "resolved"
+)
+
+const defaultHistorySize = 1000
+
+// AlertEvent is an alert starting to fire or resolved
+type AlertEvent struct {
+	Id        uint64     `json:"id"`
+	Rule      string     `json:"rule"`
+	Type      string     `json:"type"`
+	Severity  string     `json:"severity"`
+	Key       string     `json:"key"` // method name or upstream url
+	Status    string     `json:"status"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	Message   string     `json:"message"`
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"` // set when resolved
+	Time      time.Time  `json:"time"`
+	Notified  bool       `json:"notified"` // false if suppressed by cooldown or no webhooks
+}
+
+type AlertEventListVo struct {
+	Items []*AlertEvent `json:"items"`
+	Total uint          `json:"total"`
+}
+
+/**
+ * alertHistory keeps the last alert events in memory, and appends them to a json lines file if set,
+ * so the history and the firing and cooldown states of alerts survive restarts.
+ * the file is compacted to the last events and the latest states when it grows too long
+ */
+type alertHistory struct {
+	lock   sync.RWMutex
+	size   int
+	events []*AlertEvent // oldest first
+	lastId uint64
+	// the latest event and the latest notified event of each rule and key, to restore the alert states
+	latest       map[string]*AlertEvent
+	lastNotified map[string]*AlertEvent
+
+	filename  string
+	file      *os.File
+	fileLines int
+}
+
+func alertStateKey(rule string, key string) string {
+	return rule + "\x00" + key
+}
+
+// newAlertHistory loads the last {size} events of {filename} if not empty
+func newAlertHistory(size int, filename string) (history *alertHistory, err error) {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	history = &alertHistory{
+		size:         size,
+		latest:       make(map[string]*AlertEvent),
+		lastNotified: make(map[string]*AlertEvent),
+		filename:     filename,
+	}
+	if len(filename) < 1 {
+		return
+	}
+	if f, openErr := os.Open(filename); openErr == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			history.fileLines++
+			var event AlertEvent
+			if json.Unmarshal(scanner.Bytes(), &event) != nil {
+				continue
+			}
+			history.keep(&event)
+		}
+		f.Close()
+	}
+	if history.fileTooLong() {
+		history.compact()
+	}
+	if history.file == nil {
+		history.file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	return
+}
+
+func (history *alertHistory) keep(event *AlertEvent) {
+	history.events = append(history.events, event)
+	if len(history.events) > history.size {
+		history.events = history.events[len(history.events)-history.size:]
+	}
+	if event.Id > history.lastId {
+		history.lastId = event.Id
+	}
+	stateKey := alertStateKey(event.Rule, event.Key)
+	history.latest[stateKey] = event
+	if event.Notified {
+		history.lastNotified[stateKey] = event
+	}
+}
+
+// fileTooLong returns true if the file has twice more lines than the events kept by compaction
+func (history *alertHistory) fileTooLong() bool {
+	return history.fileLines > 2*(history.size+len(history.latest)+len(history.lastNotified))
+}
+
+// compact rewrites the file with the last events and the latest states, the old file is kept if it fails
+func (history *alertHistory) compact() {
+	kept := make(map[*AlertEvent]bool)
+	var events []*AlertEvent
+	for _, group := range [][]*AlertEvent{history.events, stateEvents(history.latest), stateEvents(history.lastNotified)} {
+		for _, event := range group {
+			if !kept[event] {
+				kept[event] = true
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id < events[j].Id
+	})
+	tmpFilename := history.filename + ".tmp"
+	err := writeAlertEvents(tmpFilename, events)
+	if err == nil && history.file != nil {
+		err = history.file.Close()
+		history.file = nil
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, history.filename)
+	}
+	if err != nil {
+		log.Warnf("compact alert history file %s error %s", history.filename, err.Error())
+		os.Remove(tmpFilename)
+	} else {
+		history.fileLines = len(events)
+	}
+	if history.file == nil {
+		if history.file, err = os.OpenFile(history.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			log.Warnf("open alert history file %s error %s", history.filename, err.Error())
+		}
+	}
+}
+
+func stateEvents(states map[string]*AlertEvent) []*AlertEvent {
+	result := make([]*AlertEvent, 0, len(states))
+	for _, event := range states {
+		result = append(result, event)
+	}
+	return result
+}
+
+func writeAlertEvents(filename string, events []*AlertEvent) (err error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	writer := bufio.NewWriter(f)
+	for _, event := range events {
+		line, jsonErr := json.Marshal(event)
+		if jsonErr != nil {
+			continue
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err = writer.Flush(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// add assigns the id of the event and saves it
+func (history *alertHistory) add(event *AlertEvent) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	event.Id = history.lastId + 1
+	history.keep(event)
+	if history.file == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if _, err = history.file.Write(append(line, '\n')); err != nil {
+		log.Warnf("write alert history error %s", err.Error())
+		return
+	}
+	history.fileLines++
+	if history.fileTooLong() {
+		history.compact()
+	}
+}
+
+// lastStates returns copies of the latest event and the latest notified event of each rule and key
+func (history *alertHistory) lastStates() (latest map[string]*AlertEvent, lastNotified map[string]*AlertEvent) {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+	latest = make(map[string]*AlertEvent, len(history.latest))
+	for stateKey, event := range history.latest {
+		copied := *event
+		latest[stateKey] = &copied
+	}
+	lastNotified = make(map[string]*AlertEvent, len(history.lastNotified))
+	for stateKey, event := range history.lastNotified {
+		copied := *event
+		lastNotified[stateKey] = &copied
+	}
+	return
+}
+
+// list returns events newest first
+func (history *alertHistory) list(offset int, limit int) *AlertEventListVo {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+	result := &AlertEventListVo{
+		Items: make([]*AlertEvent, 0),
+		Total: uint(len(history.events)),
+	}
+	for i := len(history.events) - 1 - offset; i >= 0 && len(result.Items) < limit; i-- {
+		event := *history.events[i]
+		result.Items = append(result.Items, &event)
+	}
+	return result
+}
+
+func (history *alertHistory) close() error {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if history.file == nil {
+		return nil
+	}
+	err := history.file.Close()
+	history.file = nil
+	return err
+}
@@ -0,0 +1,55 @@
+package alert
+
+import (
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+)
+
+func LoadAlertPluginConfig(chain *plugin.MiddlewareChain,
+	configInfo *config.ServerConfig, r registry.Registry) (result *AlertMiddleware) {
+	alertPluginConf := configInfo.Plugins.Alert
+	if !alertPluginConf.Start {
+		return
+	}
+	alertMiddleware := NewAlertMiddleware().
+		SetInterval(time.Duration(alertPluginConf.IntervalSeconds) * time.Second).
+		SetRegistry(r)
+	if err := alertMiddleware.SetHistory(alertPluginConf.HistorySize, alertPluginConf.HistoryFile); err != nil {
+		log.Fatalln("open alert history file error", err)
+		return
+	}
+	for _, ruleConf := range alertPluginConf.Rules {
+		rule := &Rule{
+			Name:        ruleConf.Name,
+			Type:        ruleConf.Type,
+			Severity:    ruleConf.Severity,
+			Methods:     ruleConf.Methods,
+			Threshold:   ruleConf.Threshold,
+			Window:      time.Duration(ruleConf.WindowSeconds) * time.Second,
+			MinRequests: ruleConf.MinRequests,
+			Cooldown:    time.Duration(ruleConf.CooldownSeconds) * time.Second,
+		}
+		if err := alertMiddleware.AddRule(rule); err != nil {
+			log.Fatalln("invalid alert rule", err)
+			return
+		}
+	}
+	for _, webhookConf := range alertPluginConf.Webhooks {
+		webhook := &Webhook{
+			Url:          webhookConf.Url,
+			Headers:      webhookConf.Headers,
+			BodyTemplate: webhookConf.BodyTemplate,
+			Timeout:      time.Duration(webhookConf.TimeoutMs) * time.Millisecond,
+		}
+		if err := alertMiddleware.AddWebhook(webhook); err != nil {
+			log.Fatalln("invalid alert webhook", err)
+			return
+		}
+	}
+	chain.InsertHead(alertMiddleware)
+	result = alertMiddleware
+	return
+}
@@ -0,0 +1,291 @@
+package alert
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+)
+
+// metrics of other plugins which alert rules are evaluated by
+const (
+	rpcRequestsMetric         = "jsonrpc_proxy_rpc_requests_total"
+	rpcRequestDurationMetric  = "jsonrpc_proxy_rpc_request_duration_seconds"
+	cacheRequestsMetric       = "jsonrpc_proxy_cache_requests_total"
+	rateLimitRejectedMetric   = "jsonrpc_proxy_rate_limit_rejected_connections_total"
+	upstreamUpMetric          = "jsonrpc_proxy_upstream_up"
+	statusErrorLabelValue     = "error"
+	cacheResultMissLabelValue = "miss"
+)
+
+type requestStat struct {
+	total  float64
+	errors float64
+}
+
+type cacheStat struct {
+	total float64
+	hits  float64
+}
+
+// latencyHistogram is the cumulative bucket counts of a histogram, sorted by upper bounds(seconds)
+type latencyHistogram struct {
+	upperBounds []float64
+	counts      []float64
+}
+
+func (h *latencyHistogram) count() float64 {
+	if len(h.counts) < 1 {
+		return 0
+	}
+	return h.counts[len(h.counts)-1]
+}
+
+// sub returns the histogram of observations after {base}
+func (h *latencyHistogram) sub(base *latencyHistogram) *latencyHistogram {
+	result := &latencyHistogram{
+		upperBounds: h.upperBounds,
+		counts:      make([]float64, len(h.counts)),
+	}
+	for i := range h.counts {
+		result.counts[i] = h.counts[i]
+		if base != nil && i < len(base.counts) {
+			result.counts[i] = math.Max(0, h.counts[i]-base.counts[i])
+		}
+	}
+	return result
+}
+
+// quantile estimates the quantile by linear interpolation in the bucket like prometheus histogram_quantile,
+// the last finite upper bound is returned if the quantile is in the +Inf bucket
+func (h *latencyHistogram) quantile(q float64) float64 {
+	total := h.count()
+	if total <= 0 {
+		return 0
+	}
+	target := q * total
+	for i, cumulative := range h.counts {
+		if cumulative < target {
+			continue
+		}
+		upper := h.upperBounds[i]
+		if math.IsInf(upper, 1) {
+			if i > 0 {
+				return h.upperBounds[i-1]
+			}
+			return 0
+		}
+		lower, lowerCount := 0.0, 0.0
+		if i > 0 {
+			lower, lowerCount = h.upperBounds[i-1], h.counts[i-1]
+		}
+		inBucket := cumulative - lowerCount
+		if inBucket <= 0 {
+			return upper
+		}
+		return lower + (upper-lower)*(target-lowerCount)/inBucket
+	}
+	return h.upperBounds[len(h.upperBounds)-1]
+}
+
+// metricsSnapshot is the values of the metrics used by alert rules at a time
+type metricsSnapshot struct {
+	time              time.Time
+	requests          map[string]*requestStat // by method
+	latency           map[string]*latencyHistogram
+	cacheRequests     map[string]*cacheStat
+	rateLimitRejected float64
+	upstreamUp        map[string]float64
+}
+
+func newMetricsSnapshot(now time.Time, families []*metrics.MetricFamily) *metricsSnapshot {
+	snapshot := &metricsSnapshot{
+		time:          now,
+		requests:      make(map[string]*requestStat),
+		latency:       make(map[string]*latencyHistogram),
+		cacheRequests: make(map[string]*cacheStat),
+		upstreamUp:    make(map[string]float64),
+	}
+	type bucket struct {
+		upperBound float64
+		count      float64
+	}
+	latencyBuckets := make(map[string][]bucket)
+	for _, family := range families {
+		for _, sample := range family.Samples {
+			switch family.Name {
+			case rpcRequestsMetric:
+				method := sample.Labels["method"]
+				stat, ok := snapshot.requests[method]
+				if !ok {
+					stat = &requestStat{}
+					snapshot.requests[method] = stat
+				}
+				stat.total += sample.Value
+				if sample.Labels["status"] == statusErrorLabelValue {
+					stat.errors += sample.Value
+				}
+			case rpcRequestDurationMetric:
+				if sample.Suffix != "_bucket" {
+					continue
+				}
+				upperBound, err := strconv.ParseFloat(sample.Labels["le"], 64)
+				if err != nil {
+					continue
+				}
+				method := sample.Labels["method"]
+				latencyBuckets[method] = append(latencyBuckets[method], bucket{upperBound, sample.Value})
+			case cacheRequestsMetric:
+				method := sample.Labels["method"]
+				stat, ok := snapshot.cacheRequests[method]
+				if !ok {
+					stat = &cacheStat{}
+					snapshot.cacheRequests[method] = stat
+				}
+				stat.total += sample.Value
+				if sample.Labels["result"] != cacheResultMissLabelValue {
+					stat.hits += sample.Value
+				}
+			case rateLimitRejectedMetric:
+				snapshot.rateLimitRejected += sample.Value
+			case upstreamUpMetric:
+				snapshot.upstreamUp[sample.Labels["upstream"]] = sample.Value
+			}
+		}
+	}
+	for method, buckets := range latencyBuckets {
+		sort.Slice(buckets, func(i, j int) bool {
+			return buckets[i].upperBound < buckets[j].upperBound
+		})
+		histogram := &latencyHistogram{}
+		for _, b := range buckets {
+			histogram.upperBounds = append(histogram.upperBounds, b.upperBound)
+			histogram.counts = append(histogram.counts, b.count)
+		}
+		snapshot.latency[method] = histogram
+	}
+	return snapshot
+}
+
+/**
+ * metricsWindow keeps snapshots of the metrics taken at each evaluation,
+ * so rates in a time window are the differences between the latest snapshot and the one at the window start
+ */
+type metricsWindow struct {
+	lock      sync.RWMutex
+	gather    func() []*metrics.MetricFamily
+	maxWindow time.Duration
+	snapshots []*metricsSnapshot // oldest first
+}
+
+func newMetricsWindow(gather func() []*metrics.MetricFamily, maxWindow time.Duration) *metricsWindow {
+	return &metricsWindow{
+		gather:    gather,
+		maxWindow: maxWindow,
+	}
+}
+
+// record takes a snapshot, and removes snapshots not needed by any window
+func (w *metricsWindow) record(now time.Time) {
+	snapshot := newMetricsSnapshot(now, w.gather())
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.snapshots = append(w.snapshots, snapshot)
+	// keep the last snapshot before the longest window as the base of it
+	keepFrom := 0
+	for i, s := range w.snapshots {
+		if now.Sub(s.time) > w.maxWindow {
+			keepFrom = i
+		}
+	}
+	w.snapshots = w.snapshots[keepFrom:]
+}
+
+// between returns the latest snapshot and the base snapshot of the window starting at {since},
+// the base is the latest one at or before since, or the oldest one if the window isn't fully recorded yet
+func (w *metricsWindow) between(since time.Time) (latest *metricsSnapshot, base *metricsSnapshot) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if len(w.snapshots) < 2 {
+		return
+	}
+	latest = w.snapshots[len(w.snapshots)-1]
+	base = w.snapshots[0]
+	for _, s := range w.snapshots[:len(w.snapshots)-1] {
+		if s.time.After(since) {
+			break
+		}
+		base = s
+	}
+	return
+}
+
+func (w *metricsWindow) methodRequests(since time.Time) map[string]*requestStat {
+	result := make(map[string]*requestStat)
+	latest, base := w.between(since)
+	if latest == nil {
+		return result
+	}
+	for method, stat := range latest.requests {
+		delta := &requestStat{total: stat.total, errors: stat.errors}
+		if baseStat, ok := base.requests[method]; ok {
+			delta.total = math.Max(0, stat.total-baseStat.total)
+			delta.errors = math.Max(0, stat.errors-baseStat.errors)
+		}
+		result[method] = delta
+	}
+	return result
+}
+
+func (w *metricsWindow) methodLatency(since time.Time) map[string]*latencyHistogram {
+	result := make(map[string]*latencyHistogram)
+	latest, base := w.between(since)
+	if latest == nil {
+		return result
+	}
+	for method, histogram := range latest.latency {
+		result[method] = histogram.sub(base.latency[method])
+	}
+	return result
+}
+
+func (w *metricsWindow) cacheRequests(since time.Time) map[string]*cacheStat {
+	result := make(map[string]*cacheStat)
+	latest, base := w.between(since)
+	if latest == nil {
+		return result
+	}
+	for method, stat := range latest.cacheRequests {
+		delta := &cacheStat{total: stat.total, hits: stat.hits}
+		if baseStat, ok := base.cacheRequests[method]; ok {
+			delta.total = math.Max(0, stat.total-baseStat.total)
+			delta.hits = math.Max(0, stat.hits-baseStat.hits)
+		}
+		result[method] = delta
+	}
+	return result
+}
+
+// rateLimitRejections returns the connections rejected in the window and the seconds of the window recorded
+func (w *metricsWindow) rateLimitRejections(since time.Time) (rejected float64, seconds float64) {
+	latest, base := w.between(since)
+	if latest == nil {
+		return
+	}
+	rejected = math.Max(0, latest.rateLimitRejected-base.rateLimitRejected)
+	seconds = latest.time.Sub(base.time).Seconds()
+	return
+}
+
+// upstreamUp returns the latest health of upstreams
+func (w *metricsWindow) upstreamUp() map[string]float64 {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if len(w.snapshots) < 1 {
+		return nil
+	}
+	return w.snapshots[len(w.snapshots)-1].upstreamUp
+}
@@ -0,0 +1,168 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// types of alert rules
+const (
+	RULE_UPSTREAM_REMOVED      = "upstream_removed"      // an upstream service is removed from the registry
+	RULE_UPSTREAM_UNHEALTHY    = "upstream_unhealthy"    // the last request to an upstream failed to connect or timed out
+	RULE_ERROR_RATE            = "error_rate"            // error responses / responses of a method > threshold
+	RULE_P99_LATENCY           = "p99_latency"           // p99 latency(milliseconds) of a method > threshold
+	RULE_RATE_LIMIT_REJECTIONS = "rate_limit_rejections" // connections rejected by rate limit per second > threshold
+	RULE_CACHE_HIT_RATIO       = "cache_hit_ratio"       // cache hits / requests of a cached method < threshold
+)
+
+const (
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+)
+
+const (
+	defaultRuleWindow = 5 * time.Minute
+	defaultCooldown   = 10 * time.Minute
+)
+
+// Rule decides which alerts are firing. alerts of a rule are keyed by method or upstream url
+type Rule struct {
+	Name     string
+	Type     string
+	Severity string   // warning by default
+	Methods  []string // exact names or globs of methods checked by the method rules, all methods if empty
+	// threshold of the rule type, alerts fire when the value is over it(below it for cache_hit_ratio)
+	Threshold float64
+	// rates and latencies are computed over the last window
+	Window time.Duration
+	// method rules don't fire if the method has fewer requests in the window
+	MinRequests int64
+	// a resolved alert firing again in the cooldown is not notified again, so flapping alerts are not noisy
+	Cooldown time.Duration
+}
+
+// Validate checks the rule and fills the defaults
+func (rule *Rule) Validate() error {
+	if len(rule.Name) < 1 {
+		rule.Name = rule.Type
+	}
+	switch rule.Type {
+	case RULE_UPSTREAM_REMOVED, RULE_UPSTREAM_UNHEALTHY:
+	case RULE_ERROR_RATE, RULE_CACHE_HIT_RATIO:
+		if rule.Threshold <= 0 || rule.Threshold > 1 {
+			return fmt.Errorf("threshold of alert rule %s should be a ratio in (0, 1]", rule.Name)
+		}
+	case RULE_P99_LATENCY, RULE_RATE_LIMIT_REJECTIONS:
+		if rule.Threshold <= 0 {
+			return fmt.Errorf("threshold of alert rule %s should be > 0", rule.Name)
+		}
+	default:
+		return fmt.Errorf("unknown type %s of alert rule %s", rule.Type, rule.Name)
+	}
+	for _, pattern := range rule.Methods {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("invalid method pattern " + pattern + " of alert rule " + rule.Name)
+		}
+	}
+	if len(rule.Severity) < 1 {
+		rule.Severity = SEVERITY_WARNING
+	}
+	if rule.Window <= 0 {
+		rule.Window = defaultRuleWindow
+	}
+	if rule.Cooldown <= 0 {
+		rule.Cooldown = defaultCooldown
+	}
+	return nil
+}
+
+func (rule *Rule) matchMethod(methodName string) bool {
+	if len(rule.Methods) < 1 {
+		return true
+	}
+	for _, pattern := range rule.Methods {
+		if matched, _ := path.Match(pattern, methodName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// condition is the state of an alert of the rule in an evaluation
+type condition struct {
+	key     string // method name or upstream url
+	value   float64
+	firing  bool
+	message string
+}
+
+// evaluate returns conditions of the method and upstream rules by the metrics in the rule's window
+func (rule *Rule) evaluate(window *metricsWindow, now time.Time) []*condition {
+	var result []*condition
+	switch rule.Type {
+	case RULE_UPSTREAM_UNHEALTHY:
+		for upstream, up := range window.upstreamUp() {
+			result = append(result, &condition{
+				key:     upstream,
+				value:   up,
+				firing:  up < 1,
+				message: fmt.Sprintf("upstream %s failed to connect or timed out", upstream),
+			})
+		}
+	case RULE_ERROR_RATE:
+		for method, stat := range window.methodRequests(now.Add(-rule.Window)) {
+			if !rule.matchMethod(method) || stat.total < float64(rule.MinRequests) || stat.total <= 0 {
+				continue
+			}
+			rate := stat.errors / stat.total
+			result = append(result, &condition{
+				key:    method,
+				value:  rate,
+				firing: rate > rule.Threshold,
+				message: fmt.Sprintf("error rate of %s is %.2f%% in the last %s(%d of %d requests)",
+					method, rate*100, rule.Window, int64(stat.errors), int64(stat.total)),
+			})
+		}
+	case RULE_P99_LATENCY:
+		for method, histogram := range window.methodLatency(now.Add(-rule.Window)) {
+			if !rule.matchMethod(method) || histogram.count() < float64(rule.MinRequests) || histogram.count() <= 0 {
+				continue
+			}
+			p99 := histogram.quantile(0.99) * 1000
+			result = append(result, &condition{
+				key:     method,
+				value:   p99,
+				firing:  p99 > rule.Threshold,
+				message: fmt.Sprintf("p99 latency of %s is %.0fms in the last %s", method, p99, rule.Window),
+			})
+		}
+	case RULE_RATE_LIMIT_REJECTIONS:
+		rejected, seconds := window.rateLimitRejections(now.Add(-rule.Window))
+		if seconds > 0 {
+			rate := rejected / seconds
+			result = append(result, &condition{
+				key:     "rate_limit",
+				value:   rate,
+				firing:  rate > rule.Threshold,
+				message: fmt.Sprintf("%.2f connections per second rejected by rate limit in the last %s", rate, rule.Window),
+			})
+		}
+	case RULE_CACHE_HIT_RATIO:
+		for method, stat := range window.cacheRequests(now.Add(-rule.Window)) {
+			if !rule.matchMethod(method) || stat.total < float64(rule.MinRequests) || stat.total <= 0 {
+				continue
+			}
+			ratio := stat.hits / stat.total
+			result = append(result, &condition{
+				key:    method,
+				value:  ratio,
+				firing: ratio < rule.Threshold,
+				message: fmt.Sprintf("cache hit ratio of %s is %.2f%% in the last %s",
+					method, ratio*100, rule.Window),
+			})
+		}
+	}
+	return result
+}
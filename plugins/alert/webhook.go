@@ -0,0 +1,102 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultBodyTemplate is a slack compatible message, also accepted by mattermost, rocket.chat and similar webhooks
+const DefaultBodyTemplate = `{"text": {{ json (printf "[%s] %s %s: %s" (upper .Status) .Severity .Rule .Message) }}}`
+
+const defaultWebhookTimeout = 5 * time.Second
+
+// Webhook receives alert events by POST of the json body rendered by BodyTemplate
+type Webhook struct {
+	Url     string
+	Headers map[string]string
+	// text/template of the json body with an AlertEvent, funcs json(value to json) and upper are available.
+	// DefaultBodyTemplate if empty
+	BodyTemplate string
+	Timeout      time.Duration
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		bytes, err := json.Marshal(value)
+		return string(bytes), err
+	},
+	"upper": strings.ToUpper,
+}
+
+type webhookNotifier struct {
+	webhook *Webhook
+	body    *template.Template
+	client  *http.Client
+}
+
+func newWebhookNotifier(webhook *Webhook) (*webhookNotifier, error) {
+	if len(webhook.Url) < 1 {
+		return nil, fmt.Errorf("url of alert webhook not set")
+	}
+	bodyTemplate := webhook.BodyTemplate
+	if len(bodyTemplate) < 1 {
+		bodyTemplate = DefaultBodyTemplate
+	}
+	body, err := template.New(webhook.Url).Funcs(templateFuncs).Parse(bodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template of alert webhook %s: %s", webhook.Url, err.Error())
+	}
+	timeout := webhook.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &webhookNotifier{
+		webhook: webhook,
+		body:    body,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// render returns the json body of the event
+func (notifier *webhookNotifier) render(event *AlertEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := notifier.body.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("body of alert webhook %s is not valid json: %s", notifier.webhook.Url, buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+func (notifier *webhookNotifier) notify(event *AlertEvent) error {
+	body, err := notifier.render(event)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, notifier.webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for k, v := range notifier.webhook.Headers {
+		request.Header.Set(k, v)
+	}
+	response, err := notifier.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook %s responded status %d", notifier.webhook.Url, response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const defaultListEntriesLimit = 100
+
+// CacheEntryVo is a cache entry shown by dashboard
+type CacheEntryVo struct {
+	Key         string `json:"key"`
+	Method      string `json:"method"`
+	Size        int64  `json:"size"`
+	TtlMillis   int64  `json:"ttl_ms"`   // remaining time in backend, -1 means never expire
+	FreshMillis int64  `json:"fresh_ms"` // remaining fresh time, negative means the entry is stale
+	Hits        int64  `json:"hits"`     // only counted by memory backend
+}
+
+// KeyPatternOfMethod returns the glob pattern of cache keys of the method for cache
+func KeyPatternOfMethod(methodNameForCache string) string {
+	return cacheKeyPrefix + methodNameForCache + "$*"
+}
+
+// ListEntries returns at most {limit} cache entries whose keys match the glob {pattern}
+func (middleware *CacheMiddleware) ListEntries(pattern string, limit int) (result []*CacheEntryVo, err error) {
+	if len(pattern) < 1 {
+		pattern = cacheKeyPrefix + "*"
+	}
+	if limit <= 0 {
+		limit = defaultListEntriesLimit
+	}
+	entries, err := middleware.backend.Entries(pattern, limit)
+	if err != nil {
+		return
+	}
+	nowMillis := time.Now().UnixNano() / int64(time.Millisecond)
+	result = make([]*CacheEntryVo, 0, len(entries))
+	for _, entry := range entries {
+		vo := &CacheEntryVo{
+			Key:       entry.Key,
+			Method:    methodOfCacheKey(entry.Key),
+			Size:      entry.Size,
+			TtlMillis: -1,
+			Hits:      entry.Hits,
+		}
+		if entry.Ttl >= 0 {
+			vo.TtlMillis = int64(entry.Ttl / time.Millisecond)
+		}
+		cached := &cachedResponse{}
+		if json.Unmarshal(entry.Value, cached) == nil {
+			vo.FreshMillis = cached.FreshUntil - nowMillis
+		}
+		result = append(result, vo)
+	}
+	return
+}
+
+func (middleware *CacheMiddleware) applyPurge(event *CachePurgeEvent) (count int64, err error) {
+	switch {
+	case event.Flush:
+		err = middleware.backend.Flush()
+	case len(event.Pattern) > 0:
+		count, err = middleware.backend.DeletePattern(event.Pattern)
+	case len(event.Key) > 0:
+		if _, ok, _ := middleware.backend.Get(event.Key); ok {
+			count = 1
+		}
+		err = middleware.backend.Delete(event.Key)
+	}
+	return
+}
+
+// purge the entries locally and broadcast to other replicas
+func (middleware *CacheMiddleware) purge(event *CachePurgeEvent) (count int64, err error) {
+	if count, err = middleware.applyPurge(event); err != nil {
+		return
+	}
+	if middleware.purgeBroadcaster != nil {
+		if publishErr := middleware.purgeBroadcaster.publish(event); publishErr != nil {
+			log.Warnf("broadcast cache purge error %s", publishErr.Error())
+		}
+	}
+	return
+}
+
+// PurgeKey delete the cache entry of the key
+func (middleware *CacheMiddleware) PurgeKey(key string) (int64, error) {
+	return middleware.purge(&CachePurgeEvent{Key: key})
+}
+
+// PurgePattern delete the cache entries whose keys match the glob {pattern}
+func (middleware *CacheMiddleware) PurgePattern(pattern string) (int64, error) {
+	return middleware.purge(&CachePurgeEvent{Pattern: pattern})
+}
+
+// Flush delete all cache entries
+func (middleware *CacheMiddleware) Flush() error {
+	_, err := middleware.purge(&CachePurgeEvent{Flush: true})
+	return err
+}
+
+// SetPurgeBroadcast broadcast purges to other replicas by redis pub/sub,
+// purges from others are applied to the backend unless it's shared by replicas
+func (middleware *CacheMiddleware) SetPurgeBroadcast(redisUrl string, channel string) (err error) {
+	broadcaster, err := newPurgeBroadcaster(redisUrl, channel)
+	if err != nil {
+		return
+	}
+	middleware.purgeBroadcaster = broadcaster
+	_, shared := middleware.backend.(*redisCacheBackend)
+	broadcaster.subscribe(func(event *CachePurgeEvent) {
+		if shared {
+			return // already purged in the shared backend
+		}
+		if _, purgeErr := middleware.applyPurge(event); purgeErr != nil {
+			log.Warnf("apply cache purge from other replica error %s", purgeErr.Error())
+		}
+	})
+	return
+}
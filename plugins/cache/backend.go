@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+const (
+	CACHE_BACKEND_MEMORY = "memory"
+	CACHE_BACKEND_REDIS  = "redis"
+)
+
+// CacheBackend stores encoded cache values with TTL. the TTL is honored by the backend itself
+type CacheBackend interface {
+	// Get returns the value of key, ok is false if not found or expired
+	Get(key string) (value []byte, ok bool, err error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	// TryLock acquires a lock of key for at most {ttl}, returns false if the lock is held by others.
+	// used to coalesce requests of a missed key across replicas
+	TryLock(key string, ttl time.Duration) (bool, error)
+	Unlock(key string) error
+	// IsLocked returns whether the lock of key is held by any replica
+	IsLocked(key string) (bool, error)
+	// Entries returns at most {limit} entries whose keys match the glob {pattern}, limit <= 0 means no limit
+	Entries(pattern string, limit int) ([]*CacheBackendEntry, error)
+	// DeletePattern delete entries whose keys match the glob {pattern}, returns the count deleted
+	DeletePattern(pattern string) (int64, error)
+	Flush() error
+	Close() error
+}
+
+// CacheBackendEntry is an entry listed by CacheBackend.Entries
+type CacheBackendEntry struct {
+	Key   string
+	Value []byte
+	Size  int64
+	Ttl   time.Duration // remaining time, negative means never expire
+	Hits  int64         // only counted by memory backend
+}
+
+// StatsCacheBackend is a CacheBackend which can report its entries and memory usage
+type StatsCacheBackend interface {
+	Stats() *utils.BoundedCacheStats
+}
+
+const (
+	defaultMemoryCacheMaxItems = 100000
+	defaultMemoryCacheMaxBytes = 256 * 1024 * 1024
+)
+
+/**
+ * memoryCacheBackend is a CacheBackend in process memory, not shared by replicas.
+ * entries are limited by count and bytes, grouped by rpc method to apply per-method memory quotas
+ */
+type memoryCacheBackend struct {
+	cache     *utils.BoundedCache
+	locksLock sync.Mutex
+	locks     map[string]time.Time // key => lock expiration
+}
+
+// NewMemoryCacheBackend create memory backend, default limits are used if MaxItems or MaxBytes is 0
+func NewMemoryCacheBackend(options utils.BoundedCacheOptions) CacheBackend {
+	if options.MaxItems <= 0 {
+		options.MaxItems = defaultMemoryCacheMaxItems
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = defaultMemoryCacheMaxBytes
+	}
+	if options.GroupOfKey == nil {
+		options.GroupOfKey = methodOfCacheKey
+	}
+	return &memoryCacheBackend{
+		cache: utils.NewBoundedCache(options),
+		locks: make(map[string]time.Time),
+	}
+}
+
+func (b *memoryCacheBackend) Get(key string) (value []byte, ok bool, err error) {
+	value, ok = b.cache.Get(key)
+	return
+}
+
+func (b *memoryCacheBackend) Set(key string, value []byte, ttl time.Duration) error {
+	if !b.cache.Set(key, value, ttl) {
+		log.Debugf("cache value of %s too large to cache", key)
+	}
+	return nil
+}
+
+func (b *memoryCacheBackend) Delete(key string) error {
+	b.cache.Delete(key)
+	return nil
+}
+
+func (b *memoryCacheBackend) TryLock(key string, ttl time.Duration) (bool, error) {
+	b.locksLock.Lock()
+	defer b.locksLock.Unlock()
+	now := time.Now()
+	if expiration, ok := b.locks[key]; ok && now.Before(expiration) {
+		return false, nil
+	}
+	b.locks[key] = now.Add(ttl)
+	return true, nil
+}
+
+func (b *memoryCacheBackend) Unlock(key string) error {
+	b.locksLock.Lock()
+	defer b.locksLock.Unlock()
+	delete(b.locks, key)
+	return nil
+}
+
+func (b *memoryCacheBackend) IsLocked(key string) (bool, error) {
+	b.locksLock.Lock()
+	defer b.locksLock.Unlock()
+	expiration, ok := b.locks[key]
+	return ok && time.Now().Before(expiration), nil
+}
+
+func (b *memoryCacheBackend) Entries(pattern string, limit int) (result []*CacheBackendEntry, err error) {
+	now := time.Now().UnixNano()
+	for _, info := range b.cache.Entries(func(key string) bool {
+		return utils.GlobMatch(pattern, key)
+	}, limit) {
+		entry := &CacheBackendEntry{
+			Key:   info.Key,
+			Value: info.Value,
+			Size:  info.Size,
+			Ttl:   -1,
+			Hits:  info.Hits,
+		}
+		if info.Expiration > 0 {
+			entry.Ttl = time.Duration(info.Expiration - now)
+		}
+		result = append(result, entry)
+	}
+	return
+}
+
+func (b *memoryCacheBackend) DeletePattern(pattern string) (int64, error) {
+	return b.cache.DeleteMatched(func(key string) bool {
+		return utils.GlobMatch(pattern, key)
+	}), nil
+}
+
+func (b *memoryCacheBackend) Flush() error {
+	b.cache.Flush()
+	return nil
+}
+
+func (b *memoryCacheBackend) Close() error {
+	return nil
+}
+
+func (b *memoryCacheBackend) Stats() *utils.BoundedCacheStats {
+	return b.cache.Stats()
+}
@@ -1,14 +1,52 @@
 package cache
 
 import (
-	"encoding/json"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
 )
 
 type BeforeCacheConfigItem struct {
 	MethodName                   string
 	FetchCacheKeyFromParamsCount int /* eg. when rpc params: [2, "info", "hello"], and FetchCacheKeyFromParamsCount==2, then methodName for cache middleware will be "call$2$\"info\""*/
+	MethodKeyPaths               []string /* json paths of params appended to methodName for cache, eg. when rpc params: {"api": "info"} and MethodKeyPaths==["api"], then methodName for cache will be "call$\"info\""*/
+	KeyPaths                     []string // only values of these json paths are used in cache key, all params if empty
+	IgnorePaths                  []string // json paths removed from params before computing cache key, eg. nonces
+
+	methodKeyTokens [][]string
+	keyTokens       [][]string
+	ignoreTokens    [][]string
+}
+
+func parseJsonPaths(paths []string) (result [][]string) {
+	for _, path := range paths {
+		result = append(result, utils.ParseJsonPath(path))
+	}
+	return
+}
+
+func (item *BeforeCacheConfigItem) hasParamsForCache() bool {
+	return len(item.KeyPaths) > 0 || len(item.IgnorePaths) > 0
+}
+
+// paramsForCache returns the params used in cache key, ignored paths removed and key paths selected
+func (item *BeforeCacheConfigItem) paramsForCache(params interface{}) (result interface{}, err error) {
+	result, err = utils.CanonicalJsonValue(params)
+	if err != nil {
+		return
+	}
+	for _, tokens := range item.ignoreTokens {
+		utils.JsonPathDeleteByTokens(result, tokens)
+	}
+	if len(item.keyTokens) < 1 {
+		return
+	}
+	keyValues := make([]interface{}, len(item.keyTokens))
+	for i, tokens := range item.keyTokens {
+		keyValues[i], _ = utils.JsonPathGetByTokens(result, tokens)
+	}
+	result = keyValues
+	return
 }
 
 /**
@@ -28,7 +66,7 @@ func NewBeforeCacheMiddleware() *BeforeCacheMiddleware {
 }
 
 func (m *BeforeCacheMiddleware) AddConfigItem(item *BeforeCacheConfigItem) *BeforeCacheMiddleware {
-	if item == nil || item.FetchCacheKeyFromParamsCount < 1 {
+	if item == nil || (item.FetchCacheKeyFromParamsCount < 1 && len(item.MethodKeyPaths) < 1 && !item.hasParamsForCache()) {
 		return m
 	}
 	m.beforeCacheConfigItems = append(m.beforeCacheConfigItems, item)
@@ -37,6 +75,9 @@ func (m *BeforeCacheMiddleware) AddConfigItem(item *BeforeCacheConfigItem) *Befo
 
 func (m *BeforeCacheMiddleware) Build() {
 	for _, item := range m.beforeCacheConfigItems {
+		item.methodKeyTokens = parseJsonPaths(item.MethodKeyPaths)
+		item.keyTokens = parseJsonPaths(item.KeyPaths)
+		item.ignoreTokens = parseJsonPaths(item.IgnorePaths)
 		m.configsMap[item.MethodName] = item
 	}
 }
@@ -63,20 +104,29 @@ func (middleware *BeforeCacheMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRe
 }
 
 func (middleware *BeforeCacheMiddleware) findBeforeCacheConfigItem(rpcReq *rpc.JSONRpcRequest) (result *BeforeCacheConfigItem, ok bool) {
-	methodName := rpcReq.Method
-	rpcParams := rpcReq.Params
-	rpcParamsArray, parseArrayOk := rpcParams.([]interface{})
-	if !parseArrayOk {
-		return
+	result, ok = middleware.configsMap[rpcReq.Method]
+	return
+}
+
+// methodNameForCache returns the methodName for cache of the request, ok is false if params not enough
+func (item *BeforeCacheConfigItem) methodNameForCache(rpcReq *rpc.JSONRpcRequest) (result string, ok bool, err error) {
+	var keyParams []interface{}
+	if item.FetchCacheKeyFromParamsCount > 0 {
+		rpcParamsArray, parseArrayOk := rpcReq.Params.([]interface{})
+		if !parseArrayOk || len(rpcParamsArray) < item.FetchCacheKeyFromParamsCount {
+			return
+		}
+		keyParams = append(keyParams, rpcParamsArray[0:item.FetchCacheKeyFromParamsCount]...)
 	}
-	rpcParamsCount := len(rpcParamsArray)
-	result, ok = middleware.configsMap[methodName]
-	if ok {
-		if rpcParamsCount < result.FetchCacheKeyFromParamsCount {
-			ok = false
-			result = nil
+	for _, tokens := range item.methodKeyTokens {
+		value, found := utils.JsonPathGetByTokens(rpcReq.Params, tokens)
+		if !found {
+			return
 		}
+		keyParams = append(keyParams, value)
 	}
+	result, err = MakeMethodNameForCache(rpcReq.Method, keyParams)
+	ok = err == nil
 	return
 }
 
@@ -84,7 +134,7 @@ func MakeMethodNameForCache(methodName string, paramsArray []interface{}) (resul
 	result = methodName
 	for i := 0; i < len(paramsArray); i++ {
 		result += "$"
-		argBytes, jsonErr := json.Marshal(paramsArray[i])
+		argBytes, jsonErr := utils.CanonicalJson(paramsArray[i])
 		if jsonErr != nil {
 			err = jsonErr
 			return
@@ -105,18 +155,23 @@ func (middleware *BeforeCacheMiddleware) OnRpcRequest(session *rpc.JSONRpcReques
 	if !ok {
 		return
 	}
-	rpcParams := rpcReq.Params
-	rpcParamsArray, parseArrayOk := rpcParams.([]interface{})
-	if !parseArrayOk {
-		return
-	}
-	fetchCacheKeyFromParamsCount := beforeCacheConfigItem.FetchCacheKeyFromParamsCount
-	methodNameForCache, jsonErr := MakeMethodNameForCache(rpcReq.Method, rpcParamsArray[0:fetchCacheKeyFromParamsCount])
+	methodNameForCache, found, jsonErr := beforeCacheConfigItem.methodNameForCache(rpcReq)
 	if jsonErr != nil {
 		log.Println("[before-cache] before_cache middleware parse param json error:", jsonErr)
 		return
 	}
+	if !found {
+		return
+	}
 	session.MethodNameForCache = &methodNameForCache
+	if beforeCacheConfigItem.hasParamsForCache() {
+		paramsForCache, paramsErr := beforeCacheConfigItem.paramsForCache(rpcReq.Params)
+		if paramsErr != nil {
+			log.Println("[before-cache] before_cache middleware parse param json error:", paramsErr)
+			return
+		}
+		session.ParamsForCache = paramsForCache
+	}
 
 	// log.Debugf("[before-cache] methodNameForCache %s set\n", methodNameForCache)
 	return
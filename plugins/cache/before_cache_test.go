@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+func mockRpcRequestSessionFromJson(t *testing.T, id uint64, method string, paramsJson string) *rpc.JSONRpcRequestSession {
+	params, err := utils.DecodeJsonUseNumber([]byte(paramsJson))
+	assert.True(t, err == nil)
+	return mockRpcRequestSession(id, method, params)
+}
+
+func TestBeforeCacheNamedParams(t *testing.T) {
+	m := NewBeforeCacheMiddleware()
+	m.AddConfigItem(&BeforeCacheConfigItem{
+		MethodName:     "call",
+		MethodKeyPaths: []string{"api"},
+		IgnorePaths:    []string{"nonce"},
+	})
+	m.Build()
+
+	session := mockRpcRequestSessionFromJson(t, 1, "call", `{"api": "getInfo", "args": {"b": 1.0, "a": "x"}, "nonce": 7}`)
+	assert.True(t, m.OnRpcRequest(session) == nil)
+	assert.Equal(t, `call$"getInfo"`, *session.MethodNameForCache)
+	paramsBytes, err := utils.CanonicalJson(session.ParamsForCache)
+	assert.True(t, err == nil)
+	assert.Equal(t, `{"api":"getInfo","args":{"a":"x","b":1}}`, string(paramsBytes))
+	// request params are not changed
+	assert.Contains(t, session.Request.Params, "nonce")
+
+	// missing method key path
+	session = mockRpcRequestSessionFromJson(t, 2, "call", `{"args": {}}`)
+	assert.True(t, m.OnRpcRequest(session) == nil)
+	assert.True(t, session.MethodNameForCache == nil)
+}
+
+func TestBeforeCacheKeyPaths(t *testing.T) {
+	before := NewBeforeCacheMiddleware()
+	before.AddConfigItem(&BeforeCacheConfigItem{
+		MethodName: "eth_call",
+		KeyPaths:   []string{"0.to", "0.data", "1"},
+	})
+	before.Build()
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_call", CacheDuration: time.Minute})
+	before.SetNextMiddleware(m)
+
+	first := mockRpcRequestSessionFromJson(t, 1, "eth_call", `[{"to": "0x01", "data": "0xab", "gas": "0x1"}, "latest"]`)
+	assert.True(t, before.OnRpcRequest(first) == nil)
+	assert.False(t, first.ResponseSetByCache)
+	first.FillRpcResponse(rpc.NewJSONRpcResponse(1, "0x10", nil))
+	assert.True(t, m.OnRpcResponse(first) == nil)
+
+	// different gas and key order, same cache entry
+	second := mockRpcRequestSessionFromJson(t, 2, "eth_call", `[{"gas": "0x2", "data": "0xab", "to": "0x01"}, "latest"]`)
+	assert.True(t, before.OnRpcRequest(second) == nil)
+	assert.True(t, second.ResponseSetByCache)
+	assert.Equal(t, "0x10", second.Response.Result)
+
+	third := mockRpcRequestSessionFromJson(t, 3, "eth_call", `[{"to": "0x02", "data": "0xab"}, "latest"]`)
+	assert.True(t, before.OnRpcRequest(third) == nil)
+	assert.False(t, third.ResponseSetByCache)
+}
+
+func TestCacheKeyCanonicalJson(t *testing.T) {
+	m := NewCacheMiddleware()
+	a, err := m.cacheKeyForRpcMethod("eth_getBalance", []interface{}{map[string]interface{}{"b": 1.0, "a": 2}, "latest"})
+	assert.True(t, err == nil)
+	b, err := m.cacheKeyForRpcMethod("eth_getBalance", []interface{}{map[string]interface{}{"a": 2.0, "b": 1}, "latest"})
+	assert.True(t, err == nil)
+	assert.Equal(t, a, b)
+}
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,14 +18,111 @@ var log = utils.GetLogger("cache")
 type CacheConfigItem struct {
 	MethodName    string
 	CacheDuration time.Duration
+	StaleDuration time.Duration // the expired value is served for this duration while refreshing it, 0 means disabled
+
+	TtlRules           []*CacheTtlRule               // the first rule matching the params overrides the durations
+	CacheErrors        bool                          // cache jsonrpc error responses for ErrorCacheDuration
+	ErrorCacheDuration time.Duration                 // defaultErrorCacheDuration if 0
+	NoCacheResults     []*pluginsCommon.ValueMatcher // responses whose result matches any of them are not cached
+}
+
+// CacheTtlRule decides the durations of requests whose params match all matchers
+type CacheTtlRule struct {
+	Params        []*pluginsCommon.ValueMatcher
+	CacheDuration time.Duration // 0 means not cached
+	StaleDuration time.Duration
 }
 
+// durationsOf returns the cache durations of the response to request with {params}, ok is false if not cacheable
+func (item *CacheConfigItem) durationsOf(params interface{}, response *rpc.JSONRpcResponse) (cacheDuration time.Duration, staleDuration time.Duration, ok bool) {
+	if response.Error != nil {
+		if !item.CacheErrors {
+			return
+		}
+		cacheDuration = item.ErrorCacheDuration
+		if cacheDuration <= 0 {
+			cacheDuration = defaultErrorCacheDuration
+		}
+		ok = true
+		return
+	}
+	for _, matcher := range item.NoCacheResults {
+		if matcher.Match(response.Result) {
+			return
+		}
+	}
+	cacheDuration = item.CacheDuration
+	staleDuration = item.StaleDuration
+	for _, rule := range item.TtlRules {
+		if pluginsCommon.MatchAllValueMatchers(rule.Params, params) {
+			cacheDuration = rule.CacheDuration
+			staleDuration = rule.StaleDuration
+			break
+		}
+	}
+	ok = cacheDuration > 0
+	return
+}
+
+// cachedResponse is the value stored in cache backend, it's kept after expired for the stale duration
+type cachedResponse struct {
+	FreshUntil int64           `json:"fresh_until"` // unix milliseconds
+	Response   json.RawMessage `json:"response"`
+}
+
+func (c *cachedResponse) fresh(now time.Time) bool {
+	return now.UnixNano()/int64(time.Millisecond) < c.FreshUntil
+}
+
+// keepWarmItem is a method+params combination refreshed before it expires
+type keepWarmItem struct {
+	method   string
+	params   []interface{}
+	cacheKey string
+	item     *CacheConfigItem
+}
+
+const (
+	defaultCoalesceLockTimeout = 5 * time.Second
+	defaultCoalesceWaitTimeout = 3 * time.Second
+	coalescePollInterval       = 50 * time.Millisecond
+	defaultErrorCacheDuration  = time.Second
+
+	refreshLockSuffix     = ":refresh"
+	refreshTimeout        = 10 * time.Second
+	keepWarmCheckInterval = time.Second
+	keepWarmMinAhead      = time.Second
+)
+
+// keys of JSONRpcRequestSession.Parameters used by cache middleware
+const (
+	sessionParamCacheKey     = "cache.key"
+	sessionParamCacheLocked  = "cache.locked"  // this request holds the coalescing lock of the key
+	sessionParamCacheWaiting = "cache.waiting" // this request waits for the response of the lock holder
+)
+
 type CacheMiddleware struct {
 	plugin.MiddlewareAdapter
 	cacheConfigItems    []*CacheConfigItem
 	cacheConfigItemsMap map[string]*CacheConfigItem // methodNameForCache => *CacheConfigItem
 
-	rpcCache *utils.MemoryCache
+	backend             CacheBackend
+	coalesce            bool
+	coalesceLockTimeout time.Duration
+	coalesceWaitTimeout time.Duration
+
+	keepWarmItems []*keepWarmItem
+
+	purgeBroadcaster *purgeBroadcaster
+
+	snapshotFile     string
+	snapshotInterval time.Duration
+	stopOnce         sync.Once
+	stopCh           chan struct{} // closed when the middleware stopped
+
+	// connection of background refresh requests, created on first use
+	refreshConnLock sync.Mutex
+	refreshConn     *rpc.ConnectionSession
 }
 
 func NewCacheMiddleware(cacheConfigItems ...*CacheConfigItem) *CacheMiddleware {
@@ -29,7 +130,8 @@ func NewCacheMiddleware(cacheConfigItems ...*CacheConfigItem) *CacheMiddleware {
 	result := &CacheMiddleware{
 		cacheConfigItems:    nil,
 		cacheConfigItemsMap: cacheConfigItemsMap,
-		rpcCache:            utils.NewMemoryCache(),
+		backend:             NewMemoryCacheBackend(utils.BoundedCacheOptions{}),
+		stopCh:              make(chan struct{}),
 	}
 	for _, item := range cacheConfigItems {
 		_ = result.AddCacheConfigItem(item)
@@ -45,14 +147,132 @@ func (middleware *CacheMiddleware) AddCacheConfigItem(item *CacheConfigItem) *Ca
 	return middleware
 }
 
+func (middleware *CacheMiddleware) SetBackend(backend CacheBackend) *CacheMiddleware {
+	middleware.backend = backend
+	return middleware
+}
+
+// SetCoalesce enable request coalescing. on a cache miss only the request holding the key lock goes upstream,
+// others wait at most {waitTimeout} for its response in the backend. 0 means the default timeouts
+func (middleware *CacheMiddleware) SetCoalesce(lockTimeout time.Duration, waitTimeout time.Duration) *CacheMiddleware {
+	if lockTimeout <= 0 {
+		lockTimeout = defaultCoalesceLockTimeout
+	}
+	if waitTimeout <= 0 {
+		waitTimeout = defaultCoalesceWaitTimeout
+	}
+	middleware.coalesce = true
+	middleware.coalesceLockTimeout = lockTimeout
+	middleware.coalesceWaitTimeout = waitTimeout
+	return middleware
+}
+
+// AddKeepWarm refresh the cache of the method+params before it expires.
+// the method must match a cache config item by its name or name with leading params
+func (middleware *CacheMiddleware) AddKeepWarm(method string, params []interface{}) (err error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	for count := len(params); count >= 0; count-- {
+		methodNameForCache, jsonErr := MakeMethodNameForCache(method, params[0:count])
+		if jsonErr != nil {
+			err = jsonErr
+			return
+		}
+		item, ok := middleware.cacheConfigItemsMap[methodNameForCache]
+		if !ok {
+			continue
+		}
+		cacheKey, keyErr := middleware.cacheKeyForRpcMethod(methodNameForCache, params)
+		if keyErr != nil {
+			err = keyErr
+			return
+		}
+		middleware.keepWarmItems = append(middleware.keepWarmItems, &keepWarmItem{
+			method:   method,
+			params:   params,
+			cacheKey: cacheKey,
+			item:     item,
+		})
+		return
+	}
+	err = fmt.Errorf("method %s to keep warm is not cached", method)
+	return
+}
+
+// SetSnapshot restore cache entries from {file} on start, and save them to it
+// every {interval}(0 means only on stop) and on stop
+func (middleware *CacheMiddleware) SetSnapshot(file string, interval time.Duration) *CacheMiddleware {
+	middleware.snapshotFile = file
+	middleware.snapshotInterval = interval
+	return middleware
+}
+
+func (middleware *CacheMiddleware) restoreSnapshot() {
+	count, err := readCacheSnapshot(middleware.backend, middleware.snapshotFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Warnf("ignore cache snapshot %s: %s", middleware.snapshotFile, err.Error())
+		return
+	}
+	log.Infof("%d cache entries restored from snapshot %s", count, middleware.snapshotFile)
+}
+
+func (middleware *CacheMiddleware) saveSnapshot() {
+	count, err := writeCacheSnapshot(middleware.backend, middleware.snapshotFile)
+	if err != nil {
+		log.Warnf("save cache snapshot %s error %s", middleware.snapshotFile, err.Error())
+		return
+	}
+	log.Debugf("%d cache entries saved to snapshot %s", count, middleware.snapshotFile)
+}
+
+func (middleware *CacheMiddleware) snapshotLoop() {
+	ticker := time.NewTicker(middleware.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-middleware.stopCh:
+			return
+		case <-ticker.C:
+			middleware.saveSnapshot()
+		}
+	}
+}
+
 func (middleware *CacheMiddleware) Name() string {
 	return "cache"
 }
 
 func (middleware *CacheMiddleware) OnStart() (err error) {
+	if len(middleware.snapshotFile) > 0 {
+		middleware.restoreSnapshot()
+		if middleware.snapshotInterval > 0 {
+			go middleware.snapshotLoop()
+		}
+	}
+	if len(middleware.keepWarmItems) > 0 {
+		go middleware.keepWarmLoop()
+	}
 	return middleware.NextOnStart()
 }
 
+// OnStop stop background loops and save the snapshot
+func (middleware *CacheMiddleware) OnStop() (err error) {
+	middleware.stopOnce.Do(func() {
+		close(middleware.stopCh)
+		if len(middleware.snapshotFile) > 0 {
+			middleware.saveSnapshot()
+		}
+		if middleware.purgeBroadcaster != nil {
+			_ = middleware.purgeBroadcaster.close()
+		}
+	})
+	return
+}
+
 func (middleware *CacheMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
 	return middleware.NextOnConnection(session)
 }
@@ -100,8 +320,12 @@ func (middleware *CacheMiddleware) getMethodNameForCache(session *rpc.JSONRpcReq
 func (middleware *CacheMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
 	next := true
 	defer func() {
-		if next {
-			err = middleware.NextOnJSONRpcRequest(session)
+		if !next {
+			return
+		}
+		err = middleware.NextOnJSONRpcRequest(session)
+		if cacheKey, ok := session.Parameters[sessionParamCacheKey].(string); ok && err != nil {
+			middleware.releaseCoalesceLock(session, cacheKey)
 		}
 	}()
 
@@ -109,81 +333,339 @@ func (middleware *CacheMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSessi
 	if _, ok := middleware.getCacheConfigItem(session); !ok {
 		return
 	}
-	cacheKey, err := middleware.cacheKeyForRpcMethod(methodNameForCache, session.Request.Params)
+	cacheKey, err := middleware.cacheKeyForRpcMethod(methodNameForCache, middleware.getParamsForCache(session))
 	if err != nil {
 		log.Fatalln("cache key for rpc method error", err)
 		return
 	}
-	cached, ok := middleware.rpcCache.Get(cacheKey)
+	session.Parameters[sessionParamCacheKey] = cacheKey
+	if middleware.fillResponseFromCache(session, cacheKey) {
+		next = false
+		if session.ResponseStale {
+			cacheRequestsCounter.WithLabelValues(session.Request.Method, cacheResultStale).Inc()
+			log.Debugf("rpc method-for-cache %s hit stale cache", methodNameForCache)
+			cacheConfigItem, _ := middleware.getCacheConfigItem(session)
+			middleware.refreshInBackground(cacheKey, cacheConfigItem, session.Request.Method, session.Request.Params)
+			return
+		}
+		cacheRequestsCounter.WithLabelValues(session.Request.Method, cacheResultHit).Inc()
+		log.Debugf("rpc method-for-cache %s hit cache", methodNameForCache)
+		return
+	}
+	session.CacheMissed = true
+	cacheRequestsCounter.WithLabelValues(session.Request.Method, cacheResultMiss).Inc()
+	if !middleware.coalesce {
+		return
+	}
+	locked, lockErr := middleware.backend.TryLock(cacheKey, middleware.coalesceLockTimeout)
+	if lockErr != nil {
+		log.Warnf("cache backend lock error %s", lockErr.Error())
+		return
+	}
+	if locked {
+		session.Parameters[sessionParamCacheLocked] = true
+		return
+	}
+	// another request(maybe in another replica) is requesting upstream,
+	// wait for its response in ProcessRpcRequest instead of blocking the connection here
+	session.Parameters[sessionParamCacheWaiting] = true
+	next = false
+	return
+}
+
+// getCachedResponse returns the cached value of key, it may be expired but still in the stale duration
+func (middleware *CacheMiddleware) getCachedResponse(cacheKey string) (result *cachedResponse, ok bool) {
+	cachedBytes, ok, err := middleware.backend.Get(cacheKey)
+	if err != nil {
+		log.Warnf("cache backend get error %s", err.Error())
+		return
+	}
 	if !ok {
 		return
 	}
-	cachedItem, ok := cached.(*rpcResponseCacheItem)
+	result = new(cachedResponse)
+	if err = json.Unmarshal(cachedBytes, result); err != nil || len(result.Response) < 1 {
+		log.Warnf("decode cached value of %s error", cacheKey)
+		ok = false
+		return
+	}
+	return
+}
+
+// fillResponseFromCache set the cached response with the request's id to session, returns false if not cached.
+// session.ResponseStale is set if the cached response is expired
+func (middleware *CacheMiddleware) fillResponseFromCache(session *rpc.JSONRpcRequestSession, cacheKey string) bool {
+	cached, ok := middleware.getCachedResponse(cacheKey)
+	if !ok {
+		return false
+	}
+	newRes, err := rpc.DecodeJSONRPCResponse(cached.Response)
+	if err != nil {
+		log.Warnf("decode cached response error %s", err.Error())
+		return false
+	}
+	// need replace cached response's rpc request id
+	newRes.Id = session.Request.Id
+	session.Response = newRes
+	session.ResponseSetByCache = true
+	session.ResponseStale = !cached.fresh(time.Now())
+	return true
+}
+
+// saveResponse cache the response if cacheable, it's fresh for the cache duration and then stale for the stale duration
+func (middleware *CacheMiddleware) saveResponse(cacheKey string, item *CacheConfigItem, params interface{},
+	response *rpc.JSONRpcResponse) (saved bool, err error) {
+	cacheDuration, staleDuration, ok := item.durationsOf(params, response)
 	if !ok {
 		return
 	}
-	// need replace cachedItem's rpc request id
-	newRes, err := rpc.CloneJSONRpcResponse(cachedItem.response)
+	rpcResBytes, err := rpc.EncodeJSONRPCResponse(response)
 	if err != nil {
 		return
 	}
-	newRes.Id = session.Request.Id
-	newResBytes, err := json.Marshal(newRes)
+	cached := &cachedResponse{
+		FreshUntil: time.Now().Add(cacheDuration).UnixNano() / int64(time.Millisecond),
+		Response:   rpcResBytes,
+	}
+	cachedBytes, err := json.Marshal(cached)
 	if err != nil {
 		return
 	}
-	session.Response = newRes
-	session.RequestBytes = newResBytes
-	session.ResponseSetByCache = true
-	next = false
-	log.Debugf("rpc method-for-cache %s hit cache", methodNameForCache)
+	if err = middleware.backend.Set(cacheKey, cachedBytes, cacheDuration+staleDuration); err != nil {
+		return
+	}
+	saved = true
 	return
 }
 
-// cache by methodName + allRpcParams
+// refreshConnection returns the connection used by background refresh requests
+func (middleware *CacheMiddleware) refreshConnection() (*rpc.ConnectionSession, error) {
+	middleware.refreshConnLock.Lock()
+	defer middleware.refreshConnLock.Unlock()
+	if middleware.refreshConn != nil {
+		return middleware.refreshConn, nil
+	}
+	connSession := plugin.NewInternalConnection()
+	if err := middleware.NextOnConnection(connSession); err != nil {
+		connSession.Close()
+		return nil, err
+	}
+	middleware.refreshConn = connSession
+	return connSession, nil
+}
+
+// resetRefreshConnection close the broken refresh connection, a new one will be created by next refresh
+func (middleware *CacheMiddleware) resetRefreshConnection(connSession *rpc.ConnectionSession) {
+	middleware.refreshConnLock.Lock()
+	defer middleware.refreshConnLock.Unlock()
+	if middleware.refreshConn != connSession {
+		return
+	}
+	middleware.refreshConn = nil
+	_ = middleware.NextOnConnectionClosed(connSession)
+	connSession.Close()
+}
+
+// refreshInBackground request the newest response of cacheKey from next middlewares and cache it.
+// only one refresh of a key is running across replicas sharing the backend
+func (middleware *CacheMiddleware) refreshInBackground(cacheKey string, item *CacheConfigItem, method string, params interface{}) {
+	refreshLockKey := cacheKey + refreshLockSuffix
+	locked, err := middleware.backend.TryLock(refreshLockKey, refreshTimeout)
+	if err != nil {
+		log.Warnf("cache backend lock error %s", err.Error())
+		return
+	}
+	if !locked {
+		return // being refreshed by others
+	}
+	go func() {
+		defer func() {
+			if unlockErr := middleware.backend.Unlock(refreshLockKey); unlockErr != nil {
+				log.Warnf("cache backend unlock error %s", unlockErr.Error())
+			}
+		}()
+		connSession, err := middleware.refreshConnection()
+		if err != nil {
+			log.Warnf("open cache refresh connection error %s", err.Error())
+			return
+		}
+		request := &rpc.JSONRpcRequest{
+			Id:      plugin.NewInternalRequestId(),
+			JSONRpc: "2.0",
+			Method:  method,
+			Params:  params,
+		}
+		response, err := plugin.CallNextMiddlewares(middleware, connSession, request)
+		if err != nil {
+			log.Warnf("refresh cache of %s error %s", cacheKey, err.Error())
+			middleware.resetRefreshConnection(connSession)
+			return
+		}
+		saved, err := middleware.saveResponse(cacheKey, item, params, response)
+		if err != nil {
+			log.Warnf("save refreshed cache of %s error %s", cacheKey, err.Error())
+			return
+		}
+		if saved {
+			log.Debugf("cache of %s refreshed", cacheKey)
+		}
+	}()
+}
+
+// keepWarmLoop refresh the keep warm items which are missing or going to expire
+func (middleware *CacheMiddleware) keepWarmLoop() {
+	ticker := time.NewTicker(keepWarmCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-middleware.stopCh:
+			return
+		case <-ticker.C:
+			middleware.checkKeepWarmItems(time.Now())
+		}
+	}
+}
+
+func (middleware *CacheMiddleware) checkKeepWarmItems(now time.Time) {
+	for _, warmItem := range middleware.keepWarmItems {
+		// refresh when less than 20% of the cache duration left
+		ahead := warmItem.item.CacheDuration / 5
+		if ahead < keepWarmMinAhead {
+			ahead = keepWarmMinAhead
+		}
+		cached, ok := middleware.getCachedResponse(warmItem.cacheKey)
+		if ok && cached.fresh(now.Add(ahead)) {
+			continue
+		}
+		middleware.refreshInBackground(warmItem.cacheKey, warmItem.item, warmItem.method, warmItem.params)
+	}
+}
+
+const cacheKeyPrefix = "cache_rpc_"
+
+func (middleware *CacheMiddleware) getParamsForCache(session *rpc.JSONRpcRequestSession) interface{} {
+	if session.ParamsForCache != nil {
+		return session.ParamsForCache
+	}
+	return session.Request.Params
+}
+
+// cache by methodName + allRpcParams. params are encoded canonically, so semantically identical requests share the cache
 func (middleware *CacheMiddleware) cacheKeyForRpcMethod(rpcMethodName string, rpcParams interface{}) (result string, err error) {
-	rpcParamsBytes, err := json.Marshal(rpcParams)
+	rpcParamsBytes, err := utils.CanonicalJson(rpcParams)
 	if err != nil {
 		return
 	}
-	result = fmt.Sprintf("cache_rpc_%s$%s", rpcMethodName, string(rpcParamsBytes))
+	result = fmt.Sprintf("%s%s$%s", cacheKeyPrefix, rpcMethodName, string(rpcParamsBytes))
 	return
 }
 
-type rpcResponseCacheItem struct {
-	response      *rpc.JSONRpcResponse
-	responseBytes []byte
+// methodOfCacheKey returns the rpc method name of cache key, used to group cache entries
+func methodOfCacheKey(cacheKey string) string {
+	method := strings.TrimPrefix(cacheKey, cacheKeyPrefix)
+	if pos := strings.Index(method, "$"); pos >= 0 {
+		method = method[:pos]
+	}
+	return method
+}
+
+// Stats returns entries and memory usage of the cache backend, false if the backend doesn't support it
+func (middleware *CacheMiddleware) Stats() (*utils.BoundedCacheStats, bool) {
+	statsBackend, ok := middleware.backend.(StatsCacheBackend)
+	if !ok {
+		return nil, false
+	}
+	return statsBackend.Stats(), true
 }
 
 func (middleware *CacheMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) (err error) {
+	defer func() {
+		if err == nil {
+			err = middleware.NextOnJSONRpcResponse(session)
+		}
+	}()
 	if session.ResponseSetByCache {
 		return // can't update cache time by cached response
 	}
-	methodNameForCache := middleware.getMethodNameForCache(session)
+	cacheKey, err := pluginsCommon.GetSessionStringParam(session, sessionParamCacheKey, nil)
+	if err != nil || len(cacheKey) < 1 {
+		return
+	}
+	// released after the response saved, so waiters find it in the backend
+	defer middleware.releaseCoalesceLock(session, cacheKey)
 	cacheConfigItem, ok := middleware.getCacheConfigItem(session)
-	if !ok {
+	if !ok || session.Response == nil {
 		return
 	}
-	rpcRes := session.Response
-	rpcResBytes := session.RequestBytes
-	cacheKey, err := middleware.cacheKeyForRpcMethod(methodNameForCache, session.Request.Params)
-	if err != nil {
+	saved, saveErr := middleware.saveResponse(cacheKey, cacheConfigItem, session.Request.Params, session.Response)
+	if saveErr != nil {
+		log.Warnf("cache response error %s", saveErr.Error())
 		return
 	}
-	middleware.rpcCache.Set(cacheKey, &rpcResponseCacheItem{
-		response:      rpcRes,
-		responseBytes: rpcResBytes,
-	}, cacheConfigItem.CacheDuration)
-	log.Debugf("rpc method-for-cache %s cached\n", methodNameForCache)
-
-	err = middleware.NextOnJSONRpcResponse(session)
+	if !saved {
+		return
+	}
+	log.Debugf("rpc method-for-cache %s cached\n", middleware.getMethodNameForCache(session))
 	return
 }
 
+// releaseCoalesceLock unlock the key if this request holds its coalescing lock
+func (middleware *CacheMiddleware) releaseCoalesceLock(session *rpc.JSONRpcRequestSession, cacheKey string) {
+	if locked, _ := session.Parameters[sessionParamCacheLocked].(bool); !locked {
+		return
+	}
+	delete(session.Parameters, sessionParamCacheLocked)
+	if err := middleware.backend.Unlock(cacheKey); err != nil {
+		log.Warnf("cache backend unlock error %s", err.Error())
+	}
+}
+
+// waitForCoalescedResponse poll the backend until the lock holder caches its response or timeout.
+// stop waiting once the lock is released without a cached response, eg. the lock holder failed or its response isn't cacheable
+func (middleware *CacheMiddleware) waitForCoalescedResponse(session *rpc.JSONRpcRequestSession) bool {
+	cacheKey, err := pluginsCommon.GetSessionStringParam(session, sessionParamCacheKey, nil)
+	if err != nil {
+		return false
+	}
+	deadline := time.Now().Add(middleware.coalesceWaitTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(coalescePollInterval)
+		if middleware.fillResponseFromCache(session, cacheKey) {
+			return true
+		}
+		locked, lockErr := middleware.backend.IsLocked(cacheKey)
+		if lockErr != nil {
+			log.Warnf("cache backend lock error %s", lockErr.Error())
+			return false
+		}
+		if !locked {
+			// the response may be cached just before the lock released
+			return middleware.fillResponseFromCache(session, cacheKey)
+		}
+	}
+	return false
+}
+
 func (middleware *CacheMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
 	if session.ResponseSetByCache {
 		return
 	}
+	if waiting, _ := session.Parameters[sessionParamCacheWaiting].(bool); waiting {
+		delete(session.Parameters, sessionParamCacheWaiting)
+		if middleware.waitForCoalescedResponse(session) {
+			return
+		}
+		// the lock holder didn't cache a response in time, request upstream by itself
+		if err = middleware.NextOnJSONRpcRequest(session); err != nil {
+			return
+		}
+	}
 	err = middleware.NextProcessJSONRpcRequest(session)
+	if err != nil || session.Response == nil {
+		// OnRpcResponse is not called, release the lock so waiters don't wait until it expires
+		if cacheKey, keyErr := pluginsCommon.GetSessionStringParam(session, sessionParamCacheKey, nil); keyErr == nil {
+			middleware.releaseCoalesceLock(session, cacheKey)
+		}
+	}
 	return
 }
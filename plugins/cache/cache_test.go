@@ -0,0 +1,339 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+func mockRpcRequestSession(id uint64, method string, params interface{}) *rpc.JSONRpcRequestSession {
+	reqSess := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+	reqSess.FillRpcRequest(&rpc.JSONRpcRequest{Id: id, JSONRpc: "2.0", Method: method, Params: params}, nil)
+	return reqSess
+}
+
+func TestCacheMiddlewareHit(t *testing.T) {
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_blockNumber", CacheDuration: time.Minute})
+	first := mockRpcRequestSession(1, "eth_blockNumber", []interface{}{})
+	assert.True(t, m.OnRpcRequest(first) == nil)
+	assert.False(t, first.ResponseSetByCache)
+	first.FillRpcResponse(rpc.NewJSONRpcResponse(1, "0x10", nil))
+	assert.True(t, m.OnRpcResponse(first) == nil)
+
+	second := mockRpcRequestSession(2, "eth_blockNumber", []interface{}{})
+	assert.True(t, m.OnRpcRequest(second) == nil)
+	assert.True(t, second.ResponseSetByCache)
+	assert.Equal(t, uint64(2), second.Response.Id)
+	assert.Equal(t, "0x10", second.Response.Result)
+
+	stats, ok := m.Stats()
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), stats.Entries)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Groups["eth_blockNumber"].Entries)
+}
+
+func TestCacheMiddlewareCoalesce(t *testing.T) {
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_getBalance", CacheDuration: time.Minute}).
+		SetCoalesce(time.Second, time.Second)
+	params := []interface{}{"0x01", "latest"}
+	leader := mockRpcRequestSession(1, "eth_getBalance", params)
+	follower := mockRpcRequestSession(2, "eth_getBalance", params)
+	assert.True(t, m.OnRpcRequest(leader) == nil)
+	assert.True(t, m.OnRpcRequest(follower) == nil)
+	assert.Equal(t, true, leader.Parameters[sessionParamCacheLocked])
+	assert.Equal(t, true, follower.Parameters[sessionParamCacheWaiting])
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.ProcessRpcRequest(follower)
+	}()
+	leader.FillRpcResponse(rpc.NewJSONRpcResponse(1, "0x64", nil))
+	assert.True(t, m.OnRpcResponse(leader) == nil)
+	assert.True(t, <-done == nil)
+	assert.True(t, follower.ResponseSetByCache)
+	assert.Equal(t, uint64(2), follower.Response.Id)
+	assert.Equal(t, "0x64", follower.Response.Result)
+
+	// lock released after the leader's response cached
+	locked, err := m.backend.TryLock(leader.Parameters[sessionParamCacheKey].(string), time.Second)
+	assert.True(t, err == nil && locked)
+}
+
+func TestCacheMiddlewareCoalesceLeaderError(t *testing.T) {
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_getBalance", CacheDuration: time.Minute}).
+		SetCoalesce(5*time.Second, 3*time.Second)
+	upstream := &mockUpstreamMiddleware{result: "0x64"}
+	m.SetNextMiddleware(upstream)
+	params := []interface{}{"0x01", "latest"}
+	leader := mockRpcRequestSession(1, "eth_getBalance", params)
+	follower := mockRpcRequestSession(2, "eth_getBalance", params)
+	assert.True(t, m.OnRpcRequest(leader) == nil)
+	assert.True(t, m.OnRpcRequest(follower) == nil)
+	assert.Equal(t, true, follower.Parameters[sessionParamCacheWaiting])
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		done <- m.ProcessRpcRequest(follower)
+	}()
+	// error responses are not cached, the follower stops waiting once the lock is released
+	leader.FillRpcResponse(rpc.NewJSONRpcResponse(1, nil, rpc.NewJSONRpcResponseError(rpc.RPC_INTERNAL_ERROR, "upstream error", nil)))
+	assert.True(t, m.OnRpcResponse(leader) == nil)
+	assert.True(t, <-done == nil)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.False(t, follower.ResponseSetByCache)
+	assert.Equal(t, "0x64", follower.Response.Result)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.requests))
+}
+
+// mockUpstreamMiddleware responds rpc requests with {result} and counts them
+type mockUpstreamMiddleware struct {
+	plugin.MiddlewareAdapter
+	result   interface{}
+	requests int32
+}
+
+func (m *mockUpstreamMiddleware) Name() string {
+	return "mock_upstream"
+}
+
+func (m *mockUpstreamMiddleware) OnStart() error {
+	return nil
+}
+
+func (m *mockUpstreamMiddleware) OnConnection(session *rpc.ConnectionSession) error {
+	return nil
+}
+
+func (m *mockUpstreamMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) error {
+	return nil
+}
+
+func (m *mockUpstreamMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession, messageType int, message []byte) error {
+	return nil
+}
+
+func (m *mockUpstreamMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+func (m *mockUpstreamMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+func (m *mockUpstreamMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) error {
+	atomic.AddInt32(&m.requests, 1)
+	session.FillRpcResponse(rpc.NewJSONRpcResponse(session.Request.Id, m.result, nil))
+	return nil
+}
+
+func waitForCachedResult(m *CacheMiddleware, method string, result interface{}) bool {
+	for i := 0; i < 100; i++ {
+		session := mockRpcRequestSession(100, method, []interface{}{})
+		_ = m.OnRpcRequest(session)
+		if session.ResponseSetByCache && !session.ResponseStale && session.Response.Result == result {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestCacheMiddlewareStaleWhileRevalidate(t *testing.T) {
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_blockNumber",
+		CacheDuration: 50 * time.Millisecond, StaleDuration: time.Minute})
+	upstream := &mockUpstreamMiddleware{result: "0x11"}
+	m.SetNextMiddleware(upstream)
+
+	first := mockRpcRequestSession(1, "eth_blockNumber", []interface{}{})
+	assert.True(t, m.OnRpcRequest(first) == nil)
+	first.FillRpcResponse(rpc.NewJSONRpcResponse(1, "0x10", nil))
+	assert.True(t, m.OnRpcResponse(first) == nil)
+	time.Sleep(80 * time.Millisecond)
+
+	stale := mockRpcRequestSession(2, "eth_blockNumber", []interface{}{})
+	assert.True(t, m.OnRpcRequest(stale) == nil)
+	assert.True(t, stale.ResponseSetByCache)
+	assert.True(t, stale.ResponseStale)
+	assert.Equal(t, uint64(2), stale.Response.Id)
+	assert.Equal(t, "0x10", stale.Response.Result)
+
+	assert.True(t, waitForCachedResult(m, "eth_blockNumber", "0x11"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.requests))
+}
+
+func TestCacheMiddlewareKeepWarm(t *testing.T) {
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_gasPrice", CacheDuration: time.Minute})
+	upstream := &mockUpstreamMiddleware{result: "0x3b9aca00"}
+	m.SetNextMiddleware(upstream)
+	assert.True(t, m.AddKeepWarm("eth_gasPrice", nil) == nil)
+	assert.True(t, m.AddKeepWarm("eth_chainId", nil) != nil)
+
+	m.checkKeepWarmItems(time.Now())
+	assert.True(t, waitForCachedResult(m, "eth_gasPrice", "0x3b9aca00"))
+	// fresh enough, not refreshed again
+	m.checkKeepWarmItems(time.Now())
+	// going to expire, refreshed ahead
+	m.checkKeepWarmItems(time.Now().Add(55 * time.Second))
+	for i := 0; i < 100 && atomic.LoadInt32(&upstream.requests) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&upstream.requests))
+}
+
+func TestCacheConfigItemDurations(t *testing.T) {
+	latestMatchers, err := pluginsCommon.NewValueMatchers([]config.ValueMatcherConfig{{Path: "1", Equals: "latest"}})
+	assert.True(t, err == nil)
+	pendingMatchers, err := pluginsCommon.NewValueMatchers([]config.ValueMatcherConfig{{Path: "1", Equals: "pending"}})
+	assert.True(t, err == nil)
+	noCacheResults, err := pluginsCommon.NewValueMatchers([]config.ValueMatcherConfig{{Empty: true}})
+	assert.True(t, err == nil)
+	item := &CacheConfigItem{
+		MethodName:    "eth_getBalance",
+		CacheDuration: time.Hour,
+		TtlRules: []*CacheTtlRule{
+			{Params: latestMatchers, CacheDuration: 2 * time.Second},
+			{Params: pendingMatchers, CacheDuration: 0},
+		},
+		NoCacheResults: noCacheResults,
+	}
+	ok := rpc.NewJSONRpcResponse(1, "0x64", nil)
+
+	cacheDuration, _, cacheable := item.durationsOf([]interface{}{"0x01", "latest"}, ok)
+	assert.True(t, cacheable)
+	assert.Equal(t, 2*time.Second, cacheDuration)
+	cacheDuration, _, cacheable = item.durationsOf([]interface{}{"0x01", "0x10"}, ok)
+	assert.True(t, cacheable)
+	assert.Equal(t, time.Hour, cacheDuration)
+	_, _, cacheable = item.durationsOf([]interface{}{"0x01", "pending"}, ok)
+	assert.False(t, cacheable)
+
+	// empty results and errors are not cached by default
+	_, _, cacheable = item.durationsOf([]interface{}{"0x01", "0x10"}, rpc.NewJSONRpcResponse(1, nil, nil))
+	assert.False(t, cacheable)
+	_, _, cacheable = item.durationsOf([]interface{}{"0x01", "0x10"}, rpc.NewJSONRpcResponse(1, "0x", nil))
+	assert.False(t, cacheable)
+	rpcErr := rpc.NewJSONRpcResponseError(rpc.RPC_INTERNAL_ERROR, "header not found", nil)
+	errRes := rpc.NewJSONRpcResponse(1, nil, rpcErr)
+	_, _, cacheable = item.durationsOf([]interface{}{"0x01", "0x10"}, errRes)
+	assert.False(t, cacheable)
+
+	item.CacheErrors = true
+	cacheDuration, staleDuration, cacheable := item.durationsOf([]interface{}{"0x01", "0x10"}, errRes)
+	assert.True(t, cacheable)
+	assert.Equal(t, defaultErrorCacheDuration, cacheDuration)
+	assert.Equal(t, time.Duration(0), staleDuration)
+}
+
+func TestCacheMiddlewareSkipErrorResponse(t *testing.T) {
+	m := NewCacheMiddleware(&CacheConfigItem{MethodName: "eth_blockNumber", CacheDuration: time.Minute})
+	first := mockRpcRequestSession(1, "eth_blockNumber", []interface{}{})
+	assert.True(t, m.OnRpcRequest(first) == nil)
+	first.FillRpcResponse(rpc.NewJSONRpcResponse(1, nil, rpc.NewJSONRpcResponseError(rpc.RPC_INTERNAL_ERROR, "timeout", nil)))
+	assert.True(t, m.OnRpcResponse(first) == nil)
+
+	second := mockRpcRequestSession(2, "eth_blockNumber", []interface{}{})
+	assert.True(t, m.OnRpcRequest(second) == nil)
+	assert.False(t, second.ResponseSetByCache)
+}
+
+func TestCacheMiddlewareListAndPurge(t *testing.T) {
+	m := NewCacheMiddleware(
+		&CacheConfigItem{MethodName: "eth_blockNumber", CacheDuration: time.Minute},
+		&CacheConfigItem{MethodName: "eth_getBalance", CacheDuration: time.Minute})
+	cacheResponse := func(id uint64, method string, params []interface{}, result interface{}) {
+		session := mockRpcRequestSession(id, method, params)
+		assert.True(t, m.OnRpcRequest(session) == nil)
+		assert.True(t, session.CacheMissed)
+		session.FillRpcResponse(rpc.NewJSONRpcResponse(id, result, nil))
+		assert.True(t, m.OnRpcResponse(session) == nil)
+	}
+	cacheResponse(1, "eth_blockNumber", []interface{}{}, "0x10")
+	cacheResponse(2, "eth_getBalance", []interface{}{"0x01", "latest"}, "0x1")
+	cacheResponse(3, "eth_getBalance", []interface{}{"0x02", "latest"}, "0x2")
+
+	entries, err := m.ListEntries(KeyPatternOfMethod("eth_getBalance"), 0)
+	assert.True(t, err == nil)
+	assert.Equal(t, 2, len(entries))
+	for _, entry := range entries {
+		assert.Equal(t, "eth_getBalance", entry.Method)
+		assert.True(t, entry.TtlMillis > 50000 && entry.FreshMillis > 50000)
+	}
+	all, err := m.ListEntries("", 0)
+	assert.True(t, err == nil)
+	assert.Equal(t, 3, len(all))
+
+	count, err := m.PurgeKey(entries[0].Key)
+	assert.True(t, err == nil)
+	assert.Equal(t, int64(1), count)
+	count, err = m.PurgePattern(KeyPatternOfMethod("eth_getBalance"))
+	assert.True(t, err == nil)
+	assert.Equal(t, int64(1), count)
+	assert.True(t, m.Flush() == nil)
+	all, err = m.ListEntries("", 0)
+	assert.True(t, err == nil)
+	assert.Equal(t, 0, len(all))
+}
+
+func TestCacheMiddlewareSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache_snapshot")
+	assert.True(t, err == nil)
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "cache.snapshot")
+
+	m := NewCacheMiddleware(
+		&CacheConfigItem{MethodName: "eth_blockNumber", CacheDuration: time.Minute},
+		&CacheConfigItem{MethodName: "eth_gasPrice", CacheDuration: 50 * time.Millisecond}).
+		SetSnapshot(snapshotFile, 0)
+	assert.True(t, m.OnStart() == nil)
+	for i, method := range []string{"eth_blockNumber", "eth_gasPrice"} {
+		session := mockRpcRequestSession(uint64(i), method, []interface{}{})
+		assert.True(t, m.OnRpcRequest(session) == nil)
+		session.FillRpcResponse(rpc.NewJSONRpcResponse(uint64(i), "0x10", nil))
+		assert.True(t, m.OnRpcResponse(session) == nil)
+	}
+	assert.True(t, m.OnStop() == nil)
+	time.Sleep(80 * time.Millisecond)
+
+	restored := NewCacheMiddleware(
+		&CacheConfigItem{MethodName: "eth_blockNumber", CacheDuration: time.Minute},
+		&CacheConfigItem{MethodName: "eth_gasPrice", CacheDuration: 50 * time.Millisecond}).
+		SetSnapshot(snapshotFile, 0)
+	assert.True(t, restored.OnStart() == nil)
+	entries, err := restored.ListEntries("", 0)
+	assert.True(t, err == nil)
+	assert.Equal(t, 1, len(entries)) // expired entry skipped
+	assert.Equal(t, "eth_blockNumber", entries[0].Method)
+	assert.True(t, entries[0].TtlMillis > 50000)
+	session := mockRpcRequestSession(3, "eth_blockNumber", []interface{}{})
+	assert.True(t, restored.OnRpcRequest(session) == nil)
+	assert.True(t, session.ResponseSetByCache)
+
+	// snapshot of another version is ignored
+	assert.True(t, ioutil.WriteFile(snapshotFile, []byte("old snapshot"), 0644) == nil)
+	_, err = readCacheSnapshot(NewMemoryCacheBackend(utils.BoundedCacheOptions{}), snapshotFile)
+	assert.True(t, err != nil)
+	var oldVersion bytes.Buffer
+	assert.True(t, gob.NewEncoder(&oldVersion).Encode(&cacheSnapshotHeader{Magic: cacheSnapshotMagic, Version: 0}) == nil)
+	assert.True(t, ioutil.WriteFile(snapshotFile, oldVersion.Bytes(), 0644) == nil)
+	_, err = readCacheSnapshot(NewMemoryCacheBackend(utils.BoundedCacheOptions{}), snapshotFile)
+	assert.Equal(t, errSnapshotVersion, err)
+	ignored := NewCacheMiddleware().SetSnapshot(snapshotFile, 0)
+	assert.True(t, ignored.OnStart() == nil)
+	entries, err = ignored.ListEntries("", 0)
+	assert.True(t, err == nil)
+	assert.Equal(t, 0, len(entries))
+}
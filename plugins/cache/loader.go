@@ -3,34 +3,110 @@ package cache
 import (
 	"github.com/zoowii/jsonrpc_proxygo/config"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
 	"time"
 )
 
-func LoadCachePluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
+func newCacheBackendFromConfig(cachePluginConf *config.CachesConfig) CacheBackend {
+	backendConf := cachePluginConf.Backend
+	switch backendConf.Type {
+	case "", CACHE_BACKEND_MEMORY:
+		return NewMemoryCacheBackend(utils.BoundedCacheOptions{
+			MaxItems:      backendConf.MaxItems,
+			MaxBytes:      backendConf.MaxBytes,
+			Eviction:      backendConf.Eviction,
+			GroupMaxBytes: backendConf.MethodMaxBytes,
+		})
+	case CACHE_BACKEND_REDIS:
+		backend, err := NewRedisCacheBackend(backendConf.Url, backendConf.KeyPrefix)
+		if err != nil {
+			log.Errorf("init redis cache backend error %s, using memory backend", err.Error())
+			return NewMemoryCacheBackend(utils.BoundedCacheOptions{})
+		}
+		return backend
+	default:
+		log.Fatalln("not supported cache backend type", backendConf.Type)
+		return nil
+	}
+}
+
+func newCacheConfigItem(methodNameForCache string, itemConf *config.CacheItemConfig) (item *CacheConfigItem, err error) {
+	item = &CacheConfigItem{
+		MethodName:         methodNameForCache,
+		CacheDuration:      time.Duration(itemConf.ExpireSeconds) * time.Second,
+		StaleDuration:      time.Duration(itemConf.StaleSeconds) * time.Second,
+		CacheErrors:        itemConf.CacheErrors,
+		ErrorCacheDuration: time.Duration(itemConf.ErrorExpireSeconds) * time.Second,
+	}
+	for _, ruleConf := range itemConf.TtlRules {
+		rule := &CacheTtlRule{
+			CacheDuration: time.Duration(ruleConf.ExpireSeconds) * time.Second,
+			StaleDuration: time.Duration(ruleConf.StaleSeconds) * time.Second,
+		}
+		if rule.Params, err = pluginsCommon.NewValueMatchers(ruleConf.Params); err != nil {
+			return
+		}
+		item.TtlRules = append(item.TtlRules, rule)
+	}
+	item.NoCacheResults, err = pluginsCommon.NewValueMatchers(itemConf.NoCacheResults)
+	return
+}
+
+func LoadCachePluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) *CacheMiddleware {
 	cachePluginConf := configInfo.Plugins.Caches
-	if len(cachePluginConf) > 0 {
+	if len(cachePluginConf.Items) > 0 {
 		cacheMiddleware := NewCacheMiddleware()
 		usingCacheItemsCount := 0
-		for _, itemConf := range cachePluginConf {
+		for _, itemConf := range cachePluginConf.Items {
 			if itemConf.ExpireSeconds <= 0 {
 				continue
 			}
 			methodNameForCache, jsonErr := MakeMethodNameForCache(itemConf.Name, itemConf.ParamsForCache)
 			if jsonErr != nil {
 				log.Fatalln("parse cache params error", jsonErr)
-				return
+				return nil
 			}
-			item := &CacheConfigItem{
-				MethodName:    methodNameForCache,
-				CacheDuration: time.Duration(itemConf.ExpireSeconds) * time.Second,
+			item, itemErr := newCacheConfigItem(methodNameForCache, itemConf)
+			if itemErr != nil {
+				log.Fatalln("cache config of", itemConf.Name, "error", itemErr)
+				return nil
 			}
 			cacheMiddleware.AddCacheConfigItem(item)
 			usingCacheItemsCount++
 		}
 		if usingCacheItemsCount > 0 {
+			cacheMiddleware.SetBackend(newCacheBackendFromConfig(&cachePluginConf))
+			if cachePluginConf.Coalesce.Start {
+				cacheMiddleware.SetCoalesce(time.Duration(cachePluginConf.Coalesce.LockMillis)*time.Millisecond,
+					time.Duration(cachePluginConf.Coalesce.WaitMillis)*time.Millisecond)
+			}
+			if broadcastConf := cachePluginConf.PurgeBroadcast; broadcastConf.Start {
+				redisUrl := utils.StringOrElse(broadcastConf.Url, cachePluginConf.Backend.Url)
+				channel := utils.StringOrElse(broadcastConf.Channel, utils.StringOrElse(cachePluginConf.Backend.KeyPrefix, DEFAULT_REDIS_KEY_PREFIX)+defaultPurgeChannelSuffix)
+				if err := cacheMiddleware.SetPurgeBroadcast(redisUrl, channel); err != nil {
+					log.Errorf("init cache purge broadcast error %s", err.Error())
+				}
+			}
+			if snapshotConf := cachePluginConf.Snapshot; len(snapshotConf.File) > 0 {
+				if _, ok := cacheMiddleware.backend.(*memoryCacheBackend); ok {
+					cacheMiddleware.SetSnapshot(snapshotConf.File, time.Duration(snapshotConf.IntervalSeconds)*time.Second)
+				} else {
+					log.Warnf("cache snapshot only works with memory backend")
+				}
+			}
+			for _, warmConf := range cachePluginConf.KeepWarm {
+				if err := cacheMiddleware.AddKeepWarm(warmConf.Method, warmConf.Params); err != nil {
+					log.Fatalln("cache keep warm config error", err)
+					return nil
+				}
+			}
+			cacheMiddleware.RegisterBackendMetrics()
 			chain.InsertHead(cacheMiddleware)
+			return cacheMiddleware
 		}
 	}
+	return nil
 }
 
 func LoadBeforeCachePluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
@@ -39,12 +115,16 @@ func LoadBeforeCachePluginConfig(chain *plugin.MiddlewareChain, configInfo *conf
 		beforeCacheMiddleware := NewBeforeCacheMiddleware()
 		usingBeforeCacheItemCount := 0
 		for _, itemConf := range beforeCachePluginConf {
-			if itemConf.FetchCacheKeyFromParamsCount <= 0 {
+			if itemConf.FetchCacheKeyFromParamsCount <= 0 && len(itemConf.MethodKeyPaths) < 1 &&
+				len(itemConf.KeyPaths) < 1 && len(itemConf.IgnorePaths) < 1 {
 				continue
 			}
 			item := &BeforeCacheConfigItem{
 				MethodName:                   itemConf.MethodName,
 				FetchCacheKeyFromParamsCount: itemConf.FetchCacheKeyFromParamsCount,
+				MethodKeyPaths:               itemConf.MethodKeyPaths,
+				KeyPaths:                     itemConf.KeyPaths,
+				IgnorePaths:                  itemConf.IgnorePaths,
 			}
 			beforeCacheMiddleware.AddConfigItem(item)
 			usingBeforeCacheItemCount++
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+const (
+	cacheResultHit   = "hit"
+	cacheResultStale = "stale"
+	cacheResultMiss  = "miss"
+)
+
+var cacheRequestsCounter = metrics.NewCounterVec("jsonrpc_proxy_cache_requests_total",
+	"requests of cached methods by method and result(hit, stale or miss)", "method", "result")
+
+func init() {
+	metrics.MustRegister(cacheRequestsCounter, &cacheHitRatioCollector{
+		desc: &metrics.Desc{
+			Name: "jsonrpc_proxy_cache_hit_ratio",
+			Help: "ratio of requests of cached methods responded from cache(fresh or stale) by method",
+			Type: metrics.GAUGE,
+		},
+	})
+}
+
+// cacheHitRatioCollector computes hit ratios from the samples of cacheRequestsCounter
+type cacheHitRatioCollector struct {
+	desc *metrics.Desc
+}
+
+func (c *cacheHitRatioCollector) Describe() *metrics.Desc {
+	return c.desc
+}
+
+func (c *cacheHitRatioCollector) Collect() []*metrics.Sample {
+	var methods []string
+	hits := make(map[string]float64)
+	totals := make(map[string]float64)
+	for _, sample := range cacheRequestsCounter.Collect() {
+		method := sample.Labels["method"]
+		if _, ok := totals[method]; !ok {
+			methods = append(methods, method)
+		}
+		totals[method] += sample.Value
+		if sample.Labels["result"] != cacheResultMiss {
+			hits[method] += sample.Value
+		}
+	}
+	result := make([]*metrics.Sample, 0, len(methods))
+	for _, method := range methods {
+		if totals[method] <= 0 {
+			continue
+		}
+		result = append(result, &metrics.Sample{
+			Labels: map[string]string{"method": method},
+			Value:  hits[method] / totals[method],
+		})
+	}
+	return result
+}
+
+// RegisterBackendMetrics register gauges of entries and memory usage of the cache backend if it supports stats
+func (middleware *CacheMiddleware) RegisterBackendMetrics() {
+	if _, ok := middleware.Stats(); !ok {
+		return
+	}
+	statsGauge := func(name string, help string, value func(stats *utils.BoundedCacheStats) int64) metrics.Collector {
+		return metrics.NewGaugeFunc(name, help, func() float64 {
+			stats, _ := middleware.Stats()
+			return float64(value(stats))
+		})
+	}
+	collectors := []metrics.Collector{
+		statsGauge("jsonrpc_proxy_cache_entries", "entries in the memory cache backend",
+			func(stats *utils.BoundedCacheStats) int64 { return stats.Entries }),
+		statsGauge("jsonrpc_proxy_cache_bytes", "memory bytes used by the memory cache backend",
+			func(stats *utils.BoundedCacheStats) int64 { return stats.Bytes }),
+		statsGauge("jsonrpc_proxy_cache_evictions", "entries evicted from the memory cache backend since started",
+			func(stats *utils.BoundedCacheStats) int64 { return stats.Evictions }),
+	}
+	for _, c := range collectors {
+		if err := metrics.Register(c); err != nil {
+			log.Warn("register metric error", err)
+		}
+	}
+}
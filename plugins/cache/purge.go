@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const defaultPurgeChannelSuffix = "purge"
+
+// CachePurgeEvent is a purge of cache entries broadcast to other replicas
+type CachePurgeEvent struct {
+	Origin  string `json:"origin"` // id of the replica purged the cache
+	Key     string `json:"key,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Flush   bool   `json:"flush,omitempty"`
+}
+
+/**
+ * purgeBroadcaster publishes purges to other replicas by redis pub/sub,
+ * so replicas with memory backends drop the purged entries too
+ */
+type purgeBroadcaster struct {
+	client  *redis.Client
+	channel string
+	origin  string
+	pubsub  *redis.PubSub
+}
+
+// newPurgeBroadcaster create broadcaster by redis url like redis://:password@127.0.0.1:6379/2
+func newPurgeBroadcaster(redisUrl string, channel string) (result *purgeBroadcaster, err error) {
+	redisOptions, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return
+	}
+	client := redis.NewClient(redisOptions)
+	if err = client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return
+	}
+	origin := make([]byte, 8)
+	if _, err = rand.Read(origin); err != nil {
+		_ = client.Close()
+		return
+	}
+	result = &purgeBroadcaster{
+		client:  client,
+		channel: channel,
+		origin:  hex.EncodeToString(origin),
+	}
+	return
+}
+
+func (b *purgeBroadcaster) publish(event *CachePurgeEvent) error {
+	event.Origin = b.origin
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(b.channel, string(eventBytes)).Err()
+}
+
+// subscribe call {handler} with purges of other replicas until the broadcaster closed
+func (b *purgeBroadcaster) subscribe(handler func(event *CachePurgeEvent)) {
+	b.pubsub = b.client.Subscribe(b.channel)
+	go func() {
+		for msg := range b.pubsub.Channel() {
+			event := &CachePurgeEvent{}
+			if err := json.Unmarshal([]byte(msg.Payload), event); err != nil {
+				log.Warnf("invalid cache purge event %s", msg.Payload)
+				continue
+			}
+			if event.Origin == b.origin {
+				continue
+			}
+			handler(event)
+		}
+	}()
+}
+
+func (b *purgeBroadcaster) close() error {
+	if b.pubsub != nil {
+		_ = b.pubsub.Close()
+	}
+	return b.client.Close()
+}
@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+const (
+	lockKeySuffix = ":lock"
+	scanBatchSize = 1000
+)
+
+// DEFAULT_REDIS_KEY_PREFIX is used when no key prefix configured, so flushes and purges never touch other keys of the db
+const DEFAULT_REDIS_KEY_PREFIX = "jsonrpc_proxygo:cache:"
+
+// delete the lock only if it's still held by this replica
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+/**
+ * redisCacheBackend is a CacheBackend shared by all proxy replicas using the same redis
+ */
+type redisCacheBackend struct {
+	client    *redis.Client
+	keyPrefix string
+	lockToken string // value of locks held by this replica
+}
+
+// NewRedisCacheBackend create redis backend by url like redis://:password@127.0.0.1:6379/2.
+// DEFAULT_REDIS_KEY_PREFIX is used if {keyPrefix} is empty
+func NewRedisCacheBackend(redisUrl string, keyPrefix string) (backend CacheBackend, err error) {
+	keyPrefix = utils.StringOrElse(keyPrefix, DEFAULT_REDIS_KEY_PREFIX)
+	redisOptions, err := redis.ParseURL(redisUrl)
+	if err != nil {
+		return
+	}
+	client := redis.NewClient(redisOptions)
+	if err = client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return
+	}
+	token := make([]byte, 8)
+	if _, err = rand.Read(token); err != nil {
+		_ = client.Close()
+		return
+	}
+	backend = &redisCacheBackend{
+		client:    client,
+		keyPrefix: keyPrefix,
+		lockToken: hex.EncodeToString(token),
+	}
+	return
+}
+
+func (b *redisCacheBackend) Get(key string) (value []byte, ok bool, err error) {
+	value, err = b.client.Get(b.keyPrefix + key).Bytes()
+	if err == redis.Nil {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+func (b *redisCacheBackend) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+	return b.client.Set(b.keyPrefix+key, value, ttl).Err()
+}
+
+func (b *redisCacheBackend) Delete(key string) error {
+	return b.client.Del(b.keyPrefix + key).Err()
+}
+
+func (b *redisCacheBackend) TryLock(key string, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(b.keyPrefix+key+lockKeySuffix, b.lockToken, ttl).Result()
+}
+
+func (b *redisCacheBackend) Unlock(key string) error {
+	return unlockScript.Run(b.client, []string{b.keyPrefix + key + lockKeySuffix}, b.lockToken).Err()
+}
+
+func (b *redisCacheBackend) IsLocked(key string) (bool, error) {
+	count, err := b.client.Exists(b.keyPrefix + key + lockKeySuffix).Result()
+	return count > 0, err
+}
+
+// escapeRedisGlob escapes all special chars of redis key patterns in {s}
+func escapeRedisGlob(s string) string {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			builder.WriteByte('\\')
+		}
+		builder.WriteByte(s[i])
+	}
+	return builder.String()
+}
+
+// redisMatchPattern converts a pattern of utils.GlobMatch to a redis key pattern matching the same keys:
+// '[' and ']' are character classes in redis but plain chars in GlobMatch(and cache keys of json params)
+func redisMatchPattern(pattern string) string {
+	var builder strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			builder.WriteByte(c)
+			i++
+			c = pattern[i]
+		case c == '[' || c == ']' || c == '\\':
+			builder.WriteByte('\\')
+		}
+		builder.WriteByte(c)
+	}
+	return builder.String()
+}
+
+// scanKeys iterate keys of the backend matching {pattern} by batches, lock keys are skipped.
+// only keys with the key prefix of the backend are scanned. stop iterating if {handler} returns false
+func (b *redisCacheBackend) scanKeys(pattern string, handler func(keys []string) (bool, error)) error {
+	match := escapeRedisGlob(b.keyPrefix) + redisMatchPattern(pattern)
+	var cursor uint64
+	for {
+		fullKeys, nextCursor, err := b.client.Scan(cursor, match, scanBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(fullKeys))
+		for _, fullKey := range fullKeys {
+			if strings.HasSuffix(fullKey, lockKeySuffix) || !strings.HasPrefix(fullKey, b.keyPrefix) {
+				continue
+			}
+			keys = append(keys, strings.TrimPrefix(fullKey, b.keyPrefix))
+		}
+		if len(keys) > 0 {
+			goOn, handleErr := handler(keys)
+			if handleErr != nil || !goOn {
+				return handleErr
+			}
+		}
+		if nextCursor == 0 {
+			return nil
+		}
+		cursor = nextCursor
+	}
+}
+
+func (b *redisCacheBackend) Entries(pattern string, limit int) (result []*CacheBackendEntry, err error) {
+	err = b.scanKeys(pattern, func(keys []string) (bool, error) {
+		pipe := b.client.Pipeline()
+		getCmds := make([]*redis.StringCmd, len(keys))
+		ttlCmds := make([]*redis.DurationCmd, len(keys))
+		for i, key := range keys {
+			getCmds[i] = pipe.Get(b.keyPrefix + key)
+			ttlCmds[i] = pipe.PTTL(b.keyPrefix + key)
+		}
+		if _, execErr := pipe.Exec(); execErr != nil && execErr != redis.Nil {
+			return false, execErr
+		}
+		for i, key := range keys {
+			value, getErr := getCmds[i].Bytes()
+			if getErr != nil {
+				continue // deleted or expired after scanned
+			}
+			result = append(result, &CacheBackendEntry{
+				Key:   key,
+				Value: value,
+				Size:  int64(len(key) + len(value)),
+				Ttl:   ttlCmds[i].Val(),
+			})
+			if limit > 0 && len(result) >= limit {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return
+}
+
+func (b *redisCacheBackend) DeletePattern(pattern string) (count int64, err error) {
+	err = b.scanKeys(pattern, func(keys []string) (bool, error) {
+		fullKeys := make([]string, len(keys))
+		for i, key := range keys {
+			fullKeys[i] = b.keyPrefix + key
+		}
+		deleted, delErr := b.client.Del(fullKeys...).Result()
+		count += deleted
+		return true, delErr
+	})
+	return
+}
+
+// Flush delete all cache entries with the key prefix of this backend
+func (b *redisCacheBackend) Flush() error {
+	_, err := b.DeletePattern("*")
+	return err
+}
+
+func (b *redisCacheBackend) Close() error {
+	return b.client.Close()
+}
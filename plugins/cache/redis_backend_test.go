@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// redisGlobMatch matches like redis MATCH patterns, with '[...]' character classes
+func redisGlobMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if redisGlobMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) < 1 {
+				return false
+			}
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || len(s) < 1 || !strings.ContainsRune(pattern[1:end+1], rune(s[0])) {
+				return false
+			}
+			pattern = pattern[end+1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) < 1 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) < 1
+}
+
+// fakeRedisServer serves the commands used by redisCacheBackend from a map
+type fakeRedisServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	values   map[string]string
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &fakeRedisServer{listener: listener, values: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeRedisServer) url() string {
+	return "redis://" + server.listener.Addr().String() + "/0"
+}
+
+func readRespCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, count)
+	for i := range args {
+		if _, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(line, "\r\n")
+	}
+	return args, nil
+}
+
+func (server *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			return
+		}
+		server.lock.Lock()
+		reply := server.execute(args)
+		server.lock.Unlock()
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (server *fakeRedisServer) execute(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		server.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		if value, ok := server.values[args[1]]; ok {
+			return respBulk(value)
+		}
+		return "$-1\r\n"
+	case "DEL":
+		var count int
+		for _, key := range args[1:] {
+			if _, ok := server.values[key]; ok {
+				delete(server.values, key)
+				count++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", count)
+	case "SCAN":
+		var keys []string
+		for key := range server.values {
+			if redisGlobMatch(args[3], key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		reply := "*2\r\n" + respBulk("0") + fmt.Sprintf("*%d\r\n", len(keys))
+		for _, key := range keys {
+			reply += respBulk(key)
+		}
+		return reply
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestRedisMatchPattern(t *testing.T) {
+	assert.Equal(t, `cache_rpc_eth_call$\[1,*`, redisMatchPattern(`cache_rpc_eth_call$[1,*`))
+	assert.Equal(t, `a\*b\]\\`, redisMatchPattern(`a\*b]\`))
+	assert.Equal(t, `p\*\[x\]:`, escapeRedisGlob(`p*[x]:`))
+}
+
+func TestRedisCacheBackendFlushKeepsOtherKeys(t *testing.T) {
+	server := newFakeRedisServer(t)
+	defer server.listener.Close()
+	server.values["registry:services"] = "unrelated"
+	backend, err := NewRedisCacheBackend(server.url(), "")
+	assert.Nil(t, err)
+	defer backend.Close()
+
+	assert.Nil(t, backend.Set(`cache_rpc_eth_call$[1]`, []byte("1"), 0))
+	assert.Nil(t, backend.Set(`cache_rpc_eth_call$2`, []byte("2"), 0))
+	// '[1]' is plain chars as in the memory backend, not a character class
+	count, err := backend.DeletePattern(`cache_rpc_eth_call$[1]*`)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+	_, ok, _ := backend.Get(`cache_rpc_eth_call$2`)
+	assert.True(t, ok)
+
+	assert.Nil(t, backend.Flush())
+	_, ok, _ = backend.Get(`cache_rpc_eth_call$2`)
+	assert.False(t, ok)
+	assert.Equal(t, "unrelated", server.values["registry:services"])
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	cacheSnapshotMagic = "jsonrpc_proxygo_cache_snapshot"
+	// increase it when the format of snapshot or cached values changed, snapshots of other versions are ignored
+	cacheSnapshotVersion = 1
+)
+
+// cacheSnapshotHeader is encoded before entries, so snapshots of other versions are detected before decoding entries
+type cacheSnapshotHeader struct {
+	Magic     string
+	Version   int
+	CreatedAt int64 // unix nano
+}
+
+type cacheSnapshotEntry struct {
+	Key        string
+	Value      []byte
+	Expiration int64 // unix nano, 0 means never expire
+}
+
+var errSnapshotVersion = errors.New("cache snapshot of another version")
+
+// writeCacheSnapshot save unexpired entries of backend to file, the file is replaced atomically
+func writeCacheSnapshot(backend CacheBackend, file string) (count int, err error) {
+	entries, err := backend.Entries("*", 0)
+	if err != nil {
+		return
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+	writer := bufio.NewWriter(tmpFile)
+	encoder := gob.NewEncoder(writer)
+	now := time.Now()
+	if err = encoder.Encode(&cacheSnapshotHeader{
+		Magic:     cacheSnapshotMagic,
+		Version:   cacheSnapshotVersion,
+		CreatedAt: now.UnixNano(),
+	}); err != nil {
+		return
+	}
+	snapshotEntries := make([]*cacheSnapshotEntry, 0, len(entries))
+	for _, entry := range entries {
+		snapshotEntry := &cacheSnapshotEntry{
+			Key:   entry.Key,
+			Value: entry.Value,
+		}
+		if entry.Ttl >= 0 {
+			snapshotEntry.Expiration = now.Add(entry.Ttl).UnixNano()
+		}
+		snapshotEntries = append(snapshotEntries, snapshotEntry)
+	}
+	if err = encoder.Encode(snapshotEntries); err != nil {
+		return
+	}
+	if err = writer.Flush(); err != nil {
+		return
+	}
+	if err = tmpFile.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(tmpFile.Name(), file); err != nil {
+		return
+	}
+	count = len(snapshotEntries)
+	return
+}
+
+// readCacheSnapshot load unexpired entries from the snapshot file to backend.
+// returns errSnapshotVersion if the snapshot is saved by a build of another version
+func readCacheSnapshot(backend CacheBackend, file string) (count int, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	decoder := gob.NewDecoder(bufio.NewReader(f))
+	header := &cacheSnapshotHeader{}
+	if err = decoder.Decode(header); err != nil {
+		err = fmt.Errorf("decode cache snapshot header error %s", err.Error())
+		return
+	}
+	if header.Magic != cacheSnapshotMagic || header.Version != cacheSnapshotVersion {
+		err = errSnapshotVersion
+		return
+	}
+	var entries []*cacheSnapshotEntry
+	if err = decoder.Decode(&entries); err != nil {
+		err = fmt.Errorf("decode cache snapshot entries error %s", err.Error())
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		var ttl time.Duration
+		if entry.Expiration > 0 {
+			if entry.Expiration <= now {
+				continue
+			}
+			ttl = time.Duration(entry.Expiration - now)
+		}
+		if err = backend.Set(entry.Key, entry.Value, ttl); err != nil {
+			return
+		}
+		count++
+	}
+	return
+}
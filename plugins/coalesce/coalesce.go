@@ -0,0 +1,212 @@
+package coalesce
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+var log = utils.GetLogger("coalesce")
+
+const defaultWaitTimeout = 5 * time.Second
+
+// keys of JSONRpcRequestSession.Parameters used by coalesce middleware
+const (
+	sessionParamFlight = "coalesce.flight" // *flight led by this request
+	sessionParamWait   = "coalesce.wait"   // *flight this request waits for
+)
+
+var coalescedRequestsCounter = metrics.NewCounter("jsonrpc_proxy_coalesced_requests_total",
+	"requests served by the upstream response of an identical in-flight request")
+
+func init() {
+	metrics.MustRegister(coalescedRequestsCounter)
+}
+
+// flight is an upstream call shared by identical concurrent requests
+type flight struct {
+	key       string
+	startedAt time.Time
+	done      chan struct{}
+	response  *rpc.JSONRpcResponse // nil if the leader failed
+}
+
+/**
+ * CoalesceMiddleware collapses identical concurrent requests(same method and canonical params) into one upstream call.
+ * the first request goes upstream, others wait for its response and get a copy with their own ids
+ */
+type CoalesceMiddleware struct {
+	plugin.MiddlewareAdapter
+	methodPatterns []string // exact names or globs of methods to coalesce
+	waitTimeout    time.Duration
+
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+func NewCoalesceMiddleware(waitTimeout time.Duration) *CoalesceMiddleware {
+	if waitTimeout <= 0 {
+		waitTimeout = defaultWaitTimeout
+	}
+	return &CoalesceMiddleware{
+		waitTimeout: waitTimeout,
+		flights:     make(map[string]*flight),
+	}
+}
+
+// AddMethod coalesce requests of methods matching the exact name or glob like "eth_get*"
+func (middleware *CoalesceMiddleware) AddMethod(pattern string) (err error) {
+	if _, err = path.Match(pattern, ""); err != nil {
+		return
+	}
+	middleware.methodPatterns = append(middleware.methodPatterns, pattern)
+	return
+}
+
+func (middleware *CoalesceMiddleware) matchMethod(methodName string) bool {
+	for _, pattern := range middleware.methodPatterns {
+		if matched, _ := path.Match(pattern, methodName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (middleware *CoalesceMiddleware) Name() string {
+	return "coalesce"
+}
+
+func (middleware *CoalesceMiddleware) OnStart() (err error) {
+	return middleware.NextOnStart()
+}
+
+func (middleware *CoalesceMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnection(session)
+}
+
+func (middleware *CoalesceMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnectionClosed(session)
+}
+
+func (middleware *CoalesceMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession,
+	messageType int, message []byte) error {
+	return middleware.NextOnWebSocketFrame(session, messageType, message)
+}
+
+func flightKey(request *rpc.JSONRpcRequest) (string, error) {
+	paramsBytes, err := utils.CanonicalJson(request.Params)
+	if err != nil {
+		return "", err
+	}
+	return request.Method + "$" + string(paramsBytes), nil
+}
+
+// joinFlight returns the flight of key and whether this request leads it.
+// a flight not finished in wait timeout is replaced, in case its leader never completes
+func (middleware *CoalesceMiddleware) joinFlight(key string) (f *flight, leader bool) {
+	middleware.lock.Lock()
+	defer middleware.lock.Unlock()
+	now := time.Now()
+	if f, ok := middleware.flights[key]; ok && now.Sub(f.startedAt) < middleware.waitTimeout {
+		return f, false
+	}
+	f = &flight{
+		key:       key,
+		startedAt: now,
+		done:      make(chan struct{}),
+	}
+	middleware.flights[key] = f
+	return f, true
+}
+
+// finishFlight share the leader's response to the waiting requests
+func (middleware *CoalesceMiddleware) finishFlight(session *rpc.JSONRpcRequestSession, response *rpc.JSONRpcResponse) {
+	f, ok := session.Parameters[sessionParamFlight].(*flight)
+	if !ok {
+		return
+	}
+	delete(session.Parameters, sessionParamFlight)
+	middleware.lock.Lock()
+	if middleware.flights[f.key] == f {
+		delete(middleware.flights, f.key)
+	}
+	middleware.lock.Unlock()
+	f.response = response
+	close(f.done)
+}
+
+func (middleware *CoalesceMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	request := session.Request
+	if session.Response != nil || !middleware.matchMethod(request.Method) {
+		return middleware.NextOnJSONRpcRequest(session)
+	}
+	key, err := flightKey(request)
+	if err != nil {
+		log.Warnf("coalesce key of %s error %s", request.Method, err.Error())
+		return middleware.NextOnJSONRpcRequest(session)
+	}
+	f, leader := middleware.joinFlight(key)
+	if !leader {
+		// wait for the leader's response in ProcessRpcRequest instead of blocking the connection here
+		session.Parameters[sessionParamWait] = f
+		return
+	}
+	session.Parameters[sessionParamFlight] = f
+	if err = middleware.NextOnJSONRpcRequest(session); err != nil {
+		middleware.finishFlight(session, nil)
+	}
+	return
+}
+
+func (middleware *CoalesceMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) error {
+	return middleware.NextOnJSONRpcResponse(session)
+}
+
+// waitForFlight returns a copy of the leader's response with the request's own id, false if timeout or the leader failed
+func (middleware *CoalesceMiddleware) waitForFlight(session *rpc.JSONRpcRequestSession, f *flight) bool {
+	timer := time.NewTimer(middleware.waitTimeout - time.Since(f.startedAt))
+	defer timer.Stop()
+	select {
+	case <-f.done:
+	case <-timer.C:
+		return false
+	}
+	if f.response == nil {
+		return false
+	}
+	response := *f.response
+	response.Id = session.Request.Id
+	session.FillRpcResponse(&response)
+	coalescedRequestsCounter.Inc()
+	return true
+}
+
+func (middleware *CoalesceMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	if f, ok := session.Parameters[sessionParamWait].(*flight); ok {
+		delete(session.Parameters, sessionParamWait)
+		if middleware.waitForFlight(session, f) {
+			return
+		}
+		// the leader didn't respond in time, request upstream by itself
+		if err = middleware.NextOnJSONRpcRequest(session); err != nil {
+			return
+		}
+		return middleware.NextProcessJSONRpcRequest(session)
+	}
+	if _, ok := session.Parameters[sessionParamFlight]; ok {
+		defer func() {
+			if err != nil {
+				middleware.finishFlight(session, nil)
+				return
+			}
+			middleware.finishFlight(session, session.Response)
+		}()
+	}
+	err = middleware.NextProcessJSONRpcRequest(session)
+	return
+}
@@ -0,0 +1,140 @@
+package coalesce
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// slowUpstreamMiddleware responds rpc requests after a delay and counts them
+type slowUpstreamMiddleware struct {
+	plugin.MiddlewareAdapter
+	delay    time.Duration
+	requests int32
+}
+
+func (m *slowUpstreamMiddleware) Name() string {
+	return "slow_upstream"
+}
+
+func (m *slowUpstreamMiddleware) OnStart() error {
+	return nil
+}
+
+func (m *slowUpstreamMiddleware) OnConnection(session *rpc.ConnectionSession) error {
+	return nil
+}
+
+func (m *slowUpstreamMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) error {
+	return nil
+}
+
+func (m *slowUpstreamMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession, messageType int, message []byte) error {
+	return nil
+}
+
+func (m *slowUpstreamMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) error {
+	atomic.AddInt32(&m.requests, 1)
+	return nil
+}
+
+func (m *slowUpstreamMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+func (m *slowUpstreamMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) error {
+	time.Sleep(m.delay)
+	session.FillRpcResponse(rpc.NewJSONRpcResponse(session.Request.Id, "0x10", nil))
+	return nil
+}
+
+func mockRpcRequestSession(id uint64, method string, params interface{}) *rpc.JSONRpcRequestSession {
+	reqSess := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+	reqSess.FillRpcRequest(&rpc.JSONRpcRequest{Id: id, JSONRpc: "2.0", Method: method, Params: params}, nil)
+	return reqSess
+}
+
+func callMiddleware(m plugin.Middleware, session *rpc.JSONRpcRequestSession) error {
+	if err := m.OnRpcRequest(session); err != nil {
+		return err
+	}
+	return m.ProcessRpcRequest(session)
+}
+
+func TestCoalesceIdenticalRequests(t *testing.T) {
+	m := NewCoalesceMiddleware(time.Second)
+	assert.True(t, m.AddMethod("eth_get*") == nil)
+	upstream := &slowUpstreamMiddleware{delay: 100 * time.Millisecond}
+	m.SetNextMiddleware(upstream)
+
+	leader := mockRpcRequestSession(1, "eth_getBalance", []interface{}{map[string]interface{}{"a": 1, "b": 2}, "latest"})
+	followers := []*rpc.JSONRpcRequestSession{
+		mockRpcRequestSession(2, "eth_getBalance", []interface{}{map[string]interface{}{"b": 2.0, "a": 1}, "latest"}),
+		mockRpcRequestSession(3, "eth_getBalance", []interface{}{map[string]interface{}{"a": 1, "b": 2}, "latest"}),
+	}
+	done := make(chan error, 3)
+	go func() {
+		done <- callMiddleware(m, leader)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	for _, follower := range followers {
+		go func(session *rpc.JSONRpcRequestSession) {
+			done <- callMiddleware(m, session)
+		}(follower)
+	}
+	for i := 0; i < 3; i++ {
+		assert.True(t, <-done == nil)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.requests))
+	assert.Equal(t, uint64(1), leader.Response.Id)
+	for _, follower := range followers {
+		assert.Equal(t, follower.Request.Id, follower.Response.Id)
+		assert.Equal(t, "0x10", follower.Response.Result)
+	}
+
+	// different params and not coalesced methods go upstream
+	other := mockRpcRequestSession(4, "eth_getBalance", []interface{}{"0x02", "latest"})
+	assert.True(t, callMiddleware(m, other) == nil)
+	send := mockRpcRequestSession(5, "eth_sendRawTransaction", []interface{}{"0x01"})
+	assert.True(t, callMiddleware(m, send) == nil)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&upstream.requests))
+}
+
+func TestCoalesceWaitTimeout(t *testing.T) {
+	m := NewCoalesceMiddleware(50 * time.Millisecond)
+	assert.True(t, m.AddMethod("eth_call") == nil)
+	upstream := &slowUpstreamMiddleware{delay: 100 * time.Millisecond}
+	m.SetNextMiddleware(upstream)
+
+	leader := mockRpcRequestSession(1, "eth_call", []interface{}{"0x01"})
+	follower := mockRpcRequestSession(2, "eth_call", []interface{}{"0x01"})
+	assert.True(t, m.OnRpcRequest(leader) == nil)
+	assert.True(t, m.OnRpcRequest(follower) == nil)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream.requests))
+	// leader never processed, follower requests upstream by itself after timeout
+	assert.True(t, m.ProcessRpcRequest(follower) == nil)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&upstream.requests))
+	assert.Equal(t, uint64(2), follower.Response.Id)
+}
+
+func TestCoalesceFlightKeyKeepsBigNumbers(t *testing.T) {
+	key := func(message string) string {
+		request, err := rpc.DecodeJSONRPCRequest([]byte(message))
+		assert.True(t, err == nil)
+		result, err := flightKey(request)
+		assert.True(t, err == nil)
+		return result
+	}
+	assert.NotEqual(t,
+		key(`{"id":1,"method":"eth_getBalance","params":[12345678901234567890]}`),
+		key(`{"id":2,"method":"eth_getBalance","params":[12345678901234567891]}`))
+	assert.Equal(t,
+		key(`{"id":1,"method":"eth_getBalance","params":[1.50]}`),
+		key(`{"id":2,"method":"eth_getBalance","params":[15e-1]}`))
+	_, err := rpc.DecodeJSONRPCRequest([]byte(`{"id":1,"method":"eth_call"} {}`))
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,23 @@
+package coalesce
+
+import (
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+)
+
+func LoadCoalescePluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
+	coalescePluginConf := configInfo.Plugins.Coalesce
+	if !coalescePluginConf.Start || len(coalescePluginConf.Methods) < 1 {
+		return
+	}
+	coalesceMiddleware := NewCoalesceMiddleware(time.Duration(coalescePluginConf.WaitMillis) * time.Millisecond)
+	for _, pattern := range coalescePluginConf.Methods {
+		if err := coalesceMiddleware.AddMethod(pattern); err != nil {
+			log.Fatalln("invalid coalesce method pattern", pattern, err)
+			return
+		}
+	}
+	chain.InsertHead(coalesceMiddleware)
+}
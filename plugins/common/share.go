@@ -3,8 +3,13 @@ package common
 import (
 	"errors"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"strings"
 )
 
+// ErrRateLimitExceeded is returned by OnConnection of the rate_limit plugin when the connection is rejected
+var ErrRateLimitExceeded = errors.New("rate limit exceed")
+
 func GetSessionStringParam(session *rpc.JSONRpcRequestSession, paramName string, defaultValue *string) (result string, err error) {
 	paramValue, ok := session.Parameters[paramName]
 	var defaultValueStr = ""
@@ -24,7 +29,7 @@ func GetSessionStringParam(session *rpc.JSONRpcRequestSession, paramName string,
 }
 
 func SetSelectedUpstreamTargetEndpoint(session *rpc.ConnectionSession, value string) (err error) {
-	session.SelectedUpstreamTarget = &value
+	session.Attributes.Set(rpc.ATTR_SELECTED_UPSTREAM_TARGET, value)
 	return
 }
 
@@ -33,10 +38,54 @@ func GetSelectedUpstreamTargetEndpoint(session *rpc.ConnectionSession, defaultVa
 	if defaultValue != nil {
 		defaultValueStr = *defaultValue
 	}
-	if session.SelectedUpstreamTarget == nil {
+	result, ok := session.Attributes.GetString(rpc.ATTR_SELECTED_UPSTREAM_TARGET)
+	if !ok {
 		result = defaultValueStr
 		return
 	}
-	result = *session.SelectedUpstreamTarget
 	return
 }
+
+// GetClientIp returns the real client ip resolved by ip_acl plugin, or the host of the connection's remote address
+func GetClientIp(session *rpc.ConnectionSession) string {
+	if clientIp, ok := session.Attributes.GetString(rpc.ATTR_CLIENT_IP); ok {
+		return clientIp
+	}
+	if session.Info == nil {
+		return ""
+	}
+	ip := utils.HostOfAddr(session.Info.RemoteAddr)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+const DEFAULT_API_KEY_HEADER = "X-Api-Key"
+
+// GetApiKey returns the client api key in the http headers of the connection, empty if not found
+func GetApiKey(session *rpc.ConnectionSession, headerName string) string {
+	if session.Info == nil || session.Info.Headers == nil {
+		return ""
+	}
+	if len(headerName) < 1 {
+		headerName = DEFAULT_API_KEY_HEADER
+	}
+	return session.Info.Headers.Get(headerName)
+}
+
+// MaskApiKey returns the api key with only the last 4 chars visible
+func MaskApiKey(apiKey string) string {
+	const visibleChars = 4
+	if len(apiKey) <= visibleChars {
+		return strings.Repeat("*", len(apiKey))
+	}
+	return strings.Repeat("*", len(apiKey)-visibleChars) + apiKey[len(apiKey)-visibleChars:]
+}
+
+// GetJwtSubject returns the subject of the connection's JWT verified by an auth plugin(rpc.ATTR_JWT_SUBJECT),
+// empty if no verified token. unverified tokens are never trusted, since any client can forge their claims
+func GetJwtSubject(session *rpc.ConnectionSession) string {
+	subject, _ := session.Attributes.GetString(rpc.ATTR_JWT_SUBJECT)
+	return subject
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// metrics of upstream targets shared by upstream plugins
+var (
+	upstreamUpGauge = metrics.NewGaugeVec("jsonrpc_proxy_upstream_up",
+		"whether the last request to the upstream target got a response(1) or failed to connect or timed out(0)", "upstream")
+	upstreamErrorsCounter = metrics.NewCounterVec("jsonrpc_proxy_upstream_errors_total",
+		"requests to the upstream target failed to connect or timed out", "upstream")
+	upstreamInflightGauge = metrics.NewGaugeVec("jsonrpc_proxy_upstream_inflight_requests",
+		"requests sent to the upstream target waiting for responses", "upstream")
+	upstreamConnectionsGauge = metrics.NewGaugeVec("jsonrpc_proxy_upstream_open_connections",
+		"open connections to the upstream target", "upstream")
+)
+
+func init() {
+	metrics.MustRegister(upstreamUpGauge, upstreamErrorsCounter, upstreamInflightGauge, upstreamConnectionsGauge)
+}
+
+// IsUpstreamFailure returns whether the response of the upstream target is failed to connect or timed out
+func IsUpstreamFailure(response *rpc.JSONRpcResponse) bool {
+	if response == nil {
+		return true
+	}
+	if response.Error == nil {
+		return false
+	}
+	return response.Error.Code == rpc.RPC_UPSTREAM_CONNECTION_CLOSED_ERROR ||
+		response.Error.Code == rpc.RPC_UPSTREAM_TIMEOUT_ERROR
+}
+
+// UpstreamRequestStarted count the in-flight request sent to the upstream target
+func UpstreamRequestStarted(target string) {
+	upstreamInflightGauge.WithLabelValues(target).Inc()
+}
+
+// UpstreamRequestFinished update the health of the upstream target by the response got from it
+func UpstreamRequestFinished(target string, response *rpc.JSONRpcResponse) {
+	upstreamInflightGauge.WithLabelValues(target).Dec()
+	if IsUpstreamFailure(response) {
+		upstreamErrorsCounter.WithLabelValues(target).Inc()
+		upstreamUpGauge.WithLabelValues(target).Set(0)
+		return
+	}
+	upstreamUpGauge.WithLabelValues(target).Set(1)
+}
+
+// UpstreamConnectionOpened count the open connection to the upstream target
+func UpstreamConnectionOpened(target string) {
+	upstreamConnectionsGauge.WithLabelValues(target).Inc()
+}
+
+func UpstreamConnectionClosed(target string) {
+	upstreamConnectionsGauge.WithLabelValues(target).Dec()
+}
+
+// UpstreamConnectFailed mark the upstream target down when failed to connect to it
+func UpstreamConnectFailed(target string) {
+	upstreamErrorsCounter.WithLabelValues(target).Inc()
+	upstreamUpGauge.WithLabelValues(target).Set(0)
+}
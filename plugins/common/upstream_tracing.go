@@ -0,0 +1,41 @@
+package common
+
+import (
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
+)
+
+const sessionParamUpstreamSpan = "tracing.upstream_span"
+
+// StartUpstreamSpan start the client span of the request sent to the upstream target at session.UpstreamSentAt.
+// the span is a child of the request's server span, or a root span for requests sent by middlewares themselves
+func StartUpstreamSpan(session *rpc.JSONRpcRequestSession, target string) *tracing.Span {
+	span := tracing.StartSpanAt("upstream "+session.Request.Method, tracing.SPAN_KIND_CLIENT,
+		session.Span.SpanContext(), session.UpstreamSentAt)
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.method", session.Request.Method)
+	span.SetAttribute("jsonrpc_proxy.upstream", target)
+	session.Parameters[sessionParamUpstreamSpan] = span
+	return span
+}
+
+// EndUpstreamSpan end the client span started by StartUpstreamSpan with the upstream's response
+func EndUpstreamSpan(session *rpc.JSONRpcRequestSession, response *rpc.JSONRpcResponse) {
+	span, ok := session.Parameters[sessionParamUpstreamSpan].(*tracing.Span)
+	if !ok {
+		return
+	}
+	delete(session.Parameters, sessionParamUpstreamSpan)
+	switch {
+	case response == nil:
+		span.SetError("no response")
+	case response.Error != nil:
+		span.SetAttribute("rpc.jsonrpc.error_code", int64(response.Error.Code))
+		span.SetError(response.Error.Message)
+	}
+	if session.UpstreamRecvAt.IsZero() {
+		span.End()
+		return
+	}
+	span.EndAt(session.UpstreamRecvAt)
+}
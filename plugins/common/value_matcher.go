@@ -0,0 +1,100 @@
+package common
+
+import (
+	"regexp"
+
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+// ValueMatcher matches the value at a json path of rpc params or result
+type ValueMatcher struct {
+	tokens      []string
+	equalsBytes []byte // canonical json of expected value, nil if not compare by value
+	regex       *regexp.Regexp
+	null        bool
+	empty       bool
+}
+
+func NewValueMatcher(conf *config.ValueMatcherConfig) (matcher *ValueMatcher, err error) {
+	matcher = &ValueMatcher{
+		tokens: utils.ParseJsonPath(conf.Path),
+		null:   conf.Null,
+		empty:  conf.Empty,
+	}
+	if conf.Equals != nil {
+		if matcher.equalsBytes, err = utils.CanonicalJson(conf.Equals); err != nil {
+			return
+		}
+	}
+	if len(conf.Regex) > 0 {
+		if matcher.regex, err = regexp.Compile(conf.Regex); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// NewValueMatchers compile the matchers configs in order
+func NewValueMatchers(confs []config.ValueMatcherConfig) (result []*ValueMatcher, err error) {
+	for i := range confs {
+		matcher, matcherErr := NewValueMatcher(&confs[i])
+		if matcherErr != nil {
+			err = matcherErr
+			return
+		}
+		result = append(result, matcher)
+	}
+	return
+}
+
+func isEmptyJsonValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return len(v) < 1 || v == "0x"
+	case []interface{}:
+		return len(v) < 1
+	case map[string]interface{}:
+		return len(v) < 1
+	}
+	return false
+}
+
+func (m *ValueMatcher) Match(value interface{}) bool {
+	value, ok := utils.JsonPathGetByTokens(value, m.tokens)
+	if !ok {
+		// a missing value is only matched by null or empty
+		return (m.null || m.empty) && m.equalsBytes == nil && m.regex == nil
+	}
+	if m.null && value != nil {
+		return false
+	}
+	if m.empty && !isEmptyJsonValue(value) {
+		return false
+	}
+	if m.equalsBytes != nil {
+		valueBytes, err := utils.CanonicalJson(value)
+		if err != nil || string(valueBytes) != string(m.equalsBytes) {
+			return false
+		}
+	}
+	if m.regex != nil {
+		str, isStr := value.(string)
+		if !isStr || !m.regex.MatchString(str) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchAllValueMatchers returns true if all matchers match the value
+func MatchAllValueMatchers(matchers []*ValueMatcher, value interface{}) bool {
+	for _, matcher := range matchers {
+		if !matcher.Match(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package dashboard
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// adminAuthError is why an admin api request is rejected, with the http status of the response
+type adminAuthError struct {
+	status  int
+	message string
+}
+
+func (e *adminAuthError) Error() string {
+	return e.message
+}
+
+// checkAdminRequest allows requests with the bearer {apiToken} if it's set, or requests from loopback clients otherwise.
+// cross origin requests are rejected either way, so a web page opened by an operator can't call the apis
+func checkAdminRequest(request *http.Request, apiToken string) *adminAuthError {
+	if origin := request.Header.Get("Origin"); len(origin) > 0 {
+		originUrl, err := url.Parse(origin)
+		if err != nil || originUrl.Host != request.Host {
+			return &adminAuthError{http.StatusForbidden, "cross origin requests are not allowed"}
+		}
+	}
+	if len(apiToken) > 0 {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+			return &adminAuthError{http.StatusUnauthorized, "invalid dashboard api token"}
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return &adminAuthError{http.StatusForbidden, "dashboard admin apis only allow loopback clients without api_token"}
+	}
+	return nil
+}
+
+// wrapAdminApi guards apis changing the proxy at runtime or exposing sensitive data.
+// unlike wrapApi, no CORS headers are sent
+func (h *apiHandlers) wrapAdminApi(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if authErr := checkAdminRequest(request, h.mOptions.ApiToken); authErr != nil {
+			log.Warnf("reject dashboard admin api %s from %s: %s", request.URL.Path, request.RemoteAddr, authErr.Error())
+			sendErrorResponseWithStatus(writer, authErr.status, errors.New(authErr.message))
+			return
+		}
+		handlerFunc(writer, request)
+	}
+}
@@ -4,21 +4,28 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/cache"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/statistic"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
 type apiHandlers struct {
 	store statistic.MetricStore
 	r registry.Registry
+	mOptions *dashboardOptions
 }
 
-func newApiHandlers(store statistic.MetricStore, r registry.Registry) *apiHandlers {
+func newApiHandlers(store statistic.MetricStore, r registry.Registry, mOptions *dashboardOptions) *apiHandlers {
 	return &apiHandlers{
 		store: store,
 		r: r,
+		mOptions: mOptions,
 	}
 }
 
@@ -30,7 +37,11 @@ func allowCors(writer *http.ResponseWriter, request *http.Request) {
 }
 
 func sendErrorResponse(writer http.ResponseWriter, e error) {
-	writer.WriteHeader(http.StatusInternalServerError)
+	sendErrorResponseWithStatus(writer, http.StatusInternalServerError, e)
+}
+
+func sendErrorResponseWithStatus(writer http.ResponseWriter, status int, e error) {
+	writer.WriteHeader(status)
 	m := struct{
 		Error struct{
 			Message string `json:"message"`
@@ -172,6 +183,28 @@ func (h *apiHandlers) listServiceDownLogsApi(writer http.ResponseWriter, request
 	sendResult(writer, reqSpanList)
 }
 
+// queryRollupsApi returns rollups of a method or upstream in a time range, eg. calls per minute of a method in the last 24 hours
+func (h *apiHandlers) queryRollupsApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive query_rollups api")
+	store := h.store
+	if store == nil {
+		sendErrorResponse(writer, errors.New("metric store not init"))
+		return
+	}
+	form := &statistic.QueryRollupForm{}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	points, err := store.QueryRollups(context.Background(), form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, points)
+}
+
 func (h *apiHandlers) queryServiceHealthApi(writer http.ResponseWriter, request *http.Request) {
 	log.Info("queryServiceHealthApi called")
 	store := h.store
@@ -204,6 +237,320 @@ func (h *apiHandlers) queryServiceHealthApi(writer http.ResponseWriter, request
 	sendResult(writer, result)
 }
 
+// slaReportApi returns uptime percentages, incidents, MTTR and up/down transitions of each upstream in a time range
+func (h *apiHandlers) slaReportApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive sla_report api")
+	store := h.store
+	if store == nil {
+		sendErrorResponse(writer, errors.New("metric store not init"))
+		return
+	}
+	form := &statistic.SlaReportForm{}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	// services registered are reported even if never down
+	var services []*registry.Service
+	if h.r != nil {
+		services, err = h.r.ListServices()
+		if err != nil {
+			sendErrorResponse(writer, err)
+			return
+		}
+	}
+	report, err := statistic.BuildSlaReport(context.Background(), store, services, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, report)
+}
+
+// readClientUsageForm reads the form of query parameters of GET requests(eg. csv downloads by links), or the json body
+func readClientUsageForm(request *http.Request) (form *statistic.QueryClientUsageForm, err error) {
+	form = &statistic.QueryClientUsageForm{}
+	if request.Method != http.MethodGet {
+		err = readJsonBody(request, form)
+		return
+	}
+	query := request.URL.Query()
+	form.From = query.Get("from")
+	form.To = query.Get("to")
+	form.ClientType = query.Get("client_type")
+	form.Client = query.Get("client")
+	form.GroupBy = query.Get("group_by")
+	if limit := query.Get("limit"); len(limit) > 0 {
+		if form.Limit, err = strconv.Atoi(limit); err != nil {
+			err = errors.New("invalid limit " + limit)
+		}
+	}
+	return
+}
+
+// clientUsageApi returns daily usage of clients(api keys, jwt subjects or ips) grouped by client, day or method
+func (h *apiHandlers) clientUsageApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive client_usage api")
+	store := h.store
+	if store == nil {
+		sendErrorResponse(writer, errors.New("metric store not init"))
+		return
+	}
+	form, err := readClientUsageForm(request)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	usages, err := store.QueryClientUsage(context.Background(), form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, usages)
+}
+
+// exportClientUsageApi returns the usage of client_usage api as a csv file
+func (h *apiHandlers) exportClientUsageApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive export_client_usage api")
+	store := h.store
+	if store == nil {
+		sendErrorResponse(writer, errors.New("metric store not init"))
+		return
+	}
+	form, err := readClientUsageForm(request)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	usages, err := store.QueryClientUsage(context.Background(), form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"client_usage_%s_%s.csv\"", form.From, form.To))
+	if err = statistic.WriteClientUsageCsv(writer, usages); err != nil {
+		log.Errorf("api send csv error %s", err.Error())
+	}
+}
+
+func (h *apiHandlers) listAlertsApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive list_alerts api")
+	alertMiddleware := h.mOptions.AlertMiddleware
+	if alertMiddleware == nil {
+		sendErrorResponse(writer, errors.New("alert plugin not started"))
+		return
+	}
+	type formType struct {
+		Offset int `json:"offset"`
+		Limit int `json:"limit"`
+	}
+	form := &formType{
+		Offset: 0,
+		Limit: 20,
+	}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	if form.Offset < 0 {
+		form.Offset = 0
+	}
+	if form.Limit <= 0 {
+		form.Limit = 20
+	}
+	sendResult(writer, alertMiddleware.ListHistory(form.Offset, form.Limit))
+}
+
+func (h *apiHandlers) activeAlertsApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive active_alerts api")
+	alertMiddleware := h.mOptions.AlertMiddleware
+	if alertMiddleware == nil {
+		sendErrorResponse(writer, errors.New("alert plugin not started"))
+		return
+	}
+	sendResult(writer, alertMiddleware.ActiveAlerts())
+}
+
+const disableRulesRuntimeOnlyNote = "disable rules changed by api are runtime-only, they are not saved to the config file and are lost on restart"
+
+// disableRulesPersistence is added to results of disable rule apis, rule changes are not persisted
+type disableRulesPersistence struct {
+	Persisted bool   `json:"persisted"`
+	Note      string `json:"note"`
+}
+
+var disableRulesRuntimeOnly = disableRulesPersistence{
+	Persisted: false,
+	Note:      disableRulesRuntimeOnlyNote,
+}
+
+func (h *apiHandlers) listDisableRulesApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive list_disable_rules api")
+	disableMiddleware := h.mOptions.DisableMiddleware
+	if disableMiddleware == nil {
+		sendErrorResponse(writer, errors.New("disable plugin not started"))
+		return
+	}
+	sendResult(writer, &struct {
+		Rules []*config.DisableRuleConfig `json:"rules"`
+		disableRulesPersistence
+	}{disableMiddleware.ListRules(), disableRulesRuntimeOnly})
+}
+
+func (h *apiHandlers) saveDisableRuleApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive save_disable_rule api")
+	disableMiddleware := h.mOptions.DisableMiddleware
+	if disableMiddleware == nil {
+		sendErrorResponse(writer, errors.New("disable plugin not started"))
+		return
+	}
+	form := &config.DisableRuleConfig{}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	rule, err := disableMiddleware.SaveRule(form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, &struct {
+		Rule *config.DisableRuleConfig `json:"rule"`
+		disableRulesPersistence
+	}{rule, disableRulesRuntimeOnly})
+}
+
+func (h *apiHandlers) removeDisableRuleApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive remove_disable_rule api")
+	disableMiddleware := h.mOptions.DisableMiddleware
+	if disableMiddleware == nil {
+		sendErrorResponse(writer, errors.New("disable plugin not started"))
+		return
+	}
+	type formType struct {
+		Id string `json:"id"`
+	}
+	form := &formType{}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	if !disableMiddleware.RemoveRule(form.Id) {
+		sendErrorResponse(writer, errors.New("disable rule "+form.Id+" not found"))
+		return
+	}
+	sendResult(writer, &struct {
+		Id string `json:"id"`
+		disableRulesPersistence
+	}{form.Id, disableRulesRuntimeOnly})
+}
+
+func (h *apiHandlers) cacheStatsApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive cache_stats api")
+	cacheMiddleware := h.mOptions.CacheMiddleware
+	if cacheMiddleware == nil {
+		sendErrorResponse(writer, errors.New("cache plugin not started"))
+		return
+	}
+	stats, ok := cacheMiddleware.Stats()
+	if !ok {
+		sendErrorResponse(writer, errors.New("cache backend not support stats"))
+		return
+	}
+	sendResult(writer, stats)
+}
+
+func (h *apiHandlers) listCacheEntriesApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive list_cache_entries api")
+	cacheMiddleware := h.mOptions.CacheMiddleware
+	if cacheMiddleware == nil {
+		sendErrorResponse(writer, errors.New("cache plugin not started"))
+		return
+	}
+	type formType struct {
+		Method  string `json:"method"`
+		Pattern string `json:"pattern"`
+		Limit   int    `json:"limit"`
+	}
+	form := &formType{}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	pattern := form.Pattern
+	if len(form.Method) > 0 {
+		pattern = cache.KeyPatternOfMethod(form.Method)
+	}
+	entries, err := cacheMiddleware.ListEntries(pattern, form.Limit)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, entries)
+}
+
+func (h *apiHandlers) purgeCacheApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive purge_cache api")
+	cacheMiddleware := h.mOptions.CacheMiddleware
+	if cacheMiddleware == nil {
+		sendErrorResponse(writer, errors.New("cache plugin not started"))
+		return
+	}
+	type formType struct {
+		Key     string `json:"key"`
+		Method  string `json:"method"`
+		Pattern string `json:"pattern"`
+	}
+	form := &formType{}
+	err := readJsonBody(request, form)
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	var count int64
+	switch {
+	case len(form.Key) > 0:
+		count, err = cacheMiddleware.PurgeKey(form.Key)
+	case len(form.Method) > 0:
+		count, err = cacheMiddleware.PurgePattern(cache.KeyPatternOfMethod(form.Method))
+	case len(form.Pattern) > 0:
+		count, err = cacheMiddleware.PurgePattern(form.Pattern)
+	default:
+		err = errors.New("empty key, method and pattern form")
+	}
+	if err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, map[string]int64{"purged": count})
+}
+
+func (h *apiHandlers) flushCacheApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive flush_cache api")
+	cacheMiddleware := h.mOptions.CacheMiddleware
+	if cacheMiddleware == nil {
+		sendErrorResponse(writer, errors.New("cache plugin not started"))
+		return
+	}
+	if err := cacheMiddleware.Flush(); err != nil {
+		sendErrorResponse(writer, err)
+		return
+	}
+	sendResult(writer, map[string]bool{"flushed": true})
+}
+
+func (h *apiHandlers) metricsApi(writer http.ResponseWriter, request *http.Request) {
+	log.Info("receive metrics api")
+	sendResult(writer, metrics.DefaultRegistry.Gather())
+}
+
 func (h *apiHandlers) wrapApi(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func (writer http.ResponseWriter, request *http.Request) {
 		allowCors(&writer, request)
@@ -215,10 +562,26 @@ func (h *apiHandlers) wrapApi(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func createDashboardApis(r registry.Registry, store statistic.MetricStore) {
-	hs := newApiHandlers(store, r)
-	http.HandleFunc("/api/statistic", hs.wrapApi(hs.statisticApi))
-	http.HandleFunc("/api/list_request_span", hs.wrapApi(hs.listRequestSpanApi))
-	http.HandleFunc("/api/list_service_down_logs", hs.wrapApi(hs.listServiceDownLogsApi))
-	http.HandleFunc("/api/query_service_health", hs.wrapApi(hs.queryServiceHealthApi))
+// createDashboardApis registers the apis to the dashboard's own mux,
+// never to http.DefaultServeMux which the providers serve on the public proxy endpoint
+func createDashboardApis(mux *http.ServeMux, r registry.Registry, store statistic.MetricStore, mOptions *dashboardOptions) {
+	hs := newApiHandlers(store, r, mOptions)
+	mux.HandleFunc("/api/statistic", hs.wrapApi(hs.statisticApi))
+	mux.HandleFunc("/api/list_request_span", hs.wrapApi(hs.listRequestSpanApi))
+	mux.HandleFunc("/api/list_service_down_logs", hs.wrapApi(hs.listServiceDownLogsApi))
+	mux.HandleFunc("/api/query_service_health", hs.wrapApi(hs.queryServiceHealthApi))
+	mux.HandleFunc("/api/query_rollups", hs.wrapApi(hs.queryRollupsApi))
+	mux.HandleFunc("/api/sla_report", hs.wrapApi(hs.slaReportApi))
+	mux.HandleFunc("/api/client_usage", hs.wrapAdminApi(hs.clientUsageApi))
+	mux.HandleFunc("/api/export_client_usage", hs.wrapAdminApi(hs.exportClientUsageApi))
+	mux.HandleFunc("/api/metrics", hs.wrapApi(hs.metricsApi))
+	mux.HandleFunc("/api/cache_stats", hs.wrapApi(hs.cacheStatsApi))
+	mux.HandleFunc("/api/list_cache_entries", hs.wrapAdminApi(hs.listCacheEntriesApi))
+	mux.HandleFunc("/api/purge_cache", hs.wrapAdminApi(hs.purgeCacheApi))
+	mux.HandleFunc("/api/flush_cache", hs.wrapAdminApi(hs.flushCacheApi))
+	mux.HandleFunc("/api/list_alerts", hs.wrapApi(hs.listAlertsApi))
+	mux.HandleFunc("/api/active_alerts", hs.wrapApi(hs.activeAlertsApi))
+	mux.HandleFunc("/api/list_disable_rules", hs.wrapApi(hs.listDisableRulesApi))
+	mux.HandleFunc("/api/save_disable_rule", hs.wrapAdminApi(hs.saveDisableRuleApi))
+	mux.HandleFunc("/api/remove_disable_rule", hs.wrapAdminApi(hs.removeDisableRuleApi))
 }
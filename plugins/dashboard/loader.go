@@ -9,7 +9,7 @@ import (
 )
 
 func LoadDashboardPluginConfig(chain *plugin.MiddlewareChain,
-	configInfo *config.ServerConfig, r registry.Registry, store statistic.MetricStore) {
+	configInfo *config.ServerConfig, r registry.Registry, store statistic.MetricStore, extraOptions ...common.Option) {
 	dashboardConfig := configInfo.Plugins.Dashboard
 	if !dashboardConfig.Start {
 		return
@@ -25,6 +25,8 @@ func LoadDashboardPluginConfig(chain *plugin.MiddlewareChain,
 	if store != nil {
 		storeOption = WithStore(store)
 	}
-	plugin := NewDashboardMiddleware(Endpoint(dashboardConfig.Endpoint), registryOption, storeOption)
+	options := []common.Option{Endpoint(dashboardConfig.Endpoint), ApiToken(dashboardConfig.ApiToken), registryOption, storeOption}
+	options = append(options, extraOptions...)
+	plugin := NewDashboardMiddleware(options...)
 	chain.InsertHead(plugin)
 }
@@ -3,15 +3,22 @@ package dashboard
 import (
 	"context"
 	"github.com/zoowii/jsonrpc_proxygo/common"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/alert"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/cache"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/disable"
 	"github.com/zoowii/jsonrpc_proxygo/plugins/statistic"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 )
 
 type dashboardOptions struct {
 	Endpoint string
+	ApiToken string // bearer token of admin apis, only loopback clients can call them if empty
 	Context  context.Context
 	Registry registry.Registry
 	Store statistic.MetricStore
+	DisableMiddleware *disable.DisableMiddleware
+	CacheMiddleware *cache.CacheMiddleware
+	AlertMiddleware *alert.AlertMiddleware
 }
 
 func newDashBoardOptions() *dashboardOptions {
@@ -27,6 +34,13 @@ func Endpoint(endpoint string) common.Option {
 	}
 }
 
+func ApiToken(token string) common.Option {
+	return func(options common.Options) {
+		mOptions := options.(*dashboardOptions)
+		mOptions.ApiToken = token
+	}
+}
+
 func WithContext(ctx context.Context) common.Option {
 	return func(options common.Options) {
 		mOptions := options.(*dashboardOptions)
@@ -47,3 +61,24 @@ func WithStore(store statistic.MetricStore) common.Option {
 		mOptions.Store = store
 	}
 }
+
+func WithDisableMiddleware(disableMiddleware *disable.DisableMiddleware) common.Option {
+	return func(options common.Options) {
+		mOptions := options.(*dashboardOptions)
+		mOptions.DisableMiddleware = disableMiddleware
+	}
+}
+
+func WithCacheMiddleware(cacheMiddleware *cache.CacheMiddleware) common.Option {
+	return func(options common.Options) {
+		mOptions := options.(*dashboardOptions)
+		mOptions.CacheMiddleware = cacheMiddleware
+	}
+}
+
+func WithAlertMiddleware(alertMiddleware *alert.AlertMiddleware) common.Option {
+	return func(options common.Options) {
+		mOptions := options.(*dashboardOptions)
+		mOptions.AlertMiddleware = alertMiddleware
+	}
+}
@@ -32,11 +32,13 @@ func (m *DashboardMiddleware) Name() string {
 	return "dashboard"
 }
 
+// createDashboardWebHandler returns a private mux of the dashboard apis, served only on the dashboard endpoint
 func (m *DashboardMiddleware) createDashboardWebHandler() http.Handler {
 	r := m.mOptions.Registry
 	store := m.mOptions.Store
-	createDashboardApis(r, store)
-	return nil
+	mux := http.NewServeMux()
+	createDashboardApis(mux, r, store, m.mOptions)
+	return mux
 }
 
 func (middleware *DashboardMiddleware) OnStart() (err error) {
@@ -0,0 +1,66 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/plugins/disable"
+)
+
+func TestDashboardApisNotOnDefaultServeMux(t *testing.T) {
+	m := NewDashboardMiddleware()
+	handler := m.createDashboardWebHandler()
+	assert.NotNil(t, handler)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// the providers serve http.DefaultServeMux on the public proxy endpoint
+	for _, path := range []string{"/api/metrics", "/api/save_disable_rule", "/api/flush_cache", "/api/client_usage"} {
+		_, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, "", pattern)
+	}
+}
+
+func TestDashboardAdminApis(t *testing.T) {
+	disableMiddleware := disable.NewDisableMiddleware()
+	saveRule := func(handler http.Handler, remoteAddr string, headers map[string]string) int {
+		request := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:5000/api/save_disable_rule",
+			strings.NewReader(`{"methods": ["admin_*"]}`))
+		request.RemoteAddr = remoteAddr
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// loopback clients only without api token
+	handler := NewDashboardMiddleware(WithDisableMiddleware(disableMiddleware)).createDashboardWebHandler()
+	assert.Equal(t, http.StatusForbidden, saveRule(handler, "8.8.8.8:1234", nil))
+	assert.Equal(t, 0, len(disableMiddleware.ListRules()))
+	assert.Equal(t, http.StatusOK, saveRule(handler, "127.0.0.1:1234", nil))
+	assert.Equal(t, http.StatusOK, saveRule(handler, "[::1]:1234", map[string]string{"Origin": "http://127.0.0.1:5000"}))
+	// a web page opened in the operator's browser
+	assert.Equal(t, http.StatusForbidden, saveRule(handler, "127.0.0.1:1234", map[string]string{"Origin": "http://evil.example"}))
+	assert.Equal(t, 2, len(disableMiddleware.ListRules()))
+
+	handler = NewDashboardMiddleware(WithDisableMiddleware(disableMiddleware), ApiToken("secret")).createDashboardWebHandler()
+	assert.Equal(t, http.StatusUnauthorized, saveRule(handler, "127.0.0.1:1234", nil))
+	assert.Equal(t, http.StatusUnauthorized, saveRule(handler, "8.8.8.8:1234", map[string]string{"Authorization": "Bearer wrong"}))
+	assert.Equal(t, http.StatusOK, saveRule(handler, "8.8.8.8:1234", map[string]string{"Authorization": "Bearer secret"}))
+	assert.Equal(t, 3, len(disableMiddleware.ListRules()))
+
+	for _, path := range []string{"/api/list_cache_entries", "/api/purge_cache", "/api/flush_cache", "/api/client_usage", "/api/export_client_usage"} {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+		request.RemoteAddr = "8.8.8.8:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	}
+}
@@ -1,30 +1,126 @@
 package disable
 
 import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/config"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
 )
 
+var log = utils.GetLogger("disable")
+
+const defaultDisabledErrorMessage = "disabled rpc method"
+
 /**
- * DisableMiddleware is a middleware which can disable some jsonrpc methods
+ * DisableMiddleware is a middleware which can disable some jsonrpc methods.
+ * besides the exact name blacklist, rules can match methods by glob or regex, params values,
+ * time windows, client ips and api keys, and can be edited at runtime
  */
 type DisableMiddleware struct {
 	plugin.MiddlewareAdapter
 	next                plugin.Middleware
 	rpcMethodsBlacklist map[string]interface{}
+	rules               []*DisableRule
+	apiKeyHeader        string
+	ruleIdSeq           int
+	lock                sync.RWMutex
+	now                 func() time.Time
 }
 
 func NewDisableMiddleware() *DisableMiddleware {
 	return &DisableMiddleware{
 		rpcMethodsBlacklist: make(map[string]interface{}),
+		now:                 time.Now,
 	}
 }
 
 func (middleware *DisableMiddleware) AddRpcMethodToBlacklist(methodName string) *DisableMiddleware {
+	middleware.lock.Lock()
+	defer middleware.lock.Unlock()
 	middleware.rpcMethodsBlacklist[methodName] = true
 	return middleware
 }
 
+func (middleware *DisableMiddleware) SetApiKeyHeader(headerName string) *DisableMiddleware {
+	middleware.apiKeyHeader = headerName
+	return middleware
+}
+
+func (middleware *DisableMiddleware) nextRuleId() string {
+	for {
+		middleware.ruleIdSeq++
+		id := "rule-" + strconv.Itoa(middleware.ruleIdSeq)
+		if middleware.findRuleIndex(id) < 0 {
+			return id
+		}
+	}
+}
+
+func (middleware *DisableMiddleware) findRuleIndex(id string) int {
+	for i, rule := range middleware.rules {
+		if rule.Config.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ListRules returns copies of the configs of all disable rules in match order
+func (middleware *DisableMiddleware) ListRules() []*config.DisableRuleConfig {
+	middleware.lock.RLock()
+	defer middleware.lock.RUnlock()
+	result := make([]*config.DisableRuleConfig, 0, len(middleware.rules))
+	for _, rule := range middleware.rules {
+		result = append(result, copyRuleConfig(rule.Config))
+	}
+	return result
+}
+
+// SaveRule add a new rule, or replace the rule with the same id. an id is generated if the rule has no id.
+// the rule keeps its own copy of conf, and a copy of the saved config is returned.
+// rules saved or removed at runtime are not written back to the config file, they are lost on restart
+func (middleware *DisableMiddleware) SaveRule(conf *config.DisableRuleConfig) (result *config.DisableRuleConfig, err error) {
+	if conf == nil {
+		err = errors.New("empty disable rule")
+		return
+	}
+	conf = copyRuleConfig(conf)
+	rule, err := NewDisableRule(conf)
+	if err != nil {
+		return
+	}
+	middleware.lock.Lock()
+	defer middleware.lock.Unlock()
+	if len(conf.Id) < 1 {
+		conf.Id = middleware.nextRuleId()
+	}
+	if index := middleware.findRuleIndex(conf.Id); index >= 0 {
+		middleware.rules[index] = rule
+	} else {
+		middleware.rules = append(middleware.rules, rule)
+	}
+	result = copyRuleConfig(conf)
+	return
+}
+
+// RemoveRule remove the rule by id, returns false if not found
+func (middleware *DisableMiddleware) RemoveRule(id string) bool {
+	middleware.lock.Lock()
+	defer middleware.lock.Unlock()
+	index := middleware.findRuleIndex(id)
+	if index < 0 {
+		return false
+	}
+	middleware.rules = append(middleware.rules[:index], middleware.rules[index+1:]...)
+	return true
+}
+
 func (middleware *DisableMiddleware) Name() string {
 	return "disable"
 }
@@ -34,6 +130,24 @@ func (middleware *DisableMiddleware) isDisabledRpcMethod(methodName string) bool
 	return ok
 }
 
+// matchRule returns the first rule disabling the rpc request, nil if not disabled by rules
+func (middleware *DisableMiddleware) matchRule(session *rpc.JSONRpcRequestSession) *DisableRule {
+	if len(middleware.rules) < 1 {
+		return nil
+	}
+	rpcRequest := session.Request
+	connSession := session.Conn
+	clientIp := pluginsCommon.GetClientIp(connSession)
+	apiKey := pluginsCommon.GetApiKey(connSession, middleware.apiKeyHeader)
+	now := middleware.now()
+	for _, rule := range middleware.rules {
+		if rule.Match(rpcRequest.Method, rpcRequest.Params, clientIp, apiKey, now) {
+			return rule
+		}
+	}
+	return nil
+}
+
 func (middleware *DisableMiddleware) OnStart() (err error) {
 	return middleware.NextOnStart()
 }
@@ -52,8 +166,28 @@ func (middleware *DisableMiddleware) OnWebSocketFrame(session *rpc.JSONRpcReques
 }
 func (middleware *DisableMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
 	rpcRequest := session.Request
-	if middleware.isDisabledRpcMethod(rpcRequest.Method) {
-		response := rpc.NewJSONRpcResponse(rpcRequest.Id, nil, rpc.NewJSONRpcResponseError(rpc.RPC_DISABLED_RPC_METHOD, "disabled rpc method", nil))
+	middleware.lock.RLock()
+	disabledByName := middleware.isDisabledRpcMethod(rpcRequest.Method)
+	var rule *DisableRule
+	if !disabledByName {
+		rule = middleware.matchRule(session)
+	}
+	middleware.lock.RUnlock()
+	if disabledByName {
+		response := rpc.NewJSONRpcResponse(rpcRequest.Id, nil, rpc.NewJSONRpcResponseError(rpc.RPC_DISABLED_RPC_METHOD, defaultDisabledErrorMessage, nil))
+		session.FillRpcResponse(response)
+		return
+	}
+	if rule != nil {
+		errorCode := rule.Config.ErrorCode
+		if errorCode == 0 {
+			errorCode = rpc.RPC_DISABLED_RPC_METHOD
+		}
+		errorMessage := rule.Config.ErrorMessage
+		if len(errorMessage) < 1 {
+			errorMessage = defaultDisabledErrorMessage
+		}
+		response := rpc.NewJSONRpcResponse(rpcRequest.Id, nil, rpc.NewJSONRpcResponseError(errorCode, errorMessage, nil))
 		session.FillRpcResponse(response)
 		return
 	}
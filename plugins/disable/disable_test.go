@@ -1 +1,121 @@
 package disable
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func mockRpcRequestSession(remoteAddr string, apiKey string, method string, paramsJson string) *rpc.JSONRpcRequestSession {
+	connSession := rpc.NewConnectionSession()
+	connSession.Info.RemoteAddr = remoteAddr
+	connSession.Info.Headers = http.Header{}
+	if len(apiKey) > 0 {
+		connSession.Info.Headers.Set("X-Api-Key", apiKey)
+	}
+	var params interface{}
+	if len(paramsJson) > 0 {
+		_ = json.Unmarshal([]byte(paramsJson), &params)
+	}
+	reqSess := rpc.NewJSONRpcRequestSession(connSession)
+	reqSess.FillRpcRequest(&rpc.JSONRpcRequest{Id: 1, JSONRpc: "2.0", Method: method, Params: params}, nil)
+	return reqSess
+}
+
+func disabledCode(t *testing.T, m *DisableMiddleware, reqSess *rpc.JSONRpcRequestSession) int {
+	err := m.OnRpcRequest(reqSess)
+	assert.True(t, err == nil)
+	if reqSess.Response == nil {
+		return 0
+	}
+	return reqSess.Response.Error.Code
+}
+
+func TestDisableMethodPatternsAndParams(t *testing.T) {
+	m := NewDisableMiddleware().AddRpcMethodToBlacklist("eth_sign")
+	_, err := m.SaveRule(&config.DisableRuleConfig{
+		Methods: []string{"admin_*"},
+	})
+	assert.True(t, err == nil)
+	_, err = m.SaveRule(&config.DisableRuleConfig{
+		MethodRegex:  "^(call|invoke)$",
+		Params:       []config.ValueMatcherConfig{{Path: "0", Equals: "dangerousMethod"}},
+		ErrorCode:    12345,
+		ErrorMessage: "dangerousMethod is not allowed",
+	})
+	assert.True(t, err == nil)
+
+	assert.Equal(t, rpc.RPC_DISABLED_RPC_METHOD, disabledCode(t, m, mockRpcRequestSession("1.2.3.4:100", "", "eth_sign", "")))
+	assert.Equal(t, rpc.RPC_DISABLED_RPC_METHOD, disabledCode(t, m, mockRpcRequestSession("1.2.3.4:100", "", "admin_peers", "")))
+	assert.Equal(t, 0, disabledCode(t, m, mockRpcRequestSession("1.2.3.4:100", "", "eth_call", "")))
+	reqSess := mockRpcRequestSession("1.2.3.4:100", "", "call", `["dangerousMethod", 1]`)
+	assert.Equal(t, 12345, disabledCode(t, m, reqSess))
+	assert.Equal(t, "dangerousMethod is not allowed", reqSess.Response.Error.Message)
+	assert.Equal(t, 0, disabledCode(t, m, mockRpcRequestSession("1.2.3.4:100", "", "call", `["safeMethod", 1]`)))
+
+	_, err = m.SaveRule(&config.DisableRuleConfig{})
+	assert.True(t, err != nil)
+}
+
+func TestDisableScheduleAndScope(t *testing.T) {
+	m := NewDisableMiddleware()
+	m.now = func() time.Time {
+		return time.Date(2020, 1, 1, 23, 30, 0, 0, time.UTC)
+	}
+	rule, err := m.SaveRule(&config.DisableRuleConfig{
+		Methods:   []string{"eth_getLogs"},
+		Schedules: []config.DisableScheduleConfig{{DailyStart: "23:00", DailyEnd: "01:00"}},
+		Clients:   []string{"10.0.0.0/8"},
+	})
+	assert.True(t, err == nil)
+	assert.Equal(t, "rule-1", rule.Id)
+	_, err = m.SaveRule(&config.DisableRuleConfig{
+		Methods: []string{"eth_sendRawTransaction"},
+		ApiKeys: []string{"free-tier"},
+	})
+	assert.True(t, err == nil)
+
+	assert.Equal(t, rpc.RPC_DISABLED_RPC_METHOD, disabledCode(t, m, mockRpcRequestSession("10.1.1.1:100", "", "eth_getLogs", "")))
+	assert.Equal(t, 0, disabledCode(t, m, mockRpcRequestSession("8.8.8.8:100", "", "eth_getLogs", "")))
+	assert.Equal(t, rpc.RPC_DISABLED_RPC_METHOD, disabledCode(t, m, mockRpcRequestSession("8.8.8.8:100", "free-tier", "eth_sendRawTransaction", "")))
+	assert.Equal(t, 0, disabledCode(t, m, mockRpcRequestSession("8.8.8.8:100", "paid", "eth_sendRawTransaction", "")))
+
+	m.now = func() time.Time {
+		return time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC)
+	}
+	assert.Equal(t, 0, disabledCode(t, m, mockRpcRequestSession("10.1.1.1:100", "", "eth_getLogs", "")))
+
+	assert.True(t, m.RemoveRule("rule-2"))
+	assert.False(t, m.RemoveRule("rule-2"))
+	assert.Equal(t, 1, len(m.ListRules()))
+	assert.Equal(t, 0, disabledCode(t, m, mockRpcRequestSession("8.8.8.8:100", "free-tier", "eth_sendRawTransaction", "")))
+}
+
+func TestDisableRulesAreCopied(t *testing.T) {
+	m := NewDisableMiddleware()
+	conf := &config.DisableRuleConfig{
+		Methods: []string{"eth_sign"},
+		Params:  []config.ValueMatcherConfig{{Path: "0", Equals: map[string]interface{}{"to": "0x1"}}},
+	}
+	saved, err := m.SaveRule(conf)
+	assert.True(t, err == nil)
+	assert.Equal(t, "", conf.Id)
+	saved.Methods[0] = "changed"
+	conf.Methods[0] = "changed"
+	conf.Params[0].Equals.(map[string]interface{})["to"] = "0x2"
+
+	listed := m.ListRules()
+	assert.Equal(t, 1, len(listed))
+	assert.Equal(t, "eth_sign", listed[0].Methods[0])
+	assert.Equal(t, "0x1", listed[0].Params[0].Equals.(map[string]interface{})["to"])
+	listed[0].Methods[0] = "changed"
+	listed[0].Id = "changed"
+	assert.Equal(t, "eth_sign", m.ListRules()[0].Methods[0])
+	assert.Equal(t, "rule-1", m.ListRules()[0].Id)
+	assert.Equal(t, rpc.RPC_DISABLED_RPC_METHOD, disabledCode(t, m, mockRpcRequestSession("1.2.3.4:100", "", "eth_sign", `[{"to": "0x1"}]`)))
+}
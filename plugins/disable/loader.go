@@ -5,13 +5,23 @@ import (
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
 )
 
-func LoadDisablePluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
+// LoadDisablePluginConfig load disable plugin when started, even without rules so rules can be added at runtime
+func LoadDisablePluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) *DisableMiddleware {
 	disablePluginConf := configInfo.Plugins.Disable
-	if disablePluginConf.Start && len(disablePluginConf.DisabledRpcMethods) > 0 {
-		disableMiddleware := NewDisableMiddleware()
-		for _, item := range disablePluginConf.DisabledRpcMethods {
-			disableMiddleware.AddRpcMethodToBlacklist(item)
+	if !disablePluginConf.Start {
+		return nil
+	}
+	disableMiddleware := NewDisableMiddleware().
+		SetApiKeyHeader(disablePluginConf.ApiKeyHeader)
+	for _, item := range disablePluginConf.DisabledRpcMethods {
+		disableMiddleware.AddRpcMethodToBlacklist(item)
+	}
+	for _, ruleConf := range disablePluginConf.Rules {
+		if _, err := disableMiddleware.SaveRule(ruleConf); err != nil {
+			log.Fatalln("invalid disable rule", err)
+			return nil
 		}
-		chain.InsertHead(disableMiddleware)
 	}
+	chain.InsertHead(disableMiddleware)
+	return disableMiddleware
 }
@@ -0,0 +1,234 @@
+package disable
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+// schedule is a time window, absolute range and daily window are both checked if set
+type schedule struct {
+	start      *time.Time
+	end        *time.Time
+	daily      bool
+	dailyStart int // minutes of the day
+	dailyEnd   int
+	location   *time.Location
+}
+
+func (s *schedule) contains(now time.Time) bool {
+	if s.start != nil && now.Before(*s.start) {
+		return false
+	}
+	if s.end != nil && !now.Before(*s.end) {
+		return false
+	}
+	if !s.daily {
+		return true
+	}
+	local := now.In(s.location)
+	minutes := local.Hour()*60 + local.Minute()
+	if s.dailyStart <= s.dailyEnd {
+		return minutes >= s.dailyStart && minutes < s.dailyEnd
+	}
+	// window crossing midnight, eg. 23:00 - 01:00
+	return minutes >= s.dailyStart || minutes < s.dailyEnd
+}
+
+func parseMinutesOfDay(value string) (minutes int, err error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 {
+		err = fmt.Errorf("invalid daily time %s, expected HH:MM", value)
+		return
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		err = fmt.Errorf("invalid daily time %s, expected HH:MM", value)
+		return
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 || (hour == 24 && minute > 0) {
+		err = fmt.Errorf("invalid daily time %s, expected HH:MM", value)
+		return
+	}
+	minutes = hour*60 + minute
+	return
+}
+
+func newSchedule(conf *config.DisableScheduleConfig) (result *schedule, err error) {
+	result = &schedule{}
+	if len(conf.Start) > 0 {
+		start, parseErr := time.Parse(time.RFC3339, conf.Start)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		result.start = &start
+	}
+	if len(conf.End) > 0 {
+		end, parseErr := time.Parse(time.RFC3339, conf.End)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		result.end = &end
+	}
+	if len(conf.DailyStart) > 0 || len(conf.DailyEnd) > 0 {
+		if len(conf.DailyStart) < 1 || len(conf.DailyEnd) < 1 {
+			err = errors.New("daily_start and daily_end must be set together")
+			return
+		}
+		result.daily = true
+		if result.dailyStart, err = parseMinutesOfDay(conf.DailyStart); err != nil {
+			return
+		}
+		if result.dailyEnd, err = parseMinutesOfDay(conf.DailyEnd); err != nil {
+			return
+		}
+		result.location = time.UTC
+		if len(conf.Timezone) > 0 {
+			if result.location, err = time.LoadLocation(conf.Timezone); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/**
+ * DisableRule disables the matched rpc calls. all conditions set in the rule must match
+ */
+type DisableRule struct {
+	Config      *config.DisableRuleConfig
+	methodRegex *regexp.Regexp
+	params      []*pluginsCommon.ValueMatcher
+	schedules   []*schedule
+	clients     utils.IpNetList
+	apiKeys     map[string]bool
+}
+
+// NewDisableRule compile the rule config. a rule must have methods or method_regex
+func NewDisableRule(conf *config.DisableRuleConfig) (rule *DisableRule, err error) {
+	if len(conf.Methods) < 1 && len(conf.MethodRegex) < 1 {
+		err = errors.New("disable rule must have methods or method_regex")
+		return
+	}
+	rule = &DisableRule{
+		Config: conf,
+	}
+	for _, pattern := range conf.Methods {
+		if _, err = path.Match(pattern, ""); err != nil {
+			err = fmt.Errorf("invalid method pattern %s: %s", pattern, err.Error())
+			return
+		}
+	}
+	if len(conf.MethodRegex) > 0 {
+		if rule.methodRegex, err = regexp.Compile(conf.MethodRegex); err != nil {
+			return
+		}
+	}
+	if rule.params, err = pluginsCommon.NewValueMatchers(conf.Params); err != nil {
+		return
+	}
+	for i := range conf.Schedules {
+		s, scheduleErr := newSchedule(&conf.Schedules[i])
+		if scheduleErr != nil {
+			err = scheduleErr
+			return
+		}
+		rule.schedules = append(rule.schedules, s)
+	}
+	if rule.clients, err = utils.ParseIpNetList(conf.Clients); err != nil {
+		return
+	}
+	if len(conf.ApiKeys) > 0 {
+		rule.apiKeys = make(map[string]bool)
+		for _, key := range conf.ApiKeys {
+			rule.apiKeys[key] = true
+		}
+	}
+	return
+}
+
+func (rule *DisableRule) matchMethod(methodName string) bool {
+	for _, pattern := range rule.Config.Methods {
+		if matched, _ := path.Match(pattern, methodName); matched {
+			return true
+		}
+	}
+	return rule.methodRegex != nil && rule.methodRegex.MatchString(methodName)
+}
+
+func (rule *DisableRule) inSchedule(now time.Time) bool {
+	if len(rule.schedules) < 1 {
+		return true
+	}
+	for _, s := range rule.schedules {
+		if s.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match check whether the rpc call of {clientIp} with {apiKey} should be disabled by this rule at {now}
+func (rule *DisableRule) Match(methodName string, params interface{}, clientIp string, apiKey string, now time.Time) bool {
+	if !rule.matchMethod(methodName) {
+		return false
+	}
+	if !pluginsCommon.MatchAllValueMatchers(rule.params, params) {
+		return false
+	}
+	if !rule.inSchedule(now) {
+		return false
+	}
+	if len(rule.clients) > 0 && !rule.clients.Contains(utils.HostOfAddr(clientIp)) {
+		return false
+	}
+	if rule.apiKeys != nil && !rule.apiKeys[apiKey] {
+		return false
+	}
+	return true
+}
+
+// copyRuleConfig deep copies a rule config, so configs handed out or taken in never share state with the running rules
+func copyRuleConfig(conf *config.DisableRuleConfig) *config.DisableRuleConfig {
+	result := *conf
+	result.Methods = append([]string(nil), conf.Methods...)
+	result.Schedules = append([]config.DisableScheduleConfig(nil), conf.Schedules...)
+	result.Clients = append([]string(nil), conf.Clients...)
+	result.ApiKeys = append([]string(nil), conf.ApiKeys...)
+	result.Params = nil
+	for _, matcher := range conf.Params {
+		matcher.Equals = copyJsonValue(matcher.Equals)
+		result.Params = append(result.Params, matcher)
+	}
+	return &result
+}
+
+func copyJsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[key] = copyJsonValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = copyJsonValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
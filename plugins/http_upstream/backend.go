@@ -8,6 +8,7 @@ import (
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
 	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
 	"io/ioutil"
 	"net/http"
@@ -87,8 +88,17 @@ func (m *HttpUpstreamMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession
 	}
 	log.Debugln("rpc request " + string(rpcRequestBytes))
 
+	session.UpstreamSentAt = time.Now()
+	upstreamSpan := pluginsCommon.StartUpstreamSpan(session, targetEndpoint)
 	httpRpcCall := func() (rpcRes *rpc.JSONRpcResponse, err error) {
-		resp, err := http.Post(targetEndpoint, "application/json", bytes.NewReader(rpcRequestBytes))
+		httpReq, err := http.NewRequest(http.MethodPost, targetEndpoint, bytes.NewReader(rpcRequestBytes))
+		if err != nil {
+			return
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		// propagate the trace context to the upstream
+		httpReq.Header.Set(tracing.TraceparentHeader, upstreamSpan.SpanContext().Traceparent())
+		resp, err := http.DefaultClient.Do(httpReq)
 		if err != nil {
 			log.Debugln("http rpc response error", err.Error())
 			errResp := rpc.NewJSONRpcResponse(rpcRequest.Id, nil,
@@ -156,6 +166,11 @@ func (m *HttpUpstreamMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSe
 	}
 
 	var rpcRes *rpc.JSONRpcResponse
+	pluginsCommon.UpstreamRequestStarted(session.TargetServer)
+	defer func() {
+		pluginsCommon.UpstreamRequestFinished(session.TargetServer, rpcRes)
+		pluginsCommon.EndUpstreamSpan(session, rpcRes)
+	}()
 	select {
 	case <-time.After(m.options.upstreamTimeout):
 		rpcRes = rpc.NewJSONRpcResponse(rpcRequestId, nil,
@@ -166,7 +181,7 @@ func (m *HttpUpstreamMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSe
 			rpc.NewJSONRpcResponseError(rpc.RPC_UPSTREAM_CONNECTION_CLOSED_ERROR,
 				"upstream target connection closed", nil))
 	case rpcRes = <-requestChan:
-		// do nothing, just receive rpcRes
+		session.UpstreamRecvAt = time.Now()
 	}
 	session.Response = rpcRes
 	return
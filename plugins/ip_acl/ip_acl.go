@@ -0,0 +1,144 @@
+package ip_acl
+
+import (
+	"fmt"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"net"
+	"net/http"
+)
+
+var log = utils.GetLogger("ip_acl")
+
+// MethodRule restricts some rpc methods to be called only from some ip ranges
+type MethodRule struct {
+	Methods []string
+	Allow   utils.IpNetList
+}
+
+/**
+ * IpAclMiddleware is a middleware which allow or deny connections and rpc methods by client ip
+ */
+type IpAclMiddleware struct {
+	plugin.MiddlewareAdapter
+	allowList      utils.IpNetList
+	denyList       utils.IpNetList
+	trustedProxies utils.IpNetList
+	methodRules    map[string]*MethodRule // rpc method name => rule
+}
+
+func NewIpAclMiddleware() *IpAclMiddleware {
+	return &IpAclMiddleware{
+		methodRules: make(map[string]*MethodRule),
+	}
+}
+
+func (middleware *IpAclMiddleware) SetAllowList(list utils.IpNetList) *IpAclMiddleware {
+	middleware.allowList = list
+	return middleware
+}
+
+func (middleware *IpAclMiddleware) SetDenyList(list utils.IpNetList) *IpAclMiddleware {
+	middleware.denyList = list
+	return middleware
+}
+
+func (middleware *IpAclMiddleware) SetTrustedProxies(list utils.IpNetList) *IpAclMiddleware {
+	middleware.trustedProxies = list
+	return middleware
+}
+
+func (middleware *IpAclMiddleware) AddMethodRule(rule *MethodRule) *IpAclMiddleware {
+	for _, methodName := range rule.Methods {
+		middleware.methodRules[methodName] = rule
+	}
+	return middleware
+}
+
+func (middleware *IpAclMiddleware) Name() string {
+	return "ip_acl"
+}
+
+// clientIp returns the real client ip of the connection, nil if the provider didn't fill the remote address
+func (middleware *IpAclMiddleware) clientIp(session *rpc.ConnectionSession) net.IP {
+	if clientIp, ok := session.Attributes.GetString(rpc.ATTR_CLIENT_IP); ok {
+		return net.ParseIP(clientIp)
+	}
+	info := session.Info
+	if info == nil || len(info.RemoteAddr) < 1 {
+		return nil
+	}
+	ip := utils.ResolveClientIp(info.RemoteAddr, info.Headers, middleware.trustedProxies)
+	if ip != nil {
+		session.Attributes.Set(rpc.ATTR_CLIENT_IP, ip.String())
+	}
+	return ip
+}
+
+// ResolveClientIp saves the real client ip to the connection before the connection limits are checked
+func (middleware *IpAclMiddleware) ResolveClientIp(session *rpc.ConnectionSession) {
+	middleware.clientIp(session)
+}
+
+func (middleware *IpAclMiddleware) isAllowedIp(ip net.IP) bool {
+	if ip == nil {
+		// can't check a connection without remote address, only allow it when no allow list
+		return len(middleware.allowList) < 1
+	}
+	if middleware.denyList.Contains(ip) {
+		return false
+	}
+	if len(middleware.allowList) > 0 && !middleware.allowList.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+func (middleware *IpAclMiddleware) isAllowedRpcMethod(ip net.IP, methodName string) bool {
+	rule, ok := middleware.methodRules[methodName]
+	if !ok {
+		return true
+	}
+	return rule.Allow.Contains(ip)
+}
+
+func (middleware *IpAclMiddleware) OnStart() (err error) {
+	return middleware.NextOnStart()
+}
+
+func (middleware *IpAclMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
+	ip := middleware.clientIp(session)
+	if !middleware.isAllowedIp(ip) {
+		err = rpc.NewConnectionRejectedError(http.StatusForbidden, rpc.RPC_ACCESS_DENIED, fmt.Sprintf("ip %s is not allowed", ip))
+		return
+	}
+	return middleware.NextOnConnection(session)
+}
+
+func (middleware *IpAclMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnectionClosed(session)
+}
+
+func (middleware *IpAclMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession,
+	messageType int, message []byte) (err error) {
+	return middleware.NextOnWebSocketFrame(session, messageType, message)
+}
+func (middleware *IpAclMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	rpcRequest := session.Request
+	ip := middleware.clientIp(session.Conn)
+	if !middleware.isAllowedRpcMethod(ip, rpcRequest.Method) {
+		log.Warnf("rpc method %s denied for ip %s", rpcRequest.Method, ip)
+		response := rpc.NewJSONRpcResponse(rpcRequest.Id, nil, rpc.NewJSONRpcResponseError(rpc.RPC_ACCESS_DENIED, "access denied", nil))
+		session.FillRpcResponse(response)
+		return
+	}
+	return middleware.NextOnJSONRpcRequest(session)
+}
+func (middleware *IpAclMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextOnJSONRpcResponse(session)
+}
+
+func (middleware *IpAclMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextProcessJSONRpcRequest(session)
+}
@@ -0,0 +1,82 @@
+package ip_acl
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"net/http"
+	"testing"
+)
+
+func mustParseIpNetList(t *testing.T, items ...string) utils.IpNetList {
+	list, err := utils.ParseIpNetList(items)
+	assert.True(t, err == nil)
+	return list
+}
+
+func mockRpcConnection(remoteAddr string, header http.Header) *rpc.ConnectionSession {
+	sess := rpc.NewConnectionSession()
+	if header == nil {
+		header = http.Header{}
+	}
+	sess.Info.RemoteAddr = remoteAddr
+	sess.Info.Headers = header
+	return sess
+}
+
+func TestResolveClientIp(t *testing.T) {
+	trusted := mustParseIpNetList(t, "10.0.0.0/8")
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.0.0.2")
+
+	// untrusted peer can't forge its address
+	assert.Equal(t, "192.168.1.3", utils.ResolveClientIp("192.168.1.3:5000", header, trusted).String())
+	// trusted peer, rightmost untrusted item is the client
+	assert.Equal(t, "5.6.7.8", utils.ResolveClientIp("10.0.0.1:5000", header, trusted).String())
+
+	realIpHeader := http.Header{}
+	realIpHeader.Set("X-Real-IP", "8.8.8.8")
+	assert.Equal(t, "8.8.8.8", utils.ResolveClientIp("10.0.0.1:5000", realIpHeader, trusted).String())
+	assert.Equal(t, "::1", utils.ResolveClientIp("[::1]:5000", nil, trusted).String())
+}
+
+func TestIpAclMiddlewareOnConnection(t *testing.T) {
+	m := NewIpAclMiddleware().
+		SetAllowList(mustParseIpNetList(t, "192.168.0.0/16", "127.0.0.1")).
+		SetDenyList(mustParseIpNetList(t, "192.168.2.0/24"))
+
+	assert.True(t, m.OnConnection(mockRpcConnection("127.0.0.1:1234", nil)) == nil)
+	assert.True(t, m.OnConnection(mockRpcConnection("192.168.1.10:1234", nil)) == nil)
+	assert.True(t, m.OnConnection(mockRpcConnection("192.168.2.10:1234", nil)) != nil)
+	err := m.OnConnection(mockRpcConnection("8.8.8.8:1234", nil))
+	rejectedErr, ok := err.(*rpc.ConnectionRejectedError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusForbidden, rejectedErr.HttpStatus)
+	assert.Equal(t, rpc.RPC_ACCESS_DENIED, rejectedErr.Code)
+}
+
+func TestIpAclMiddlewareMethodRule(t *testing.T) {
+	m := NewIpAclMiddleware().AddMethodRule(&MethodRule{
+		Methods: []string{"admin_stop"},
+		Allow:   mustParseIpNetList(t, "10.0.0.0/8"),
+	})
+	for _, item := range []struct {
+		remoteAddr string
+		method     string
+		denied     bool
+	}{
+		{"10.1.2.3:1234", "admin_stop", false},
+		{"8.8.8.8:1234", "admin_stop", true},
+		{"8.8.8.8:1234", "eth_blockNumber", false},
+	} {
+		reqSess := rpc.NewJSONRpcRequestSession(mockRpcConnection(item.remoteAddr, nil))
+		reqSess.FillRpcRequest(&rpc.JSONRpcRequest{Id: 1, JSONRpc: "2.0", Method: item.method}, nil)
+		err := m.OnRpcRequest(reqSess)
+		assert.True(t, err == nil)
+		if item.denied {
+			assert.True(t, reqSess.Response != nil && reqSess.Response.Error.Code == rpc.RPC_ACCESS_DENIED)
+		} else {
+			assert.True(t, reqSess.Response == nil)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package ip_acl
+
+import (
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+func LoadIpAclPluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
+	ipAclPluginConf := configInfo.Plugins.IpAcl
+	if !ipAclPluginConf.Start {
+		return
+	}
+	allowList, err := utils.ParseIpNetList(ipAclPluginConf.Allow)
+	if err != nil {
+		log.Fatalln("invalid ip_acl allow list", err)
+		return
+	}
+	denyList, err := utils.ParseIpNetList(ipAclPluginConf.Deny)
+	if err != nil {
+		log.Fatalln("invalid ip_acl deny list", err)
+		return
+	}
+	trustedProxies, err := utils.ParseIpNetList(ipAclPluginConf.TrustedProxies)
+	if err != nil {
+		log.Fatalln("invalid ip_acl trusted proxies", err)
+		return
+	}
+	ipAclMiddleware := NewIpAclMiddleware().
+		SetAllowList(allowList).
+		SetDenyList(denyList).
+		SetTrustedProxies(trustedProxies)
+	for _, ruleConf := range ipAclPluginConf.MethodRules {
+		ruleAllowList, ruleErr := utils.ParseIpNetList(ruleConf.Allow)
+		if ruleErr != nil {
+			log.Fatalln("invalid ip_acl method rule allow list", ruleErr)
+			return
+		}
+		ipAclMiddleware.AddMethodRule(&MethodRule{
+			Methods: ruleConf.Methods,
+			Allow:   ruleAllowList,
+		})
+	}
+	chain.InsertHead(ipAclMiddleware)
+}
@@ -3,6 +3,7 @@ package load_balancer
 import (
 	"errors"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
 )
@@ -76,7 +77,7 @@ func (middleware *LoadBalanceMiddleware) OnConnection(session *rpc.ConnectionSes
 		return
 	}
 	log.Debugf("selected upstream target item id#%d endpoint: %s\n", selectedTargetItem.Id, selectedTargetItem.TargetEndpoint)
-	session.SelectedUpstreamTarget = &selectedTargetItem.TargetEndpoint
+	_ = pluginsCommon.SetSelectedUpstreamTargetEndpoint(session, selectedTargetItem.TargetEndpoint)
 
 	return middleware.NextOnConnection(session)
 }
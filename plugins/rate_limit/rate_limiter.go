@@ -1,12 +1,20 @@
 package rate_limit
 
 import (
-	"errors"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"time"
 )
 
+var rejectedConnectionsCounter = metrics.NewCounter("jsonrpc_proxy_rate_limit_rejected_connections_total",
+	"connections rejected by rate_limit plugin")
+
+func init() {
+	metrics.MustRegister(rejectedConnectionsCounter)
+}
+
 type RateLimiterMiddleware struct {
 	plugin.MiddlewareAdapter
 	connLimiter Limiter
@@ -32,7 +40,8 @@ func (middleware *RateLimiterMiddleware) OnStart() (err error) {
 func (middleware *RateLimiterMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
 	taken := middleware.connLimiter.Take()
 	if !taken {
-		err = errors.New("rate limit exceed")
+		rejectedConnectionsCounter.Inc()
+		err = pluginsCommon.ErrRateLimitExceeded
 		return
 	}
 	return middleware.NextOnConnection(session)
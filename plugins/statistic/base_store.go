@@ -1,29 +1,57 @@
 package statistic
 
 import (
+	"context"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// cache stats are keyed by cache method names, which include params chosen by clients.
+// names out of the first maxCacheStatNames distinct names are counted as otherCacheStatName
+const (
+	maxCacheStatNames  = 500
+	otherCacheStatName = "other"
+)
+
 type BaseMetricStore struct {
 	MetricStore
 	globalRpcMethodsCount *utils.MemoryCache
 	globalRpcCallCount    uint64
 
-	hourlyLock            sync.RWMutex
-	hourlyStartTime       time.Time
-	hourlyRpcMethodsCount *utils.MemoryCache
-	hourlyRpcCallCount    uint64
+	// the hourly stat is the sliding last hour of minute rollups
+	rollups         *rollupAggregator
+	memoryRollups   *memoryRollups // rollups of stores without persistence
+	rollupRetention *RollupRetention
+
+	cacheStatLock sync.Mutex
+	cacheStat     map[string]*MethodCacheStat
+
+	methodLatency   *latencyStat // from received to response written
+	upstreamLatency *latencyStat // from sent to upstream to its response received
+
+	usage              *usageTable // added since the last flush
+	usageLimiter       *usageLimiter
+	memoryUsage        *usageTable // daily usage of stores without persistence
+	usageRetentionDays int
 }
 
 func (store *BaseMetricStore) Init() error {
 	store.globalRpcMethodsCount = utils.NewMemoryCache()
 	store.globalRpcCallCount = 0
-	store.hourlyStartTime = time.Now()
-	store.hourlyRpcMethodsCount = utils.NewMemoryCache()
-	store.hourlyRpcCallCount = 0
+	store.rollups = newRollupAggregator()
+	store.memoryRollups = newMemoryRollups()
+	if store.rollupRetention == nil {
+		store.rollupRetention = DefaultRollupRetention()
+	}
+	store.cacheStat = make(map[string]*MethodCacheStat)
+	store.methodLatency = newLatencyStat()
+	store.upstreamLatency = newLatencyStat()
+	store.usage = newUsageTable()
+	store.usageLimiter = newUsageLimiter()
+	store.memoryUsage = newUsageTable()
 	return nil
 }
 
@@ -47,22 +75,24 @@ func (store *BaseMetricStore) DumpStatInfo() (dump *StatData, err error) {
 	}
 	dump.GlobalRpcCallCount = store.globalRpcCallCount
 	// hourly
-	hourlyItems, err := store.hourlyRpcMethodsCount.DumpItems()
-	if err != nil {
-		return
-	}
-	for k, v := range hourlyItems {
-		objectInt, objectErr := v.ObjectAsInt64()
-		if objectErr != nil {
-			err = objectErr
-			return
-		}
+	now := time.Now()
+	hourlyCounts, hourlyTotal := store.rollups.recentCounts(ROLLUP_DIMENSION_METHOD, now)
+	for k, v := range hourlyCounts {
 		dump.HourlyStat[k] = &MethodCallCacheInfo{
-			Expiration: v.Expiration,
-			CallCount:  objectInt,
+			CallCount: v,
 		}
 	}
-	dump.HourlyRpcCallCount = store.hourlyRpcCallCount
+	dump.HourlyRpcCallCount = hourlyTotal
+	// latency
+	dump.MethodLatency = store.methodLatency.dump(now)
+	dump.UpstreamLatency = store.upstreamLatency.dump(now)
+	// cache
+	store.cacheStatLock.Lock()
+	defer store.cacheStatLock.Unlock()
+	for k, v := range store.cacheStat {
+		stat := *v
+		dump.CacheStat[k] = &stat
+	}
 	return
 }
 
@@ -81,30 +111,103 @@ func (store *BaseMetricStore) incrementGlobalRpcMethodCalledCount(methodName str
 	}
 }
 
-func (store *BaseMetricStore) incrementHourlyRpcMethodCalledCount(methodName string) {
-	store.hourlyLock.Lock()
-	defer store.hourlyLock.Unlock()
-	now := time.Now()
-	if now.Sub(store.hourlyStartTime) > 1*time.Hour {
-		store.hourlyStartTime = now
-		store.hourlyRpcMethodsCount.Flush() // delete all items
-		store.hourlyRpcCallCount = 0
+func (store *BaseMetricStore) AddRpcMethodCall(methodName string) {
+	store.incrementGlobalRpcMethodCalledCount(methodName)
+}
+
+// AddRpcMethodCacheResult count the cache result of the request, requests not cacheable are ignored
+func (store *BaseMetricStore) AddRpcMethodCacheResult(methodName string, reqSession *rpc.JSONRpcRequestSession) {
+	if !reqSession.ResponseSetByCache && !reqSession.CacheMissed {
+		return
 	}
-	_, ok := store.hourlyRpcMethodsCount.Get(methodName)
-	if ok {
-		_ = store.hourlyRpcMethodsCount.Increment(methodName, 1)
-	} else {
-		store.hourlyRpcMethodsCount.SetDefault(methodName, 1)
+	store.cacheStatLock.Lock()
+	defer store.cacheStatLock.Unlock()
+	stat, ok := store.cacheStat[methodName]
+	if !ok && len(store.cacheStat) >= maxCacheStatNames {
+		methodName = otherCacheStatName
+		stat, ok = store.cacheStat[methodName]
 	}
-	for {
-		newValue := store.hourlyRpcCallCount + 1
-		if atomic.AddUint64(&store.hourlyRpcCallCount, 1) == newValue {
-			break
-		}
+	if !ok {
+		stat = &MethodCacheStat{}
+		store.cacheStat[methodName] = stat
+	}
+	switch {
+	case reqSession.ResponseStale:
+		stat.Expired++
+	case reqSession.ResponseSetByCache:
+		stat.Hits++
+	default:
+		stat.Misses++
 	}
 }
 
-func (store *BaseMetricStore) addRpcMethodCall(methodName string) {
-	store.incrementGlobalRpcMethodCalledCount(methodName)
-	store.incrementHourlyRpcMethodCalledCount(methodName)
+// AddRpcLatency aggregate latencies of the written response by method and upstream, to the sliding windows and rollups
+func (store *BaseMetricStore) AddRpcLatency(methodName string, reqSession *rpc.JSONRpcRequestSession) {
+	if reqSession.ResponseWrittenAt.IsZero() {
+		return
+	}
+	store.rollups.addRequest(methodName, reqSession)
+	store.methodLatency.add(methodName, reqSession.ResponseWrittenAt, reqSession.Latency())
+	if !reqSession.UpstreamRecvAt.IsZero() && len(reqSession.TargetServer) > 0 {
+		store.upstreamLatency.add(reqSession.TargetServer, reqSession.UpstreamRecvAt, reqSession.UpstreamLatency())
+	}
+}
+
+func (store *BaseMetricStore) setRollupRetention(retention *RollupRetention) {
+	store.rollupRetention = retention
+}
+
+// TakeCompletedRollups returns the minute rollups ended before {now} not taken yet, for stores persisting rollups
+func (store *BaseMetricStore) TakeCompletedRollups(now time.Time) []*RollupPoint {
+	return store.rollups.takeCompleted(now)
+}
+
+// RestoreRollups puts back the minute rollups taken by TakeCompletedRollups but failed to persist
+func (store *BaseMetricStore) RestoreRollups(points []*RollupPoint) {
+	store.rollups.restore(points)
+}
+
+// FlushRollups keeps the completed rollups and their hourly and daily downsamples in memory, and removes expired ones
+func (store *BaseMetricStore) FlushRollups(ctx context.Context, now time.Time) error {
+	store.memoryRollups.save(downsampleRollups(store.TakeCompletedRollups(now)))
+	store.memoryRollups.prune(now, store.rollupRetention)
+	return nil
+}
+
+// QueryRollups returns the rollups kept in memory
+func (store *BaseMetricStore) QueryRollups(ctx context.Context, form *QueryRollupForm) ([]*RollupPoint, error) {
+	if err := form.normalize(time.Now()); err != nil {
+		return nil, err
+	}
+	return store.memoryRollups.query(form), nil
+}
+
+func (store *BaseMetricStore) setUsageRetentionDays(days int) {
+	store.usageRetentionDays = days
+}
+
+// AddClientUsage aggregates the usage until the next FlushClientUsage, clients and methods out of the daily caps are counted as "other"
+func (store *BaseMetricStore) AddClientUsage(usage *ClientUsageVo) {
+	store.usageLimiter.limit(usage)
+	store.usage.add(usage)
+}
+
+// TakeClientUsage returns the usage added since the last call, for stores persisting usage
+func (store *BaseMetricStore) TakeClientUsage() []*ClientUsageVo {
+	return store.usage.take()
+}
+
+// FlushClientUsage keeps the daily usage in memory, and removes usage out of retention
+func (store *BaseMetricStore) FlushClientUsage(ctx context.Context, now time.Time) error {
+	store.memoryUsage.add(store.TakeClientUsage()...)
+	store.memoryUsage.prune(usageRetentionStart(now, store.usageRetentionDays))
+	return nil
+}
+
+// QueryClientUsage returns the usage kept in memory
+func (store *BaseMetricStore) QueryClientUsage(ctx context.Context, form *QueryClientUsageForm) ([]*ClientUsageVo, error) {
+	if err := form.normalize(time.Now()); err != nil {
+		return nil, err
+	}
+	return groupClientUsage(store.memoryUsage.query(form), form), nil
 }
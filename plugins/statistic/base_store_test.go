@@ -0,0 +1,43 @@
+package statistic
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func TestBaseMetricStoreCacheStat(t *testing.T) {
+	store := NewDefaultMetricStore()
+	assert.True(t, store.Init() == nil)
+	newSession := func(hit bool, stale bool, missed bool) *rpc.JSONRpcRequestSession {
+		session := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+		session.ResponseSetByCache = hit
+		session.ResponseStale = stale
+		session.CacheMissed = missed
+		return session
+	}
+	store.AddRpcMethodCacheResult("eth_blockNumber", newSession(false, false, true))
+	store.AddRpcMethodCacheResult("eth_blockNumber", newSession(true, false, false))
+	store.AddRpcMethodCacheResult("eth_blockNumber", newSession(true, false, false))
+	store.AddRpcMethodCacheResult("eth_blockNumber", newSession(true, true, false))
+	store.AddRpcMethodCacheResult("eth_sendRawTransaction", newSession(false, false, false))
+
+	dump, err := store.DumpStatInfo()
+	assert.True(t, err == nil)
+	assert.Equal(t, &MethodCacheStat{Hits: 2, Misses: 1, Expired: 1}, dump.CacheStat["eth_blockNumber"])
+	_, ok := dump.CacheStat["eth_sendRawTransaction"]
+	assert.False(t, ok)
+
+	// cache names with client chosen params are capped
+	for i := 0; i < 2*maxCacheStatNames; i++ {
+		store.AddRpcMethodCacheResult("eth_getBalance$"+strconv.Itoa(i), newSession(false, false, true))
+	}
+	store.AddRpcMethodCacheResult("eth_blockNumber", newSession(true, false, false))
+	dump, err = store.DumpStatInfo()
+	assert.True(t, err == nil)
+	assert.Equal(t, maxCacheStatNames+1, len(dump.CacheStat))
+	assert.Equal(t, int64(maxCacheStatNames+1), dump.CacheStat[otherCacheStatName].Misses)
+	assert.Equal(t, int64(3), dump.CacheStat["eth_blockNumber"].Hits)
+}
@@ -7,11 +7,22 @@ type MethodCallCacheInfo struct {
 	CallCount  int64 `json:"callCount"`
 }
 
+// cache results of requests of a method
+type MethodCacheStat struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Expired int64 `json:"expired"` // requests served expired responses while refreshing
+}
+
 type StatData struct {
 	GlobalStat         map[string]*MethodCallCacheInfo `json:"globalStat"`
 	HourlyStat         map[string]*MethodCallCacheInfo `json:"hourlyStat"`
 	GlobalRpcCallCount uint64                          `json:"globalRpcCallCount"`
 	HourlyRpcCallCount uint64                          `json:"hourlyRpcCallCount"`
+	CacheStat          map[string]*MethodCacheStat     `json:"cacheStat"`
+	// latency percentiles by method(or upstream) and sliding window("1m", "5m", "15m")
+	MethodLatency   map[string]map[string]*LatencyPercentiles `json:"methodLatency"`
+	UpstreamLatency map[string]map[string]*LatencyPercentiles `json:"upstreamLatency"`
 
 	UpstreamServices []*registry.Service `json:"upstreamServices"`
 	Services         []*registry.Service `json:"services"`
@@ -23,6 +34,9 @@ func NewStatData() *StatData {
 		HourlyStat:         make(map[string]*MethodCallCacheInfo),
 		GlobalRpcCallCount: 0,
 		HourlyRpcCallCount: 0,
+		CacheStat:          make(map[string]*MethodCacheStat),
+		MethodLatency:      make(map[string]map[string]*LatencyPercentiles),
+		UpstreamLatency:    make(map[string]map[string]*LatencyPercentiles),
 		UpstreamServices:   make([]*registry.Service, 0),
 		Services:           make([]*registry.Service, 0),
 	}
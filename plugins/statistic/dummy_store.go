@@ -19,7 +19,7 @@ func (store *dummyMetricStore) LogRequest(ctx context.Context, reqSession *rpc.J
 
 }
 
-func (store *dummyMetricStore) logResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
+func (store *dummyMetricStore) LogResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
 
 }
 
@@ -35,6 +35,14 @@ func (store *dummyMetricStore) LogServiceDown(ctx context.Context, service *regi
 
 }
 
+func (store *dummyMetricStore) LogServiceStatus(ctx context.Context, service *registry.Service, up bool, reason string, at time.Time) {
+
+}
+
+func (store *dummyMetricStore) QueryServiceStatusLogs(ctx context.Context, from time.Time, to time.Time) ([]*ServiceLogVo, error) {
+	return make([]*ServiceLogVo, 0), nil
+}
+
 func (store *dummyMetricStore) QueryServiceDownLogs(ctx context.Context, offset int, limit int) (*ServiceLogListVo, error) {
 	list := &ServiceLogListVo{
 		Items: make([]*ServiceLogVo, 0),
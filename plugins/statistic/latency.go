@@ -0,0 +1,217 @@
+package statistic
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxLatencySamplesPerBucket = 256 // samples of a bucket are reservoir sampled over this count
+
+// names are method names chosen by clients. names out of the first maxLatencyStatNames distinct names
+// are counted as otherLatencyStatName, and names without requests in all windows are pruned every latencyStatPruneInterval
+const (
+	maxLatencyStatNames      = 500
+	otherLatencyStatName     = "other"
+	latencyStatPruneInterval = time.Minute
+)
+
+// sliding windows of latency percentiles, each window is split to buckets which expire one by one
+var latencyWindows = []struct {
+	name           string
+	bucketDuration time.Duration
+	buckets        int
+}{
+	{"1m", 10 * time.Second, 6},
+	{"5m", 30 * time.Second, 10},
+	{"15m", time.Minute, 15},
+}
+
+// latency percentiles(milliseconds) of requests in a sliding window
+type LatencyPercentiles struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+type latencyBucket struct {
+	index   int64 // unix time / bucket duration of the bucket's time range
+	count   int64
+	max     float64
+	samples []float64
+}
+
+func (b *latencyBucket) add(value float64) {
+	b.count++
+	if value > b.max {
+		b.max = value
+	}
+	if len(b.samples) < maxLatencySamplesPerBucket {
+		b.samples = append(b.samples, value)
+		return
+	}
+	if i := rand.Int63n(b.count); i < maxLatencySamplesPerBucket {
+		b.samples[i] = value
+	}
+}
+
+// slidingLatencyWindow keeps latency samples of the last {bucketDuration * len(buckets)}
+type slidingLatencyWindow struct {
+	bucketDuration time.Duration
+	buckets        []*latencyBucket
+}
+
+func newSlidingLatencyWindow(bucketDuration time.Duration, buckets int) *slidingLatencyWindow {
+	return &slidingLatencyWindow{
+		bucketDuration: bucketDuration,
+		buckets:        make([]*latencyBucket, buckets),
+	}
+}
+
+func (w *slidingLatencyWindow) bucketIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(w.bucketDuration)
+}
+
+func (w *slidingLatencyWindow) add(now time.Time, value float64) {
+	index := w.bucketIndex(now)
+	pos := int(index % int64(len(w.buckets)))
+	bucket := w.buckets[pos]
+	if bucket == nil || bucket.index != index {
+		bucket = &latencyBucket{index: index}
+		w.buckets[pos] = bucket
+	}
+	bucket.add(value)
+}
+
+// empty returns whether no requests in the window
+func (w *slidingLatencyWindow) empty(now time.Time) bool {
+	minIndex := w.bucketIndex(now) - int64(len(w.buckets)) + 1
+	for _, bucket := range w.buckets {
+		if bucket != nil && bucket.index >= minIndex && bucket.count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// percentiles returns nil if no samples in the window. percentiles are estimated by samples weighted by bucket counts
+func (w *slidingLatencyWindow) percentiles(now time.Time) *LatencyPercentiles {
+	type weightedSample struct {
+		value  float64
+		weight float64
+	}
+	minIndex := w.bucketIndex(now) - int64(len(w.buckets)) + 1
+	result := &LatencyPercentiles{}
+	var samples []weightedSample
+	for _, bucket := range w.buckets {
+		if bucket == nil || bucket.index < minIndex || len(bucket.samples) < 1 {
+			continue
+		}
+		result.Count += bucket.count
+		if bucket.max > result.Max {
+			result.Max = bucket.max
+		}
+		weight := float64(bucket.count) / float64(len(bucket.samples))
+		for _, value := range bucket.samples {
+			samples = append(samples, weightedSample{value: value, weight: weight})
+		}
+	}
+	if result.Count < 1 {
+		return nil
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].value < samples[j].value
+	})
+	quantile := func(q float64) float64 {
+		target := q * float64(result.Count)
+		var accumulated float64
+		for _, sample := range samples {
+			accumulated += sample.weight
+			if accumulated >= target {
+				return sample.value
+			}
+		}
+		return samples[len(samples)-1].value
+	}
+	result.P50 = quantile(0.5)
+	result.P90 = quantile(0.9)
+	result.P99 = quantile(0.99)
+	return result
+}
+
+// latencyStat aggregates latencies by name(method or upstream) in all sliding windows
+type latencyStat struct {
+	lock       sync.Mutex
+	windows    map[string][]*slidingLatencyWindow
+	lastPruned time.Time
+}
+
+func newLatencyStat() *latencyStat {
+	return &latencyStat{
+		windows: make(map[string][]*slidingLatencyWindow),
+	}
+}
+
+func (s *latencyStat) add(name string, now time.Time, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.lastPruned) >= latencyStatPruneInterval {
+		s.prune(now)
+	}
+	windows, ok := s.windows[name]
+	if !ok && len(s.windows) >= maxLatencyStatNames {
+		name = otherLatencyStatName
+		windows, ok = s.windows[name]
+	}
+	if !ok {
+		for _, conf := range latencyWindows {
+			windows = append(windows, newSlidingLatencyWindow(conf.bucketDuration, conf.buckets))
+		}
+		s.windows[name] = windows
+	}
+	value := float64(latency) / float64(time.Millisecond)
+	for _, w := range windows {
+		w.add(now, value)
+	}
+}
+
+// prune removes names without requests in all windows
+func (s *latencyStat) prune(now time.Time) {
+	s.lastPruned = now
+	for name, windows := range s.windows {
+		empty := true
+		for _, w := range windows {
+			if !w.empty(now) {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			delete(s.windows, name)
+		}
+	}
+}
+
+// dump returns percentiles by name and window name, names without requests in all windows are removed
+func (s *latencyStat) dump(now time.Time) map[string]map[string]*LatencyPercentiles {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make(map[string]map[string]*LatencyPercentiles)
+	for name, windows := range s.windows {
+		byWindow := make(map[string]*LatencyPercentiles)
+		for i, w := range windows {
+			if p := w.percentiles(now); p != nil {
+				byWindow[latencyWindows[i].name] = p
+			}
+		}
+		if len(byWindow) < 1 {
+			delete(s.windows, name)
+			continue
+		}
+		result[name] = byWindow
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package statistic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func TestSlidingLatencyWindow(t *testing.T) {
+	w := newSlidingLatencyWindow(10*time.Second, 6)
+	now := time.Unix(1600000000, 0)
+	for i := 1; i <= 100; i++ {
+		w.add(now, float64(i))
+	}
+	p := w.percentiles(now)
+	assert.Equal(t, int64(100), p.Count)
+	assert.Equal(t, float64(50), p.P50)
+	assert.Equal(t, float64(90), p.P90)
+	assert.Equal(t, float64(99), p.P99)
+	assert.Equal(t, float64(100), p.Max)
+
+	// samples of a bucket are limited but weighted by the bucket's count
+	later := now.Add(20 * time.Second)
+	for i := 0; i < 10000; i++ {
+		w.add(later, 1000)
+	}
+	p = w.percentiles(later)
+	assert.Equal(t, int64(10100), p.Count)
+	assert.Equal(t, float64(1000), p.P50)
+
+	// buckets out of the window expire
+	assert.Equal(t, int64(10000), w.percentiles(now.Add(65*time.Second)).Count)
+	assert.True(t, w.percentiles(now.Add(100*time.Second)) == nil)
+}
+
+func TestLatencyStatLimits(t *testing.T) {
+	s := newLatencyStat()
+	now := time.Unix(1600000000, 0)
+	for i := 0; i < maxLatencyStatNames+100; i++ {
+		s.add(fmt.Sprintf("method_%d", i), now, time.Millisecond)
+	}
+	// names over the limit are counted as other, without dump
+	assert.Equal(t, maxLatencyStatNames+1, len(s.windows))
+	other := s.windows[otherLatencyStatName]
+	assert.NotNil(t, other)
+	assert.Equal(t, int64(100), other[0].percentiles(now).Count)
+
+	// names without requests in all windows are pruned when adding later
+	s.add("eth_call", now.Add(time.Hour), time.Millisecond)
+	assert.Equal(t, 1, len(s.windows))
+	assert.NotNil(t, s.windows["eth_call"])
+}
+
+func TestBaseMetricStoreLatency(t *testing.T) {
+	store := NewDefaultMetricStore()
+	now := time.Now()
+	session := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+	session.ReceivedAt = now
+	session.TargetServer = "ws://127.0.0.1:3000"
+	session.UpstreamSentAt = now.Add(time.Millisecond)
+	session.UpstreamRecvAt = now.Add(21 * time.Millisecond)
+	session.ResponseWrittenAt = now.Add(25 * time.Millisecond)
+	store.AddRpcLatency("eth_call", session)
+	// not written responses are ignored
+	store.AddRpcLatency("eth_blockNumber", rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession()))
+
+	dump, err := store.DumpStatInfo()
+	assert.True(t, err == nil)
+	assert.Equal(t, 1, len(dump.MethodLatency))
+	assert.Equal(t, float64(25), dump.MethodLatency["eth_call"]["1m"].P99)
+	assert.Equal(t, float64(20), dump.UpstreamLatency["ws://127.0.0.1:3000"]["15m"].P50)
+}
@@ -1,12 +1,17 @@
 package statistic
 
 import (
+	"time"
+
 	"github.com/zoowii/jsonrpc_proxygo/common"
 	"github.com/zoowii/jsonrpc_proxygo/config"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 )
 
+// defaultSqliteDbUrl is the db file of sqlite store if no dbUrl
+const defaultSqliteDbUrl = "file:jsonrpc_proxygo_statistic.db?_journal_mode=WAL&_busy_timeout=5000"
+
 func LoadStatisticPluginConfig(chain *plugin.MiddlewareChain,
 	configInfo *config.ServerConfig, r registry.Registry) (result *StatisticMiddleware) {
 	statisticPluginConf := configInfo.Plugins.Statistic
@@ -16,10 +21,90 @@ func LoadStatisticPluginConfig(chain *plugin.MiddlewareChain,
 			options = append(options, DumpInterval())
 			log.Info("statistic plugin load DumpInterval option")
 		}
-		if statisticPluginConf.Store.Type == metricDbStoreName && len(statisticPluginConf.Store.DbUrl) > 0 {
-			options = append(options, DbStore(statisticPluginConf.Store.DbUrl))
-			log.Info("statistic plugin load DbStore option")
+		storeConf := statisticPluginConf.Store
+		storeType := storeConf.Type
+		if len(storeType) < 1 {
+			storeType = STORE_TYPE_MEMORY
+		}
+		store, err := NewMetricStore(&StoreConfig{
+			Type:          storeType,
+			DbUrl:         storeConf.DbUrl,
+			Capacity:      storeConf.Capacity,
+			EventCapacity: storeConf.EventCapacity,
+		})
+		if err != nil {
+			log.Fatalln("invalid statistic store config", err)
+			return
+		}
+		options = append(options, UseStore(store))
+		log.Infof("statistic plugin load %s store option", store.Name())
+		if _, isSqlStore := dialectOfStoreType(storeType); isSqlStore {
+			writeOptions := DefaultDbWriteOptions()
+			if storeConf.BatchSize > 0 {
+				writeOptions.BatchSize = storeConf.BatchSize
+			}
+			if storeConf.FlushIntervalMs > 0 {
+				writeOptions.FlushInterval = time.Duration(storeConf.FlushIntervalMs) * time.Millisecond
+			}
+			if storeConf.QueueSize > 0 {
+				writeOptions.QueueSize = storeConf.QueueSize
+			}
+			if storeConf.MaxRetries != nil {
+				writeOptions.MaxRetries = *storeConf.MaxRetries
+			}
+			options = append(options, DbWrite(writeOptions))
+		}
+		if samplingConf := statisticPluginConf.Sampling; samplingConf != nil {
+			policy := DefaultSamplingPolicy()
+			if samplingConf.Percentage != nil {
+				policy.Percentage = *samplingConf.Percentage
+			}
+			policy.AlwaysLogErrors = samplingConf.AlwaysLogErrors
+			policy.SlowThreshold = time.Duration(samplingConf.SlowThresholdMs) * time.Millisecond
+			for _, methodConf := range samplingConf.Methods {
+				policy.MethodOverrides = append(policy.MethodOverrides, &MethodSampling{
+					Methods:    methodConf.Methods,
+					Percentage: methodConf.Percentage,
+				})
+			}
+			policy.MaxPayloadBytes = samplingConf.MaxPayloadBytes
+			if err := policy.Validate(); err != nil {
+				log.Fatalln("invalid statistic sampling config", err)
+				return
+			}
+			options = append(options, Sampling(policy))
+			log.Info("statistic plugin load Sampling option")
 		}
+		rollupConf := statisticPluginConf.Rollup
+		retention := DefaultRollupRetention()
+		if rollupConf.MinuteRetentionHours > 0 {
+			retention.Minute = time.Duration(rollupConf.MinuteRetentionHours) * time.Hour
+		}
+		if rollupConf.HourRetentionDays > 0 {
+			retention.Hour = time.Duration(rollupConf.HourRetentionDays) * 24 * time.Hour
+		}
+		if rollupConf.DayRetentionDays > 0 {
+			retention.Day = time.Duration(rollupConf.DayRetentionDays) * 24 * time.Hour
+		}
+		options = append(options, Rollups(retention))
+		if usageConf := statisticPluginConf.Usage; usageConf.Start {
+			usageOptions := DefaultUsageOptions()
+			if len(usageConf.Identities) > 0 {
+				usageOptions.Identities = usageConf.Identities
+			}
+			usageOptions.ApiKeyHeader = usageConf.ApiKeyHeader
+			usageOptions.MaskApiKey = usageConf.MaskApiKey
+			if usageConf.RetentionDays > 0 {
+				usageOptions.RetentionDays = usageConf.RetentionDays
+			}
+			if err := usageOptions.Validate(); err != nil {
+				log.Fatalln("invalid statistic usage config", err)
+				return
+			}
+			options = append(options, Usage(usageOptions))
+			log.Info("statistic plugin load Usage option")
+		}
+
 		options = append(options, SetRegistry(r))
 		log.Info("statistic plugin load registry option")
 
@@ -0,0 +1,357 @@
+package statistic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+/**
+ * migration is a versioned schema change of the sql metric store, applied in order of versions when the store starts.
+ * applied versions are recorded in table schema_migrations, so each migration runs once
+ */
+type migration struct {
+	version     int
+	description string
+	statements  []string
+	// apply runs instead of statements if not nil, for changes depending on the current schema
+	apply func(tx *sql.Tx) error
+}
+
+const createSchemaMigrationsSql = "create table if not exists `schema_migrations` (" +
+	"`version` INT NOT NULL PRIMARY KEY, " +
+	"`description` VARCHAR(255) NOT NULL, " +
+	"`applied_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)"
+
+// tables of mysql, the same as sql/jsonrpc_proxygo.sql
+var mysqlCreateTableStatements = map[string][]string{
+	"request_span": {
+		"CREATE TABLE `request_span` (" +
+			"`id` BIGINT NOT NULL, " +
+			"`annotation` VARCHAR(50) NULL COMMENT 'cs/sr/ss/cr', " +
+			"`trace_id` VARCHAR(100) NULL, " +
+			"`rpc_request_id` VARCHAR(100) NULL, " +
+			"`rpc_method_name` VARCHAR(100) NULL, " +
+			"`rpc_request_params` TEXT NULL, " +
+			"`rpc_response_error` TEXT NULL, " +
+			"`rpc_response_result` TEXT NULL, " +
+			"`target_server` TEXT NULL, " +
+			"`received_at` TIMESTAMP(6) NULL COMMENT 'received from the client', " +
+			"`upstream_sent_at` TIMESTAMP(6) NULL COMMENT 'sent to the upstream', " +
+			"`upstream_received_at` TIMESTAMP(6) NULL COMMENT 'response received from the upstream', " +
+			"`response_written_at` TIMESTAMP(6) NULL COMMENT 'response written to the client', " +
+			"`log_time` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`create_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`update_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, " +
+			"PRIMARY KEY (`id`)) COMMENT = 'each request have some spans'",
+		"ALTER TABLE `request_span` ADD INDEX `request_span_idx_trace_request` (`trace_id` ASC, `rpc_request_id` ASC)",
+		"ALTER TABLE `request_span` ADD INDEX `request_span_idx_method_name` (`rpc_method_name` ASC)",
+	},
+	"service_log": {
+		"CREATE TABLE `service_log` (" +
+			"`id` BIGINT NOT NULL, " +
+			"`service_name` VARCHAR(100) NOT NULL, " +
+			"`url` TEXT NOT NULL, " +
+			"`down_time` TIMESTAMP NULL, " +
+			"`create_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`update_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, " +
+			"PRIMARY KEY (`id`))",
+		"ALTER TABLE `service_log` ADD INDEX `service_log_idx_service_name` (`service_name` ASC)",
+	},
+	"service_health": {
+		"CREATE TABLE `service_health` (" +
+			"`id` BIGINT NOT NULL, " +
+			"`service_name` VARCHAR(100) NOT NULL, " +
+			"`service_url` VARCHAR(255) NOT NULL, " +
+			"`service_host` VARCHAR(100) NOT NULL, " +
+			"`rtt` INT NULL COMMENT 'rtt milliseconds', " +
+			"`connected` INT(1) NOT NULL, " +
+			"`create_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`update_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP, " +
+			"PRIMARY KEY (`id`))",
+		"ALTER TABLE `service_health` ADD INDEX `service_health_idx_service_host` (`service_host` ASC)",
+		"ALTER TABLE `service_health` ADD INDEX `service_health_idx_service_name` (`service_name` ASC)",
+		"ALTER TABLE `service_health` ADD UNIQUE INDEX `service_health_idx_service_url` (`service_url` ASC)",
+	},
+}
+
+func mysqlTableExists(tx *sql.Tx, table string) (exists bool, err error) {
+	var count int
+	err = tx.QueryRow("select count(1) from information_schema.tables where table_schema = database() and table_name = ?",
+		table).Scan(&count)
+	exists = count > 0
+	return
+}
+
+func mysqlColumnExists(tx *sql.Tx, table string, column string) (exists bool, err error) {
+	var count int
+	err = tx.QueryRow("select count(1) from information_schema.columns where table_schema = database()"+
+		" and table_name = ? and column_name = ?", table, column).Scan(&count)
+	exists = count > 0
+	return
+}
+
+var mysqlMigrations = []*migration{
+	{
+		version:     1,
+		description: "create tables",
+		// tables may be created by sql/jsonrpc_proxygo.sql before migrations are supported
+		apply: func(tx *sql.Tx) error {
+			for _, table := range []string{"request_span", "service_log", "service_health"} {
+				exists, err := mysqlTableExists(tx, table)
+				if err != nil {
+					return err
+				}
+				if exists {
+					continue
+				}
+				for _, statement := range mysqlCreateTableStatements[table] {
+					if _, err = tx.Exec(statement); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "add timestamps of request stages to request_span",
+		apply: func(tx *sql.Tx) error {
+			exists, err := mysqlColumnExists(tx, "request_span", "received_at")
+			if err != nil || exists {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE `request_span`" +
+				" ADD COLUMN `received_at` TIMESTAMP(6) NULL COMMENT 'received from the client' AFTER `target_server`," +
+				" ADD COLUMN `upstream_sent_at` TIMESTAMP(6) NULL COMMENT 'sent to the upstream' AFTER `received_at`," +
+				" ADD COLUMN `upstream_received_at` TIMESTAMP(6) NULL COMMENT 'response received from the upstream' AFTER `upstream_sent_at`," +
+				" ADD COLUMN `response_written_at` TIMESTAMP(6) NULL COMMENT 'response written to the client' AFTER `upstream_received_at`")
+			return err
+		},
+	},
+	{
+		version:     3,
+		description: "create metric_rollup",
+		statements: []string{
+			createRollupTableSql(", INDEX `metric_rollup_idx_resolution_time` (`resolution`, `bucket_time`)"),
+		},
+	},
+	{
+		version:     4,
+		description: "add up_time and reason to service_log",
+		apply: func(tx *sql.Tx) error {
+			exists, err := mysqlColumnExists(tx, "service_log", "up_time")
+			if err != nil || exists {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE `service_log`" +
+				" ADD COLUMN `up_time` TIMESTAMP NULL AFTER `down_time`," +
+				" ADD COLUMN `reason` VARCHAR(50) NULL AFTER `up_time`")
+			return err
+		},
+	},
+	{
+		version:     5,
+		description: "create client_usage",
+		statements: []string{
+			createClientUsageTableSql(", INDEX `client_usage_idx_client` (`client_type`, `client`, `day`)"),
+		},
+	},
+}
+
+// createTablesStatements returns the portable schema of sqlite and postgres, they differ only in the timestamp type
+func createTablesStatements(timestampType string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS `request_span` (" +
+			"`id` BIGINT NOT NULL PRIMARY KEY, " +
+			"`annotation` VARCHAR(50) NULL, " +
+			"`trace_id` VARCHAR(100) NULL, " +
+			"`rpc_request_id` VARCHAR(100) NULL, " +
+			"`rpc_method_name` VARCHAR(100) NULL, " +
+			"`rpc_request_params` TEXT NULL, " +
+			"`rpc_response_error` TEXT NULL, " +
+			"`rpc_response_result` TEXT NULL, " +
+			"`target_server` TEXT NULL, " +
+			"`received_at` " + timestampType + " NULL, " +
+			"`upstream_sent_at` " + timestampType + " NULL, " +
+			"`upstream_received_at` " + timestampType + " NULL, " +
+			"`response_written_at` " + timestampType + " NULL, " +
+			"`log_time` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`create_at` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`update_at` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE INDEX IF NOT EXISTS `request_span_idx_trace_request` ON `request_span` (`trace_id`, `rpc_request_id`)",
+		"CREATE INDEX IF NOT EXISTS `request_span_idx_method_name` ON `request_span` (`rpc_method_name`)",
+		"CREATE INDEX IF NOT EXISTS `request_span_idx_create_at` ON `request_span` (`create_at`)",
+		"CREATE TABLE IF NOT EXISTS `service_log` (" +
+			"`id` BIGINT NOT NULL PRIMARY KEY, " +
+			"`service_name` VARCHAR(100) NOT NULL, " +
+			"`url` TEXT NOT NULL, " +
+			"`down_time` " + timestampType + " NULL, " +
+			"`create_at` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`update_at` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE INDEX IF NOT EXISTS `service_log_idx_service_name` ON `service_log` (`service_name`)",
+		"CREATE TABLE IF NOT EXISTS `service_health` (" +
+			"`id` BIGINT NOT NULL PRIMARY KEY, " +
+			"`service_name` VARCHAR(100) NOT NULL, " +
+			"`service_url` VARCHAR(255) NOT NULL, " +
+			"`service_host` VARCHAR(100) NOT NULL, " +
+			"`rtt` INT NULL, " +
+			"`connected` INT NOT NULL, " +
+			"`create_at` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP, " +
+			"`update_at` " + timestampType + " NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE INDEX IF NOT EXISTS `service_health_idx_service_host` ON `service_health` (`service_host`)",
+		"CREATE INDEX IF NOT EXISTS `service_health_idx_service_name` ON `service_health` (`service_name`)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS `service_health_idx_service_url` ON `service_health` (`service_url`)",
+	}
+}
+
+// createClientUsageTableStatements returns the portable schema of client_usage of sqlite and postgres
+func createClientUsageTableStatements() []string {
+	return []string{
+		createClientUsageTableSql(""),
+		"CREATE INDEX IF NOT EXISTS `client_usage_idx_client` ON `client_usage` (`client_type`, `client`, `day`)",
+	}
+}
+
+// addServiceStatusColumnsStatements returns the columns of up logs and reasons added to service_log of sqlite and postgres
+func addServiceStatusColumnsStatements(timestampType string) []string {
+	return []string{
+		"ALTER TABLE `service_log` ADD COLUMN `up_time` " + timestampType + " NULL",
+		"ALTER TABLE `service_log` ADD COLUMN `reason` VARCHAR(50) NULL",
+	}
+}
+
+// createRollupTableStatements returns the portable schema of metric_rollup of sqlite and postgres
+func createRollupTableStatements() []string {
+	return []string{
+		createRollupTableSql(""),
+		"CREATE INDEX IF NOT EXISTS `metric_rollup_idx_resolution_time` ON `metric_rollup` (`resolution`, `bucket_time`)",
+	}
+}
+
+var sqliteMigrations = []*migration{
+	{
+		version:     1,
+		description: "create tables",
+		// the sqlite driver parses TIMESTAMP columns to time.Time
+		statements: createTablesStatements("TIMESTAMP"),
+	},
+	{
+		version:     2,
+		description: "create metric_rollup",
+		statements:  createRollupTableStatements(),
+	},
+	{
+		version:     3,
+		description: "add up_time and reason to service_log",
+		statements:  addServiceStatusColumnsStatements("TIMESTAMP"),
+	},
+	{
+		version:     4,
+		description: "create client_usage",
+		statements:  createClientUsageTableStatements(),
+	},
+}
+
+var postgresMigrations = []*migration{
+	{
+		version:     1,
+		description: "create tables",
+		statements:  createTablesStatements("TIMESTAMPTZ"),
+	},
+	{
+		version:     2,
+		description: "create metric_rollup",
+		statements:  createRollupTableStatements(),
+	},
+	{
+		version:     3,
+		description: "add up_time and reason to service_log",
+		statements:  addServiceStatusColumnsStatements("TIMESTAMPTZ"),
+	},
+	{
+		version:     4,
+		description: "create client_usage",
+		statements:  createClientUsageTableStatements(),
+	},
+}
+
+// migrate apply the migrations of dialect not applied yet to db, each migration in a transaction.
+// the current version is read holding the lock of migrations, so replicas never apply a migration twice
+func migrate(db *sql.DB, dialect *sqlDialect) (err error) {
+	if len(dialect.lockMigrationsSql) < 1 {
+		return applyMigrations(db, dialect)
+	}
+	ctx := context.Background()
+	// the lock belongs to the session, so it's taken and released by the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, dialect.lockMigrationsSql).Scan(&locked); err != nil {
+		return
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return errors.New("wait for the lock of migrations timeout")
+	}
+	defer func() {
+		if _, unlockErr := conn.ExecContext(ctx, dialect.unlockMigrationsSql); unlockErr != nil {
+			log.Warnf("release the lock of migrations error %s", unlockErr.Error())
+		}
+	}()
+	return applyMigrations(db, dialect)
+}
+
+func applyMigrations(db *sql.DB, dialect *sqlDialect) (err error) {
+	if _, err = db.Exec(dialect.rebind(createSchemaMigrationsSql)); err != nil {
+		return
+	}
+	var currentVersion int
+	err = db.QueryRow(dialect.rebind("select coalesce(max(`version`), 0) from `schema_migrations`")).Scan(&currentVersion)
+	if err != nil {
+		return
+	}
+	for _, m := range dialect.migrations {
+		if m.version <= currentVersion {
+			continue
+		}
+		if err = applyMigration(db, dialect, m); err != nil {
+			err = fmt.Errorf("apply %s migration %d(%s) error: %s", dialect.name, m.version, m.description, err.Error())
+			return
+		}
+		log.Infof("applied %s migration %d(%s)", dialect.name, m.version, m.description)
+	}
+	return
+}
+
+func applyMigration(db *sql.DB, dialect *sqlDialect, m *migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	if m.apply != nil {
+		if err = m.apply(tx); err != nil {
+			return
+		}
+	} else {
+		for _, statement := range m.statements {
+			if _, err = tx.Exec(dialect.rebind(statement)); err != nil {
+				return
+			}
+		}
+	}
+	_, err = tx.Exec(dialect.rebind("insert into `schema_migrations` (`version`, `description`) values (?, ?)"),
+		m.version, m.description)
+	return
+}
@@ -8,18 +8,58 @@ import (
 type MetricOptions struct {
 	store              MetricStore // metric store strategy
 	r                  registry.Registry
-	dumpIntervalOpened bool // whether dump metric status interval
+	dumpIntervalOpened bool             // whether dump metric status interval
+	sampling           *SamplingPolicy  // which requests are logged to store, all by default
+	dbWrite            *DbWriteOptions  // buffering and batching of the db store, DefaultDbWriteOptions if nil
+	rollupRetention    *RollupRetention // DefaultRollupRetention if nil
+	usage              *UsageOptions    // usage of clients is not tracked if nil
 }
 
+// DbStore use the mysql store
 func DbStore(dbUrl string) common.Option {
+	return SqlDbStore(STORE_TYPE_MYSQL, dbUrl)
+}
+
+// SqlDbStore use the sql store of {storeType}(mysql, sqlite or postgres), ignored if it's not a sql store type
+func SqlDbStore(storeType string, dbUrl string) common.Option {
 	return func(options common.Options) {
 		mOptions, _ := options.(*MetricOptions)
-		dbStore := newMetricDbStore(dbUrl)
-		mOptions.store = dbStore
-		err := dbStore.Init()
+		dialect, ok := dialectOfStoreType(storeType)
+		if !ok {
+			log.Errorf("unknown sql metric store type %s", storeType)
+			return
+		}
+		// the store is initialized by the statistic middleware after all options applied
+		mOptions.store = newMetricDbStore(dialect, dbUrl)
+	}
+}
+
+// StoreOfConfig use the store created by the registered factory of config's type, see RegisterMetricStore
+func StoreOfConfig(config *StoreConfig) common.Option {
+	return func(options common.Options) {
+		mOptions, _ := options.(*MetricOptions)
+		store, err := NewMetricStore(config)
 		if err != nil {
-			log.Error("metric db init error ", err)
+			log.Errorf("create metric store error %s", err.Error())
+			return
 		}
+		mOptions.store = store
+	}
+}
+
+// UseStore use the store, which is initialized by the statistic middleware
+func UseStore(store MetricStore) common.Option {
+	return func(options common.Options) {
+		mOptions, _ := options.(*MetricOptions)
+		mOptions.store = store
+	}
+}
+
+// DbWrite set how request spans are buffered and written by the db store
+func DbWrite(writeOptions *DbWriteOptions) common.Option {
+	return func(options common.Options) {
+		mOptions, _ := options.(*MetricOptions)
+		mOptions.dbWrite = writeOptions
 	}
 }
 
@@ -36,3 +76,26 @@ func SetRegistry(r registry.Registry) common.Option {
 		mOptions.r = r
 	}
 }
+
+func Sampling(policy *SamplingPolicy) common.Option {
+	return func(options common.Options) {
+		mOptions, _ := options.(*MetricOptions)
+		mOptions.sampling = policy
+	}
+}
+
+// Rollups set how long rollups of each resolution are kept
+func Rollups(retention *RollupRetention) common.Option {
+	return func(options common.Options) {
+		mOptions, _ := options.(*MetricOptions)
+		mOptions.rollupRetention = retention
+	}
+}
+
+// Usage track calls, errors, bytes and rate limit denials of each client per day
+func Usage(usageOptions *UsageOptions) common.Option {
+	return func(options common.Options) {
+		mOptions, _ := options.(*MetricOptions)
+		mOptions.usage = usageOptions
+	}
+}
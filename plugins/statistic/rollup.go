@@ -0,0 +1,442 @@
+package statistic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// resolutions of rollups, minute rollups are downsampled to hourly and daily rollups
+const (
+	ROLLUP_RESOLUTION_MINUTE = "minute"
+	ROLLUP_RESOLUTION_HOUR   = "hour"
+	ROLLUP_RESOLUTION_DAY    = "day"
+)
+
+// dimensions of rollups, the key of a rollup is the method name or the upstream url
+const (
+	ROLLUP_DIMENSION_METHOD   = "method"
+	ROLLUP_DIMENSION_UPSTREAM = "upstream"
+)
+
+var rollupResolutions = []struct {
+	name     string
+	duration time.Duration
+}{
+	{ROLLUP_RESOLUTION_MINUTE, time.Minute},
+	{ROLLUP_RESOLUTION_HOUR, time.Hour},
+	{ROLLUP_RESOLUTION_DAY, 24 * time.Hour},
+}
+
+func rollupResolutionDuration(resolution string) (time.Duration, bool) {
+	for _, r := range rollupResolutions {
+		if r.name == resolution {
+			return r.duration, true
+		}
+	}
+	return 0, false
+}
+
+// RollupLatencyBucketsMs are the upper bounds(milliseconds) of the latency histogram of rollups,
+// the last bucket of a histogram counts latencies above all bounds
+var RollupLatencyBucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+var rollupLatencyBucketCount = len(RollupLatencyBucketsMs) + 1
+
+func rollupLatencyBucketOf(latencyMs float64) int {
+	for i, bound := range RollupLatencyBucketsMs {
+		if latencyMs <= bound {
+			return i
+		}
+	}
+	return len(RollupLatencyBucketsMs)
+}
+
+// RollupPoint aggregates the requests of a method(or upstream) in a time bucket of the resolution
+type RollupPoint struct {
+	Resolution     string    `json:"resolution"`
+	Dimension      string    `json:"dimension"`
+	Key            string    `json:"key"`
+	Time           time.Time `json:"time"` // start of the bucket, UTC
+	Count          int64     `json:"count"`
+	Errors         int64     `json:"errors"`
+	LatencySumMs   float64   `json:"latencySumMs"`
+	LatencyBuckets []int64   `json:"latencyBuckets"` // counts of RollupLatencyBucketsMs and the overflow bucket
+
+	// computed by the histogram when queried
+	LatencyAvgMs *float64 `json:"latencyAvgMs,omitempty"`
+	LatencyP50Ms *float64 `json:"latencyP50Ms,omitempty"`
+	LatencyP90Ms *float64 `json:"latencyP90Ms,omitempty"`
+	LatencyP99Ms *float64 `json:"latencyP99Ms,omitempty"`
+}
+
+func newRollupPoint(resolution string, dimension string, key string, bucketTime time.Time) *RollupPoint {
+	return &RollupPoint{
+		Resolution:     resolution,
+		Dimension:      dimension,
+		Key:            key,
+		Time:           bucketTime,
+		LatencyBuckets: make([]int64, rollupLatencyBucketCount),
+	}
+}
+
+func (point *RollupPoint) add(latencyMs float64, isError bool) {
+	point.Count++
+	if isError {
+		point.Errors++
+	}
+	point.LatencySumMs += latencyMs
+	point.LatencyBuckets[rollupLatencyBucketOf(latencyMs)]++
+}
+
+func (point *RollupPoint) merge(other *RollupPoint) {
+	point.Count += other.Count
+	point.Errors += other.Errors
+	point.LatencySumMs += other.LatencySumMs
+	for i := 0; i < len(point.LatencyBuckets) && i < len(other.LatencyBuckets); i++ {
+		point.LatencyBuckets[i] += other.LatencyBuckets[i]
+	}
+}
+
+// downsample returns a point of the coarser resolution containing this point
+func (point *RollupPoint) downsample(resolution string, duration time.Duration) *RollupPoint {
+	result := newRollupPoint(resolution, point.Dimension, point.Key, point.Time.Truncate(duration))
+	result.merge(point)
+	return result
+}
+
+// histogramQuantile estimates the quantile by linear interpolation in the histogram bucket,
+// the upper bound of the overflow bucket is taken as twice of the last bound
+func histogramQuantile(buckets []int64, count int64, q float64) float64 {
+	target := q * float64(count)
+	var accumulated float64
+	for i, n := range buckets {
+		if n < 1 {
+			continue
+		}
+		if accumulated+float64(n) >= target {
+			lower := 0.0
+			if i > 0 {
+				lower = RollupLatencyBucketsMs[i-1]
+			}
+			var upper float64
+			if i < len(RollupLatencyBucketsMs) {
+				upper = RollupLatencyBucketsMs[i]
+			} else {
+				upper = 2 * RollupLatencyBucketsMs[len(RollupLatencyBucketsMs)-1]
+			}
+			return lower + (upper-lower)*(target-accumulated)/float64(n)
+		}
+		accumulated += float64(n)
+	}
+	return 0
+}
+
+// fillLatency compute the average and percentiles of latency by the histogram
+func (point *RollupPoint) fillLatency() {
+	if point.Count < 1 {
+		return
+	}
+	avg := point.LatencySumMs / float64(point.Count)
+	p50 := histogramQuantile(point.LatencyBuckets, point.Count, 0.5)
+	p90 := histogramQuantile(point.LatencyBuckets, point.Count, 0.9)
+	p99 := histogramQuantile(point.LatencyBuckets, point.Count, 0.99)
+	point.LatencyAvgMs = &avg
+	point.LatencyP50Ms = &p50
+	point.LatencyP90Ms = &p90
+	point.LatencyP99Ms = &p99
+}
+
+// RollupRetention is how long rollups of each resolution are kept
+type RollupRetention struct {
+	Minute time.Duration
+	Hour   time.Duration
+	Day    time.Duration
+}
+
+func DefaultRollupRetention() *RollupRetention {
+	return &RollupRetention{
+		Minute: 48 * time.Hour,
+		Hour:   30 * 24 * time.Hour,
+		Day:    365 * 24 * time.Hour,
+	}
+}
+
+func (retention *RollupRetention) of(resolution string) time.Duration {
+	switch resolution {
+	case ROLLUP_RESOLUTION_MINUTE:
+		return retention.Minute
+	case ROLLUP_RESOLUTION_HOUR:
+		return retention.Hour
+	default:
+		return retention.Day
+	}
+}
+
+// QueryRollupForm queries the rollups of a dimension in time range [From, To), all keys of the dimension if Key is empty
+type QueryRollupForm struct {
+	Resolution string `json:"resolution"` // minute by default
+	Dimension  string `json:"dimension"`  // method by default
+	Key        string `json:"key"`
+	From       int64  `json:"from"` // unix seconds, 24 hours before To by default
+	To         int64  `json:"to"`   // unix seconds, now by default
+}
+
+// normalize fills the defaults of the form, and returns error if it's invalid
+func (form *QueryRollupForm) normalize(now time.Time) error {
+	if len(form.Resolution) < 1 {
+		form.Resolution = ROLLUP_RESOLUTION_MINUTE
+	}
+	if _, ok := rollupResolutionDuration(form.Resolution); !ok {
+		return fmt.Errorf("invalid rollup resolution %s", form.Resolution)
+	}
+	if len(form.Dimension) < 1 {
+		form.Dimension = ROLLUP_DIMENSION_METHOD
+	}
+	if form.Dimension != ROLLUP_DIMENSION_METHOD && form.Dimension != ROLLUP_DIMENSION_UPSTREAM {
+		return fmt.Errorf("invalid rollup dimension %s", form.Dimension)
+	}
+	if form.To <= 0 {
+		form.To = now.Unix()
+	}
+	if form.From <= 0 {
+		form.From = form.To - int64((24*time.Hour)/time.Second)
+	}
+	if form.From >= form.To {
+		return errors.New("rollup query from must be before to")
+	}
+	return nil
+}
+
+// sortRollupPoints sorts points by key and time
+func sortRollupPoints(points []*RollupPoint) {
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].Key != points[j].Key {
+			return points[i].Key < points[j].Key
+		}
+		return points[i].Time.Before(points[j].Time)
+	})
+}
+
+type rollupKey struct {
+	resolution string
+	dimension  string
+	key        string
+	time       int64 // unix seconds of the bucket start
+}
+
+func rollupKeyOf(point *RollupPoint) rollupKey {
+	return rollupKey{point.Resolution, point.Dimension, point.Key, point.Time.Unix()}
+}
+
+const rollupRecentWindow = time.Hour // minute rollups kept by the aggregator, for the hourly stat
+
+// keys of rollups are method names chosen by clients. keys out of the first maxRollupKeysPerMinute distinct keys
+// of a dimension in a minute are counted as otherRollupKey, and keys are truncated to the size of the column
+const (
+	maxRollupKeysPerMinute = 500
+	otherRollupKey         = "other"
+	maxRollupKeyLength     = 255
+)
+
+// rollupMinuteDimension is a dimension in a minute, to count its distinct keys
+type rollupMinuteDimension struct {
+	dimension string
+	time      int64
+}
+
+/**
+ * rollupAggregator aggregates requests to minute rollups in memory.
+ * completed minutes are taken by the store to persist, and the last hour is kept for the sliding hourly stat
+ */
+type rollupAggregator struct {
+	lock      sync.Mutex
+	points    map[rollupKey]*RollupPoint
+	keyCounts map[rollupMinuteDimension]int
+	// minutes before it have been taken, requests logged late are counted in this minute
+	takenBefore time.Time
+}
+
+func newRollupAggregator() *rollupAggregator {
+	return &rollupAggregator{
+		points:    make(map[rollupKey]*RollupPoint),
+		keyCounts: make(map[rollupMinuteDimension]int),
+	}
+}
+
+func (aggregator *rollupAggregator) add(dimension string, key string, at time.Time, latencyMs float64, isError bool) {
+	minute := at.UTC().Truncate(time.Minute)
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	if minute.Before(aggregator.takenBefore) {
+		minute = aggregator.takenBefore
+	}
+	key = truncateString(key, maxRollupKeyLength)
+	k := rollupKey{ROLLUP_RESOLUTION_MINUTE, dimension, key, minute.Unix()}
+	point, ok := aggregator.points[k]
+	if !ok {
+		minuteDimension := rollupMinuteDimension{dimension, k.time}
+		if aggregator.keyCounts[minuteDimension] >= maxRollupKeysPerMinute {
+			k.key = otherRollupKey
+			point, ok = aggregator.points[k]
+		}
+		if !ok {
+			point = newRollupPoint(ROLLUP_RESOLUTION_MINUTE, dimension, k.key, minute)
+			aggregator.points[k] = point
+			aggregator.keyCounts[minuteDimension]++
+		}
+	}
+	point.add(latencyMs, isError)
+}
+
+// takeCompleted returns copies of minute rollups ended before {now} and not taken yet
+func (aggregator *rollupAggregator) takeCompleted(now time.Time) []*RollupPoint {
+	end := now.UTC().Truncate(time.Minute)
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	result := make([]*RollupPoint, 0)
+	if !end.After(aggregator.takenBefore) {
+		return result
+	}
+	expireBefore := end.Add(-rollupRecentWindow).Unix()
+	for k, point := range aggregator.points {
+		if k.time >= aggregator.takenBefore.Unix() && k.time < end.Unix() {
+			taken := newRollupPoint(point.Resolution, point.Dimension, point.Key, point.Time)
+			taken.merge(point)
+			result = append(result, taken)
+		}
+		if k.time < expireBefore {
+			delete(aggregator.points, k)
+			delete(aggregator.keyCounts, rollupMinuteDimension{k.dimension, k.time})
+		}
+	}
+	aggregator.takenBefore = end
+	return result
+}
+
+// restore puts back minute rollups taken but failed to persist, so they are taken again by the next flush
+func (aggregator *rollupAggregator) restore(points []*RollupPoint) {
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	for _, point := range points {
+		if point.Time.Before(aggregator.takenBefore) {
+			aggregator.takenBefore = point.Time
+		}
+		// points of the last hour are still kept, only expired ones are added back
+		k := rollupKeyOf(point)
+		if _, ok := aggregator.points[k]; ok {
+			continue
+		}
+		restored := newRollupPoint(point.Resolution, point.Dimension, point.Key, point.Time)
+		restored.merge(point)
+		aggregator.points[k] = restored
+		aggregator.keyCounts[rollupMinuteDimension{k.dimension, k.time}]++
+	}
+}
+
+// recentCounts returns request counts by key of the dimension in the last hour, and the total count
+func (aggregator *rollupAggregator) recentCounts(dimension string, now time.Time) (counts map[string]int64, total uint64) {
+	since := now.UTC().Add(-rollupRecentWindow).Unix()
+	counts = make(map[string]int64)
+	aggregator.lock.Lock()
+	defer aggregator.lock.Unlock()
+	for k, point := range aggregator.points {
+		if k.dimension != dimension || k.time <= since {
+			continue
+		}
+		counts[k.key] += point.Count
+		total += uint64(point.Count)
+	}
+	return
+}
+
+// addRequest aggregates the request with a written response to the rollups of its method and upstream
+func (aggregator *rollupAggregator) addRequest(methodName string, reqSession *rpc.JSONRpcRequestSession) {
+	isError := reqSession.Response == nil || reqSession.Response.Error != nil
+	latencyMs := float64(reqSession.Latency()) / float64(time.Millisecond)
+	aggregator.add(ROLLUP_DIMENSION_METHOD, methodName, reqSession.ResponseWrittenAt, latencyMs, isError)
+	if len(reqSession.TargetServer) > 0 && !reqSession.UpstreamRecvAt.IsZero() {
+		upstreamLatencyMs := float64(reqSession.UpstreamLatency()) / float64(time.Millisecond)
+		aggregator.add(ROLLUP_DIMENSION_UPSTREAM, reqSession.TargetServer, reqSession.ResponseWrittenAt,
+			upstreamLatencyMs, isError)
+	}
+}
+
+// downsampleRollups returns the minute points and their hourly and daily points, points of the same bucket merged
+func downsampleRollups(minutePoints []*RollupPoint) []*RollupPoint {
+	merged := make(map[rollupKey]*RollupPoint)
+	result := make([]*RollupPoint, 0, len(minutePoints)*len(rollupResolutions))
+	for _, point := range minutePoints {
+		for _, r := range rollupResolutions {
+			p := point.downsample(r.name, r.duration)
+			k := rollupKeyOf(p)
+			if existed, ok := merged[k]; ok {
+				existed.merge(p)
+				continue
+			}
+			merged[k] = p
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// memoryRollups keeps the rollups of all resolutions in memory, for stores without persistence
+type memoryRollups struct {
+	lock   sync.RWMutex
+	points map[rollupKey]*RollupPoint
+}
+
+func newMemoryRollups() *memoryRollups {
+	return &memoryRollups{
+		points: make(map[rollupKey]*RollupPoint),
+	}
+}
+
+func (rollups *memoryRollups) save(points []*RollupPoint) {
+	rollups.lock.Lock()
+	defer rollups.lock.Unlock()
+	for _, point := range points {
+		k := rollupKeyOf(point)
+		if existed, ok := rollups.points[k]; ok {
+			existed.merge(point)
+			continue
+		}
+		rollups.points[k] = point
+	}
+}
+
+// prune removes the rollups older than the retention of their resolution
+func (rollups *memoryRollups) prune(now time.Time, retention *RollupRetention) {
+	rollups.lock.Lock()
+	defer rollups.lock.Unlock()
+	for k := range rollups.points {
+		if k.time < now.Add(-retention.of(k.resolution)).Unix() {
+			delete(rollups.points, k)
+		}
+	}
+}
+
+func (rollups *memoryRollups) query(form *QueryRollupForm) []*RollupPoint {
+	rollups.lock.RLock()
+	defer rollups.lock.RUnlock()
+	result := make([]*RollupPoint, 0)
+	for k, point := range rollups.points {
+		if k.resolution != form.Resolution || k.dimension != form.Dimension || k.time < form.From || k.time >= form.To {
+			continue
+		}
+		if len(form.Key) > 0 && k.key != form.Key {
+			continue
+		}
+		p := newRollupPoint(point.Resolution, point.Dimension, point.Key, point.Time)
+		p.merge(point)
+		p.fillLatency()
+		result = append(result, p)
+	}
+	sortRollupPoints(result)
+	return result
+}
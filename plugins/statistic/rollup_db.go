@@ -0,0 +1,171 @@
+package statistic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rollupBucketColumns are the columns of histogram buckets in table metric_rollup, le_5, le_10 ... le_inf
+var rollupBucketColumns = func() []string {
+	columns := make([]string, 0, rollupLatencyBucketCount)
+	for _, bound := range RollupLatencyBucketsMs {
+		columns = append(columns, fmt.Sprintf("le_%g", bound))
+	}
+	return append(columns, "le_inf")
+}()
+
+var rollupKeyColumns = []string{"resolution", "dimension", "dimension_key", "bucket_time"}
+
+var rollupValueColumns = append([]string{"calls", "errors", "latency_sum_ms"}, rollupBucketColumns...)
+
+func quoteColumns(columns []string) []string {
+	result := make([]string, len(columns))
+	for i, column := range columns {
+		result[i] = "`" + column + "`"
+	}
+	return result
+}
+
+// createRollupTableSql returns the create statement of metric_rollup, {extra} is appended to the column definitions
+func createRollupTableSql(extra string) string {
+	var sb strings.Builder
+	sb.WriteString("CREATE TABLE IF NOT EXISTS `metric_rollup` (" +
+		"`resolution` VARCHAR(10) NOT NULL, " +
+		"`dimension` VARCHAR(20) NOT NULL, " +
+		"`dimension_key` VARCHAR(255) NOT NULL, " +
+		"`bucket_time` BIGINT NOT NULL, " +
+		"`calls` BIGINT NOT NULL DEFAULT 0, " +
+		"`errors` BIGINT NOT NULL DEFAULT 0, " +
+		"`latency_sum_ms` DOUBLE PRECISION NOT NULL DEFAULT 0, ")
+	for _, column := range rollupBucketColumns {
+		sb.WriteString("`" + column + "` BIGINT NOT NULL DEFAULT 0, ")
+	}
+	sb.WriteString("PRIMARY KEY (`resolution`, `dimension`, `dimension_key`, `bucket_time`)")
+	sb.WriteString(extra)
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// additiveUpsertSql returns the insert of a row which adds its values to the existing row of the same key,
+// by "on duplicate key update" of mysql if {onDuplicateKey}, or "on conflict" of sqlite and postgres
+func additiveUpsertSql(table string, keyColumns []string, valueColumns []string, onDuplicateKey bool) string {
+	columns := append(append([]string{}, keyColumns...), valueColumns...)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	sql := "insert into `" + table + "` (" + strings.Join(quoteColumns(columns), ", ") + ") values (" + placeholders + ")"
+	updates := make([]string, len(valueColumns))
+	for i, column := range valueColumns {
+		if onDuplicateKey {
+			updates[i] = fmt.Sprintf("`%s`=`%s`+values(`%s`)", column, column, column)
+		} else {
+			updates[i] = fmt.Sprintf("`%s`=`%s`.`%s`+excluded.`%s`", column, table, column, column)
+		}
+	}
+	if onDuplicateKey {
+		return sql + " on duplicate key update " + strings.Join(updates, ", ")
+	}
+	return sql + " on conflict (" + strings.Join(quoteColumns(keyColumns), ", ") + ") do update set " +
+		strings.Join(updates, ", ")
+}
+
+// rollupUpsertSql returns the insert of a rollup which adds to the existing row of the same bucket
+func rollupUpsertSql(onDuplicateKey bool) string {
+	return additiveUpsertSql("metric_rollup", rollupKeyColumns, rollupValueColumns, onDuplicateKey)
+}
+
+// FlushRollups upserts the completed minute rollups and their downsamples to table metric_rollup,
+// so rollups of the same bucket from restarts or other proxies are added up
+func (store *metricDbStore) FlushRollups(ctx context.Context, now time.Time) (err error) {
+	db := store.db
+	if db == nil {
+		return errors.New("metric db not init")
+	}
+	minutePoints := store.TakeCompletedRollups(now)
+	if len(minutePoints) > 0 {
+		if err = store.upsertRollups(ctx, downsampleRollups(minutePoints)); err != nil {
+			// the minutes are taken again by the next flush, instead of lost with their hourly and daily sums
+			store.RestoreRollups(minutePoints)
+			return
+		}
+	}
+	for _, r := range rollupResolutions {
+		expireBefore := now.Add(-store.rollupRetention.of(r.name)).Unix()
+		_, err = db.ExecContext(ctx, store.dialect.rebind("delete from `metric_rollup` where `resolution` = ? and `bucket_time` < ?"),
+			r.name, expireBefore)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// upsertRollups adds the rollups to table metric_rollup in a transaction
+func (store *metricDbStore) upsertRollups(ctx context.Context, points []*RollupPoint) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(store.dialect.rebind(store.dialect.upsertRollupSql))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, point := range points {
+		args := []interface{}{point.Resolution, point.Dimension, point.Key, point.Time.Unix(),
+			point.Count, point.Errors, point.LatencySumMs}
+		for _, n := range point.LatencyBuckets {
+			args = append(args, n)
+		}
+		if _, err = stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *metricDbStore) QueryRollups(ctx context.Context, form *QueryRollupForm) (result []*RollupPoint, err error) {
+	db := store.db
+	if db == nil {
+		err = errors.New("metric db not init")
+		return
+	}
+	if err = form.normalize(time.Now()); err != nil {
+		return
+	}
+	query := "select " + strings.Join(quoteColumns(append(append([]string{}, rollupKeyColumns...), rollupValueColumns...)), ", ") +
+		" from `metric_rollup` where `resolution` = ? and `dimension` = ? and `bucket_time` >= ? and `bucket_time` < ?"
+	args := []interface{}{form.Resolution, form.Dimension, form.From, form.To}
+	if len(form.Key) > 0 {
+		query += " and `dimension_key` = ?"
+		args = append(args, form.Key)
+	}
+	query += " order by `dimension_key`, `bucket_time`"
+	rows, err := db.QueryContext(ctx, store.dialect.rebind(query), args...)
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	defer rows.Close()
+	result = make([]*RollupPoint, 0)
+	for rows.Next() {
+		point := newRollupPoint("", "", "", time.Time{})
+		var bucketTime int64
+		dest := []interface{}{&point.Resolution, &point.Dimension, &point.Key, &bucketTime,
+			&point.Count, &point.Errors, &point.LatencySumMs}
+		for i := range point.LatencyBuckets {
+			dest = append(dest, &point.LatencyBuckets[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			log.Warn("metric db error", err)
+			return
+		}
+		point.Time = time.Unix(bucketTime, 0).UTC()
+		point.fillLatency()
+		result = append(result, point)
+	}
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,199 @@
+package statistic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func newRollupSession(method string, upstream string, writtenAt time.Time, latency time.Duration, isError bool) *rpc.JSONRpcRequestSession {
+	session := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+	session.FillRpcRequest(&rpc.JSONRpcRequest{Id: 1, Method: method}, nil)
+	if isError {
+		session.FillRpcResponse(&rpc.JSONRpcResponse{Id: 1, Error: rpc.NewJSONRpcResponseError(-32000, "error", nil)})
+	} else {
+		session.FillRpcResponse(&rpc.JSONRpcResponse{Id: 1, Result: "0x1"})
+	}
+	session.TargetServer = upstream
+	session.ReceivedAt = writtenAt.Add(-latency)
+	session.UpstreamSentAt = session.ReceivedAt
+	session.UpstreamRecvAt = writtenAt
+	session.ResponseWrittenAt = writtenAt
+	return session
+}
+
+func TestRollupAggregatorTakeCompleted(t *testing.T) {
+	aggregator := newRollupAggregator()
+	minute := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)
+	aggregator.addRequest("eth_call", newRollupSession("eth_call", "http://upstream1", minute.Add(10*time.Second), 20*time.Millisecond, false))
+	aggregator.addRequest("eth_call", newRollupSession("eth_call", "http://upstream1", minute.Add(20*time.Second), 200*time.Millisecond, true))
+	aggregator.addRequest("eth_call", newRollupSession("eth_call", "http://upstream1", minute.Add(70*time.Second), 3*time.Millisecond, false))
+
+	// the current minute is not completed
+	points := aggregator.takeCompleted(minute.Add(50 * time.Second))
+	assert.Equal(t, 0, len(points))
+
+	points = aggregator.takeCompleted(minute.Add(61 * time.Second))
+	sortRollupPoints(points)
+	assert.Equal(t, 2, len(points))
+	methodPoint := points[0]
+	assert.Equal(t, ROLLUP_DIMENSION_METHOD, methodPoint.Dimension)
+	assert.Equal(t, "eth_call", methodPoint.Key)
+	assert.Equal(t, minute, methodPoint.Time)
+	assert.Equal(t, int64(2), methodPoint.Count)
+	assert.Equal(t, int64(1), methodPoint.Errors)
+	assert.Equal(t, float64(220), methodPoint.LatencySumMs)
+	assert.Equal(t, int64(1), methodPoint.LatencyBuckets[rollupLatencyBucketOf(20)])
+	assert.Equal(t, int64(1), methodPoint.LatencyBuckets[rollupLatencyBucketOf(200)])
+	assert.Equal(t, ROLLUP_DIMENSION_UPSTREAM, points[1].Dimension)
+
+	// taken minutes are not taken again, and late requests are counted in the next minute
+	assert.Equal(t, 0, len(aggregator.takeCompleted(minute.Add(61*time.Second))))
+	aggregator.addRequest("eth_call", newRollupSession("eth_call", "", minute.Add(30*time.Second), time.Millisecond, false))
+	points = aggregator.takeCompleted(minute.Add(121 * time.Second))
+	assert.Equal(t, 2, len(points))
+	for _, point := range points {
+		if point.Dimension == ROLLUP_DIMENSION_METHOD {
+			assert.Equal(t, minute.Add(time.Minute), point.Time)
+			assert.Equal(t, int64(2), point.Count)
+		}
+	}
+
+	// the last hour is kept for the hourly stat
+	counts, total := aggregator.recentCounts(ROLLUP_DIMENSION_METHOD, minute.Add(5*time.Minute))
+	assert.Equal(t, map[string]int64{"eth_call": 4}, counts)
+	assert.Equal(t, uint64(4), total)
+	counts, total = aggregator.recentCounts(ROLLUP_DIMENSION_METHOD, minute.Add(2*time.Hour))
+	assert.Equal(t, 0, len(counts))
+	assert.Equal(t, uint64(0), total)
+}
+
+func TestRollupAggregatorRestore(t *testing.T) {
+	aggregator := newRollupAggregator()
+	minute := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)
+	aggregator.addRequest("eth_call", newRollupSession("eth_call", "", minute.Add(10*time.Second), time.Millisecond, false))
+	points := aggregator.takeCompleted(minute.Add(time.Minute))
+	assert.Equal(t, 1, len(points))
+
+	// restored minutes are taken again, without counting the kept ones twice
+	aggregator.addRequest("eth_call", newRollupSession("eth_call", "", minute.Add(70*time.Second), time.Millisecond, false))
+	aggregator.restore(points)
+	points = aggregator.takeCompleted(minute.Add(2 * time.Minute))
+	sortRollupPoints(points)
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, int64(1), points[0].Count)
+	assert.Equal(t, int64(1), points[1].Count)
+	counts, total := aggregator.recentCounts(ROLLUP_DIMENSION_METHOD, minute.Add(2*time.Minute))
+	assert.Equal(t, map[string]int64{"eth_call": 2}, counts)
+	assert.Equal(t, uint64(2), total)
+
+	// minutes expired from the aggregator while failing to persist are added back
+	points = aggregator.takeCompleted(minute.Add(2 * time.Hour))
+	assert.Equal(t, 0, len(points))
+	expired := newRollupPoint(ROLLUP_RESOLUTION_MINUTE, ROLLUP_DIMENSION_METHOD, "eth_call", minute)
+	expired.add(1, false)
+	aggregator.restore([]*RollupPoint{expired})
+	points = aggregator.takeCompleted(minute.Add(2 * time.Hour))
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, minute, points[0].Time)
+}
+
+func TestRollupAggregatorKeyLimits(t *testing.T) {
+	aggregator := newRollupAggregator()
+	minute := time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC)
+	longMethod := strings.Repeat("m", 300)
+	aggregator.addRequest(longMethod, newRollupSession(longMethod, "", minute, time.Millisecond, false))
+	for i := 0; i < maxRollupKeysPerMinute+10; i++ {
+		method := fmt.Sprintf("method_%d", i)
+		aggregator.addRequest(method, newRollupSession(method, "", minute, time.Millisecond, false))
+	}
+	points := aggregator.takeCompleted(minute.Add(time.Minute))
+	assert.Equal(t, maxRollupKeysPerMinute+1, len(points))
+	keys := make(map[string]int64)
+	for _, point := range points {
+		keys[point.Key] = point.Count
+	}
+	assert.Equal(t, int64(1), keys[longMethod[:maxRollupKeyLength]])
+	assert.Equal(t, int64(11), keys[otherRollupKey])
+}
+
+func TestDownsampleRollups(t *testing.T) {
+	hour := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	a := newRollupPoint(ROLLUP_RESOLUTION_MINUTE, ROLLUP_DIMENSION_METHOD, "eth_call", hour.Add(5*time.Minute))
+	a.add(10, false)
+	b := newRollupPoint(ROLLUP_RESOLUTION_MINUTE, ROLLUP_DIMENSION_METHOD, "eth_call", hour.Add(6*time.Minute))
+	b.add(30, true)
+	points := downsampleRollups([]*RollupPoint{a, b})
+	// 2 minute points, 1 hourly and 1 daily point
+	assert.Equal(t, 4, len(points))
+	byResolution := make(map[string][]*RollupPoint)
+	for _, point := range points {
+		byResolution[point.Resolution] = append(byResolution[point.Resolution], point)
+	}
+	assert.Equal(t, 2, len(byResolution[ROLLUP_RESOLUTION_MINUTE]))
+	hourly := byResolution[ROLLUP_RESOLUTION_HOUR][0]
+	assert.Equal(t, hour, hourly.Time)
+	assert.Equal(t, int64(2), hourly.Count)
+	assert.Equal(t, int64(1), hourly.Errors)
+	daily := byResolution[ROLLUP_RESOLUTION_DAY][0]
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), daily.Time)
+	// downsampling doesn't change the source points
+	assert.Equal(t, int64(1), a.Count)
+}
+
+func TestRollupPointFillLatency(t *testing.T) {
+	point := newRollupPoint(ROLLUP_RESOLUTION_MINUTE, ROLLUP_DIMENSION_METHOD, "eth_call", time.Now())
+	for i := 0; i < 90; i++ {
+		point.add(8, false)
+	}
+	for i := 0; i < 10; i++ {
+		point.add(400, false)
+	}
+	point.fillLatency()
+	assert.InDelta(t, 47.2, *point.LatencyAvgMs, 0.001)
+	// p50 and p90 in (5, 10], p99 in (250, 500]
+	assert.True(t, *point.LatencyP50Ms > 5 && *point.LatencyP50Ms <= 10)
+	assert.True(t, *point.LatencyP90Ms > 5 && *point.LatencyP90Ms <= 10)
+	assert.True(t, *point.LatencyP99Ms > 250 && *point.LatencyP99Ms <= 500)
+}
+
+func TestBaseMetricStoreRollups(t *testing.T) {
+	store := newMemoryMetricStore(0, 0)
+	assert.Nil(t, store.Init())
+	store.setRollupRetention(&RollupRetention{Minute: time.Hour, Hour: 24 * time.Hour, Day: 48 * time.Hour})
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		store.AddRpcLatency("eth_call", newRollupSession("eth_call", "http://upstream1", now, 10*time.Millisecond, i == 0))
+	}
+	dump, err := store.DumpStatInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), dump.HourlyStat["eth_call"].CallCount)
+	assert.Equal(t, uint64(3), dump.HourlyRpcCallCount)
+
+	assert.Nil(t, store.FlushRollups(ctx, now.Add(time.Minute)))
+	points, err := store.QueryRollups(ctx, &QueryRollupForm{Key: "eth_call"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, int64(3), points[0].Count)
+	assert.Equal(t, int64(1), points[0].Errors)
+
+	points, err = store.QueryRollups(ctx, &QueryRollupForm{Resolution: ROLLUP_RESOLUTION_HOUR, Dimension: ROLLUP_DIMENSION_UPSTREAM})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, "http://upstream1", points[0].Key)
+
+	// minute rollups are removed after the retention
+	assert.Nil(t, store.FlushRollups(ctx, now.Add(2*time.Hour)))
+	points, err = store.QueryRollups(ctx, &QueryRollupForm{To: now.Add(2 * time.Hour).Unix()})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(points))
+
+	_, err = store.QueryRollups(ctx, &QueryRollupForm{Resolution: "week"})
+	assert.NotNil(t, err)
+}
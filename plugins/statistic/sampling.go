@@ -0,0 +1,138 @@
+package statistic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// MethodSampling overrides the sampling percentage of some rpc methods
+type MethodSampling struct {
+	Methods    []string // exact names or globs like "eth_get*"
+	Percentage float64
+}
+
+/**
+ * SamplingPolicy decides which requests are logged to the store with their payloads.
+ * requests are head sampled by trace id, so all proxies and services sharing a trace make the same decision.
+ * errors and slow requests can be always logged, they are decided when the response is written
+ */
+type SamplingPolicy struct {
+	Percentage      float64 // percentage of requests logged, 0 ~ 100
+	AlwaysLogErrors bool
+	SlowThreshold   time.Duration     // requests slower than it are always logged if > 0
+	MethodOverrides []*MethodSampling // the first matched override is used instead of Percentage
+	MaxPayloadBytes int               // params and results longer than it are truncated if > 0
+}
+
+// DefaultSamplingPolicy logs all requests with full payloads
+func DefaultSamplingPolicy() *SamplingPolicy {
+	return &SamplingPolicy{
+		Percentage: 100,
+	}
+}
+
+func validatePercentage(percentage float64) error {
+	if percentage < 0 || percentage > 100 {
+		return fmt.Errorf("invalid sampling percentage %v", percentage)
+	}
+	return nil
+}
+
+func (policy *SamplingPolicy) Validate() (err error) {
+	if err = validatePercentage(policy.Percentage); err != nil {
+		return
+	}
+	for _, override := range policy.MethodOverrides {
+		if err = validatePercentage(override.Percentage); err != nil {
+			return
+		}
+		for _, pattern := range override.Methods {
+			if _, err = path.Match(pattern, ""); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (policy *SamplingPolicy) percentageOf(methodName string) float64 {
+	for _, override := range policy.MethodOverrides {
+		for _, pattern := range override.Methods {
+			if matched, _ := path.Match(pattern, methodName); matched {
+				return override.Percentage
+			}
+		}
+	}
+	return policy.Percentage
+}
+
+// samplingPoint maps the request to [0, 1) by the random part of its trace id, random if not traced
+func samplingPoint(session *rpc.JSONRpcRequestSession) float64 {
+	sc := session.Span.SpanContext()
+	if !sc.IsValid() {
+		return rand.Float64()
+	}
+	// the right most 8 bytes of W3C trace id are random
+	return float64(binary.BigEndian.Uint64(sc.TraceId[8:])>>11) / float64(uint64(1)<<53)
+}
+
+// SampleRequest is the head sampling decision, made when the request is received
+func (policy *SamplingPolicy) SampleRequest(session *rpc.JSONRpcRequestSession) bool {
+	if session.Request == nil {
+		return false
+	}
+	percentage := policy.percentageOf(session.Request.Method)
+	if percentage <= 0 {
+		return false
+	}
+	if percentage >= 100 {
+		return true
+	}
+	return samplingPoint(session)*100 < percentage
+}
+
+// SampleResponse decides whether the written response is logged, it's true for head sampled requests
+func (policy *SamplingPolicy) SampleResponse(session *rpc.JSONRpcRequestSession) bool {
+	if policy.SampleRequest(session) {
+		return true
+	}
+	if policy.AlwaysLogErrors && (session.Response == nil || session.Response.Error != nil) {
+		return true
+	}
+	if policy.SlowThreshold > 0 && session.Latency() >= policy.SlowThreshold {
+		return true
+	}
+	return false
+}
+
+const truncatedPayloadSuffix = "...(truncated)"
+
+// truncatePayload cut {payload} longer than {maxBytes} bytes and mark it truncated, the result is never longer than {maxBytes}.
+// utf8 chars are kept whole, and the mark is dropped if there's no room for it. 0 means no limit
+func truncatePayload(payload string, maxBytes int) string {
+	if maxBytes <= 0 || len(payload) <= maxBytes {
+		return payload
+	}
+	if maxBytes < len(truncatedPayloadSuffix) {
+		return cutAtRuneBoundary(payload, maxBytes)
+	}
+	return cutAtRuneBoundary(payload, maxBytes-len(truncatedPayloadSuffix)) + truncatedPayloadSuffix
+}
+
+// cutAtRuneBoundary returns the longest prefix of {value} not longer than {maxBytes} without breaking utf8 chars
+func cutAtRuneBoundary(value string, maxBytes int) string {
+	if len(value) <= maxBytes {
+		return value
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
@@ -0,0 +1,99 @@
+package statistic
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
+)
+
+func newSampledSession(method string, traceIdByte byte) *rpc.JSONRpcRequestSession {
+	session := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+	session.FillRpcRequest(&rpc.JSONRpcRequest{Id: 1, Method: method}, nil)
+	var parent tracing.SpanContext
+	// the random part of the trace id decides the sampling point
+	parent.TraceId[8] = traceIdByte
+	parent.TraceId[0] = 1
+	parent.SpanId = tracing.NewSpanId()
+	parent.Sampled = true
+	session.Span = tracing.NewTracer(nil).StartSpan("test", tracing.SPAN_KIND_SERVER, parent)
+	return session
+}
+
+func TestSamplingPolicyHeadSampling(t *testing.T) {
+	policy := &SamplingPolicy{
+		Percentage: 50,
+		MethodOverrides: []*MethodSampling{
+			{Methods: []string{"eth_sendRawTransaction"}, Percentage: 100},
+			{Methods: []string{"eth_get*"}, Percentage: 0},
+		},
+	}
+	assert.Nil(t, policy.Validate())
+
+	low := newSampledSession("eth_call", 0x10)  // point 0.06
+	high := newSampledSession("eth_call", 0xf0) // point 0.94
+	assert.True(t, policy.SampleRequest(low))
+	assert.False(t, policy.SampleRequest(high))
+	// the decision is consistent for the same trace id
+	for i := 0; i < 10; i++ {
+		assert.True(t, policy.SampleRequest(newSampledSession("eth_call", 0x10)))
+	}
+
+	assert.True(t, policy.SampleRequest(newSampledSession("eth_sendRawTransaction", 0xf0)))
+	assert.False(t, policy.SampleRequest(newSampledSession("eth_getBalance", 0x10)))
+
+	assert.NotNil(t, (&SamplingPolicy{Percentage: 101}).Validate())
+	assert.NotNil(t, (&SamplingPolicy{MethodOverrides: []*MethodSampling{{Methods: []string{"["}}}}).Validate())
+}
+
+func TestSamplingPolicyErrorsAndSlowRequests(t *testing.T) {
+	policy := &SamplingPolicy{
+		Percentage:      0,
+		AlwaysLogErrors: true,
+		SlowThreshold:   100 * time.Millisecond,
+	}
+	session := newSampledSession("eth_call", 0x10)
+	session.FillRpcResponse(&rpc.JSONRpcResponse{Id: 1, Result: "0x"})
+	session.ResponseWrittenAt = session.ReceivedAt.Add(10 * time.Millisecond)
+	assert.False(t, policy.SampleRequest(session))
+	assert.False(t, policy.SampleResponse(session))
+
+	session.ResponseWrittenAt = session.ReceivedAt.Add(200 * time.Millisecond)
+	assert.True(t, policy.SampleResponse(session))
+
+	session.ResponseWrittenAt = session.ReceivedAt.Add(10 * time.Millisecond)
+	session.FillRpcResponse(&rpc.JSONRpcResponse{Id: 1, Error: rpc.NewJSONRpcResponseError(-32000, "error", nil)})
+	assert.True(t, policy.SampleResponse(session))
+}
+
+func TestTruncatePayload(t *testing.T) {
+	assert.Equal(t, "short", truncatePayload("short", 10))
+	assert.Equal(t, "short", truncatePayload("short", 0))
+	long := strings.Repeat("a", 100)
+	truncated := truncatePayload(long, 30)
+	assert.Equal(t, 30, len(truncated))
+	assert.True(t, strings.HasSuffix(truncated, "...(truncated)"))
+	// multi-byte chars are not broken
+	truncated = truncatePayload(strings.Repeat("中", 20), 30)
+	assert.True(t, strings.HasPrefix(truncated, strings.Repeat("中", 5)+"..."))
+	assert.True(t, utf8.ValidString(truncated))
+
+	// no room for the mark
+	assert.Equal(t, "aaaaa", truncatePayload(long, 5))
+	assert.Equal(t, "中", truncatePayload(strings.Repeat("中", 20), 5))
+	assert.Equal(t, "", truncatePayload(strings.Repeat("中", 20), 2))
+	assert.Equal(t, "aaaaaaaaaaaaa", truncatePayload(long, len(truncatedPayloadSuffix)-1))
+	// only room for the mark
+	assert.Equal(t, truncatedPayloadSuffix, truncatePayload(long, len(truncatedPayloadSuffix)))
+	assert.Equal(t, truncatedPayloadSuffix, truncatePayload(strings.Repeat("中", 20), len(truncatedPayloadSuffix)+2))
+	for maxBytes := 1; maxBytes <= 40; maxBytes++ {
+		truncated = truncatePayload("a"+strings.Repeat("中", 20), maxBytes)
+		assert.True(t, len(truncated) <= maxBytes)
+		assert.True(t, utf8.ValidString(truncated))
+	}
+	assert.Equal(t, "a中", truncateString("a中中", 5))
+}
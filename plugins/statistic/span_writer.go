@@ -0,0 +1,310 @@
+package statistic
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+)
+
+// reasons of dropped request spans
+const (
+	dropReasonEventQueueFull = "event_queue_full" // the statistic middleware's event channel is full
+	dropReasonWriteQueueFull = "write_queue_full" // the db writer's queue is full
+	dropReasonWriteFailed    = "write_failed"     // the batch insert failed after retries
+)
+
+var (
+	droppedSpansCounter = metrics.NewCounterVec("jsonrpc_proxy_statistic_dropped_spans_total",
+		"request spans not saved by the statistic plugin", "reason")
+	spanWriteRetriesCounter = metrics.NewCounter("jsonrpc_proxy_statistic_span_write_retries_total",
+		"retries of request span batch inserts after transient db errors")
+	spanBatchesCounter = metrics.NewCounter("jsonrpc_proxy_statistic_span_batches_total",
+		"request span batches inserted to db")
+)
+
+func init() {
+	metrics.MustRegister(droppedSpansCounter, spanWriteRetriesCounter, spanBatchesCounter)
+}
+
+// DbWriteOptions controls how request spans are buffered and written to db
+type DbWriteOptions struct {
+	BatchSize     int           // max rows of a multi-row insert
+	FlushInterval time.Duration // max time a span is buffered
+	QueueSize     int           // max spans buffered, more spans are dropped
+	MaxRetries    int           // retries of a batch after transient db errors
+	RetryBackoff  time.Duration // wait before the first retry, doubled for each retry
+}
+
+func DefaultDbWriteOptions() *DbWriteOptions {
+	return &DbWriteOptions{
+		BatchSize:     200,
+		FlushInterval: time.Second,
+		QueueSize:     10000,
+		MaxRetries:    3,
+		RetryBackoff:  100 * time.Millisecond,
+	}
+}
+
+func (options *DbWriteOptions) withDefaults() *DbWriteOptions {
+	defaults := DefaultDbWriteOptions()
+	result := *options
+	if result.BatchSize <= 0 {
+		result.BatchSize = defaults.BatchSize
+	}
+	if result.FlushInterval <= 0 {
+		result.FlushInterval = defaults.FlushInterval
+	}
+	if result.QueueSize <= 0 {
+		result.QueueSize = defaults.QueueSize
+	}
+	if result.QueueSize < result.BatchSize {
+		result.QueueSize = result.BatchSize
+	}
+	if result.MaxRetries < 0 {
+		result.MaxRetries = 0
+	}
+	if result.RetryBackoff <= 0 {
+		result.RetryBackoff = defaults.RetryBackoff
+	}
+	return &result
+}
+
+// requestSpanRow is a row of table request_span
+type requestSpanRow struct {
+	id                 uint64
+	annotation         string
+	traceId            string
+	rpcRequestId       string
+	rpcMethodName      string
+	rpcRequestParams   string
+	rpcResponseError   string
+	rpcResponseResult  string
+	targetServer       string
+	receivedAt         interface{}
+	upstreamSentAt     interface{}
+	upstreamReceivedAt interface{}
+	responseWrittenAt  interface{}
+}
+
+// sizes of the VARCHAR columns of table request_span
+const (
+	maxSpanTraceIdLength    = 100
+	maxSpanRequestIdLength  = 100
+	maxSpanMethodNameLength = 100
+)
+
+// fitColumns truncates the values chosen by clients to the sizes of the columns of {dialect},
+// so one row never fails the multi-row insert of its batch
+func (row *requestSpanRow) fitColumns(dialect *sqlDialect) {
+	row.traceId = truncateString(row.traceId, maxSpanTraceIdLength)
+	row.rpcRequestId = truncateString(row.rpcRequestId, maxSpanRequestIdLength)
+	row.rpcMethodName = truncateString(row.rpcMethodName, maxSpanMethodNameLength)
+	if dialect.maxTextBytes > 0 {
+		row.rpcRequestParams = truncatePayload(row.rpcRequestParams, dialect.maxTextBytes)
+		row.rpcResponseError = truncatePayload(row.rpcResponseError, dialect.maxTextBytes)
+		row.rpcResponseResult = truncatePayload(row.rpcResponseResult, dialect.maxTextBytes)
+		row.targetServer = truncateString(row.targetServer, dialect.maxTextBytes)
+	}
+}
+
+func (row *requestSpanRow) values() []interface{} {
+	return []interface{}{row.id, row.annotation, row.traceId, row.rpcRequestId, row.rpcMethodName,
+		row.rpcRequestParams, row.rpcResponseError, row.rpcResponseResult, row.targetServer,
+		row.receivedAt, row.upstreamSentAt, row.upstreamReceivedAt, row.responseWrittenAt}
+}
+
+const requestSpanInsertPrefix = "insert into request_span (`id`, `annotation`, `trace_id`, `rpc_request_id`, " +
+	"`rpc_method_name`, `rpc_request_params`, `rpc_response_error`, `rpc_response_result`, " +
+	"`target_server`, `received_at`, `upstream_sent_at`, `upstream_received_at`, `response_written_at`) values "
+
+const requestSpanColumns = 13
+
+const requestSpanRowPlaceholders = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+// requestSpanInsertSql returns the insert of {rows} request spans, rows with existing ids are skipped
+func requestSpanInsertSql(dialect *sqlDialect, rows int) string {
+	placeholders := make([]string, rows)
+	for i := range placeholders {
+		placeholders[i] = requestSpanRowPlaceholders
+	}
+	return requestSpanInsertPrefix + strings.Join(placeholders, ", ") + dialect.ignoreDuplicateSpanSql
+}
+
+// isTransientDbError returns true for errors which may succeed if retried, eg. broken connections and deadlocks
+func isTransientDbError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+		switch mysqlErr.Number {
+		case 1040, // too many connections
+			1205, // lock wait timeout
+			1213: // deadlock
+			return true
+		}
+	}
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "40001", // serialization failure
+			"40P01", // deadlock
+			"53300": // too many connections
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * spanBatchWriter buffers request spans and inserts them to db in batches by size or interval in background.
+ * spans are dropped and counted when the buffer is full, so a slow db never blocks the requests
+ */
+type spanBatchWriter struct {
+	options *DbWriteOptions
+	// insert writes rows in order, and returns how many leading rows are written when it fails
+	insert func(rows []*requestSpanRow) (inserted int, err error)
+	sleep  func(d time.Duration)
+
+	queue     chan *requestSpanRow
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+}
+
+func newSpanBatchWriter(options *DbWriteOptions, insert func(rows []*requestSpanRow) (int, error)) *spanBatchWriter {
+	options = options.withDefaults()
+	return &spanBatchWriter{
+		options:   options,
+		insert:    insert,
+		sleep:     time.Sleep,
+		queue:     make(chan *requestSpanRow, options.QueueSize),
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+}
+
+// newDbInsert returns the insert function of the writer using multi-row insert statements of db,
+// batches are split if they need more placeholders than the dialect allows.
+// the rows of committed chunks are reported as inserted, and a chunk committed before an error is skipped when retried
+func newDbInsert(db *sql.DB, dialect *sqlDialect) func(rows []*requestSpanRow) (int, error) {
+	maxRows := dialect.maxParams / requestSpanColumns
+	return func(rows []*requestSpanRow) (inserted int, err error) {
+		for inserted < len(rows) {
+			chunk := rows[inserted:]
+			if len(chunk) > maxRows {
+				chunk = chunk[:maxRows]
+			}
+			args := make([]interface{}, 0, len(chunk)*requestSpanColumns)
+			for _, row := range chunk {
+				args = append(args, row.values()...)
+			}
+			if _, err = db.Exec(dialect.rebind(requestSpanInsertSql(dialect, len(chunk))), args...); err != nil {
+				return
+			}
+			inserted += len(chunk)
+		}
+		return
+	}
+}
+
+func (writer *spanBatchWriter) start() {
+	writer.startOnce.Do(func() {
+		go writer.loop()
+	})
+}
+
+// enqueue never blocks, the span is dropped if the queue is full
+func (writer *spanBatchWriter) enqueue(row *requestSpanRow) {
+	select {
+	case writer.queue <- row:
+	default:
+		droppedSpansCounter.WithLabelValues(dropReasonWriteQueueFull).Inc()
+	}
+}
+
+func (writer *spanBatchWriter) write(rows []*requestSpanRow) {
+	if len(rows) < 1 {
+		return
+	}
+	backoff := writer.options.RetryBackoff
+	for retry := 0; ; retry++ {
+		inserted, err := writer.insert(rows)
+		if err == nil {
+			spanBatchesCounter.Inc()
+			return
+		}
+		// only the rows not written yet are retried or dropped
+		rows = rows[inserted:]
+		if retry >= writer.options.MaxRetries || !isTransientDbError(err) {
+			droppedSpansCounter.WithLabelValues(dropReasonWriteFailed).Add(float64(len(rows)))
+			log.Warnf("insert %d request spans error %s", len(rows), err.Error())
+			return
+		}
+		spanWriteRetriesCounter.Inc()
+		writer.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (writer *spanBatchWriter) loop() {
+	defer close(writer.stoppedCh)
+	ticker := time.NewTicker(writer.options.FlushInterval)
+	defer ticker.Stop()
+	batchSize := writer.options.BatchSize
+	batch := make([]*requestSpanRow, 0, batchSize)
+	flush := func() {
+		writer.write(batch)
+		batch = make([]*requestSpanRow, 0, batchSize)
+	}
+	for {
+		select {
+		case row := <-writer.queue:
+			batch = append(batch, row)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-writer.stopCh:
+			// write the queued spans before stopped
+			for {
+				select {
+				case row := <-writer.queue:
+					batch = append(batch, row)
+					if len(batch) >= batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// stop write the buffered spans and stop the background goroutine
+func (writer *spanBatchWriter) stop() {
+	writer.start()
+	writer.stopOnce.Do(func() {
+		close(writer.stopCh)
+	})
+	<-writer.stoppedCh
+}
@@ -0,0 +1,180 @@
+package statistic
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingInsert records the inserted batches and fails with the queued errors first
+type recordingInsert struct {
+	lock    sync.Mutex
+	batches [][]*requestSpanRow
+	errs    []error
+}
+
+func (r *recordingInsert) insert(rows []*requestSpanRow) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return 0, err
+	}
+	r.batches = append(r.batches, rows)
+	return len(rows), nil
+}
+
+func (r *recordingInsert) batchSizes() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var sizes []int
+	for _, batch := range r.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func TestRequestSpanInsertSql(t *testing.T) {
+	sql := requestSpanInsertSql(mysqlDialect, 3)
+	assert.True(t, strings.HasPrefix(sql, "insert into request_span ("))
+	assert.Equal(t, 3, strings.Count(sql, requestSpanRowPlaceholders))
+	assert.True(t, strings.HasSuffix(sql, " on duplicate key update `id`=`id`"))
+	assert.Equal(t, 13, len((&requestSpanRow{}).values()))
+}
+
+func TestSpanBatchWriterFlushBySizeAndInterval(t *testing.T) {
+	recorder := &recordingInsert{}
+	writer := newSpanBatchWriter(&DbWriteOptions{BatchSize: 3, FlushInterval: 50 * time.Millisecond}, recorder.insert)
+	writer.start()
+	for i := 0; i < 4; i++ {
+		writer.enqueue(&requestSpanRow{id: uint64(i)})
+	}
+	// the full batch is written at once, the remaining one after the flush interval
+	for i := 0; i < 100 && len(recorder.batchSizes()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []int{3, 1}, recorder.batchSizes())
+
+	writer.enqueue(&requestSpanRow{id: 5})
+	writer.stop()
+	assert.Equal(t, []int{3, 1, 1}, recorder.batchSizes())
+}
+
+func TestSpanBatchWriterDropsWhenFull(t *testing.T) {
+	recorder := &recordingInsert{}
+	writer := newSpanBatchWriter(&DbWriteOptions{BatchSize: 2, QueueSize: 2, FlushInterval: time.Hour}, recorder.insert)
+	before := droppedSpansCounter.WithLabelValues(dropReasonWriteQueueFull).Value()
+	// not started, so the queue is never consumed and enqueue must not block
+	for i := 0; i < 5; i++ {
+		writer.enqueue(&requestSpanRow{id: uint64(i)})
+	}
+	assert.Equal(t, float64(3), droppedSpansCounter.WithLabelValues(dropReasonWriteQueueFull).Value()-before)
+	writer.stop()
+	assert.Equal(t, []int{2}, recorder.batchSizes())
+}
+
+func TestSpanBatchWriterRetries(t *testing.T) {
+	recorder := &recordingInsert{errs: []error{driver.ErrBadConn, &mysql.MySQLError{Number: 1213, Message: "deadlock"}}}
+	writer := newSpanBatchWriter(&DbWriteOptions{BatchSize: 1, MaxRetries: 2}, recorder.insert)
+	var sleeps []time.Duration
+	writer.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+	writer.write([]*requestSpanRow{{id: 1}})
+	assert.Equal(t, []int{1}, recorder.batchSizes())
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, sleeps)
+
+	// non transient errors are not retried
+	failedBefore := droppedSpansCounter.WithLabelValues(dropReasonWriteFailed).Value()
+	recorder.errs = []error{errors.New("syntax error")}
+	sleeps = nil
+	writer.write([]*requestSpanRow{{id: 2}, {id: 3}})
+	assert.Equal(t, 0, len(sleeps))
+	assert.Equal(t, float64(2), droppedSpansCounter.WithLabelValues(dropReasonWriteFailed).Value()-failedBefore)
+	assert.Equal(t, []int{1}, recorder.batchSizes())
+}
+
+func TestSpanBatchWriterRetriesOnlyFailedRows(t *testing.T) {
+	var attempts [][]uint64
+	// the first chunk of 2 rows is written before the connection breaks
+	insert := func(rows []*requestSpanRow) (int, error) {
+		var ids []uint64
+		for _, row := range rows {
+			ids = append(ids, row.id)
+		}
+		attempts = append(attempts, ids)
+		if len(attempts) == 1 {
+			return 2, driver.ErrBadConn
+		}
+		if len(attempts) == 2 {
+			return 1, driver.ErrBadConn
+		}
+		return 0, errors.New("syntax error")
+	}
+	writer := newSpanBatchWriter(&DbWriteOptions{BatchSize: 5, MaxRetries: 3}, insert)
+	writer.sleep = func(d time.Duration) {}
+	failedBefore := droppedSpansCounter.WithLabelValues(dropReasonWriteFailed).Value()
+	writer.write([]*requestSpanRow{{id: 1}, {id: 2}, {id: 3}, {id: 4}, {id: 5}})
+	assert.Equal(t, [][]uint64{{1, 2, 3, 4, 5}, {3, 4, 5}, {4, 5}}, attempts)
+	// only the rows never written are dropped
+	assert.Equal(t, float64(2), droppedSpansCounter.WithLabelValues(dropReasonWriteFailed).Value()-failedBefore)
+}
+
+func TestDbInsertSkipsWrittenSpans(t *testing.T) {
+	store := createTestMetricStore()
+	if store == nil {
+		return
+	}
+	err := store.Init()
+	assert.True(t, err == nil)
+	id := uint64(time.Now().UnixNano())
+	insert := newDbInsert(store.db, store.dialect)
+	inserted, err := insert([]*requestSpanRow{{id: id, rpcMethodName: "first"}})
+	assert.True(t, err == nil)
+	assert.Equal(t, 1, inserted)
+	// a retried row written by an attempt reported as failed doesn't fail the batch
+	inserted, err = insert([]*requestSpanRow{{id: id, rpcMethodName: "retried"}, {id: id + 1, rpcMethodName: "second"}})
+	assert.True(t, err == nil)
+	assert.Equal(t, 2, inserted)
+	var count int
+	err = store.db.QueryRow(store.dialect.rebind("select count(*) from `request_span` where `id` in (?, ?)"), id, id+1).Scan(&count)
+	assert.True(t, err == nil)
+	assert.Equal(t, 2, count)
+	var method string
+	err = store.db.QueryRow(store.dialect.rebind("select `rpc_method_name` from `request_span` where `id` = ?"), id).Scan(&method)
+	assert.True(t, err == nil)
+	assert.Equal(t, "first", method)
+}
+
+func TestRequestSpanRowFitColumns(t *testing.T) {
+	newRow := func() *requestSpanRow {
+		return &requestSpanRow{
+			traceId:          strings.Repeat("t", 200),
+			rpcRequestId:     "1",
+			rpcMethodName:    strings.Repeat("m", 101),
+			rpcRequestParams: strings.Repeat("p", 100000),
+			targetServer:     "http://127.0.0.1:3000",
+		}
+	}
+	row := newRow()
+	row.fitColumns(mysqlDialect)
+	assert.Equal(t, maxSpanTraceIdLength, len(row.traceId))
+	assert.Equal(t, maxSpanMethodNameLength, len(row.rpcMethodName))
+	assert.Equal(t, "1", row.rpcRequestId)
+	assert.Equal(t, mysqlDialect.maxTextBytes, len(row.rpcRequestParams))
+	assert.True(t, strings.HasSuffix(row.rpcRequestParams, truncatedPayloadSuffix))
+	assert.Equal(t, "http://127.0.0.1:3000", row.targetServer)
+
+	// TEXT of postgres has no practical limit
+	row = newRow()
+	row.fitColumns(postgresDialect)
+	assert.Equal(t, maxSpanMethodNameLength, len(row.rpcMethodName))
+	assert.Equal(t, 100000, len(row.rpcRequestParams))
+}
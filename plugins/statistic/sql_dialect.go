@@ -0,0 +1,134 @@
+package statistic
+
+import (
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// store types of the sql metric stores, value of statistic store.type in config
+const (
+	STORE_TYPE_DB       = "db" // mysql, kept for old configs
+	STORE_TYPE_MYSQL    = "mysql"
+	STORE_TYPE_SQLITE   = "sqlite"
+	STORE_TYPE_POSTGRES = "postgres"
+)
+
+/**
+ * sqlDialect hides the differences of sql databases from the sql metric store.
+ * queries of the store are written in mysql style(`?` placeholders and backtick quoted names) and rebound for the dialect
+ */
+type sqlDialect struct {
+	name         string
+	driverName   string
+	maxParams    int // max placeholders in a statement
+	maxOpenConns int // 0 means no limit
+	maxTextBytes int // max bytes of TEXT columns, 0 means no limit
+	// upsert of service_health by service_url, with args (id, service_name, service_url, service_host, rtt, connected)
+	upsertServiceHealthSql string
+	// upsert of metric_rollup adding to the existing bucket, with args of rollupKeyColumns and rollupValueColumns
+	upsertRollupSql string
+	// upsert of client_usage adding to the existing row, with args of usageKeyColumns and usageValueColumns
+	upsertClientUsageSql string
+	// appended to inserts of request_span to skip rows whose id exists, so retried inserts are idempotent
+	ignoreDuplicateSpanSql string
+	// query taking the lock of migrations in its session, returning 1 if locked, so replicas starting together
+	// migrate one by one. empty if the db is not shared by proxies
+	lockMigrationsSql   string
+	unlockMigrationsSql string
+	migrations          []*migration
+}
+
+var mysqlDialect = &sqlDialect{
+	name:         STORE_TYPE_MYSQL,
+	driverName:   "mysql",
+	maxParams:    65535,
+	maxTextBytes: 65535,
+	upsertServiceHealthSql: "insert into `service_health` (`id`, `service_name`, `service_url`, `service_host`, `rtt`, `connected`)" +
+		" values (?, ?, ?, ?, ?, ?)" +
+		" on duplicate key update `service_host`=values(`service_host`), `rtt`=values(`rtt`), `connected`=values(`connected`)",
+	upsertRollupSql:        rollupUpsertSql(true),
+	upsertClientUsageSql:   clientUsageUpsertSql(true),
+	ignoreDuplicateSpanSql: " on duplicate key update `id`=`id`",
+	lockMigrationsSql:      "select get_lock('jsonrpc_proxygo_migrations', 300)",
+	unlockMigrationsSql:    "select release_lock('jsonrpc_proxygo_migrations')",
+	migrations:             mysqlMigrations,
+}
+
+var sqliteDialect = &sqlDialect{
+	name:       STORE_TYPE_SQLITE,
+	driverName: "sqlite3",
+	maxParams:  32766,
+	// sqlite allows only one writer, and each connection of ":memory:" is a different database
+	maxOpenConns: 1,
+	upsertServiceHealthSql: "insert into `service_health` (`id`, `service_name`, `service_url`, `service_host`, `rtt`, `connected`)" +
+		" values (?, ?, ?, ?, ?, ?)" +
+		" on conflict (`service_url`) do update set `service_host`=excluded.`service_host`, `rtt`=excluded.`rtt`," +
+		" `connected`=excluded.`connected`, `update_at`=CURRENT_TIMESTAMP",
+	upsertRollupSql:        rollupUpsertSql(false),
+	upsertClientUsageSql:   clientUsageUpsertSql(false),
+	ignoreDuplicateSpanSql: " on conflict (`id`) do nothing",
+	migrations:             sqliteMigrations,
+}
+
+var postgresDialect = &sqlDialect{
+	name:       STORE_TYPE_POSTGRES,
+	driverName: "postgres",
+	maxParams:  65535,
+	upsertServiceHealthSql: "insert into `service_health` (`id`, `service_name`, `service_url`, `service_host`, `rtt`, `connected`)" +
+		" values (?, ?, ?, ?, ?, ?)" +
+		" on conflict (`service_url`) do update set `service_host`=excluded.`service_host`, `rtt`=excluded.`rtt`," +
+		" `connected`=excluded.`connected`, `update_at`=CURRENT_TIMESTAMP",
+	upsertRollupSql:        rollupUpsertSql(false),
+	upsertClientUsageSql:   clientUsageUpsertSql(false),
+	ignoreDuplicateSpanSql: " on conflict (`id`) do nothing",
+	// pg_advisory_lock waits until locked and returns void
+	lockMigrationsSql:   "select 1 from (select pg_advisory_lock(7061626978)) as migrations_lock",
+	unlockMigrationsSql: "select pg_advisory_unlock(7061626978)",
+	migrations:          postgresMigrations,
+}
+
+// dialectOfStoreType returns the dialect of the sql store type, false if it's not a sql store
+func dialectOfStoreType(storeType string) (*sqlDialect, bool) {
+	switch strings.ToLower(storeType) {
+	case STORE_TYPE_DB, STORE_TYPE_MYSQL:
+		return mysqlDialect, true
+	case STORE_TYPE_SQLITE, "sqlite3":
+		return sqliteDialect, true
+	case STORE_TYPE_POSTGRES, "postgresql":
+		return postgresDialect, true
+	}
+	return nil, false
+}
+
+// rebind converts the mysql style query to the dialect, postgres uses $n placeholders and double quoted names
+func (dialect *sqlDialect) rebind(query string) string {
+	if dialect != postgresDialect {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inString = !inString
+			sb.WriteByte(c)
+		case inString:
+			sb.WriteByte(c)
+		case c == '`':
+			sb.WriteByte('"')
+		case c == '?':
+			n++
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(n))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -10,9 +10,11 @@ import (
 	"github.com/sparrc/go-ping"
 	"github.com/zoowii/jsonrpc_proxygo/common"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"io"
 	"time"
 )
 
@@ -25,8 +27,17 @@ type StatisticMiddleware struct {
 
 	metricOptions *MetricOptions
 	store         MetricStore
+	statusTracker *serviceStatusTracker
+	circuits      *upstreamCircuits
+
+	rollupFlushStarted bool
+	rollupStopCh       chan struct{}
+	rollupStoppedCh    chan struct{}
 }
 
+// rollupFlushInterval is how often completed minute rollups and client usage are saved by the store
+const rollupFlushInterval = 15 * time.Second
+
 func NewStatisticMiddleware(options ...common.Option) *StatisticMiddleware {
 	const maxRpcChannelSize = 10000
 
@@ -39,7 +50,23 @@ func NewStatisticMiddleware(options ...common.Option) *StatisticMiddleware {
 	if mOptions.store != nil {
 		store = mOptions.store
 	} else {
-		store = NewDefaultMetricStore()
+		store = newMemoryMetricStore(0, 0)
+	}
+
+	if mOptions.sampling == nil {
+		mOptions.sampling = DefaultSamplingPolicy()
+	}
+	if limitedStore, ok := store.(payloadLimitedStore); ok {
+		limitedStore.setMaxPayloadBytes(mOptions.sampling.MaxPayloadBytes)
+	}
+	if batchStore, ok := store.(batchWriteStore); ok && mOptions.dbWrite != nil {
+		batchStore.setWriteOptions(mOptions.dbWrite)
+	}
+	if retentionStore, ok := store.(rollupRetentionStore); ok && mOptions.rollupRetention != nil {
+		retentionStore.setRollupRetention(mOptions.rollupRetention)
+	}
+	if retentionStore, ok := store.(usageRetentionStore); ok && mOptions.usage != nil {
+		retentionStore.setUsageRetentionDays(mOptions.usage.RetentionDays)
 	}
 
 	err := store.Init()
@@ -52,6 +79,10 @@ func NewStatisticMiddleware(options ...common.Option) *StatisticMiddleware {
 		rpcResponsesReceived: make(chan *rpc.JSONRpcRequestSession, maxRpcChannelSize),
 		metricOptions:        mOptions,
 		store:                store,
+		statusTracker:        newServiceStatusTracker(),
+		circuits:             newUpstreamCircuits(),
+		rollupStopCh:         make(chan struct{}),
+		rollupStoppedCh:      make(chan struct{}),
 	}
 }
 
@@ -63,6 +94,11 @@ func (m *StatisticMiddleware) GetStore() MetricStore {
 	return m.store
 }
 
+// isClientRequest returns whether the request is from a client, not sent by middlewares themselves
+func isClientRequest(session *rpc.JSONRpcRequestSession) bool {
+	return session.Conn != nil && (session.Conn.Info == nil || session.Conn.Info.ProviderType != rpc.PROVIDER_INTERNAL)
+}
+
 func getMethodNameForRpcStatistic(session *rpc.JSONRpcRequestSession) string {
 	if session.MethodNameForCache != nil {
 		return *session.MethodNameForCache // cache name is more acurrate for statistic
@@ -70,11 +106,88 @@ func getMethodNameForRpcStatistic(session *rpc.JSONRpcRequestSession) string {
 	return session.Request.Method
 }
 
+// updateServiceStatus logs the service down or up again if the event of {reason} changes its status
+func (middleware *StatisticMiddleware) updateServiceStatus(ctx context.Context, service *registry.Service, reason string) {
+	changed, up := middleware.statusTracker.update(service.Url, reason)
+	if !changed {
+		return
+	}
+	log.Infof("service %s %s up=%v because of %s", service.Name, service.Url, up, reason)
+	middleware.store.LogServiceStatus(ctx, service, up, reason, time.Now())
+}
+
+// updateUpstreamCircuit logs the upstream of the request down or up when its circuit is opened or closed
+func (middleware *StatisticMiddleware) updateUpstreamCircuit(ctx context.Context, reqSession *rpc.JSONRpcRequestSession) {
+	if len(reqSession.TargetServer) < 1 || reqSession.UpstreamSentAt.IsZero() {
+		return
+	}
+	reason := middleware.circuits.update(reqSession.TargetServer, pluginsCommon.IsUpstreamFailure(reqSession.Response))
+	if len(reason) < 1 {
+		return
+	}
+	middleware.updateServiceStatus(ctx, middleware.serviceOfUpstream(reqSession.TargetServer), reason)
+}
+
+// serviceOfUpstream returns the registered service of the upstream url, or a service named by the url
+func (middleware *StatisticMiddleware) serviceOfUpstream(url string) *registry.Service {
+	if r := middleware.metricOptions.r; r != nil {
+		if services, err := r.ListServices(); err == nil {
+			for _, s := range services {
+				if s.Url == url {
+					return s
+				}
+			}
+		}
+	}
+	return &registry.Service{Name: url, Url: url}
+}
+
+// flushAggregates saves the rollups and client usage of the store
+func (middleware *StatisticMiddleware) flushAggregates(now time.Time) {
+	if err := middleware.store.FlushRollups(context.Background(), now); err != nil {
+		log.Warnf("flush rollups error %s", err.Error())
+	}
+	if middleware.metricOptions.usage == nil {
+		return
+	}
+	if err := middleware.store.FlushClientUsage(context.Background(), now); err != nil {
+		log.Warnf("flush client usage error %s", err.Error())
+	}
+}
+
+// flushRollups saves the completed rollups and client usage periodically in its own goroutine,
+// so a slow store never delays the statistic
+func (middleware *StatisticMiddleware) flushRollups() {
+	defer close(middleware.rollupStoppedCh)
+	ticker := time.NewTicker(rollupFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			middleware.flushAggregates(time.Now())
+		case <-middleware.rollupStopCh:
+			return
+		}
+	}
+}
+
 func (middleware *StatisticMiddleware) OnStart() (err error) {
+	middleware.rollupFlushStarted = true
+	go middleware.flushRollups()
 	go func() {
 		ctx := context.Background()
 
 		store := middleware.store
+		sampling := middleware.metricOptions.sampling
+
+		// services down before restarts are logged up again when registered or health checked
+		now := time.Now()
+		if lastLogs, queryErr := store.QueryServiceStatusLogs(ctx, now, now); queryErr == nil {
+			middleware.statusTracker.restore(lastLogs)
+			middleware.circuits.restore(lastLogs)
+		} else {
+			log.Warnf("query service status logs error %s", queryErr.Error())
+		}
 
 		dumpIntervalOpened := middleware.metricOptions.dumpIntervalOpened
 		dumpTick := time.Tick(60 * time.Second)
@@ -108,6 +221,9 @@ func (middleware *StatisticMiddleware) OnStart() (err error) {
 				}
 				// notify user every tick time
 			case <- pingTick:
+				if r == nil {
+					continue
+				}
 				// ping all upstream servers
 				allServices, listErr := r.ListServices()
 				if listErr != nil {
@@ -137,26 +253,43 @@ func (middleware *StatisticMiddleware) OnStart() (err error) {
 						log.Infof("service host %s avg RTT %d ms", host, rtt.Nanoseconds() / 1e6)
 						// update to store
 						store.UpdateServiceHostPing(context.Background(), s, rtt, connected)
+						reason := SERVICE_REASON_HEALTH_CHECK_PASSED
+						if !connected {
+							reason = SERVICE_REASON_HEALTH_CHECK_FAILED
+						}
+						middleware.updateServiceStatus(context.Background(), s, reason)
 					}(s)
 				}
 
 			case reqSession := <-middleware.rpcRequestsReceived:
 				methodNameForStatistic := getMethodNameForRpcStatistic(reqSession)
 
-				store.addRpcMethodCall(methodNameForStatistic)
+				store.AddRpcMethodCall(methodNameForStatistic)
 
-				// TODO: 根据策略随机采样或者全部记录请求和返回的数据
-				includeDebug := true
-				store.LogRequest(ctx, reqSession, includeDebug)
+				// errors and slow requests not head sampled are logged when their responses are written
+				if sampling.SampleRequest(reqSession) {
+					includeDebug := true
+					store.LogRequest(ctx, reqSession, includeDebug)
+				}
 			case resSession := <-middleware.rpcResponsesReceived:
-				includeDebug := true
-				store.logResponse(ctx, resSession, includeDebug)
+				store.AddRpcMethodCacheResult(getMethodNameForRpcStatistic(resSession), resSession)
+				store.AddRpcLatency(getMethodNameForRpcStatistic(resSession), resSession)
+				middleware.updateUpstreamCircuit(ctx, resSession)
+				if usage := middleware.metricOptions.usage; usage != nil && isClientRequest(resSession) {
+					store.AddClientUsage(usage.usageOfRequest(resSession))
+				}
+				if sampling.SampleResponse(resSession) {
+					includeDebug := true
+					store.LogResponse(ctx, resSession, includeDebug)
+				}
 			case registryEvent := <-registryEventChan:
 				log.Infof("receive registry event %s", registryEvent.String())
 				// 如果是服务掉线，发出提醒记录到数据库
 				switch registryEvent.Type {
 				case registry.SERVICE_REMOVE:
-					store.LogServiceDown(ctx, registryEvent.ServiceInfo)
+					middleware.updateServiceStatus(ctx, registryEvent.ServiceInfo, SERVICE_REASON_DEREGISTERED)
+				case registry.SERVICE_ADD:
+					middleware.updateServiceStatus(ctx, registryEvent.ServiceInfo, SERVICE_REASON_REGISTERED)
 				}
 			default:
 				time.Sleep(50 * time.Millisecond)
@@ -166,8 +299,13 @@ func (middleware *StatisticMiddleware) OnStart() (err error) {
 	return middleware.NextOnStart()
 }
 
+// OnConnection counts the connections rejected by the rate_limit plugin after this middleware to the client usage
 func (middleware *StatisticMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
-	return middleware.NextOnConnection(session)
+	err = middleware.NextOnConnection(session)
+	if usage := middleware.metricOptions.usage; usage != nil && err == pluginsCommon.ErrRateLimitExceeded {
+		middleware.store.AddClientUsage(usage.usageOfRateLimitDenial(session, time.Now()))
+	}
+	return
 }
 
 func (middleware *StatisticMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) (err error) {
@@ -179,12 +317,39 @@ func (middleware *StatisticMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequ
 	return middleware.NextOnWebSocketFrame(session, messageType, message)
 }
 func (middleware *StatisticMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
-	middleware.rpcRequestsReceived <- session
+	// never block the request if the statistic goroutine falls behind
+	select {
+	case middleware.rpcRequestsReceived <- session:
+	default:
+		droppedSpansCounter.WithLabelValues(dropReasonEventQueueFull).Inc()
+	}
 	return middleware.NextOnJSONRpcRequest(session)
 }
 func (middleware *StatisticMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) (err error) {
-	err = middleware.NextOnJSONRpcResponse(session)
-	middleware.rpcResponsesReceived <- session
+	return middleware.NextOnJSONRpcResponse(session)
+}
+
+// OnRpcResponseWritten log the response after written, so the whole latency of the request is known
+func (middleware *StatisticMiddleware) OnRpcResponseWritten(session *rpc.JSONRpcRequestSession) {
+	select {
+	case middleware.rpcResponsesReceived <- session:
+	default:
+		droppedSpansCounter.WithLabelValues(dropReasonEventQueueFull).Inc()
+	}
+}
+
+// OnStop write the rollups of the current minute and the buffered data of the store, if it's closable
+func (middleware *StatisticMiddleware) OnStop() (err error) {
+	if middleware.rollupFlushStarted {
+		middleware.rollupFlushStarted = false
+		close(middleware.rollupStopCh)
+		<-middleware.rollupStoppedCh
+	}
+	// rollups of the same minute are added up if the proxy restarts in the minute
+	middleware.flushAggregates(time.Now().Add(time.Minute))
+	if closer, ok := middleware.store.(io.Closer); ok {
+		err = closer.Close()
+	}
 	return
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
 	"time"
 )
 
@@ -25,6 +26,49 @@ type RequestSpanVo struct {
 	LogTime           *time.Time `json:"logTime"`
 	CreatedAt         time.Time  `json:"createdAt"`
 	UpdatedAt         time.Time  `json:"updatedAt"`
+
+	// timestamps of the request's stages, nil if not reached when the span logged
+	ReceivedAt         *time.Time `json:"receivedAt"`
+	UpstreamSentAt     *time.Time `json:"upstreamSentAt"`
+	UpstreamReceivedAt *time.Time `json:"upstreamReceivedAt"`
+	ResponseWrittenAt  *time.Time `json:"responseWrittenAt"`
+	LatencyMs          *float64   `json:"latencyMs,omitempty"`         // from received to response written
+	UpstreamLatencyMs  *float64   `json:"upstreamLatencyMs,omitempty"` // from sent to upstream to its response received
+}
+
+func millisecondsBetween(start *time.Time, end *time.Time) *float64 {
+	if start == nil || end == nil {
+		return nil
+	}
+	ms := float64(end.Sub(*start)) / float64(time.Millisecond)
+	return &ms
+}
+
+// fillLatency compute latencies by the timestamps
+func (vo *RequestSpanVo) fillLatency() {
+	vo.LatencyMs = millisecondsBetween(vo.ReceivedAt, vo.ResponseWrittenAt)
+	vo.UpstreamLatencyMs = millisecondsBetween(vo.UpstreamSentAt, vo.UpstreamReceivedAt)
+}
+
+// spanPayloads returns the params, response error and result of the request logged in spans, truncated if longer than {maxPayloadBytes}.
+// params are logged only if {includeDebug}, response error and result only if {withResponse}
+func spanPayloads(reqSession *rpc.JSONRpcRequestSession, includeDebug bool, withResponse bool,
+	maxPayloadBytes int) (params string, responseError string, responseResult string) {
+	if includeDebug {
+		params = truncatePayload(utils.JsonDumpsToStringSilently(reqSession.Request.Params, ""), maxPayloadBytes)
+	}
+	if !withResponse {
+		return
+	}
+	response := reqSession.Response
+	if response == nil {
+		responseError = "no response"
+	} else if response.Error != nil {
+		responseError = truncatePayload(utils.JsonDumpsToStringSilently(response.Error, response.Error.Message), maxPayloadBytes)
+	} else {
+		responseResult = truncatePayload(utils.JsonDumpsToStringSilently(response.Result, ""), maxPayloadBytes)
+	}
+	return
 }
 
 type RequestSpanListVo struct {
@@ -36,7 +80,9 @@ type ServiceLogVo struct {
 	Id          uint64     `json:"id"`
 	ServiceName string     `json:"serviceName"`
 	Url         string     `json:"url"`
-	DownTime    *time.Time `json:"downTime"`
+	DownTime    *time.Time `json:"downTime"`         // set if the service is found down
+	UpTime      *time.Time `json:"upTime,omitempty"` // set if the service is up again
+	Reason      string     `json:"reason"`           // SERVICE_REASON_*, empty of logs before reasons are recorded
 	CreatedAt   time.Time  `json:"createdAt"`
 	UpdatedAt   time.Time  `json:"updatedAt"`
 }
@@ -57,21 +103,80 @@ type ServiceHealthVo struct {
 	UpdatedAt   time.Time     `json:"updatedAt"`
 }
 
+// payloadLimitedStore is implemented by stores which truncate logged payloads
+type payloadLimitedStore interface {
+	setMaxPayloadBytes(maxBytes int)
+}
+
+// rollupRetentionStore is implemented by stores embedding BaseMetricStore
+type rollupRetentionStore interface {
+	setRollupRetention(retention *RollupRetention)
+}
+
+// usageRetentionStore is implemented by stores embedding BaseMetricStore
+type usageRetentionStore interface {
+	setUsageRetentionDays(days int)
+}
+
+// batchWriteStore is implemented by stores which buffer request spans and write them in batches
+type batchWriteStore interface {
+	setWriteOptions(options *DbWriteOptions)
+}
+
+/**
+ * MetricStore saves what the statistic plugin collects and serves the queries of the dashboard.
+ * stores outside this package can embed BaseMetricStore for the in-memory aggregates(DumpStatInfo and Add* methods),
+ * and be used by RegisterMetricStore or the UseStore option.
+ * the methods are called from the statistic middleware's goroutines and the dashboard concurrently
+ */
 type MetricStore interface {
+	// Name of the store type
 	Name() string
+	// Init is called once by the statistic middleware before the store is used
 	Init() error
 	// LogRequest store request info. if {includeDebug}==true, store request's content and debug info
 	LogRequest(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool)
-	// LogRequest store response info. if {includeDebug}==true, store response's content and debug info
-	logResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool)
+	// LogResponse store response info. if {includeDebug}==true, store response's content and debug info
+	LogResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool)
+	// QueryRequestSpanList returns the spans logged, newest first
 	QueryRequestSpanList(ctx context.Context, form *QueryLogForm) (*RequestSpanListVo, error)
 
+	// LogServiceDown store that the upstream service is removed from the registry,
+	// the same as LogServiceStatus of SERVICE_REASON_DEREGISTERED now
 	LogServiceDown(ctx context.Context, service *registry.Service)
+	// LogServiceStatus store that the upstream service is found down(or up again if {up}) at {at} because of {reason}
+	LogServiceStatus(ctx context.Context, service *registry.Service, up bool, reason string, at time.Time)
+	// QueryServiceDownLogs returns the service down logs, newest first
 	QueryServiceDownLogs(ctx context.Context, offset int, limit int) (*ServiceLogListVo, error)
+	// QueryServiceStatusLogs returns the up and down logs of all services in [from, to) oldest first,
+	// after the last log of each service before {from}, which is the status of the service at {from}
+	QueryServiceStatusLogs(ctx context.Context, from time.Time, to time.Time) ([]*ServiceLogVo, error)
 
+	// UpdateServiceHostPing store the latest health check result of the service
 	UpdateServiceHostPing(ctx context.Context, service *registry.Service, rtt time.Duration, connected bool)
+	// QueryServiceHealthByUrl returns the latest health check result of the service, nil if not checked yet
 	QueryServiceHealthByUrl(ctx context.Context, service *registry.Service) (*ServiceHealthVo, error)
 
+	// DumpStatInfo returns the aggregated call counts, cache results and latencies
 	DumpStatInfo() (dump *StatData, err error)
-	addRpcMethodCall(methodName string)
+	// AddRpcMethodCall count a call of the method
+	AddRpcMethodCall(methodName string)
+	// AddRpcMethodCacheResult count the cache hit or miss of the request
+	AddRpcMethodCacheResult(methodName string, reqSession *rpc.JSONRpcRequestSession)
+	// AddRpcLatency aggregate the latencies of the request with a written response
+	AddRpcLatency(methodName string, reqSession *rpc.JSONRpcRequestSession)
+
+	// FlushRollups saves the minute rollups completed before {now} with their hourly and daily downsamples,
+	// and removes rollups out of retention. called periodically and on stop
+	FlushRollups(ctx context.Context, now time.Time) error
+	// QueryRollups returns the rollups of the form's range, sorted by key and time
+	QueryRollups(ctx context.Context, form *QueryRollupForm) ([]*RollupPoint, error)
+
+	// AddClientUsage aggregate the usage of a client, saved by FlushClientUsage
+	AddClientUsage(usage *ClientUsageVo)
+	// FlushClientUsage saves the usage aggregated since the last flush, and removes daily usage out of retention.
+	// called periodically and on stop
+	FlushClientUsage(ctx context.Context, now time.Time) error
+	// QueryClientUsage returns the daily usage of clients in the form's range, grouped by the form's group_by
+	QueryClientUsage(ctx context.Context, form *QueryClientUsageForm) ([]*ClientUsageVo, error)
 }
@@ -5,17 +5,23 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/sony/sonyflake"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
-	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"os"
 	"time"
 )
 
-// createConn by dbUrl format like 'user:pass@tcp(ip:port)/dbName?param1=value1&param2=value2'
-func createConn(dbUrl string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dbUrl)
+// createConn by dbUrl of the dialect's driver, eg. 'user:pass@tcp(ip:port)/dbName?param1=value1&param2=value2' of mysql,
+// 'file:statistic.db?_journal_mode=WAL' of sqlite or 'postgres://user:pass@ip:port/dbName?sslmode=disable' of postgres
+func createConn(dialect *sqlDialect, dbUrl string) (*sql.DB, error) {
+	db, err := sql.Open(dialect.driverName, dbUrl)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.maxOpenConns > 0 {
+		db.SetMaxOpenConns(dialect.maxOpenConns)
+	}
 	return db, err
 }
 
@@ -27,123 +33,102 @@ func nextId(sf *sonyflake.Sonyflake) uint64 {
 	return id
 }
 
+// traceIdOfSession returns the trace id of the request's span, or the rpc request id if the request isn't traced
+func traceIdOfSession(reqSession *rpc.JSONRpcRequestSession) string {
+	if sc := reqSession.Span.SpanContext(); sc.IsValid() {
+		return sc.TraceId.String()
+	}
+	return fmt.Sprintf("%d", reqSession.Request.Id)
+}
+
+// nullableTime returns nil for zero time, so it's stored as NULL
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+/**
+ * metricDbStore saves request spans and service status to a sql database of the dialect(mysql, sqlite or postgres).
+ * the tables are created and migrated when the store starts
+ */
 type metricDbStore struct {
 	BaseMetricStore
-	dbUrl string
-	db    *sql.DB
-	sf    *sonyflake.Sonyflake
+	dialect         *sqlDialect
+	dbUrl           string
+	db              *sql.DB
+	sf              *sonyflake.Sonyflake
+	maxPayloadBytes int             // logged params and results are truncated if > 0
+	writeOptions    *DbWriteOptions // how request spans are buffered and written
+	writer          *spanBatchWriter
+}
+
+func (store *metricDbStore) setMaxPayloadBytes(maxBytes int) {
+	store.maxPayloadBytes = maxBytes
+}
+
+func (store *metricDbStore) setWriteOptions(options *DbWriteOptions) {
+	store.writeOptions = options
 }
 
-func newMetricDbStore(dbUrl string) *metricDbStore {
+func newMetricDbStore(dialect *sqlDialect, dbUrl string) *metricDbStore {
 	sonyFlakeSettings := sonyflake.Settings{
 		StartTime: time.Unix(0, 0),
 	}
 	sf := sonyflake.NewSonyflake(sonyFlakeSettings)
+	if sf == nil {
+		// sonyflake derives machine id from the private ip, use pid if the host has no private ip
+		sonyFlakeSettings.MachineID = func() (uint16, error) {
+			return uint16(os.Getpid()), nil
+		}
+		sf = sonyflake.NewSonyflake(sonyFlakeSettings)
+	}
 	return &metricDbStore{
-		dbUrl: dbUrl,
-		sf:    sf,
+		dialect: dialect,
+		dbUrl:   dbUrl,
+		sf:      sf,
 	}
 }
 
 func (store *metricDbStore) LogRequest(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
-	db := store.db
-	if db == nil {
-		return
-	}
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		log.Warn("metric db error", err)
-		return
-	}
-	defer func() {
-		if err != nil {
-			log.Errorf("tx error %s", err.Error())
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-	stmt, err := tx.Prepare("insert into request_span (`id`, `annotation`, `trace_id`, `rpc_request_id`, " +
-		"`rpc_method_name`, `rpc_request_params`, `rpc_response_error`, `rpc_response_result`, " +
-		"`target_server`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		log.Warn("metric db error", err)
-		return
-	}
-	id := nextId(store.sf)
-	annotation := "sr"
-	traceId := reqSession.Request.Id
-	rpcRequestId := fmt.Sprintf("%d", reqSession.Request.Id)
-	rpcMethodName := reqSession.Request.Method
-	var rpcRequestParams string
-	if includeDebug {
-		rpcRequestParams = utils.JsonDumpsToStringSilently(reqSession.Request.Params, "")
-	}
-	rpcResponseError := ""
-	rpcResponseResult := ""
-	targetServer := reqSession.TargetServer
-	_, err = stmt.Exec(id, annotation, traceId, rpcRequestId, rpcMethodName, rpcRequestParams,
-		rpcResponseError, rpcResponseResult, targetServer)
-	if err != nil {
+	if store.writer == nil {
 		return
 	}
+	row := &requestSpanRow{
+		id:            nextId(store.sf),
+		annotation:    "sr",
+		traceId:       traceIdOfSession(reqSession),
+		rpcRequestId:  fmt.Sprintf("%d", reqSession.Request.Id),
+		rpcMethodName: reqSession.Request.Method,
+		targetServer:  reqSession.TargetServer,
+		// later stages are still going on when the request is logged
+		receivedAt: nullableTime(reqSession.ReceivedAt),
+	}
+	row.rpcRequestParams, _, _ = spanPayloads(reqSession, includeDebug, false, store.maxPayloadBytes)
+	row.fitColumns(store.dialect)
+	store.writer.enqueue(row)
 }
 
-func (store *metricDbStore) logResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
-	db := store.db
-	if db == nil {
-		return
-	}
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		log.Warn("metric db error", err)
-		return
-	}
-	defer func() {
-		if err != nil {
-			log.Errorf("tx error %s", err.Error())
-			tx.Rollback()
-		} else {
-			tx.Commit()
-		}
-	}()
-	stmt, err := tx.Prepare("insert into request_span (`id`, `annotation`, `trace_id`, `rpc_request_id`, " +
-		"`rpc_method_name`, `rpc_request_params`, `rpc_response_error`, `rpc_response_result`, " +
-		"`target_server`) values (?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		log.Warn("metric db error", err)
-		return
-	}
-	id := nextId(store.sf)
-	annotation := "ss"
-	traceId := reqSession.Request.Id
-	rpcRequestId := fmt.Sprintf("%d", reqSession.Request.Id)
-	rpcMethodName := reqSession.Request.Method
-	var rpcRequestParams string
-	if includeDebug {
-		rpcRequestParams = utils.JsonDumpsToStringSilently(reqSession.Request.Params, "")
-	}
-	response := reqSession.Response
-	var rpcResponseError string
-	if response != nil {
-		if response.Error != nil {
-			rpcResponseError = utils.JsonDumpsToStringSilently(response.Error, response.Error.Message)
-		}
-	} else {
-		rpcResponseError = "no response"
-	}
-	var rpcResponseResult string
-	if response != nil {
-		if response.Error == nil {
-			rpcResponseResult = utils.JsonDumpsToStringSilently(response.Result, "")
-		}
-	}
-	targetServer := reqSession.TargetServer
-	_, err = stmt.Exec(id, annotation, traceId, rpcRequestId, rpcMethodName, rpcRequestParams,
-		rpcResponseError, rpcResponseResult, targetServer)
-	if err != nil {
+func (store *metricDbStore) LogResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
+	if store.writer == nil {
 		return
 	}
+	row := &requestSpanRow{
+		id:                 nextId(store.sf),
+		annotation:         "ss",
+		traceId:            traceIdOfSession(reqSession),
+		rpcRequestId:       fmt.Sprintf("%d", reqSession.Request.Id),
+		rpcMethodName:      reqSession.Request.Method,
+		targetServer:       reqSession.TargetServer,
+		receivedAt:         nullableTime(reqSession.ReceivedAt),
+		upstreamSentAt:     nullableTime(reqSession.UpstreamSentAt),
+		upstreamReceivedAt: nullableTime(reqSession.UpstreamRecvAt),
+		responseWrittenAt:  nullableTime(reqSession.ResponseWrittenAt),
+	}
+	row.rpcRequestParams, row.rpcResponseError, row.rpcResponseResult = spanPayloads(reqSession, includeDebug, true, store.maxPayloadBytes)
+	row.fitColumns(store.dialect)
+	store.writer.enqueue(row)
 }
 
 func (store *metricDbStore) QueryRequestSpanList(ctx context.Context, form *QueryLogForm) (result *RequestSpanListVo, err error) {
@@ -152,23 +137,17 @@ func (store *metricDbStore) QueryRequestSpanList(ctx context.Context, form *Quer
 		err = errors.New("metric db not init")
 		return
 	}
-	totalRows, err := db.Query("select count(1) from request_span")
+	// QueryRow releases the connection before the next query, sqlite store has only one connection
+	var total uint
+	err = db.QueryRow(store.dialect.rebind("select count(1) from `request_span`")).Scan(&total)
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
 	}
-	defer totalRows.Close()
-	var total uint
-	if totalRows.Next() {
-		err = totalRows.Scan(&total)
-		if err != nil {
-			log.Warn("metric db error", err)
-			return
-		}
-	}
-	rows, err := db.Query("select `id`, `annotation`, `trace_id`, `rpc_request_id`, `rpc_method_name`,"+
-		" `rpc_request_params`, `rpc_response_error`, `rpc_response_result`, `target_server`, `log_time`,"+
-		" `create_at`, `update_at` from `request_span` order by `create_at` desc limit ?, ?", form.Offset, form.Limit)
+	rows, err := db.Query(store.dialect.rebind("select `id`, `annotation`, `trace_id`, `rpc_request_id`, `rpc_method_name`,"+
+		" `rpc_request_params`, `rpc_response_error`, `rpc_response_result`, `target_server`, `received_at`,"+
+		" `upstream_sent_at`, `upstream_received_at`, `response_written_at`, `log_time`,"+
+		" `create_at`, `update_at` from `request_span` order by `create_at` desc limit ? offset ?"), form.Limit, form.Offset)
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
@@ -182,11 +161,13 @@ func (store *metricDbStore) QueryRequestSpanList(ctx context.Context, form *Quer
 		var item RequestSpanVo
 		err = rows.Scan(&item.Id, &item.Annotation, &item.TraceId, &item.RpcRequestId, &item.RpcMethodName,
 			&item.RpcRequestParams, &item.RpcResponseError, &item.RpcResponseResult, &item.TargetServer,
+			&item.ReceivedAt, &item.UpstreamSentAt, &item.UpstreamReceivedAt, &item.ResponseWrittenAt,
 			&item.LogTime, &item.CreatedAt, &item.UpdatedAt)
 		if err != nil {
 			log.Warn("metric db error", err)
 			return
 		}
+		item.fillLatency()
 		list.Items = append(list.Items, &item)
 	}
 	result = list
@@ -194,6 +175,10 @@ func (store *metricDbStore) QueryRequestSpanList(ctx context.Context, form *Quer
 }
 
 func (store *metricDbStore) LogServiceDown(ctx context.Context, service *registry.Service) {
+	store.LogServiceStatus(ctx, service, false, SERVICE_REASON_DEREGISTERED, time.Now())
+}
+
+func (store *metricDbStore) LogServiceStatus(ctx context.Context, service *registry.Service, up bool, reason string, at time.Time) {
 	db := store.db
 	if db == nil {
 		return
@@ -211,7 +196,12 @@ func (store *metricDbStore) LogServiceDown(ctx context.Context, service *registr
 			tx.Commit()
 		}
 	}()
-	stmt, err := tx.Prepare("insert into service_log (`id`, `service_name`, `url`, `down_time`) values (?, ?, ?, ?)")
+	timeColumn := "down_time"
+	if up {
+		timeColumn = "up_time"
+	}
+	stmt, err := tx.Prepare(store.dialect.rebind("insert into `service_log` (`id`, `service_name`, `url`, `" + timeColumn + "`, `reason`)" +
+		" values (?, ?, ?, ?, ?)"))
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
@@ -220,8 +210,9 @@ func (store *metricDbStore) LogServiceDown(ctx context.Context, service *registr
 	log.Infof("new service_log id %d", id)
 	serviceName := service.Name
 	serviceUrl := service.Url
-	downTime := time.Now().UTC()
-	_, err = stmt.Exec(id, serviceName, serviceUrl, downTime)
+	// timestamp columns keep seconds
+	logTime := at.UTC().Truncate(time.Second)
+	_, err = stmt.Exec(id, serviceName, serviceUrl, logTime, reason)
 	if err != nil {
 		return
 	}
@@ -233,22 +224,15 @@ func (store *metricDbStore) QueryServiceDownLogs(ctx context.Context, offset int
 		err = errors.New("metric db not init")
 		return
 	}
-	totalRows, err := db.Query("select count(1) from service_log where `down_time` is not null")
+	// QueryRow releases the connection before the next query, sqlite store has only one connection
+	var total uint
+	err = db.QueryRow(store.dialect.rebind("select count(1) from `service_log` where `down_time` is not null")).Scan(&total)
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
 	}
-	defer totalRows.Close()
-	var total uint
-	if totalRows.Next() {
-		err = totalRows.Scan(&total)
-		if err != nil {
-			log.Warn("metric db error", err)
-			return
-		}
-	}
-	rows, err := db.Query("select `id`, `service_name`, `url`, `down_time`,"+
-		" `create_at`, `update_at` from `service_log` where `down_time` is not null order by `create_at` desc limit ?, ?", offset, limit)
+	rows, err := db.Query(store.dialect.rebind("select "+serviceLogColumns+
+		" from `service_log` where `down_time` is not null order by `create_at` desc limit ? offset ?"), limit, offset)
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
@@ -258,16 +242,66 @@ func (store *metricDbStore) QueryServiceDownLogs(ctx context.Context, offset int
 		Items: make([]*ServiceLogVo, 0),
 		Total: total,
 	}
-	for ; rows.Next(); {
+	list.Items, err = scanServiceLogs(rows)
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	result = list
+	return
+}
+
+const serviceLogColumns = "`id`, `service_name`, `url`, `down_time`, `up_time`, coalesce(`reason`, ''), `create_at`, `update_at`"
+
+// scanServiceLogs reads the rows of serviceLogColumns
+func scanServiceLogs(rows *sql.Rows) ([]*ServiceLogVo, error) {
+	items := make([]*ServiceLogVo, 0)
+	for rows.Next() {
 		var item ServiceLogVo
-		err = rows.Scan(&item.Id, &item.ServiceName, &item.Url, &item.DownTime, &item.CreatedAt, &item.UpdatedAt)
+		err := rows.Scan(&item.Id, &item.ServiceName, &item.Url, &item.DownTime, &item.UpTime, &item.Reason,
+			&item.CreatedAt, &item.UpdatedAt)
 		if err != nil {
-			log.Warn("metric db error", err)
-			return
+			return nil, err
 		}
-		list.Items = append(list.Items, &item)
+		items = append(items, &item)
 	}
-	result = list
+	return items, rows.Err()
+}
+
+func (store *metricDbStore) QueryServiceStatusLogs(ctx context.Context, from time.Time, to time.Time) (result []*ServiceLogVo, err error) {
+	db := store.db
+	if db == nil {
+		err = errors.New("metric db not init")
+		return
+	}
+	const logTime = "coalesce(`up_time`, `down_time`)"
+	// ids increase with time, so the max id of a service before from is its last log
+	rows, err := db.QueryContext(ctx, store.dialect.rebind("select "+serviceLogColumns+" from `service_log` where `id` in"+
+		" (select max(`id`) from `service_log` where "+logTime+" < ? group by `url`)"+
+		" order by "+logTime+", `id`"), from.UTC())
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	lastLogs, err := scanServiceLogs(rows)
+	rows.Close()
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	rows, err = db.QueryContext(ctx, store.dialect.rebind("select "+serviceLogColumns+" from `service_log`"+
+		" where "+logTime+" >= ? and "+logTime+" < ? order by "+logTime+", `id`"), from.UTC(), to.UTC())
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	defer rows.Close()
+	logs, err := scanServiceLogs(rows)
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	result = append(lastLogs, logs...)
 	return
 }
 
@@ -289,9 +323,7 @@ func (store *metricDbStore) UpdateServiceHostPing(ctx context.Context, service *
 			tx.Commit()
 		}
 	}()
-	stmt, err := tx.Prepare("insert INTO service_health (`id`, `service_name`, `service_url`, `service_host`, `rtt`, `connected`)" +
-		" VALUES (?, ?, ?, ?, ?, ?)" +
-		" on DUPLICATE  key update `service_url`=?, `service_host`=?, `rtt`=?, `connected`=?")
+	stmt, err := tx.Prepare(store.dialect.rebind(store.dialect.upsertServiceHealthSql))
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
@@ -306,7 +338,7 @@ func (store *metricDbStore) UpdateServiceHostPing(ctx context.Context, service *
 		connectedInt = 1
 	}
 	rttInt := rtt.Nanoseconds() / 1e6
-	_, err = stmt.Exec(id, serviceName, serviceUrl, host, rttInt, connectedInt, serviceUrl, host, rttInt, connectedInt)
+	_, err = stmt.Exec(id, serviceName, serviceUrl, host, rttInt, connectedInt)
 	if err != nil {
 		return
 	}
@@ -320,8 +352,8 @@ func (store *metricDbStore) QueryServiceHealthByUrl(ctx context.Context, service
 		return
 	}
 	serviceUrl := service.Url
-	rows, err := db.Query("select `id`, `service_name`, `service_url`, `service_host`, `rtt`, `connected`,"+
-		" `create_at`, `update_at` from `service_health` where service_url=?", serviceUrl)
+	rows, err := db.Query(store.dialect.rebind("select `id`, `service_name`, `service_url`, `service_host`, `rtt`, `connected`,"+
+		" `create_at`, `update_at` from `service_health` where `service_url`=?"), serviceUrl)
 	if err != nil {
 		log.Warn("metric db error", err)
 		return
@@ -346,10 +378,8 @@ func (store *metricDbStore) QueryServiceHealthByUrl(ctx context.Context, service
 	return
 }
 
-const metricDbStoreName = "db"
-
 func (store *metricDbStore) Name() string {
-	return metricDbStoreName
+	return store.dialect.name
 }
 
 func (store *metricDbStore) Init() error {
@@ -357,10 +387,32 @@ func (store *metricDbStore) Init() error {
 	if err != nil {
 		return err
 	}
-	db, err := createConn(store.dbUrl)
+	if store.db != nil {
+		return nil
+	}
+	db, err := createConn(store.dialect, store.dbUrl)
 	if err != nil {
 		return err
 	}
+	// the proxy keeps serving if the db is unavailable, request spans are dropped until it's back
+	if err = migrate(db, store.dialect); err != nil {
+		log.Errorf("migrate %s metric store error %s", store.dialect.name, err.Error())
+	}
 	store.db = db
+	writeOptions := store.writeOptions
+	if writeOptions == nil {
+		writeOptions = DefaultDbWriteOptions()
+	}
+	store.writer = newSpanBatchWriter(writeOptions, newDbInsert(db, store.dialect))
+	store.writer.start()
 	return nil
 }
+
+// Close write the buffered request spans and close the db
+func (store *metricDbStore) Close() error {
+	if store.db == nil {
+		return nil
+	}
+	store.writer.stop()
+	return store.db.Close()
+}
@@ -0,0 +1,268 @@
+package statistic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+const (
+	defaultMemoryStoreCapacity      = 10000
+	defaultMemoryStoreEventCapacity = 1000
+)
+
+// ringBuffer keeps the last {capacity} items, the oldest item is overwritten when full
+type ringBuffer struct {
+	items []interface{}
+	next  int // position of the next item
+	size  int
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{
+		items: make([]interface{}, capacity),
+	}
+}
+
+func (ring *ringBuffer) push(item interface{}) {
+	ring.items[ring.next] = item
+	ring.next = (ring.next + 1) % len(ring.items)
+	if ring.size < len(ring.items) {
+		ring.size++
+	}
+}
+
+// newest returns at most {limit} items after skipping the newest {offset} items, newest first
+func (ring *ringBuffer) newest(offset int, limit int) []interface{} {
+	result := make([]interface{}, 0)
+	for i := offset; i < ring.size && len(result) < limit; i++ {
+		pos := (ring.next - 1 - i + 2*len(ring.items)) % len(ring.items)
+		result = append(result, ring.items[pos])
+	}
+	return result
+}
+
+/**
+ * memoryMetricStore keeps the last request spans, service down logs and health results in memory,
+ * so the dashboard works without a database. all data is lost when the proxy stops
+ */
+type memoryMetricStore struct {
+	BaseMetricStore
+	capacity        int
+	eventCapacity   int
+	maxPayloadBytes int // logged params and results are truncated if > 0
+
+	lastId uint64
+
+	lock        sync.RWMutex
+	spans       *ringBuffer // of *RequestSpanVo
+	serviceLogs *ringBuffer // of *ServiceLogVo
+	health      map[string]*ServiceHealthVo
+}
+
+// newMemoryMetricStore keeps at most {capacity} request spans, {eventCapacity} service down logs and health results
+func newMemoryMetricStore(capacity int, eventCapacity int) *memoryMetricStore {
+	if capacity <= 0 {
+		capacity = defaultMemoryStoreCapacity
+	}
+	if eventCapacity <= 0 {
+		eventCapacity = defaultMemoryStoreEventCapacity
+	}
+	return &memoryMetricStore{
+		capacity:      capacity,
+		eventCapacity: eventCapacity,
+	}
+}
+
+func (store *memoryMetricStore) setMaxPayloadBytes(maxBytes int) {
+	store.maxPayloadBytes = maxBytes
+}
+
+func (store *memoryMetricStore) Name() string {
+	return STORE_TYPE_MEMORY
+}
+
+func (store *memoryMetricStore) Init() error {
+	store.lock.Lock()
+	store.spans = newRingBuffer(store.capacity)
+	store.serviceLogs = newRingBuffer(store.eventCapacity)
+	store.health = make(map[string]*ServiceHealthVo)
+	store.lock.Unlock()
+	return store.BaseMetricStore.Init()
+}
+
+func (store *memoryMetricStore) nextId() uint64 {
+	return atomic.AddUint64(&store.lastId, 1)
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (store *memoryMetricStore) logSpan(reqSession *rpc.JSONRpcRequestSession, annotation string, includeDebug bool) {
+	now := time.Now()
+	span := &RequestSpanVo{
+		Id:            store.nextId(),
+		Annotation:    annotation,
+		TraceId:       traceIdOfSession(reqSession),
+		RpcRequestId:  fmt.Sprintf("%d", reqSession.Request.Id),
+		RpcMethodName: reqSession.Request.Method,
+		TargetServer:  reqSession.TargetServer,
+		LogTime:       &now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		ReceivedAt:    timePtr(reqSession.ReceivedAt),
+	}
+	withResponse := annotation == "ss"
+	if withResponse {
+		span.UpstreamSentAt = timePtr(reqSession.UpstreamSentAt)
+		span.UpstreamReceivedAt = timePtr(reqSession.UpstreamRecvAt)
+		span.ResponseWrittenAt = timePtr(reqSession.ResponseWrittenAt)
+	}
+	span.RpcRequestParams, span.RpcResponseError, span.RpcResponseResult = spanPayloads(reqSession, includeDebug,
+		withResponse, store.maxPayloadBytes)
+	span.fillLatency()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.spans.push(span)
+}
+
+func (store *memoryMetricStore) LogRequest(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
+	store.logSpan(reqSession, "sr", includeDebug)
+}
+
+func (store *memoryMetricStore) LogResponse(ctx context.Context, reqSession *rpc.JSONRpcRequestSession, includeDebug bool) {
+	store.logSpan(reqSession, "ss", includeDebug)
+}
+
+func (store *memoryMetricStore) QueryRequestSpanList(ctx context.Context, form *QueryLogForm) (*RequestSpanListVo, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	list := &RequestSpanListVo{
+		Items: make([]*RequestSpanVo, 0),
+		Total: uint(store.spans.size),
+	}
+	for _, item := range store.spans.newest(int(form.Offset), int(form.Limit)) {
+		span := *item.(*RequestSpanVo)
+		list.Items = append(list.Items, &span)
+	}
+	return list, nil
+}
+
+func (store *memoryMetricStore) LogServiceDown(ctx context.Context, service *registry.Service) {
+	store.LogServiceStatus(ctx, service, false, SERVICE_REASON_DEREGISTERED, time.Now())
+}
+
+func (store *memoryMetricStore) LogServiceStatus(ctx context.Context, service *registry.Service, up bool, reason string, at time.Time) {
+	now := time.Now()
+	serviceLog := &ServiceLogVo{
+		Id:          store.nextId(),
+		ServiceName: service.Name,
+		Url:         service.Url,
+		Reason:      reason,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if up {
+		serviceLog.UpTime = &at
+	} else {
+		serviceLog.DownTime = &at
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.serviceLogs.push(serviceLog)
+}
+
+// QueryServiceDownLogs returns the down logs of the service logs kept, which are up and down logs
+func (store *memoryMetricStore) QueryServiceDownLogs(ctx context.Context, offset int, limit int) (*ServiceLogListVo, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	list := &ServiceLogListVo{
+		Items: make([]*ServiceLogVo, 0),
+	}
+	for _, item := range store.serviceLogs.newest(0, store.serviceLogs.size) {
+		serviceLog := *item.(*ServiceLogVo)
+		if serviceLog.Up() {
+			continue
+		}
+		if int(list.Total) >= offset && len(list.Items) < limit {
+			list.Items = append(list.Items, &serviceLog)
+		}
+		list.Total++
+	}
+	return list, nil
+}
+
+func (store *memoryMetricStore) QueryServiceStatusLogs(ctx context.Context, from time.Time, to time.Time) ([]*ServiceLogVo, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	lastLogs := make(map[string]*ServiceLogVo)
+	logs := make([]*ServiceLogVo, 0)
+	for _, item := range store.serviceLogs.newest(0, store.serviceLogs.size) {
+		serviceLog := *item.(*ServiceLogVo)
+		logTime := serviceLog.Time()
+		if logTime.Before(from) {
+			if _, ok := lastLogs[serviceLog.Url]; !ok {
+				lastLogs[serviceLog.Url] = &serviceLog
+			}
+		} else if logTime.Before(to) {
+			logs = append(logs, &serviceLog)
+		}
+	}
+	result := make([]*ServiceLogVo, 0, len(lastLogs)+len(logs))
+	for _, serviceLog := range lastLogs {
+		result = append(result, serviceLog)
+	}
+	sortServiceLogs(result)
+	sortServiceLogs(logs)
+	return append(result, logs...), nil
+}
+
+func (store *memoryMetricStore) UpdateServiceHostPing(ctx context.Context, service *registry.Service, rtt time.Duration, connected bool) {
+	now := time.Now()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	health, ok := store.health[service.Url]
+	if !ok {
+		// evict the health result not updated for the longest time
+		if len(store.health) >= store.eventCapacity {
+			var oldest *ServiceHealthVo
+			for _, item := range store.health {
+				if oldest == nil || item.UpdatedAt.Before(oldest.UpdatedAt) {
+					oldest = item
+				}
+			}
+			delete(store.health, oldest.ServiceUrl)
+		}
+		health = &ServiceHealthVo{
+			Id:         store.nextId(),
+			ServiceUrl: service.Url,
+			CreatedAt:  now,
+		}
+		store.health[service.Url] = health
+	}
+	health.ServiceName = service.Name
+	health.ServiceHost = service.Host
+	health.Rtt = rtt.Nanoseconds() / 1e6
+	health.Connected = connected
+	health.UpdatedAt = now
+}
+
+func (store *memoryMetricStore) QueryServiceHealthByUrl(ctx context.Context, service *registry.Service) (*ServiceHealthVo, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	health, ok := store.health[service.Url]
+	if !ok {
+		return nil, nil
+	}
+	result := *health
+	return &result, nil
+}
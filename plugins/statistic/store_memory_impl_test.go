@@ -0,0 +1,127 @@
+package statistic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func TestMemoryMetricStoreRequestSpans(t *testing.T) {
+	store := newMemoryMetricStore(3, 0)
+	assert.Nil(t, store.Init())
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		session := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+		session.FillRpcRequest(&rpc.JSONRpcRequest{Id: uint64(i), Method: "eth_call", Params: []interface{}{i}}, nil)
+		session.FillRpcResponse(&rpc.JSONRpcResponse{Id: uint64(i), Result: "0x1"})
+		session.ResponseWrittenAt = session.ReceivedAt.Add(5 * time.Millisecond)
+		store.LogResponse(ctx, session, i%2 == 1)
+	}
+	// only the last 3 spans are kept, newest first
+	list, err := store.QueryRequestSpanList(ctx, &QueryLogForm{Offset: 0, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, uint(3), list.Total)
+	var ids []string
+	for _, span := range list.Items {
+		ids = append(ids, span.RpcRequestId)
+	}
+	assert.Equal(t, []string{"5", "4", "3"}, ids)
+	assert.Equal(t, "[5]", list.Items[0].RpcRequestParams)
+	assert.Equal(t, "", list.Items[1].RpcRequestParams)
+	assert.Equal(t, "\"0x1\"", list.Items[0].RpcResponseResult)
+	assert.NotNil(t, list.Items[0].LatencyMs)
+	assert.Equal(t, float64(5), *list.Items[0].LatencyMs)
+
+	list, err = store.QueryRequestSpanList(ctx, &QueryLogForm{Offset: 2, Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list.Items))
+	assert.Equal(t, "3", list.Items[0].RpcRequestId)
+}
+
+func TestMemoryMetricStoreServiceEvents(t *testing.T) {
+	store := newMemoryMetricStore(0, 2)
+	assert.Nil(t, store.Init())
+	ctx := context.Background()
+	services := make([]*registry.Service, 3)
+	for i := range services {
+		services[i] = &registry.Service{
+			Name: "test",
+			Url:  fmt.Sprintf("http://test:1234/service%d", i),
+			Host: "127.0.0.1",
+		}
+		store.LogServiceDown(ctx, services[i])
+		store.UpdateServiceHostPing(ctx, services[i], 20*time.Millisecond, i > 0)
+	}
+	logs, err := store.QueryServiceDownLogs(ctx, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), logs.Total)
+	assert.Equal(t, services[2].Url, logs.Items[0].Url)
+	assert.Equal(t, services[1].Url, logs.Items[1].Url)
+
+	// the health result updated earliest is evicted
+	health, err := store.QueryServiceHealthByUrl(ctx, services[0])
+	assert.Nil(t, err)
+	assert.Nil(t, health)
+	health, err = store.QueryServiceHealthByUrl(ctx, services[2])
+	assert.Nil(t, err)
+	assert.True(t, health.Connected)
+	assert.Equal(t, int64(20), health.Rtt)
+
+	store.UpdateServiceHostPing(ctx, services[2], 30*time.Millisecond, false)
+	health, _ = store.QueryServiceHealthByUrl(ctx, services[2])
+	assert.False(t, health.Connected)
+	assert.Equal(t, int64(30), health.Rtt)
+}
+
+type testExternalStore struct {
+	dummyMetricStore
+}
+
+func (store *testExternalStore) Name() string {
+	return "external"
+}
+
+func TestRegisterMetricStore(t *testing.T) {
+	RegisterMetricStore("External", func(config *StoreConfig) (MetricStore, error) {
+		return &testExternalStore{}, nil
+	})
+	store, err := NewMetricStore(&StoreConfig{Type: "external"})
+	assert.Nil(t, err)
+	assert.Equal(t, "external", store.Name())
+
+	store, err = NewMetricStore(&StoreConfig{Type: STORE_TYPE_MEMORY, Capacity: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, store.(*memoryMetricStore).capacity)
+
+	_, err = NewMetricStore(&StoreConfig{Type: STORE_TYPE_MYSQL})
+	assert.NotNil(t, err)
+	_, err = NewMetricStore(&StoreConfig{Type: "unknown"})
+	assert.NotNil(t, err)
+}
+
+func TestMemoryMetricStoreServiceStatusLogs(t *testing.T) {
+	store := newMemoryMetricStore(0, 0)
+	assert.Nil(t, store.Init())
+	ctx := context.Background()
+	service := &registry.Service{Name: "test", Url: "http://test:1234/service"}
+	now := time.Now()
+	store.LogServiceStatus(ctx, service, false, SERVICE_REASON_DEREGISTERED, now.Add(-3*time.Hour))
+	store.LogServiceStatus(ctx, service, true, SERVICE_REASON_REGISTERED, now.Add(-2*time.Hour))
+	store.LogServiceStatus(ctx, service, false, SERVICE_REASON_HEALTH_CHECK_FAILED, now.Add(-time.Hour))
+
+	logs, err := store.QueryServiceStatusLogs(ctx, now.Add(-90*time.Minute), now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(logs))
+	assert.Equal(t, SERVICE_REASON_REGISTERED, logs[0].Reason)
+	assert.Equal(t, SERVICE_REASON_HEALTH_CHECK_FAILED, logs[1].Reason)
+
+	downLogs, err := store.QueryServiceDownLogs(ctx, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), downLogs.Total)
+	assert.Equal(t, SERVICE_REASON_HEALTH_CHECK_FAILED, downLogs.Items[0].Reason)
+}
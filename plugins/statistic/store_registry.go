@@ -0,0 +1,79 @@
+package statistic
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// store types of the bundled non-sql metric stores
+const (
+	STORE_TYPE_DUMMY  = "dummy"
+	STORE_TYPE_MEMORY = "memory"
+)
+
+// StoreConfig is the config of a metric store passed to its factory, fields not used by the store type are ignored
+type StoreConfig struct {
+	Type          string
+	DbUrl         string // DSN of the sql stores
+	Capacity      int    // max request spans kept by the memory store
+	EventCapacity int    // max service events and health results kept by the memory store
+}
+
+// MetricStoreFactory creates a store of the config, the store is initialized by the statistic middleware later
+type MetricStoreFactory func(config *StoreConfig) (MetricStore, error)
+
+var (
+	storeFactoriesLock sync.RWMutex
+	storeFactories     = make(map[string]MetricStoreFactory)
+)
+
+// RegisterMetricStore make the store type usable as statistic store.type in config, types are case insensitive.
+// a registered type is replaced by the later one
+func RegisterMetricStore(storeType string, factory MetricStoreFactory) {
+	storeFactoriesLock.Lock()
+	defer storeFactoriesLock.Unlock()
+	storeFactories[strings.ToLower(storeType)] = factory
+}
+
+// NewMetricStore creates a store by the registered factory of config's type
+func NewMetricStore(config *StoreConfig) (MetricStore, error) {
+	storeFactoriesLock.RLock()
+	factory, ok := storeFactories[strings.ToLower(config.Type)]
+	storeFactoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown metric store type %s", config.Type)
+	}
+	return factory(config)
+}
+
+func newSqlStoreFactory(dialect *sqlDialect, defaultDbUrl string) MetricStoreFactory {
+	return func(config *StoreConfig) (MetricStore, error) {
+		dbUrl := config.DbUrl
+		if len(dbUrl) < 1 {
+			dbUrl = defaultDbUrl
+		}
+		if len(dbUrl) < 1 {
+			return nil, fmt.Errorf("dbUrl of %s metric store not set", dialect.name)
+		}
+		return newMetricDbStore(dialect, dbUrl), nil
+	}
+}
+
+func init() {
+	RegisterMetricStore(STORE_TYPE_DUMMY, func(config *StoreConfig) (MetricStore, error) {
+		return &dummyMetricStore{}, nil
+	})
+	RegisterMetricStore(STORE_TYPE_MEMORY, func(config *StoreConfig) (MetricStore, error) {
+		return newMemoryMetricStore(config.Capacity, config.EventCapacity), nil
+	})
+	mysqlFactory := newSqlStoreFactory(mysqlDialect, "")
+	RegisterMetricStore(STORE_TYPE_DB, mysqlFactory)
+	RegisterMetricStore(STORE_TYPE_MYSQL, mysqlFactory)
+	sqliteFactory := newSqlStoreFactory(sqliteDialect, defaultSqliteDbUrl)
+	RegisterMetricStore(STORE_TYPE_SQLITE, sqliteFactory)
+	RegisterMetricStore("sqlite3", sqliteFactory)
+	postgresFactory := newSqlStoreFactory(postgresDialect, "")
+	RegisterMetricStore(STORE_TYPE_POSTGRES, postgresFactory)
+	RegisterMetricStore("postgresql", postgresFactory)
+}
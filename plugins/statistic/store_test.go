@@ -2,19 +2,31 @@ package statistic
 
 import (
 	"context"
+	"github.com/stretchr/testify/assert"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+// createTestMetricStore creates store of DATABASE_TYPE(mysql by default) and DATABASE_URL,
+// or an in-memory sqlite store if DATABASE_URL is not set
 func createTestMetricStore() *metricDbStore {
 	dbUrl := os.Getenv("DATABASE_URL")
 	log.Infof("DATABASE_URL=%s", dbUrl)
 	if len(dbUrl) < 1 {
+		return newMetricDbStore(sqliteDialect, ":memory:")
+	}
+	dialect, ok := dialectOfStoreType(utils.StringOrElse(os.Getenv("DATABASE_TYPE"), STORE_TYPE_MYSQL))
+	if !ok {
 		return nil
 	}
-	return newMetricDbStore(dbUrl)
+	return newMetricDbStore(dialect, dbUrl)
 }
 
 func TestMetricDbStore_LogServiceDown(t *testing.T) {
@@ -95,5 +107,226 @@ func TestMetricDbStore_UpdateServiceHostPing(t *testing.T) {
 		t.Errorf("query no service health record of host %s", service.Host)
 		return
 	}
-	log.Infof("found health record rtt = %d ms", healthRecord.Rtt.Milliseconds())
+	log.Infof("found health record rtt = %d ms", healthRecord.Rtt)
+
+	// the record of the service url is updated
+	store.UpdateServiceHostPing(ctx, service, 2 * time.Second, false)
+	healthRecord, err = store.QueryServiceHealthByUrl(ctx, service)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), healthRecord.Rtt)
+	assert.False(t, healthRecord.Connected)
+}
+
+func TestMetricDbStore_RequestSpans(t *testing.T) {
+	store := createTestMetricStore()
+	if store == nil {
+		return
+	}
+	store.setWriteOptions(&DbWriteOptions{BatchSize: 10, FlushInterval: 10 * time.Millisecond})
+	err := store.Init()
+	assert.Nil(t, err)
+	defer store.Close()
+	ctx := context.Background()
+
+	session := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+	methodName := "test_method_" + time.Now().Format("150405.000000")
+	session.FillRpcRequest(&rpc.JSONRpcRequest{Id: 1, Method: methodName, Params: []interface{}{"a", 1}}, nil)
+	session.FillRpcResponse(&rpc.JSONRpcResponse{Id: 1, Result: "ok"})
+	session.UpstreamSentAt = session.ReceivedAt.Add(time.Millisecond)
+	session.UpstreamRecvAt = session.ReceivedAt.Add(3 * time.Millisecond)
+	session.ResponseWrittenAt = session.ReceivedAt.Add(4 * time.Millisecond)
+	store.LogRequest(ctx, session, true)
+	store.LogResponse(ctx, session, true)
+
+	var items []*RequestSpanVo
+	for i := 0; i < 100; i++ {
+		list, err := store.QueryRequestSpanList(ctx, &QueryLogForm{Offset: 0, Limit: 10})
+		assert.Nil(t, err)
+		items = nil
+		for _, item := range list.Items {
+			if item.RpcMethodName == methodName {
+				items = append(items, item)
+			}
+		}
+		if len(items) >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, len(items))
+	for _, item := range items {
+		assert.Equal(t, `["a",1]`, item.RpcRequestParams)
+		if item.Annotation == "ss" {
+			assert.Equal(t, `"ok"`, item.RpcResponseResult)
+			assert.NotNil(t, item.LatencyMs)
+			assert.InDelta(t, 4.0, *item.LatencyMs, 0.01)
+		}
+	}
+}
+
+func TestMetricDbStore_Migrations(t *testing.T) {
+	store := createTestMetricStore()
+	if store == nil {
+		return
+	}
+	assert.Nil(t, store.Init())
+	defer store.Close()
+	// applied migrations are skipped
+	assert.Nil(t, migrate(store.db, store.dialect))
+	var version int
+	assert.Nil(t, store.db.QueryRow(store.dialect.rebind("select max(`version`) from `schema_migrations`")).Scan(&version))
+	assert.Equal(t, store.dialect.migrations[len(store.dialect.migrations)-1].version, version)
+}
+
+func TestMigrateWithLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statistic")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// a sqlite dialect with the lock of migrations, which needs another connection to migrate
+	dialect := *sqliteDialect
+	dialect.maxOpenConns = 0
+	dialect.lockMigrationsSql = "select 1"
+	dialect.unlockMigrationsSql = "select 0"
+	store := newMetricDbStore(&dialect, "file:"+filepath.Join(dir, "statistic.db"))
+	assert.Nil(t, store.Init())
+	defer store.Close()
+	assert.Nil(t, migrate(store.db, &dialect))
+	var version int
+	assert.Nil(t, store.db.QueryRow("select max(`version`) from `schema_migrations`").Scan(&version))
+	assert.Equal(t, dialect.migrations[len(dialect.migrations)-1].version, version)
+
+	// never migrates without the lock
+	dialect.lockMigrationsSql = "select 0"
+	assert.NotNil(t, migrate(store.db, &dialect))
+}
+
+func TestSqlDialectRebind(t *testing.T) {
+	query := "select `id` from `t` where `a`=? and `b`='?' limit ? offset ?"
+	assert.Equal(t, query, mysqlDialect.rebind(query))
+	assert.Equal(t, `select "id" from "t" where "a"=$1 and "b"='?' limit $2 offset $3`, postgresDialect.rebind(query))
+}
+
+func TestMetricDbStore_Rollups(t *testing.T) {
+	store := createTestMetricStore()
+	if store == nil {
+		return
+	}
+	assert.Nil(t, store.Init())
+	defer store.Close()
+	ctx := context.Background()
+	methodName := "test_method_" + time.Now().Format("150405.000000")
+	now := time.Now().UTC()
+	store.AddRpcLatency(methodName, newRollupSession(methodName, "http://upstream1", now, 20*time.Millisecond, false))
+	store.AddRpcLatency(methodName, newRollupSession(methodName, "http://upstream1", now, 300*time.Millisecond, true))
+	assert.Nil(t, store.FlushRollups(ctx, now.Add(time.Minute)))
+	// rollups of the same bucket saved again, eg. after restarts, are added up
+	store.AddRpcLatency(methodName, newRollupSession(methodName, "http://upstream1", now.Add(time.Minute), 20*time.Millisecond, false))
+	assert.Nil(t, store.FlushRollups(ctx, now.Add(2*time.Minute)))
+
+	points, err := store.QueryRollups(ctx, &QueryRollupForm{Key: methodName, To: now.Add(2 * time.Minute).Unix()})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, int64(2), points[0].Count)
+	assert.Equal(t, int64(1), points[0].Errors)
+	assert.Equal(t, float64(320), points[0].LatencySumMs)
+	assert.Equal(t, int64(1), points[0].LatencyBuckets[rollupLatencyBucketOf(300)])
+
+	points, err = store.QueryRollups(ctx, &QueryRollupForm{Key: methodName, Resolution: ROLLUP_RESOLUTION_DAY,
+		From: now.Add(-48 * time.Hour).Unix(), To: now.Add(time.Hour).Unix()})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, int64(3), points[0].Count)
+	assert.NotNil(t, points[0].LatencyP50Ms)
+
+	// method names longer than the key column are truncated instead of failing the minute's rollups
+	longMethod := methodName + strings.Repeat("m", 300)
+	store.AddRpcLatency(longMethod, newRollupSession(longMethod, "", now.Add(2*time.Minute), 20*time.Millisecond, false))
+	assert.Nil(t, store.FlushRollups(ctx, now.Add(3*time.Minute)))
+	points, err = store.QueryRollups(ctx, &QueryRollupForm{Key: longMethod[:maxRollupKeyLength], To: now.Add(3 * time.Minute).Unix()})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(points))
+
+	// rollups failed to save are saved by the next flush
+	store.AddRpcLatency(methodName, newRollupSession(methodName, "", now.Add(3*time.Minute), 20*time.Millisecond, false))
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NotNil(t, store.FlushRollups(cancelledCtx, now.Add(4*time.Minute)))
+	assert.Nil(t, store.FlushRollups(ctx, now.Add(5*time.Minute)))
+	points, err = store.QueryRollups(ctx, &QueryRollupForm{Key: methodName, From: now.Add(2 * time.Minute).Unix(),
+		To: now.Add(5 * time.Minute).Unix()})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, int64(1), points[0].Count)
+}
+
+func TestMetricDbStore_ServiceStatusLogs(t *testing.T) {
+	store := createTestMetricStore()
+	if store == nil {
+		return
+	}
+	assert.Nil(t, store.Init())
+	defer store.Close()
+	ctx := context.Background()
+	service := &registry.Service{
+		Name: "test",
+		Url:  "http://test:1234/service" + time.Now().String(),
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	store.LogServiceStatus(ctx, service, false, SERVICE_REASON_DEREGISTERED, now.Add(-3*time.Hour))
+	store.LogServiceStatus(ctx, service, true, SERVICE_REASON_REGISTERED, now.Add(-2*time.Hour))
+	store.LogServiceStatus(ctx, service, false, SERVICE_REASON_HEALTH_CHECK_FAILED, now.Add(-time.Hour))
+
+	logs, err := store.QueryServiceStatusLogs(ctx, now.Add(-90*time.Minute), now)
+	assert.Nil(t, err)
+	var serviceLogs []*ServiceLogVo
+	for _, serviceLog := range logs {
+		if serviceLog.Url == service.Url {
+			serviceLogs = append(serviceLogs, serviceLog)
+		}
+	}
+	// the last log before from is the status at from
+	assert.Equal(t, 2, len(serviceLogs))
+	assert.True(t, serviceLogs[0].Up())
+	assert.Equal(t, SERVICE_REASON_REGISTERED, serviceLogs[0].Reason)
+	assert.True(t, now.Add(-2*time.Hour).Equal(serviceLogs[0].Time()))
+	assert.False(t, serviceLogs[1].Up())
+	assert.Equal(t, SERVICE_REASON_HEALTH_CHECK_FAILED, serviceLogs[1].Reason)
+
+	// only down logs are listed as service down logs
+	list, err := store.QueryServiceDownLogs(ctx, 0, 10)
+	assert.Nil(t, err)
+	for _, item := range list.Items {
+		assert.NotNil(t, item.DownTime)
+	}
+}
+
+func TestMetricDbStore_ClientUsage(t *testing.T) {
+	store := createTestMetricStore()
+	if store == nil {
+		return
+	}
+	assert.Nil(t, store.Init())
+	defer store.Close()
+	ctx := context.Background()
+	client := "test_client_" + time.Now().Format("150405.000000")
+	now := time.Now().UTC()
+	today := now.Format(usageDayLayout)
+	store.AddClientUsage(&ClientUsageVo{Day: today, ClientType: CLIENT_IDENTITY_API_KEY, Client: client, Method: "eth_call", Calls: 1, BytesIn: 10, BytesOut: 100})
+	assert.Nil(t, store.FlushClientUsage(ctx, now))
+	// usage of the same day flushed again, eg. after restarts, is added up
+	store.AddClientUsage(&ClientUsageVo{Day: today, ClientType: CLIENT_IDENTITY_API_KEY, Client: client, Method: "eth_call", Calls: 1, Errors: 1})
+	store.AddClientUsage(&ClientUsageVo{Day: today, ClientType: CLIENT_IDENTITY_API_KEY, Client: client, RateLimitDenials: 1})
+	assert.Nil(t, store.FlushClientUsage(ctx, now))
+
+	usages, err := store.QueryClientUsage(ctx, &QueryClientUsageForm{Client: client})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(usages))
+	assert.Equal(t, int64(2), usages[0].Calls)
+	assert.Equal(t, int64(1), usages[0].Errors)
+	assert.Equal(t, int64(100), usages[0].BytesOut)
+	assert.Equal(t, int64(1), usages[0].RateLimitDenials)
+
+	usages, err = store.QueryClientUsage(ctx, &QueryClientUsageForm{Client: client, GroupBy: USAGE_GROUP_BY_METHOD})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(usages))
 }
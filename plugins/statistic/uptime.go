@@ -0,0 +1,362 @@
+package statistic
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+)
+
+// reasons of service up and down logs
+const (
+	SERVICE_REASON_DEREGISTERED        = "deregistered"
+	SERVICE_REASON_REGISTERED          = "registered"
+	SERVICE_REASON_HEALTH_CHECK_FAILED = "health_check_failed"
+	SERVICE_REASON_HEALTH_CHECK_PASSED = "health_check_passed"
+	SERVICE_REASON_CIRCUIT_OPENED      = "circuit_opened"
+	SERVICE_REASON_CIRCUIT_CLOSED      = "circuit_closed"
+)
+
+// clearedDownReasons are the down reasons cleared by the up reasons
+var clearedDownReasons = map[string]string{
+	SERVICE_REASON_REGISTERED:          SERVICE_REASON_DEREGISTERED,
+	SERVICE_REASON_HEALTH_CHECK_PASSED: SERVICE_REASON_HEALTH_CHECK_FAILED,
+	SERVICE_REASON_CIRCUIT_CLOSED:      SERVICE_REASON_CIRCUIT_OPENED,
+}
+
+// Up returns whether the log is of the service up again
+func (serviceLog *ServiceLogVo) Up() bool {
+	return serviceLog.UpTime != nil
+}
+
+// Time returns when the service is found down or up
+func (serviceLog *ServiceLogVo) Time() time.Time {
+	if serviceLog.UpTime != nil {
+		return *serviceLog.UpTime
+	}
+	if serviceLog.DownTime != nil {
+		return *serviceLog.DownTime
+	}
+	return serviceLog.CreatedAt
+}
+
+// sortServiceLogs sorts the logs oldest first
+func sortServiceLogs(logs []*ServiceLogVo) {
+	sort.SliceStable(logs, func(i, j int) bool {
+		if logs[i].Time().Equal(logs[j].Time()) {
+			return logs[i].Id < logs[j].Id
+		}
+		return logs[i].Time().Before(logs[j].Time())
+	})
+}
+
+/**
+ * serviceStatusTracker keeps the down reasons of each service, so only transitions are logged:
+ * a service is down when it has any down reason, and up again when all its down reasons are cleared
+ */
+type serviceStatusTracker struct {
+	lock        sync.Mutex
+	downReasons map[string]map[string]bool // by service url
+}
+
+func newServiceStatusTracker() *serviceStatusTracker {
+	return &serviceStatusTracker{
+		downReasons: make(map[string]map[string]bool),
+	}
+}
+
+// restore the status of services by their last logs, so a service down before restarts is logged up again
+func (tracker *serviceStatusTracker) restore(lastLogs []*ServiceLogVo) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for _, serviceLog := range lastLogs {
+		if serviceLog.Up() {
+			delete(tracker.downReasons, serviceLog.Url)
+			continue
+		}
+		reason := serviceLog.Reason
+		if len(reason) < 1 {
+			// down logs before reasons are recorded are logged by registry events
+			reason = SERVICE_REASON_DEREGISTERED
+		}
+		tracker.downReasons[serviceLog.Url] = map[string]bool{reason: true}
+	}
+}
+
+// update the service by the event of {reason}, returns whether the service is changed to down or up
+func (tracker *serviceStatusTracker) update(url string, reason string) (changed bool, up bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	reasons := tracker.downReasons[url]
+	if downReason, ok := clearedDownReasons[reason]; ok {
+		if !reasons[downReason] {
+			return
+		}
+		delete(reasons, downReason)
+		if len(reasons) > 0 {
+			return
+		}
+		delete(tracker.downReasons, url)
+		return true, true
+	}
+	if reasons == nil {
+		reasons = make(map[string]bool)
+		tracker.downReasons[url] = reasons
+	}
+	changed = len(reasons) < 1
+	reasons[reason] = true
+	return
+}
+
+// circuitOpenFailures is the count of consecutive failed requests to an upstream to open its circuit
+const circuitOpenFailures = 5
+
+/**
+ * upstreamCircuits opens the circuit of an upstream target after circuitOpenFailures consecutive requests
+ * to it failed to connect or timed out, and closes it when a request to it gets a response again.
+ * it is only used by the statistic goroutine
+ */
+type upstreamCircuits struct {
+	failures map[string]int  // consecutive failures by upstream url
+	opened   map[string]bool // upstream urls with opened circuits
+}
+
+func newUpstreamCircuits() *upstreamCircuits {
+	return &upstreamCircuits{
+		failures: make(map[string]int),
+		opened:   make(map[string]bool),
+	}
+}
+
+// restore the circuits opened before restarts by the last service logs, so they are closed by the next response
+func (circuits *upstreamCircuits) restore(lastLogs []*ServiceLogVo) {
+	for _, serviceLog := range lastLogs {
+		if !serviceLog.Up() && serviceLog.Reason == SERVICE_REASON_CIRCUIT_OPENED {
+			circuits.opened[serviceLog.Url] = true
+		}
+	}
+}
+
+// update the circuit of the upstream by a request to it, returns the reason if the circuit is opened or closed
+func (circuits *upstreamCircuits) update(url string, failed bool) string {
+	if !failed {
+		delete(circuits.failures, url)
+		if !circuits.opened[url] {
+			return ""
+		}
+		delete(circuits.opened, url)
+		return SERVICE_REASON_CIRCUIT_CLOSED
+	}
+	if circuits.opened[url] {
+		return ""
+	}
+	circuits.failures[url]++
+	if circuits.failures[url] < circuitOpenFailures {
+		return ""
+	}
+	delete(circuits.failures, url)
+	circuits.opened[url] = true
+	return SERVICE_REASON_CIRCUIT_OPENED
+}
+
+// default windows of SLA reports, 1 day, 7 days and 30 days
+var defaultSlaWindowsHours = []int64{24, 24 * 7, 24 * 30}
+
+const defaultSlaReportRange = 30 * 24 * time.Hour
+
+type SlaReportForm struct {
+	From         int64   `json:"from"`          // unix seconds, 30 days before {to} by default
+	To           int64   `json:"to"`            // unix seconds, now by default
+	WindowsHours []int64 `json:"windows_hours"` // uptime over the windows ending at {to}, 24, 168 and 720 hours by default
+}
+
+func (form *SlaReportForm) normalize(now time.Time) {
+	if form.To <= 0 {
+		form.To = now.Unix()
+	}
+	if form.From <= 0 || form.From >= form.To {
+		form.From = form.To - int64(defaultSlaReportRange/time.Second)
+	}
+	windows := make([]int64, 0, len(form.WindowsHours))
+	for _, hours := range form.WindowsHours {
+		if hours > 0 {
+			windows = append(windows, hours)
+		}
+	}
+	if len(windows) < 1 {
+		windows = defaultSlaWindowsHours
+	}
+	form.WindowsHours = windows
+}
+
+type UptimeWindowVo struct {
+	Hours         int64   `json:"hours"`
+	UptimePercent float64 `json:"uptimePercent"`
+}
+
+type ServiceSlaVo struct {
+	ServiceName            string            `json:"serviceName"`
+	Url                    string            `json:"url"`
+	Up                     bool              `json:"up"` // status at the end of the range
+	UptimePercent          float64           `json:"uptimePercent"`
+	DowntimeSeconds        float64           `json:"downtimeSeconds"`
+	Incidents              int               `json:"incidents"`   // down periods overlapping the range
+	MttrSeconds            float64           `json:"mttrSeconds"` // mean time to recover of incidents recovered in the range
+	LongestDowntimeSeconds float64           `json:"longestDowntimeSeconds"`
+	Windows                []*UptimeWindowVo `json:"windows"`
+	Transitions            []*ServiceLogVo   `json:"transitions"` // up and down logs in the range, oldest first
+}
+
+type SlaReportVo struct {
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Services []*ServiceSlaVo `json:"services"`
+}
+
+// downPeriod is a period the service is down, ongoing ones end at the end of the report
+type downPeriod struct {
+	start     time.Time
+	end       time.Time
+	recovered bool
+}
+
+// downPeriodsOf returns the down periods by the logs of a service oldest first, ending before {to}
+func downPeriodsOf(logs []*ServiceLogVo, to time.Time) []*downPeriod {
+	var periods []*downPeriod
+	var downSince *time.Time
+	for _, serviceLog := range logs {
+		t := serviceLog.Time()
+		if serviceLog.Up() {
+			if downSince != nil {
+				periods = append(periods, &downPeriod{start: *downSince, end: t, recovered: true})
+				downSince = nil
+			}
+		} else if downSince == nil {
+			downSince = &t
+		}
+	}
+	if downSince != nil {
+		periods = append(periods, &downPeriod{start: *downSince, end: to})
+	}
+	return periods
+}
+
+// downtimeIn returns the downtime of the periods in [from, to)
+func downtimeIn(periods []*downPeriod, from time.Time, to time.Time) (downtime time.Duration) {
+	for _, period := range periods {
+		start, end := period.start, period.end
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			downtime += end.Sub(start)
+		}
+	}
+	return
+}
+
+func uptimePercent(downtime time.Duration, from time.Time, to time.Time) float64 {
+	total := to.Sub(from)
+	if total <= 0 {
+		return 100
+	}
+	return 100 * (1 - float64(downtime)/float64(total))
+}
+
+// serviceSla computes the SLA of a service in [from, to) by its logs oldest first,
+// the service is assumed up before its first log
+func serviceSla(url string, logs []*ServiceLogVo, from time.Time, to time.Time, windowsHours []int64) *ServiceSlaVo {
+	result := &ServiceSlaVo{
+		Url:         url,
+		Up:          true,
+		Windows:     make([]*UptimeWindowVo, 0, len(windowsHours)),
+		Transitions: make([]*ServiceLogVo, 0),
+	}
+	for _, serviceLog := range logs {
+		result.ServiceName = serviceLog.ServiceName
+		result.Up = serviceLog.Up()
+		if !serviceLog.Time().Before(from) {
+			result.Transitions = append(result.Transitions, serviceLog)
+		}
+	}
+	periods := downPeriodsOf(logs, to)
+	downtime := downtimeIn(periods, from, to)
+	result.DowntimeSeconds = downtime.Seconds()
+	result.UptimePercent = uptimePercent(downtime, from, to)
+	var recoveredCount int
+	var recoveredDuration time.Duration
+	for _, period := range periods {
+		if !period.end.After(from) {
+			continue
+		}
+		result.Incidents++
+		duration := period.end.Sub(period.start)
+		if duration.Seconds() > result.LongestDowntimeSeconds {
+			result.LongestDowntimeSeconds = duration.Seconds()
+		}
+		if period.recovered {
+			recoveredCount++
+			recoveredDuration += duration
+		}
+	}
+	if recoveredCount > 0 {
+		result.MttrSeconds = recoveredDuration.Seconds() / float64(recoveredCount)
+	}
+	for _, hours := range windowsHours {
+		windowFrom := to.Add(-time.Duration(hours) * time.Hour)
+		result.Windows = append(result.Windows, &UptimeWindowVo{
+			Hours:         hours,
+			UptimePercent: uptimePercent(downtimeIn(periods, windowFrom, to), windowFrom, to),
+		})
+	}
+	return result
+}
+
+// BuildSlaReport returns the SLA of services in the form's range by the service logs of the store.
+// {services} of the registry are included even if they have no logs, sorted by url
+func BuildSlaReport(ctx context.Context, store MetricStore, services []*registry.Service, form *SlaReportForm) (*SlaReportVo, error) {
+	form.normalize(time.Now())
+	from := time.Unix(form.From, 0).UTC()
+	to := time.Unix(form.To, 0).UTC()
+	queryFrom := from
+	for _, hours := range form.WindowsHours {
+		if windowFrom := to.Add(-time.Duration(hours) * time.Hour); windowFrom.Before(queryFrom) {
+			queryFrom = windowFrom
+		}
+	}
+	logs, err := store.QueryServiceStatusLogs(ctx, queryFrom, to)
+	if err != nil {
+		return nil, err
+	}
+	logsByUrl := make(map[string][]*ServiceLogVo)
+	names := make(map[string]string)
+	for _, service := range services {
+		logsByUrl[service.Url] = nil
+		names[service.Url] = service.Name
+	}
+	for _, serviceLog := range logs {
+		logsByUrl[serviceLog.Url] = append(logsByUrl[serviceLog.Url], serviceLog)
+	}
+	report := &SlaReportVo{
+		From:     from,
+		To:       to,
+		Services: make([]*ServiceSlaVo, 0, len(logsByUrl)),
+	}
+	for url, serviceLogs := range logsByUrl {
+		sortServiceLogs(serviceLogs)
+		sla := serviceSla(url, serviceLogs, from, to, form.WindowsHours)
+		if name, ok := names[url]; ok {
+			sla.ServiceName = name
+		}
+		report.Services = append(report.Services, sla)
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		return report.Services[i].Url < report.Services[j].Url
+	})
+	return report, nil
+}
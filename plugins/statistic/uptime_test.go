@@ -0,0 +1,135 @@
+package statistic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/registry"
+)
+
+func TestServiceStatusTracker(t *testing.T) {
+	tracker := newServiceStatusTracker()
+	url := "ws://127.0.0.1:3000"
+	changed, _ := tracker.update(url, SERVICE_REASON_HEALTH_CHECK_PASSED)
+	assert.False(t, changed)
+
+	changed, up := tracker.update(url, SERVICE_REASON_HEALTH_CHECK_FAILED)
+	assert.True(t, changed)
+	assert.False(t, up)
+	// down already
+	changed, _ = tracker.update(url, SERVICE_REASON_HEALTH_CHECK_FAILED)
+	assert.False(t, changed)
+	changed, _ = tracker.update(url, SERVICE_REASON_DEREGISTERED)
+	assert.False(t, changed)
+	// up again when all down reasons are cleared
+	changed, _ = tracker.update(url, SERVICE_REASON_HEALTH_CHECK_PASSED)
+	assert.False(t, changed)
+	changed, up = tracker.update(url, SERVICE_REASON_REGISTERED)
+	assert.True(t, changed)
+	assert.True(t, up)
+
+	// a service deregistered before restarts is up again when registered
+	now := time.Now()
+	tracker = newServiceStatusTracker()
+	tracker.restore([]*ServiceLogVo{{Url: url, DownTime: &now}})
+	changed, up = tracker.update(url, SERVICE_REASON_REGISTERED)
+	assert.True(t, changed)
+	assert.True(t, up)
+}
+
+func TestUpstreamCircuits(t *testing.T) {
+	circuits := newUpstreamCircuits()
+	tracker := newServiceStatusTracker()
+	url := "ws://127.0.0.1:3000"
+	// failures not consecutive never open the circuit
+	for i := 0; i < circuitOpenFailures-1; i++ {
+		assert.Equal(t, "", circuits.update(url, true))
+	}
+	assert.Equal(t, "", circuits.update(url, false))
+	for i := 0; i < circuitOpenFailures-1; i++ {
+		assert.Equal(t, "", circuits.update(url, true))
+	}
+	reason := circuits.update(url, true)
+	assert.Equal(t, SERVICE_REASON_CIRCUIT_OPENED, reason)
+	changed, up := tracker.update(url, reason)
+	assert.True(t, changed)
+	assert.False(t, up)
+	assert.Equal(t, "", circuits.update(url, true))
+
+	reason = circuits.update(url, false)
+	assert.Equal(t, SERVICE_REASON_CIRCUIT_CLOSED, reason)
+	changed, up = tracker.update(url, reason)
+	assert.True(t, changed)
+	assert.True(t, up)
+	assert.Equal(t, "", circuits.update(url, false))
+
+	// a circuit opened before restarts is closed by the next response
+	now := time.Now()
+	circuits = newUpstreamCircuits()
+	circuits.restore([]*ServiceLogVo{testServiceLog(url, false, SERVICE_REASON_CIRCUIT_OPENED, now)})
+	assert.Equal(t, SERVICE_REASON_CIRCUIT_CLOSED, circuits.update(url, false))
+}
+
+func testServiceLog(url string, up bool, reason string, at time.Time) *ServiceLogVo {
+	serviceLog := &ServiceLogVo{ServiceName: "test", Url: url, Reason: reason}
+	if up {
+		serviceLog.UpTime = &at
+	} else {
+		serviceLog.DownTime = &at
+	}
+	return serviceLog
+}
+
+func TestServiceSla(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(100 * time.Hour)
+	url := "ws://127.0.0.1:3000"
+	logs := []*ServiceLogVo{
+		// down before the range, recovered 1 hour in the range
+		testServiceLog(url, false, SERVICE_REASON_DEREGISTERED, from.Add(-time.Hour)),
+		testServiceLog(url, true, SERVICE_REASON_REGISTERED, from.Add(time.Hour)),
+		testServiceLog(url, false, SERVICE_REASON_HEALTH_CHECK_FAILED, from.Add(10*time.Hour)),
+		testServiceLog(url, true, SERVICE_REASON_HEALTH_CHECK_PASSED, from.Add(14*time.Hour)),
+		// ongoing
+		testServiceLog(url, false, SERVICE_REASON_HEALTH_CHECK_FAILED, to.Add(-5*time.Hour)),
+	}
+	sla := serviceSla(url, logs, from, to, []int64{24})
+	assert.False(t, sla.Up)
+	assert.Equal(t, 3, sla.Incidents)
+	assert.Equal(t, 4, len(sla.Transitions))
+	assert.InDelta(t, 10*3600.0, sla.DowntimeSeconds, 0.001)
+	assert.InDelta(t, 90.0, sla.UptimePercent, 0.001)
+	assert.InDelta(t, 3*3600.0, sla.MttrSeconds, 0.001)
+	assert.InDelta(t, 5*3600.0, sla.LongestDowntimeSeconds, 0.001)
+	assert.Equal(t, int64(24), sla.Windows[0].Hours)
+	assert.InDelta(t, 100*(1-5.0/24), sla.Windows[0].UptimePercent, 0.001)
+
+	sla = serviceSla(url, nil, from, to, nil)
+	assert.True(t, sla.Up)
+	assert.Equal(t, 100.0, sla.UptimePercent)
+	assert.Equal(t, 0, sla.Incidents)
+}
+
+func TestBuildSlaReport(t *testing.T) {
+	store := newMemoryMetricStore(0, 0)
+	assert.Nil(t, store.Init())
+	ctx := context.Background()
+	to := time.Now().Truncate(time.Second)
+	down := &registry.Service{Name: "down", Url: "ws://127.0.0.1:3001"}
+	store.LogServiceStatus(ctx, down, false, SERVICE_REASON_DEREGISTERED, to.Add(-12*time.Hour))
+	store.LogServiceStatus(ctx, down, true, SERVICE_REASON_REGISTERED, to.Add(-6*time.Hour))
+
+	report, err := BuildSlaReport(ctx, store, []*registry.Service{{Name: "up", Url: "ws://127.0.0.1:3000"}},
+		&SlaReportForm{From: to.Add(-24 * time.Hour).Unix(), To: to.Unix()})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(report.Services))
+	assert.Equal(t, "up", report.Services[0].ServiceName)
+	assert.Equal(t, 100.0, report.Services[0].UptimePercent)
+	assert.Equal(t, "down", report.Services[1].ServiceName)
+	assert.InDelta(t, 75.0, report.Services[1].UptimePercent, 0.001)
+	assert.InDelta(t, 6*3600.0, report.Services[1].MttrSeconds, 0.001)
+	assert.Equal(t, 3, len(report.Services[1].Windows))
+	assert.InDelta(t, 100*(1-6.0/(24*30)), report.Services[1].Windows[2].UptimePercent, 0.001)
+}
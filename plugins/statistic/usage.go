@@ -0,0 +1,415 @@
+package statistic
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// types of client identities which usage is tracked by
+const (
+	CLIENT_IDENTITY_API_KEY     = "api_key"
+	CLIENT_IDENTITY_JWT_SUBJECT = "jwt_subject"
+	CLIENT_IDENTITY_IP          = "ip"
+)
+
+// how QueryClientUsage groups the daily usage
+const (
+	USAGE_GROUP_BY_CLIENT = "client" // totals of each client in the range
+	USAGE_GROUP_BY_DAY    = "day"    // totals of each client and day
+	USAGE_GROUP_BY_METHOD = "method" // each client, day and method
+)
+
+// max lengths of clients and methods kept, the sizes of the columns of the sql stores
+const (
+	maxUsageClientLength = 255
+	maxUsageMethodLength = 100
+)
+
+func truncateString(value string, maxLength int) string {
+	return cutAtRuneBoundary(value, maxLength)
+}
+
+const (
+	usageDayLayout             = "2006-01-02"
+	defaultUsageRetentionDays  = 400
+	defaultUsageQueryRangeDays = 30
+)
+
+// UsageOptions is how clients are identified in usage analytics
+type UsageOptions struct {
+	// identities tried in order, the first found identifies the client. api_key, ip by default.
+	// jwt_subject is the subject verified by an auth plugin(rpc.ATTR_JWT_SUBJECT), not in the default identities
+	// and never found without such a plugin, since unverified tokens can be forged to charge other clients.
+	// the client ip is used if none found
+	Identities   []string
+	ApiKeyHeader string // X-Api-Key by default
+	MaskApiKey   bool   // track only the last 4 chars of api keys
+	// days of daily usage kept, 400 by default
+	RetentionDays int
+}
+
+func DefaultUsageOptions() *UsageOptions {
+	return &UsageOptions{
+		Identities:    []string{CLIENT_IDENTITY_API_KEY, CLIENT_IDENTITY_IP},
+		RetentionDays: defaultUsageRetentionDays,
+	}
+}
+
+func (options *UsageOptions) Validate() error {
+	for _, identity := range options.Identities {
+		switch identity {
+		case CLIENT_IDENTITY_API_KEY, CLIENT_IDENTITY_JWT_SUBJECT, CLIENT_IDENTITY_IP:
+		default:
+			return fmt.Errorf("unknown client identity %s", identity)
+		}
+	}
+	return nil
+}
+
+// clientIdentityOf returns the type and value of the first identity found of the connection
+func (options *UsageOptions) clientIdentityOf(conn *rpc.ConnectionSession) (identityType string, client string) {
+	for _, identity := range options.Identities {
+		switch identity {
+		case CLIENT_IDENTITY_API_KEY:
+			client = pluginsCommon.GetApiKey(conn, options.ApiKeyHeader)
+			if options.MaskApiKey && len(client) > 0 {
+				client = pluginsCommon.MaskApiKey(client)
+			}
+		case CLIENT_IDENTITY_JWT_SUBJECT:
+			client = pluginsCommon.GetJwtSubject(conn)
+		case CLIENT_IDENTITY_IP:
+			client = pluginsCommon.GetClientIp(conn)
+		}
+		if len(client) > 0 {
+			return identity, truncateString(client, maxUsageClientLength)
+		}
+	}
+	return CLIENT_IDENTITY_IP, pluginsCommon.GetClientIp(conn)
+}
+
+// usageOfRequest returns the usage of a request with a written response
+func (options *UsageOptions) usageOfRequest(reqSession *rpc.JSONRpcRequestSession) *ClientUsageVo {
+	identityType, client := options.clientIdentityOf(reqSession.Conn)
+	usage := &ClientUsageVo{
+		Day:        reqSession.ResponseWrittenAt.UTC().Format(usageDayLayout),
+		ClientType: identityType,
+		Client:     client,
+		Method:     truncateString(reqSession.Request.Method, maxUsageMethodLength),
+		Calls:      1,
+		BytesIn:    int64(len(reqSession.RequestBytes)),
+		BytesOut:   int64(reqSession.ResponseBytes),
+	}
+	if reqSession.Response == nil || reqSession.Response.Error != nil {
+		usage.Errors = 1
+	}
+	return usage
+}
+
+// usageOfRateLimitDenial returns the usage of a connection rejected by the rate_limit plugin
+func (options *UsageOptions) usageOfRateLimitDenial(conn *rpc.ConnectionSession, now time.Time) *ClientUsageVo {
+	identityType, client := options.clientIdentityOf(conn)
+	return &ClientUsageVo{
+		Day:              now.UTC().Format(usageDayLayout),
+		ClientType:       identityType,
+		Client:           client,
+		RateLimitDenials: 1,
+	}
+}
+
+// ClientUsageVo is the usage of a client in a day(UTC) by method
+type ClientUsageVo struct {
+	Day        string `json:"day"`        // yyyy-mm-dd, empty if summed over days
+	ClientType string `json:"clientType"` // CLIENT_IDENTITY_*
+	Client     string `json:"client"`
+	// empty if summed over methods. rate limit denials are of connections, so counted with empty method
+	Method           string `json:"method"`
+	Calls            int64  `json:"calls"`
+	Errors           int64  `json:"errors"`
+	BytesIn          int64  `json:"bytesIn"`  // bytes of requests
+	BytesOut         int64  `json:"bytesOut"` // bytes of responses written
+	RateLimitDenials int64  `json:"rateLimitDenials"`
+}
+
+func (usage *ClientUsageVo) add(other *ClientUsageVo) {
+	usage.Calls += other.Calls
+	usage.Errors += other.Errors
+	usage.BytesIn += other.BytesIn
+	usage.BytesOut += other.BytesOut
+	usage.RateLimitDenials += other.RateLimitDenials
+}
+
+type usageKey struct {
+	day        string
+	clientType string
+	client     string
+	method     string
+}
+
+func usageKeyOf(usage *ClientUsageVo) usageKey {
+	return usageKey{usage.Day, usage.ClientType, usage.Client, usage.Method}
+}
+
+// usageTable sums usage by day, client and method
+type usageTable struct {
+	lock sync.Mutex
+	rows map[usageKey]*ClientUsageVo
+}
+
+func newUsageTable() *usageTable {
+	return &usageTable{
+		rows: make(map[usageKey]*ClientUsageVo),
+	}
+}
+
+func (table *usageTable) add(usages ...*ClientUsageVo) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	for _, usage := range usages {
+		key := usageKeyOf(usage)
+		row, ok := table.rows[key]
+		if !ok {
+			row = &ClientUsageVo{Day: usage.Day, ClientType: usage.ClientType, Client: usage.Client, Method: usage.Method}
+			table.rows[key] = row
+		}
+		row.add(usage)
+	}
+}
+
+// take returns the rows and clears the table
+func (table *usageTable) take() []*ClientUsageVo {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	result := make([]*ClientUsageVo, 0, len(table.rows))
+	for _, row := range table.rows {
+		result = append(result, row)
+	}
+	table.rows = make(map[usageKey]*ClientUsageVo)
+	return result
+}
+
+// prune removes the rows of days before {beforeDay}
+func (table *usageTable) prune(beforeDay string) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	for key := range table.rows {
+		if key.day < beforeDay {
+			delete(table.rows, key)
+		}
+	}
+}
+
+// api keys and methods of client usage are chosen by clients, so the distinct clients, methods and rows of a day are capped.
+// usage out of the caps is counted as otherUsageKey, like keys of rollups
+const (
+	maxUsageClientsPerDay = 10000
+	maxUsageMethodsPerDay = 500
+	maxUsageRowsPerDay    = 100000
+	otherUsageKey         = "other"
+	usageLimiterDays      = 2 // usage of the day before is still added around midnight
+)
+
+type usageDayKeys struct {
+	clients map[string]bool
+	methods map[string]bool
+	rows    map[usageKey]bool
+}
+
+// usageLimiter tracks the distinct keys of the recent days to cap them
+type usageLimiter struct {
+	lock sync.Mutex
+	days map[string]*usageDayKeys
+}
+
+func newUsageLimiter() *usageLimiter {
+	return &usageLimiter{
+		days: make(map[string]*usageDayKeys),
+	}
+}
+
+// limit replaces the client or method of {usage} by otherUsageKey if it's new and out of the caps of its day
+func (limiter *usageLimiter) limit(usage *ClientUsageVo) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	keys, ok := limiter.days[usage.Day]
+	if !ok {
+		keys = &usageDayKeys{
+			clients: make(map[string]bool),
+			methods: make(map[string]bool),
+			rows:    make(map[usageKey]bool),
+		}
+		limiter.days[usage.Day] = keys
+		for len(limiter.days) > usageLimiterDays {
+			oldest := usage.Day
+			for day := range limiter.days {
+				if day < oldest {
+					oldest = day
+				}
+			}
+			delete(limiter.days, oldest)
+		}
+	}
+	clientKey := usage.ClientType + "\x00" + usage.Client
+	if !keys.clients[clientKey] {
+		if len(keys.clients) < maxUsageClientsPerDay {
+			keys.clients[clientKey] = true
+		} else {
+			usage.Client = otherUsageKey
+		}
+	}
+	// rate limit denials have no method
+	if len(usage.Method) > 0 && !keys.methods[usage.Method] {
+		if len(keys.methods) < maxUsageMethodsPerDay {
+			keys.methods[usage.Method] = true
+		} else {
+			usage.Method = otherUsageKey
+		}
+	}
+	row := usageKeyOf(usage)
+	if !keys.rows[row] {
+		if len(keys.rows) < maxUsageRowsPerDay {
+			keys.rows[row] = true
+		} else {
+			usage.Client = otherUsageKey
+			if len(usage.Method) > 0 {
+				usage.Method = otherUsageKey
+			}
+		}
+	}
+}
+
+// query returns copies of the rows in the form's range matching its client filters
+func (table *usageTable) query(form *QueryClientUsageForm) []*ClientUsageVo {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	result := make([]*ClientUsageVo, 0)
+	for _, row := range table.rows {
+		if form.match(row) {
+			usage := *row
+			result = append(result, &usage)
+		}
+	}
+	return result
+}
+
+// usageRetentionStart returns the first day kept by the retention
+func usageRetentionStart(now time.Time, retentionDays int) string {
+	if retentionDays <= 0 {
+		retentionDays = defaultUsageRetentionDays
+	}
+	return now.UTC().AddDate(0, 0, -retentionDays).Format(usageDayLayout)
+}
+
+type QueryClientUsageForm struct {
+	From       string `json:"from"`        // yyyy-mm-dd, 30 days before {to} by default
+	To         string `json:"to"`          // yyyy-mm-dd inclusive, today(UTC) by default
+	ClientType string `json:"client_type"` // all types if empty
+	Client     string `json:"client"`      // all clients if empty
+	GroupBy    string `json:"group_by"`    // client(default), day or method
+	Limit      int    `json:"limit"`       // max rows returned, all if <= 0
+}
+
+func (form *QueryClientUsageForm) normalize(now time.Time) error {
+	if len(form.To) < 1 {
+		form.To = now.UTC().Format(usageDayLayout)
+	}
+	to, err := time.Parse(usageDayLayout, form.To)
+	if err != nil {
+		return fmt.Errorf("invalid to date %s, yyyy-mm-dd expected", form.To)
+	}
+	if len(form.From) < 1 {
+		form.From = to.AddDate(0, 0, -defaultUsageQueryRangeDays).Format(usageDayLayout)
+	}
+	if _, err = time.Parse(usageDayLayout, form.From); err != nil {
+		return fmt.Errorf("invalid from date %s, yyyy-mm-dd expected", form.From)
+	}
+	switch form.GroupBy {
+	case "":
+		form.GroupBy = USAGE_GROUP_BY_CLIENT
+	case USAGE_GROUP_BY_CLIENT, USAGE_GROUP_BY_DAY, USAGE_GROUP_BY_METHOD:
+	default:
+		return fmt.Errorf("invalid group_by %s", form.GroupBy)
+	}
+	return nil
+}
+
+func (form *QueryClientUsageForm) match(usage *ClientUsageVo) bool {
+	return usage.Day >= form.From && usage.Day <= form.To &&
+		(len(form.ClientType) < 1 || usage.ClientType == form.ClientType) &&
+		(len(form.Client) < 1 || usage.Client == form.Client)
+}
+
+// groupClientUsage sums the daily usage rows by the form's group_by. clients are sorted by calls(most first),
+// days and methods by day, client and method
+func groupClientUsage(rows []*ClientUsageVo, form *QueryClientUsageForm) []*ClientUsageVo {
+	grouped := newUsageTable()
+	for _, row := range rows {
+		usage := *row
+		switch form.GroupBy {
+		case USAGE_GROUP_BY_CLIENT:
+			usage.Day = ""
+			usage.Method = ""
+		case USAGE_GROUP_BY_DAY:
+			usage.Method = ""
+		}
+		grouped.add(&usage)
+	}
+	result := grouped.take()
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if form.GroupBy == USAGE_GROUP_BY_CLIENT && a.Calls != b.Calls {
+			return a.Calls > b.Calls
+		}
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.ClientType != b.ClientType {
+			return a.ClientType < b.ClientType
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Method < b.Method
+	})
+	if form.Limit > 0 && len(result) > form.Limit {
+		result = result[:form.Limit]
+	}
+	return result
+}
+
+// csvText escapes values starting like formulas, clients are chosen by callers and the csv may be opened by spreadsheets
+func csvText(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// WriteClientUsageCsv writes the usage rows as csv with a header line
+func WriteClientUsageCsv(writer io.Writer, rows []*ClientUsageVo) error {
+	w := csv.NewWriter(writer)
+	err := w.Write([]string{"day", "client_type", "client", "method", "calls", "errors", "bytes_in", "bytes_out",
+		"rate_limit_denials"})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = w.Write([]string{row.Day, row.ClientType, csvText(row.Client), csvText(row.Method),
+			strconv.FormatInt(row.Calls, 10), strconv.FormatInt(row.Errors, 10),
+			strconv.FormatInt(row.BytesIn, 10), strconv.FormatInt(row.BytesOut, 10),
+			strconv.FormatInt(row.RateLimitDenials, 10)})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,111 @@
+package statistic
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var usageKeyColumns = []string{"day", "client_type", "client", "method"}
+
+var usageValueColumns = []string{"calls", "errors", "bytes_in", "bytes_out", "rate_limit_denials"}
+
+// createClientUsageTableSql returns the create statement of client_usage, {extra} is appended to the column definitions
+func createClientUsageTableSql(extra string) string {
+	return "CREATE TABLE IF NOT EXISTS `client_usage` (" +
+		"`day` VARCHAR(10) NOT NULL, " +
+		"`client_type` VARCHAR(20) NOT NULL, " +
+		"`client` VARCHAR(255) NOT NULL, " +
+		"`method` VARCHAR(100) NOT NULL, " +
+		"`calls` BIGINT NOT NULL DEFAULT 0, " +
+		"`errors` BIGINT NOT NULL DEFAULT 0, " +
+		"`bytes_in` BIGINT NOT NULL DEFAULT 0, " +
+		"`bytes_out` BIGINT NOT NULL DEFAULT 0, " +
+		"`rate_limit_denials` BIGINT NOT NULL DEFAULT 0, " +
+		"PRIMARY KEY (`day`, `client_type`, `client`, `method`)" + extra + ")"
+}
+
+// clientUsageUpsertSql returns the insert of usage which adds to the existing row of the same day, client and method
+func clientUsageUpsertSql(onDuplicateKey bool) string {
+	return additiveUpsertSql("client_usage", usageKeyColumns, usageValueColumns, onDuplicateKey)
+}
+
+// FlushClientUsage upserts the usage added since the last flush to table client_usage,
+// so usage from restarts or other proxies is added up
+func (store *metricDbStore) FlushClientUsage(ctx context.Context, now time.Time) (err error) {
+	db := store.db
+	if db == nil {
+		return errors.New("metric db not init")
+	}
+	usages := store.TakeClientUsage()
+	if len(usages) > 0 {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(store.dialect.rebind(store.dialect.upsertClientUsageSql))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, usage := range usages {
+			_, err = stmt.Exec(usage.Day, usage.ClientType, usage.Client, usage.Method,
+				usage.Calls, usage.Errors, usage.BytesIn, usage.BytesOut, usage.RateLimitDenials)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, store.dialect.rebind("delete from `client_usage` where `day` < ?"),
+		usageRetentionStart(now, store.usageRetentionDays))
+	return
+}
+
+func (store *metricDbStore) QueryClientUsage(ctx context.Context, form *QueryClientUsageForm) (result []*ClientUsageVo, err error) {
+	db := store.db
+	if db == nil {
+		err = errors.New("metric db not init")
+		return
+	}
+	if err = form.normalize(time.Now()); err != nil {
+		return
+	}
+	query := "select " + strings.Join(quoteColumns(append(append([]string{}, usageKeyColumns...), usageValueColumns...)), ", ") +
+		" from `client_usage` where `day` >= ? and `day` <= ?"
+	args := []interface{}{form.From, form.To}
+	if len(form.ClientType) > 0 {
+		query += " and `client_type` = ?"
+		args = append(args, form.ClientType)
+	}
+	if len(form.Client) > 0 {
+		query += " and `client` = ?"
+		args = append(args, form.Client)
+	}
+	rows, err := db.QueryContext(ctx, store.dialect.rebind(query), args...)
+	if err != nil {
+		log.Warn("metric db error", err)
+		return
+	}
+	defer rows.Close()
+	usages := make([]*ClientUsageVo, 0)
+	for rows.Next() {
+		var usage ClientUsageVo
+		err = rows.Scan(&usage.Day, &usage.ClientType, &usage.Client, &usage.Method,
+			&usage.Calls, &usage.Errors, &usage.BytesIn, &usage.BytesOut, &usage.RateLimitDenials)
+		if err != nil {
+			log.Warn("metric db error", err)
+			return
+		}
+		usages = append(usages, &usage)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	result = groupClientUsage(usages, form)
+	return
+}
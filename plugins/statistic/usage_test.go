@@ -0,0 +1,145 @@
+package statistic
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func newUsageConnection(headers http.Header) *rpc.ConnectionSession {
+	conn := rpc.NewConnectionSession()
+	conn.Info = &rpc.ConnectionInfo{RemoteAddr: "10.0.0.1:12345", Headers: headers}
+	return conn
+}
+
+func TestUsageOptions_ClientIdentityOf(t *testing.T) {
+	options := &UsageOptions{Identities: []string{CLIENT_IDENTITY_API_KEY, CLIENT_IDENTITY_JWT_SUBJECT, CLIENT_IDENTITY_IP}}
+	// unverified tokens are never trusted
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user1"}`))
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer header."+payload+".signature")
+	conn := newUsageConnection(headers)
+	identityType, client := options.clientIdentityOf(conn)
+	assert.Equal(t, CLIENT_IDENTITY_IP, identityType)
+
+	// the subject verified by an auth plugin
+	conn.Attributes.Set(rpc.ATTR_JWT_SUBJECT, "user1")
+	identityType, client = options.clientIdentityOf(conn)
+	assert.Equal(t, CLIENT_IDENTITY_JWT_SUBJECT, identityType)
+	assert.Equal(t, "user1", client)
+	// not an identity by default
+	identityType, _ = DefaultUsageOptions().clientIdentityOf(conn)
+	assert.Equal(t, CLIENT_IDENTITY_IP, identityType)
+
+	headers.Set("X-Api-Key", "secret-api-key")
+	identityType, client = options.clientIdentityOf(conn)
+	assert.Equal(t, CLIENT_IDENTITY_API_KEY, identityType)
+	assert.Equal(t, "secret-api-key", client)
+
+	options.MaskApiKey = true
+	_, client = options.clientIdentityOf(conn)
+	assert.False(t, strings.Contains(client, "secret"))
+
+	// the client ip if no identity found
+	identityType, client = options.clientIdentityOf(newUsageConnection(nil))
+	assert.Equal(t, CLIENT_IDENTITY_IP, identityType)
+	assert.Equal(t, "10.0.0.1", client)
+
+	assert.NotNil(t, (&UsageOptions{Identities: []string{"cookie"}}).Validate())
+}
+
+func TestMemoryMetricStore_ClientUsage(t *testing.T) {
+	store := newMemoryMetricStore(0, 0)
+	assert.Nil(t, store.Init())
+	ctx := context.Background()
+	now := time.Now().UTC()
+	today := now.Format(usageDayLayout)
+	yesterday := now.AddDate(0, 0, -1).Format(usageDayLayout)
+	store.AddClientUsage(&ClientUsageVo{Day: today, ClientType: CLIENT_IDENTITY_IP, Client: "10.0.0.1", Method: "eth_call", Calls: 1, BytesIn: 10})
+	store.AddClientUsage(&ClientUsageVo{Day: yesterday, ClientType: CLIENT_IDENTITY_IP, Client: "10.0.0.1", Method: "eth_call", Calls: 1, Errors: 1})
+	store.AddClientUsage(&ClientUsageVo{Day: today, ClientType: CLIENT_IDENTITY_IP, Client: "10.0.0.2", Method: "eth_call", Calls: 3})
+	store.AddClientUsage(&ClientUsageVo{Day: today, ClientType: CLIENT_IDENTITY_IP, Client: "10.0.0.1", RateLimitDenials: 1})
+	store.AddClientUsage(&ClientUsageVo{Day: "2000-01-01", ClientType: CLIENT_IDENTITY_IP, Client: "10.0.0.1", Calls: 1})
+	assert.Nil(t, store.FlushClientUsage(ctx, now))
+
+	usages, err := store.QueryClientUsage(ctx, &QueryClientUsageForm{From: "1999-01-01"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(usages))
+	assert.Equal(t, "10.0.0.2", usages[0].Client)
+	assert.Equal(t, int64(3), usages[0].Calls)
+	assert.Equal(t, "10.0.0.1", usages[1].Client)
+	assert.Equal(t, int64(2), usages[1].Calls)
+	assert.Equal(t, int64(1), usages[1].Errors)
+	assert.Equal(t, int64(1), usages[1].RateLimitDenials)
+
+	usages, err = store.QueryClientUsage(ctx, &QueryClientUsageForm{Client: "10.0.0.1", GroupBy: USAGE_GROUP_BY_METHOD})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(usages))
+	assert.Equal(t, yesterday, usages[0].Day)
+
+	usages, err = store.QueryClientUsage(ctx, &QueryClientUsageForm{GroupBy: USAGE_GROUP_BY_DAY, Limit: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(usages))
+
+	_, err = store.QueryClientUsage(ctx, &QueryClientUsageForm{From: "yesterday"})
+	assert.NotNil(t, err)
+}
+
+func TestWriteClientUsageCsv(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteClientUsageCsv(&buf, []*ClientUsageVo{
+		{Day: "2020-01-01", ClientType: CLIENT_IDENTITY_JWT_SUBJECT, Client: "=cmd()", Method: "eth_call", Calls: 2},
+	})
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "2020-01-01,jwt_subject,'=cmd(),eth_call,2,0,0,0,0", lines[1])
+}
+
+func TestUsageLimiter(t *testing.T) {
+	limiter := newUsageLimiter()
+	add := func(day string, client string, method string) *ClientUsageVo {
+		usage := &ClientUsageVo{Day: day, ClientType: CLIENT_IDENTITY_API_KEY, Client: client, Method: method, Calls: 1}
+		limiter.limit(usage)
+		return usage
+	}
+	for i := 0; i < maxUsageClientsPerDay; i++ {
+		add("2020-01-01", "key-"+strconv.Itoa(i), "eth_call")
+	}
+	usage := add("2020-01-01", "random-key", "eth_call")
+	assert.Equal(t, otherUsageKey, usage.Client)
+	assert.Equal(t, "key-1", add("2020-01-01", "key-1", "eth_call").Client)
+	// caps are per day
+	assert.Equal(t, "random-key", add("2020-01-02", "random-key", "eth_call").Client)
+
+	for i := 0; i < 2*maxUsageMethodsPerDay; i++ {
+		add("2020-01-02", "key-1", "method_"+strconv.Itoa(i))
+	}
+	usage = add("2020-01-02", "key-1", "random_method")
+	assert.Equal(t, "key-1", usage.Client)
+	assert.Equal(t, otherUsageKey, usage.Method)
+	assert.Equal(t, "eth_call", add("2020-01-02", "key-1", "eth_call").Method)
+	// rate limit denials have no method
+	assert.Equal(t, "", add("2020-01-02", "key-2", "").Method)
+
+	// only the recent days are tracked
+	add("2020-01-03", "key-1", "eth_call")
+	assert.Equal(t, 2, len(limiter.days))
+
+	// distinct rows are capped too
+	limiter = newUsageLimiter()
+	for i := 0; i < maxUsageRowsPerDay; i++ {
+		add("2020-01-01", "key-"+strconv.Itoa(i%maxUsageClientsPerDay), "method_"+strconv.Itoa(i/maxUsageClientsPerDay))
+	}
+	usage = add("2020-01-01", "key-1", "method_20")
+	assert.Equal(t, otherUsageKey, usage.Client)
+	assert.Equal(t, otherUsageKey, usage.Method)
+}
@@ -0,0 +1,57 @@
+package validator
+
+import (
+	"encoding/json"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"io/ioutil"
+)
+
+func LoadValidatorPluginConfig(chain *plugin.MiddlewareChain, configInfo *config.ServerConfig) {
+	validatorPluginConf := configInfo.Plugins.Validator
+	if !validatorPluginConf.Start {
+		return
+	}
+	validatorMiddleware := NewValidatorMiddleware()
+	if len(validatorPluginConf.OpenRpcFile) > 0 {
+		docBytes, err := ioutil.ReadFile(validatorPluginConf.OpenRpcFile)
+		if err != nil {
+			log.Fatalln("read openrpc document error", err)
+			return
+		}
+		methodSchemas, err := LoadOpenRpcDocument(docBytes)
+		if err != nil {
+			log.Fatalln("load openrpc document error", err)
+			return
+		}
+		for _, methodSchema := range methodSchemas {
+			validatorMiddleware.AddMethodSchema(methodSchema)
+		}
+	}
+	// methods in config override the same methods in openrpc document
+	for _, itemConf := range validatorPluginConf.Methods {
+		paramsSchema := itemConf.ParamsSchema
+		if len(itemConf.SchemaFile) > 0 {
+			schemaBytes, err := ioutil.ReadFile(itemConf.SchemaFile)
+			if err != nil {
+				log.Fatalln("read params schema file error", err)
+				return
+			}
+			if err = json.Unmarshal(schemaBytes, &paramsSchema); err != nil {
+				log.Fatalln("params schema file json error", err)
+				return
+			}
+		}
+		var params interface{}
+		if itemConf.Params != nil {
+			params = itemConf.Params
+		}
+		methodSchema, err := NewMethodSchema(itemConf.Method, itemConf.ParamStructure, paramsSchema, params)
+		if err != nil {
+			log.Fatalln("load params schema error", err)
+			return
+		}
+		validatorMiddleware.AddMethodSchema(methodSchema)
+	}
+	chain.InsertHead(validatorMiddleware)
+}
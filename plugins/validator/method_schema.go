@@ -0,0 +1,206 @@
+package validator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	PARAM_STRUCTURE_EITHER      = "either"
+	PARAM_STRUCTURE_BY_POSITION = "by-position"
+	PARAM_STRUCTURE_BY_NAME     = "by-name"
+)
+
+const paramsPath = "/params"
+
+// ParamSchema is schema of one param of a rpc method, same as OpenRPC ContentDescriptor
+type ParamSchema struct {
+	Name     string
+	Required bool
+	Schema   *Schema
+}
+
+// MethodSchema validates params of a rpc method.
+// if ParamsSchema is set, the whole params value(array or object) is validated by it,
+// otherwise each param is validated by Params in positional array or named object style
+type MethodSchema struct {
+	MethodName     string
+	ParamStructure string
+	Params         []*ParamSchema
+	ParamsSchema   *Schema
+}
+
+func (m *MethodSchema) findParam(name string) *ParamSchema {
+	for _, p := range m.Params {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// ValidateParams validate rpc params value and returns the first failing location
+func (m *MethodSchema) ValidateParams(params interface{}) *ValidationError {
+	if m.ParamsSchema != nil {
+		return m.ParamsSchema.Validate(params, paramsPath)
+	}
+	switch value := params.(type) {
+	case nil:
+		return m.validatePositional(nil)
+	case []interface{}:
+		if m.ParamStructure == PARAM_STRUCTURE_BY_NAME {
+			return invalid(paramsPath, "params must be an object")
+		}
+		return m.validatePositional(value)
+	case map[string]interface{}:
+		if m.ParamStructure == PARAM_STRUCTURE_BY_POSITION {
+			return invalid(paramsPath, "params must be an array")
+		}
+		return m.validateNamed(value)
+	default:
+		return invalid(paramsPath, "params must be an array or object but got %s", jsonTypeOf(params))
+	}
+}
+
+func (m *MethodSchema) validatePositional(params []interface{}) *ValidationError {
+	for i, p := range m.Params {
+		path := childPath(paramsPath, strconv.Itoa(i))
+		if i >= len(params) {
+			if p.Required {
+				return invalid(path, "required param %s missing", p.Name)
+			}
+			continue
+		}
+		if err := p.Schema.Validate(params[i], path); err != nil {
+			return err
+		}
+	}
+	if len(params) > len(m.Params) {
+		return invalid(childPath(paramsPath, strconv.Itoa(len(m.Params))),
+			"expected at most %d params but got %d", len(m.Params), len(params))
+	}
+	return nil
+}
+
+func (m *MethodSchema) validateNamed(params map[string]interface{}) *ValidationError {
+	for _, p := range m.Params {
+		path := childPath(paramsPath, p.Name)
+		value, ok := params[p.Name]
+		if !ok {
+			if p.Required {
+				return invalid(path, "required param missing")
+			}
+			continue
+		}
+		if err := p.Schema.Validate(value, path); err != nil {
+			return err
+		}
+	}
+	for name := range params {
+		if m.findParam(name) == nil {
+			return invalid(childPath(paramsPath, name), "unknown param")
+		}
+	}
+	return nil
+}
+
+// contentDescriptor is the param description format of OpenRPC and the validator config
+type contentDescriptor struct {
+	Name     string      `json:"name"`
+	Required bool        `json:"required"`
+	Schema   interface{} `json:"schema"`
+}
+
+func (c *schemaCompiler) compileParams(methodName string, descriptors []*contentDescriptor) (result []*ParamSchema, err error) {
+	for i, d := range descriptors {
+		if len(d.Name) < 1 {
+			d.Name = strconv.Itoa(i)
+		}
+		var s *Schema
+		if d.Schema == nil {
+			s = &Schema{alwaysValid: true}
+		} else if s, err = c.compile(d.Schema); err == nil {
+			err = checkRefCycles(s)
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid schema of method %s param %s: %s", methodName, d.Name, err.Error())
+			return
+		}
+		result = append(result, &ParamSchema{
+			Name:     d.Name,
+			Required: d.Required,
+			Schema:   s,
+		})
+	}
+	return
+}
+
+// NewMethodSchema create method schema from a JSON Schema of the whole params, or OpenRPC style param descriptors.
+// {params} is a json array like [{"name": "address", "required": true, "schema": {"type": "string"}}]
+func NewMethodSchema(methodName string, paramStructure string, paramsSchema interface{}, params interface{}) (result *MethodSchema, err error) {
+	result = &MethodSchema{
+		MethodName:     methodName,
+		ParamStructure: paramStructure,
+	}
+	if paramsSchema != nil {
+		result.ParamsSchema, err = CompileSchema(paramsSchema)
+		if err != nil {
+			err = fmt.Errorf("invalid params schema of method %s: %s", methodName, err.Error())
+		}
+		return
+	}
+	if params == nil {
+		err = errors.New("empty schema of method " + methodName)
+		return
+	}
+	paramsBytes, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	var descriptors []*contentDescriptor
+	if err = json.Unmarshal(paramsBytes, &descriptors); err != nil {
+		return
+	}
+	result.Params, err = newSchemaCompiler(params).compileParams(methodName, descriptors)
+	return
+}
+
+// LoadOpenRpcDocument load method schemas from an OpenRPC document.
+// $ref in params schemas are resolved against the document, eg. "#/components/schemas/Address"
+func LoadOpenRpcDocument(data []byte) (result []*MethodSchema, err error) {
+	var root interface{}
+	if err = json.Unmarshal(data, &root); err != nil {
+		return
+	}
+	type openRpcDocument struct {
+		Methods []struct {
+			Name           string               `json:"name"`
+			ParamStructure string               `json:"paramStructure"`
+			Params         []*contentDescriptor `json:"params"`
+		} `json:"methods"`
+	}
+	var doc openRpcDocument
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return
+	}
+	c := newSchemaCompiler(root)
+	for _, method := range doc.Methods {
+		params, compileErr := c.compileParams(method.Name, method.Params)
+		if compileErr != nil {
+			err = compileErr
+			return
+		}
+		paramStructure := method.ParamStructure
+		if len(paramStructure) < 1 {
+			paramStructure = PARAM_STRUCTURE_EITHER
+		}
+		result = append(result, &MethodSchema{
+			MethodName:     method.Name,
+			ParamStructure: paramStructure,
+			Params:         params,
+		})
+	}
+	return
+}
@@ -0,0 +1,695 @@
+package validator
+
+/**
+ * a compact JSON Schema(draft-07 subset) implementation used to validate jsonrpc params.
+ * supported keywords: type, enum, const, properties, required, additionalProperties, items,
+ * minItems, maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength,
+ * pattern, allOf, anyOf, oneOf, not and local $ref(eg. "#/definitions/x", "#/components/schemas/x")
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type Schema struct {
+	alwaysValid   bool // true schema or empty schema
+	alwaysInvalid bool // false schema
+
+	types    []string
+	enum     []interface{}
+	constVal interface{}
+	hasConst bool
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+
+	items      *Schema
+	tupleItems []*Schema
+	minItems   *int
+	maxItems   *int
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+// ValidationError is the first failing location of a value
+type ValidationError struct {
+	Path    string `json:"path"` // JSON pointer of the failing value
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// schemaCompiler compile schemas of a document, $ref are resolved against the document root
+type schemaCompiler struct {
+	root interface{}
+	refs map[string]*Schema
+}
+
+func newSchemaCompiler(root interface{}) *schemaCompiler {
+	return &schemaCompiler{
+		root: root,
+		refs: make(map[string]*Schema),
+	}
+}
+
+// CompileSchema compile a standalone JSON Schema document
+func CompileSchema(raw interface{}) (*Schema, error) {
+	s, err := newSchemaCompiler(raw).compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRefCycles(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CompileSchemaJson compile a standalone JSON Schema document in json bytes
+func CompileSchemaJson(data []byte) (*Schema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return CompileSchema(raw)
+}
+
+// sameValueSchemas returns the sub schemas applied to the same value as s($ref, allOf, anyOf, oneOf and not)
+func (s *Schema) sameValueSchemas() []*Schema {
+	result := make([]*Schema, 0, len(s.allOf)+len(s.anyOf)+len(s.oneOf)+1)
+	result = append(result, s.allOf...)
+	result = append(result, s.anyOf...)
+	result = append(result, s.oneOf...)
+	if s.not != nil {
+		result = append(result, s.not)
+	}
+	return result
+}
+
+// childSchemas returns the sub schemas applied to the properties or items of the value
+func (s *Schema) childSchemas() []*Schema {
+	result := make([]*Schema, 0, len(s.properties)+len(s.tupleItems)+2)
+	for _, property := range s.properties {
+		result = append(result, property)
+	}
+	if s.additionalProperties != nil {
+		result = append(result, s.additionalProperties)
+	}
+	if s.items != nil {
+		result = append(result, s.items)
+	}
+	return append(result, s.tupleItems...)
+}
+
+// checkRefCycles returns error if a schema reachable from {root} applies itself to the same value,
+// eg. {"$ref": "#"}, which never ends when validating. recursion through properties or items is allowed
+func checkRefCycles(root *Schema) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	states := make(map[*Schema]int)
+	var visit func(s *Schema) error
+	visit = func(s *Schema) error {
+		switch states[s] {
+		case visiting:
+			return errors.New("$ref cycle applies a schema to the same value endlessly")
+		case visited:
+			return nil
+		}
+		states[s] = visiting
+		for _, sub := range s.sameValueSchemas() {
+			if err := visit(sub); err != nil {
+				return err
+			}
+		}
+		states[s] = visited
+		return nil
+	}
+	// visit every schema reachable from root, the schemas of a cycle through children are checked once
+	seen := map[*Schema]bool{root: true}
+	queue := []*Schema{root}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		if err := visit(s); err != nil {
+			return err
+		}
+		for _, sub := range append(s.sameValueSchemas(), s.childSchemas()...) {
+			if !seen[sub] {
+				seen[sub] = true
+				queue = append(queue, sub)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *schemaCompiler) compile(raw interface{}) (*Schema, error) {
+	s := &Schema{}
+	err := c.compileInto(s, raw)
+	return s, err
+}
+
+func (c *schemaCompiler) compileList(raw interface{}) (result []*Schema, err error) {
+	items, ok := raw.([]interface{})
+	if !ok {
+		err = errors.New("schema list must be an array")
+		return
+	}
+	for _, item := range items {
+		s, compileErr := c.compile(item)
+		if compileErr != nil {
+			err = compileErr
+			return
+		}
+		result = append(result, s)
+	}
+	return
+}
+
+func (c *schemaCompiler) resolveRef(ref string) (*Schema, error) {
+	if s, ok := c.refs[ref]; ok {
+		return s, nil
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local $ref supported, got %s", ref)
+	}
+	target, ok := lookupJsonPointer(c.root, strings.TrimPrefix(ref, "#"))
+	if !ok {
+		return nil, fmt.Errorf("can't resolve $ref %s", ref)
+	}
+	// register before compiling so recursive schemas point to the same instance
+	s := &Schema{}
+	c.refs[ref] = s
+	if err := c.compileInto(s, target); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func lookupJsonPointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" || pointer == "/" {
+		return doc, true
+	}
+	current := doc
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch value := current.(type) {
+		case map[string]interface{}:
+			next, ok := value[token]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, false
+			}
+			current = value[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func schemaInt(raw map[string]interface{}, key string) (*int, error) {
+	value, ok := raw[key]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := value.(float64)
+	if !ok || f < 0 || math.Trunc(f) != f {
+		return nil, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	result := int(f)
+	return &result, nil
+}
+
+func schemaNumber(raw map[string]interface{}, key string) (*float64, error) {
+	value, ok := raw[key]
+	if !ok {
+		return nil, nil
+	}
+	f, ok := value.(float64)
+	if !ok {
+		// draft-04 boolean exclusiveMinimum/exclusiveMaximum are handled by caller
+		return nil, fmt.Errorf("%s must be a number", key)
+	}
+	return &f, nil
+}
+
+func (c *schemaCompiler) compileInto(s *Schema, raw interface{}) (err error) {
+	switch value := raw.(type) {
+	case bool:
+		s.alwaysValid = value
+		s.alwaysInvalid = !value
+		return
+	case map[string]interface{}:
+		return c.compileObject(s, value)
+	default:
+		return errors.New("schema must be an object or boolean")
+	}
+}
+
+func (c *schemaCompiler) compileObject(s *Schema, raw map[string]interface{}) (err error) {
+	if ref, ok := raw["$ref"].(string); ok {
+		// keywords besides $ref are ignored as draft-07 says
+		target, refErr := c.resolveRef(ref)
+		if refErr != nil {
+			return refErr
+		}
+		s.allOf = []*Schema{target}
+		return
+	}
+	if len(raw) == 0 {
+		s.alwaysValid = true
+		return
+	}
+	switch t := raw["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			typeName, ok := item.(string)
+			if !ok {
+				return errors.New("type must be string or array of strings")
+			}
+			s.types = append(s.types, typeName)
+		}
+	default:
+		return errors.New("type must be string or array of strings")
+	}
+	if enum, ok := raw["enum"]; ok {
+		if s.enum, ok = enum.([]interface{}); !ok {
+			return errors.New("enum must be an array")
+		}
+	}
+	if constVal, ok := raw["const"]; ok {
+		s.constVal = constVal
+		s.hasConst = true
+	}
+	if properties, ok := raw["properties"]; ok {
+		propertiesMap, isMap := properties.(map[string]interface{})
+		if !isMap {
+			return errors.New("properties must be an object")
+		}
+		s.properties = make(map[string]*Schema)
+		for name, propertyRaw := range propertiesMap {
+			if s.properties[name], err = c.compile(propertyRaw); err != nil {
+				return
+			}
+		}
+	}
+	if required, ok := raw["required"]; ok {
+		requiredList, isList := required.([]interface{})
+		if !isList {
+			return errors.New("required must be an array")
+		}
+		for _, item := range requiredList {
+			name, isString := item.(string)
+			if !isString {
+				return errors.New("required must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if additional, ok := raw["additionalProperties"]; ok {
+		if s.additionalProperties, err = c.compile(additional); err != nil {
+			return
+		}
+	}
+	if items, ok := raw["items"]; ok {
+		if _, isList := items.([]interface{}); isList {
+			if s.tupleItems, err = c.compileList(items); err != nil {
+				return
+			}
+		} else if s.items, err = c.compile(items); err != nil {
+			return
+		}
+	}
+	if s.minItems, err = schemaInt(raw, "minItems"); err != nil {
+		return
+	}
+	if s.maxItems, err = schemaInt(raw, "maxItems"); err != nil {
+		return
+	}
+	if s.minLength, err = schemaInt(raw, "minLength"); err != nil {
+		return
+	}
+	if s.maxLength, err = schemaInt(raw, "maxLength"); err != nil {
+		return
+	}
+	if s.minimum, err = schemaNumber(raw, "minimum"); err != nil {
+		return
+	}
+	if s.maximum, err = schemaNumber(raw, "maximum"); err != nil {
+		return
+	}
+	// draft-04 style boolean exclusive flags
+	if exclusive, ok := raw["exclusiveMinimum"].(bool); ok {
+		if exclusive && s.minimum != nil {
+			s.exclusiveMinimum, s.minimum = s.minimum, nil
+		}
+	} else if s.exclusiveMinimum, err = schemaNumber(raw, "exclusiveMinimum"); err != nil {
+		return
+	}
+	if exclusive, ok := raw["exclusiveMaximum"].(bool); ok {
+		if exclusive && s.maximum != nil {
+			s.exclusiveMaximum, s.maximum = s.maximum, nil
+		}
+	} else if s.exclusiveMaximum, err = schemaNumber(raw, "exclusiveMaximum"); err != nil {
+		return
+	}
+	if pattern, ok := raw["pattern"]; ok {
+		patternStr, isString := pattern.(string)
+		if !isString {
+			return errors.New("pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(patternStr); err != nil {
+			return
+		}
+	}
+	if allOf, ok := raw["allOf"]; ok {
+		if s.allOf, err = c.compileList(allOf); err != nil {
+			return
+		}
+	}
+	if anyOf, ok := raw["anyOf"]; ok {
+		if s.anyOf, err = c.compileList(anyOf); err != nil {
+			return
+		}
+	}
+	if oneOf, ok := raw["oneOf"]; ok {
+		if s.oneOf, err = c.compileList(oneOf); err != nil {
+			return
+		}
+	}
+	if not, ok := raw["not"]; ok {
+		if s.not, err = c.compile(not); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if math.Trunc(v) == v {
+			return "integer"
+		}
+		return "number"
+	case json.Number:
+		if isIntegerLiteral(string(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// isIntegerLiteral returns true if the json number literal has no fraction, eg. 1.0, 1.5e1 and big integers like 1e21.
+// it's decided by the digits of the literal, since json.Number may be out of the range of int64 or the precision of float64
+func isIntegerLiteral(literal string) bool {
+	literal = strings.TrimPrefix(literal, "-")
+	exponentText := ""
+	if index := strings.IndexAny(literal, "eE"); index >= 0 {
+		exponentText = literal[index+1:]
+		literal = literal[:index]
+	}
+	digits := literal
+	fractionDigits := 0
+	if index := strings.IndexByte(literal, '.'); index >= 0 {
+		fraction := strings.TrimRight(literal[index+1:], "0")
+		digits = literal[:index] + fraction
+		fractionDigits = len(fraction)
+	}
+	// the value is digits * 10^(exponent - fractionDigits)
+	significant := strings.TrimRight(digits, "0")
+	if strings.TrimLeft(significant, "0") == "" {
+		return true
+	}
+	if len(exponentText) < 1 {
+		return fractionDigits == 0
+	}
+	exponent, err := strconv.ParseInt(exponentText, 10, 32)
+	if err != nil {
+		// out of range exponents, a huge value is an integer and a tiny one is not
+		return !strings.HasPrefix(exponentText, "-")
+	}
+	return exponent+int64(len(digits)-len(significant)) >= int64(fractionDigits)
+}
+
+func matchType(expected string, actual string) bool {
+	return expected == actual || (expected == "number" && actual == "integer")
+}
+
+func numberOf(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func jsonEqual(a interface{}, b interface{}) bool {
+	if fa, ok := numberOf(a); ok {
+		fb, ok := numberOf(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func childPath(path string, token string) string {
+	token = strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+	return path + "/" + token
+}
+
+func invalid(path string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Validate check {value}(decoded by encoding/json) and returns the first failing location. {path} is the JSON pointer of value
+func (s *Schema) Validate(value interface{}, path string) *ValidationError {
+	if s.alwaysValid {
+		return nil
+	}
+	if s.alwaysInvalid {
+		return invalid(path, "no value allowed")
+	}
+	actualType := jsonTypeOf(value)
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			if matchType(t, actualType) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return invalid(path, "expected %s but got %s", strings.Join(s.types, " or "), actualType)
+		}
+	}
+	if s.enum != nil {
+		found := false
+		for _, item := range s.enum {
+			if jsonEqual(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return invalid(path, "value is not one of the enum values")
+		}
+	}
+	if s.hasConst && !jsonEqual(s.constVal, value) {
+		return invalid(path, "value must be %v", s.constVal)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if err := s.validateObject(v, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(v, path); err != nil {
+			return err
+		}
+	case string:
+		if err := s.validateString(v, path); err != nil {
+			return err
+		}
+	default:
+		if f, ok := numberOf(value); ok {
+			if err := s.validateNumber(f, path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, sub := range s.allOf {
+		if err := sub.Validate(value, path); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		var firstErr *ValidationError
+		matched := false
+		for _, sub := range s.anyOf {
+			err := sub.Validate(value, path)
+			if err == nil {
+				matched = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if !matched {
+			return firstErr
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matchedCount := 0
+		for _, sub := range s.oneOf {
+			if sub.Validate(value, path) == nil {
+				matchedCount++
+			}
+		}
+		if matchedCount != 1 {
+			return invalid(path, "value must match exactly one schema of oneOf, matched %d", matchedCount)
+		}
+	}
+	if s.not != nil && s.not.Validate(value, path) == nil {
+		return invalid(path, "value must not match the schema of not")
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(value map[string]interface{}, path string) *ValidationError {
+	for _, name := range s.required {
+		if _, ok := value[name]; !ok {
+			return invalid(childPath(path, name), "required property missing")
+		}
+	}
+	// sorted to report the same path for the same value every time
+	keys := make([]string, 0, len(value))
+	for k := range value {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if propertySchema, ok := s.properties[k]; ok {
+			if err := propertySchema.Validate(value[k], childPath(path, k)); err != nil {
+				return err
+			}
+		} else if s.additionalProperties != nil {
+			if s.additionalProperties.alwaysInvalid {
+				return invalid(childPath(path, k), "additional property not allowed")
+			}
+			if err := s.additionalProperties.Validate(value[k], childPath(path, k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(value []interface{}, path string) *ValidationError {
+	if s.minItems != nil && len(value) < *s.minItems {
+		return invalid(path, "expected at least %d items but got %d", *s.minItems, len(value))
+	}
+	if s.maxItems != nil && len(value) > *s.maxItems {
+		return invalid(path, "expected at most %d items but got %d", *s.maxItems, len(value))
+	}
+	for i, item := range value {
+		var itemSchema *Schema
+		if s.tupleItems != nil {
+			if i >= len(s.tupleItems) {
+				break
+			}
+			itemSchema = s.tupleItems[i]
+		} else {
+			itemSchema = s.items
+		}
+		if itemSchema == nil {
+			break
+		}
+		if err := itemSchema.Validate(item, childPath(path, strconv.Itoa(i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateString(value string, path string) *ValidationError {
+	length := utf8.RuneCountInString(value)
+	if s.minLength != nil && length < *s.minLength {
+		return invalid(path, "expected length >= %d but got %d", *s.minLength, length)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return invalid(path, "expected length <= %d but got %d", *s.maxLength, length)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		return invalid(path, "value does not match pattern %s", s.pattern.String())
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(value float64, path string) *ValidationError {
+	if s.minimum != nil && value < *s.minimum {
+		return invalid(path, "expected >= %v but got %v", *s.minimum, value)
+	}
+	if s.maximum != nil && value > *s.maximum {
+		return invalid(path, "expected <= %v but got %v", *s.maximum, value)
+	}
+	if s.exclusiveMinimum != nil && value <= *s.exclusiveMinimum {
+		return invalid(path, "expected > %v but got %v", *s.exclusiveMinimum, value)
+	}
+	if s.exclusiveMaximum != nil && value >= *s.exclusiveMaximum {
+		return invalid(path, "expected < %v but got %v", *s.exclusiveMaximum, value)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package validator
+
+import (
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+var log = utils.GetLogger("validator")
+
+/**
+ * ValidatorMiddleware is a middleware which validates jsonrpc params by JSON Schema of each method
+ * and rejects invalid requests before they reach the upstream
+ */
+type ValidatorMiddleware struct {
+	plugin.MiddlewareAdapter
+	methodSchemas map[string]*MethodSchema // rpc method name => schema
+}
+
+func NewValidatorMiddleware() *ValidatorMiddleware {
+	return &ValidatorMiddleware{
+		methodSchemas: make(map[string]*MethodSchema),
+	}
+}
+
+func (middleware *ValidatorMiddleware) AddMethodSchema(methodSchema *MethodSchema) *ValidatorMiddleware {
+	middleware.methodSchemas[methodSchema.MethodName] = methodSchema
+	return middleware
+}
+
+func (middleware *ValidatorMiddleware) Name() string {
+	return "validator"
+}
+
+func (middleware *ValidatorMiddleware) OnStart() (err error) {
+	return middleware.NextOnStart()
+}
+
+func (middleware *ValidatorMiddleware) OnConnection(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnection(session)
+}
+
+func (middleware *ValidatorMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) (err error) {
+	return middleware.NextOnConnectionClosed(session)
+}
+
+func (middleware *ValidatorMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession,
+	messageType int, message []byte) (err error) {
+	return middleware.NextOnWebSocketFrame(session, messageType, message)
+}
+func (middleware *ValidatorMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	rpcRequest := session.Request
+	methodSchema, ok := middleware.methodSchemas[rpcRequest.Method]
+	if ok {
+		if validationErr := methodSchema.ValidateParams(rpcRequest.Params); validationErr != nil {
+			log.Debugf("rpc method %s invalid params %s", rpcRequest.Method, validationErr.Error())
+			response := rpc.NewJSONRpcResponse(rpcRequest.Id, nil,
+				rpc.NewJSONRpcResponseError(rpc.RPC_INVALID_PARAMS, "invalid params", validationErr))
+			session.FillRpcResponse(response)
+			return
+		}
+	}
+	return middleware.NextOnJSONRpcRequest(session)
+}
+func (middleware *ValidatorMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextOnJSONRpcResponse(session)
+}
+
+func (middleware *ValidatorMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) (err error) {
+	return middleware.NextProcessJSONRpcRequest(session)
+}
@@ -0,0 +1,158 @@
+package validator
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"testing"
+)
+
+const testOpenRpcDocument = `{
+  "openrpc": "1.2.6",
+  "methods": [
+    {
+      "name": "eth_getBalance",
+      "params": [
+        {"name": "address", "required": true, "schema": {"$ref": "#/components/schemas/Address"}},
+        {"name": "block", "required": true, "schema": {"oneOf": [
+          {"type": "string", "enum": ["latest", "earliest", "pending"]},
+          {"type": "string", "pattern": "^0x[0-9a-f]+$"}
+        ]}}
+      ]
+    },
+    {
+      "name": "eth_call",
+      "params": [
+        {"name": "transaction", "required": true, "schema": {
+          "type": "object",
+          "required": ["to"],
+          "properties": {
+            "to": {"$ref": "#/components/schemas/Address"},
+            "gas": {"type": "integer", "minimum": 0}
+          },
+          "additionalProperties": false
+        }}
+      ]
+    }
+  ],
+  "components": {
+    "schemas": {
+      "Address": {"type": "string", "pattern": "^0x[0-9a-fA-F]{40}$"}
+    }
+  }
+}`
+
+const testAddress = "0x0000000000000000000000000000000000000001"
+
+func decodeParams(t *testing.T, paramsJson string) interface{} {
+	var params interface{}
+	assert.True(t, json.Unmarshal([]byte(paramsJson), &params) == nil)
+	return params
+}
+
+func newTestMiddleware(t *testing.T) *ValidatorMiddleware {
+	methodSchemas, err := LoadOpenRpcDocument([]byte(testOpenRpcDocument))
+	assert.True(t, err == nil)
+	m := NewValidatorMiddleware()
+	for _, methodSchema := range methodSchemas {
+		m.AddMethodSchema(methodSchema)
+	}
+	return m
+}
+
+func TestValidatorMiddlewareParams(t *testing.T) {
+	m := newTestMiddleware(t)
+	for _, item := range []struct {
+		method      string
+		params      string
+		invalidPath string // empty means valid
+	}{
+		{"eth_getBalance", `["` + testAddress + `", "latest"]`, ""},
+		{"eth_getBalance", `{"address": "` + testAddress + `", "block": "0x1f"}`, ""},
+		{"eth_getBalance", `["0x123", "latest"]`, "/params/0"},
+		{"eth_getBalance", `["` + testAddress + `"]`, "/params/1"},
+		{"eth_getBalance", `["` + testAddress + `", "latest", 1]`, "/params/2"},
+		{"eth_getBalance", `{"address": "` + testAddress + `", "block": "latest", "foo": 1}`, "/params/foo"},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 21000}]`, ""},
+		{"eth_call", `[{"to": "0xabc"}]`, "/params/0/to"},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 1.5}]`, "/params/0/gas"},
+		// numbers are json.Number decoded by UseNumber, integers are decided by their literals
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 1000000000000000000000}]`, ""},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 1.0}]`, ""},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 2.5e3}]`, ""},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 1e21}]`, ""},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 1.0000000000000000001}]`, "/params/0/gas"},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": 15e-1}]`, "/params/0/gas"},
+		{"eth_call", `[{"to": "` + testAddress + `", "gas": -1}]`, "/params/0/gas"},
+		{"eth_call", `[{"to": "` + testAddress + `", "value": 1}]`, "/params/0/value"},
+		{"eth_call", `[{}]`, "/params/0/to"},
+		{"unknown_method", `[1, 2, 3]`, ""},
+	} {
+		// decoded as the providers do
+		request, err := rpc.DecodeJSONRPCRequest([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "` + item.method +
+			`", "params": ` + item.params + `}`))
+		assert.True(t, err == nil)
+		reqSess := rpc.NewJSONRpcRequestSession(rpc.NewConnectionSession())
+		reqSess.FillRpcRequest(request, nil)
+		err = m.OnRpcRequest(reqSess)
+		assert.True(t, err == nil)
+		if len(item.invalidPath) < 1 {
+			assert.True(t, reqSess.Response == nil, "%s %s should be valid", item.method, item.params)
+			continue
+		}
+		if !assert.True(t, reqSess.Response != nil, "%s %s should be invalid", item.method, item.params) {
+			continue
+		}
+		resErr := reqSess.Response.Error
+		assert.Equal(t, rpc.RPC_INVALID_PARAMS, resErr.Code)
+		validationErr, ok := resErr.Data.(*ValidationError)
+		assert.True(t, ok)
+		assert.Equal(t, item.invalidPath, validationErr.Path)
+	}
+}
+
+func TestWholeParamsSchema(t *testing.T) {
+	methodSchema, err := NewMethodSchema("call", "", decodeParams(t, `{
+		"type": "array",
+		"items": [{"type": "integer"}, {"type": "string", "not": {"const": "dangerousMethod"}}],
+		"minItems": 2
+	}`), nil)
+	assert.True(t, err == nil)
+	assert.True(t, methodSchema.ValidateParams(decodeParams(t, `[2, "getInfo"]`)) == nil)
+	validationErr := methodSchema.ValidateParams(decodeParams(t, `[2, "dangerousMethod"]`))
+	assert.True(t, validationErr != nil && validationErr.Path == "/params/1")
+	validationErr = methodSchema.ValidateParams(decodeParams(t, `[2]`))
+	assert.True(t, validationErr != nil && validationErr.Path == "/params")
+}
+
+func TestSchemaRefCycles(t *testing.T) {
+	_, err := CompileSchemaJson([]byte(`{"$ref": "#"}`))
+	assert.True(t, err != nil)
+	_, err = CompileSchemaJson([]byte(`{
+		"anyOf": [{"$ref": "#/definitions/a"}],
+		"definitions": {"a": {"allOf": [{"$ref": "#/definitions/b"}]}, "b": {"not": {"$ref": "#/definitions/a"}}}
+	}`))
+	assert.True(t, err != nil)
+	_, err = LoadOpenRpcDocument([]byte(`{"methods": [{"name": "m", "params": [{"name": "p", "schema": {"$ref": "#/components/schemas/Loop"}}]}],
+		"components": {"schemas": {"Loop": {"$ref": "#/components/schemas/Loop"}}}}`))
+	assert.True(t, err != nil)
+
+	// recursion through properties ends with the value
+	s, err := CompileSchemaJson([]byte(`{
+		"type": "object",
+		"properties": {"name": {"type": "string"}, "children": {"type": "array", "items": {"$ref": "#"}}}
+	}`))
+	assert.True(t, err == nil)
+	assert.True(t, s.Validate(decodeParams(t, `{"name": "a", "children": [{"name": "b", "children": []}]}`), "") == nil)
+	assert.True(t, s.Validate(decodeParams(t, `{"name": "a", "children": [{"name": 1}]}`), "") != nil)
+}
+
+func TestIsIntegerLiteral(t *testing.T) {
+	for literal, expected := range map[string]bool{
+		"0": true, "-0.0": true, "10": true, "1.0": true, "1.50e1": true, "100e-2": true, "1e21": true,
+		"115792089237316195423570985008687907853269984665640564039457584007913129639935": true, "1e99999999999": true,
+		"1.5": false, "0.5": false, "1e-1": false, "-1.0000000000000000001": false, "1e-99999999999": false,
+	} {
+		assert.Equal(t, expected, isIntegerLiteral(literal), literal)
+	}
+}
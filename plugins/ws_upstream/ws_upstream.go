@@ -115,8 +115,8 @@ func (middleware *WsUpstreamMiddleware) OnConnection(session *rpc.ConnectionSess
 	}
 
 	session.UpstreamRpcRequestsChan = make(chan *rpc.JSONRpcRequestBundle, 1000)
-	if session.SelectedUpstreamTarget == nil {
-		session.SelectedUpstreamTarget = &targetEndpoint
+	if !session.Attributes.Has(rpc.ATTR_SELECTED_UPSTREAM_TARGET) {
+		_ = pluginsCommon.SetSelectedUpstreamTargetEndpoint(session, targetEndpoint)
 	}
 
 	go func() {
@@ -124,9 +124,12 @@ func (middleware *WsUpstreamMiddleware) OnConnection(session *rpc.ConnectionSess
 		c, err := connectTargetEndpoint(targetEndpoint)
 		if err != nil {
 			log.Println("dial:", err)
+			pluginsCommon.UpstreamConnectFailed(targetEndpoint)
 			return
 		}
 		log.Debugf("connected to %s\n", targetEndpoint)
+		pluginsCommon.UpstreamConnectionOpened(targetEndpoint)
+		defer pluginsCommon.UpstreamConnectionClosed(targetEndpoint)
 		session.UpstreamTargetConnection = c
 		session.UpstreamTargetConnectionDone = make(chan struct{})
 		defer close(session.UpstreamTargetConnectionDone)
@@ -245,8 +248,8 @@ func (middleware *WsUpstreamMiddleware) OnRpcRequest(session *rpc.JSONRpcRequest
 
 	// create response future before to use in ProcessRpcRequest
 	session.RpcResponseFutureChan = make(chan *rpc.JSONRpcResponse, 1)
-	if connSession.SelectedUpstreamTarget != nil {
-		session.TargetServer = *connSession.SelectedUpstreamTarget
+	if targetEndpoint, ok := connSession.Attributes.GetString(rpc.ATTR_SELECTED_UPSTREAM_TARGET); ok {
+		session.TargetServer = targetEndpoint
 	}
 
 	connSession.RpcRequestsDispatchChannel <- &rpc.RpcRequestDispatchData{
@@ -254,6 +257,8 @@ func (middleware *WsUpstreamMiddleware) OnRpcRequest(session *rpc.JSONRpcRequest
 		Data: session,
 	}
 
+	session.UpstreamSentAt = time.Now()
+	pluginsCommon.StartUpstreamSpan(session, session.TargetServer)
 	middleware.sendRequestToTargetConn(connSession, websocket.TextMessage, rpcRequestBytes, rpcRequest, session.RpcResponseFutureChan)
 	return
 }
@@ -296,6 +301,11 @@ func (middleware *WsUpstreamMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRe
 	}
 
 	var rpcRes *rpc.JSONRpcResponse
+	pluginsCommon.UpstreamRequestStarted(session.TargetServer)
+	defer func() {
+		pluginsCommon.UpstreamRequestFinished(session.TargetServer, rpcRes)
+		pluginsCommon.EndUpstreamSpan(session, rpcRes)
+	}()
 	select {
 	case <-time.After(middleware.options.upstreamTimeout):
 		rpcRes = rpc.NewJSONRpcResponse(rpcRequestId, nil,
@@ -306,7 +316,7 @@ func (middleware *WsUpstreamMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRe
 			rpc.NewJSONRpcResponseError(rpc.RPC_UPSTREAM_CONNECTION_CLOSED_ERROR,
 				"upstream target connection closed", nil))
 	case rpcRes = <-requestChan:
-		// do nothing, just receive rpcRes
+		session.UpstreamRecvAt = time.Now()
 	}
 	session.Response = rpcRes
 	return
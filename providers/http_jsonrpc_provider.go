@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -12,6 +14,7 @@ import (
 
 type HttpJsonRpcProviderOptions struct {
 	TimeoutSeconds uint32
+	MaxRequestSize int64 // max bytes of request body, 0 means no limit
 }
 
 type HttpJsonRpcProvider struct {
@@ -42,7 +45,7 @@ func sendErrorResponse(w http.ResponseWriter, err error, errCode int, requestId
 	resErr := rpc.NewJSONRpcResponseError(errCode, err.Error(), nil)
 	errRes := rpc.NewJSONRpcResponse(requestId, nil, resErr)
 	errResBytes, encodeErr := json.Marshal(errRes)
-	if encodeErr != nil {
+	if encodeErr == nil {
 		_, _ = w.Write(errResBytes)
 	}
 }
@@ -100,10 +103,29 @@ func (provider *HttpJsonRpcProvider) asyncWatchMessagesToConnection(ctx context.
 	}()
 }
 
+type requestTooLargeError struct {
+	maxRequestSize int64
+}
+
+func (e *requestTooLargeError) Error() string {
+	return fmt.Sprintf("request too large, max %d bytes", e.maxRequestSize)
+}
+
 func (provider *HttpJsonRpcProvider) watchConnectionMessages(ctx context.Context, connSession *rpc.ConnectionSession, w http.ResponseWriter, r *http.Request) (err error) {
 	body := r.Body
 	defer body.Close()
-	message, err := ioutil.ReadAll(body)
+	maxRequestSize := provider.options.MaxRequestSize
+	var message []byte
+	if maxRequestSize > 0 {
+		// read one more byte to know whether the body exceeds the limit
+		message, err = ioutil.ReadAll(io.LimitReader(body, maxRequestSize+1))
+		if err == nil && int64(len(message)) > maxRequestSize {
+			requestTooLargeCounter.Inc()
+			err = &requestTooLargeError{maxRequestSize: maxRequestSize}
+		}
+	} else {
+		message, err = ioutil.ReadAll(body)
+	}
 	if err != nil {
 		return
 	}
@@ -142,16 +164,31 @@ func (provider *HttpJsonRpcProvider) serverHandler(w http.ResponseWriter, r *htt
 		return
 	}
 	connSession := rpc.NewConnectionSession()
+	connSession.HttpRequest = r
+	connSession.HttpResponse = w
+	fillConnectionInfo(connSession, r, rpc.PROVIDER_HTTP, provider.endpoint)
 	defer connSession.Close()
 	defer provider.rpcProcessor.OnConnectionClosed(connSession)
 	if connErr := provider.rpcProcessor.NotifyNewConnection(connSession); connErr != nil {
 		log.Warn("OnConnection error", connErr)
+		if rejectedErr, ok := connErr.(*rpc.ConnectionRejectedError); ok {
+			w.WriteHeader(rejectedErr.HttpStatus)
+			sendErrorResponse(w, rejectedErr, rejectedErr.Code, 0)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		sendErrorResponse(w, connErr, rpc.RPC_INTERNAL_ERROR, 0)
 		return
 	}
 	ctx := context.Background()
 
 	err := provider.watchConnectionMessages(ctx, connSession, w, r)
 	if err != nil {
+		if _, ok := err.(*requestTooLargeError); ok {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			sendErrorResponse(w, err, rpc.RPC_LIMIT_EXCEEDED, 0)
+			return
+		}
 		sendErrorResponse(w, err, rpc.RPC_INTERNAL_ERROR, 0)
 		return
 	}
@@ -0,0 +1,46 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+// rejectingProcessor rejects all connections with {err}
+type rejectingProcessor struct {
+	err error
+}
+
+func (processor *rejectingProcessor) NotifyNewConnection(connSession *rpc.ConnectionSession) error {
+	return processor.err
+}
+
+func (processor *rejectingProcessor) OnConnectionClosed(connSession *rpc.ConnectionSession) error {
+	return nil
+}
+
+func (processor *rejectingProcessor) OnRawRequestMessage(connSession *rpc.ConnectionSession, rpcSession *rpc.JSONRpcRequestSession,
+	messageType int, message []byte) error {
+	return nil
+}
+
+func (processor *rejectingProcessor) OnRpcRequest(connSession *rpc.ConnectionSession, rpcSession *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+func TestHttpProviderRejectedConnection(t *testing.T) {
+	provider := NewHttpJsonRpcProvider("127.0.0.1:0", "/", &HttpJsonRpcProviderOptions{TimeoutSeconds: 1})
+	provider.SetRpcProcessor(&rejectingProcessor{
+		err: rpc.NewConnectionRejectedError(http.StatusForbidden, rpc.RPC_ACCESS_DENIED, "ip 8.8.8.8 is not allowed"),
+	})
+	recorder := httptest.NewRecorder()
+	provider.serverHandler(recorder, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"id":1,"method":"eth_call"}`)))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "60002")
+	assert.Contains(t, recorder.Body.String(), "not allowed")
+}
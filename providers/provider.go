@@ -1,12 +1,26 @@
 package providers
 
 import (
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"net"
+	"net/http"
 )
 
 var log = utils.GetLogger("provider")
 
+var (
+	requestTooLargeCounter = metrics.NewCounter("jsonrpc_proxy_limit_request_too_large_total",
+		"requests rejected because of max_request_size")
+	slowClientWriteTimeoutCounter = metrics.NewCounter("jsonrpc_proxy_limit_slow_client_write_timeout_total",
+		"connections closed because writing to the client timeout")
+)
+
+func init() {
+	metrics.MustRegister(requestTooLargeCounter, slowClientWriteTimeoutCounter)
+}
+
 type RpcProviderProcessor interface {
 	NotifyNewConnection(connSession *rpc.ConnectionSession) error
 	OnConnectionClosed(connSession *rpc.ConnectionSession) error
@@ -19,3 +33,16 @@ type RpcProvider interface {
 	SetRpcProcessor(processor RpcProviderProcessor)
 	ListenAndServe() error
 }
+
+// fillConnectionInfo fill connection metadata of the http request(or websocket upgrade request) to connSession
+func fillConnectionInfo(connSession *rpc.ConnectionSession, r *http.Request, providerType string, listenerName string) {
+	info := connSession.Info
+	info.RemoteAddr = r.RemoteAddr
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		info.LocalAddr = localAddr.String()
+	}
+	info.Headers = r.Header.Clone()
+	info.TLS = r.TLS
+	info.ProviderType = providerType
+	info.ListenerName = listenerName
+}
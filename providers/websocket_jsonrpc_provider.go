@@ -6,6 +6,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"net"
 	"net/http"
 	"time"
 )
@@ -16,16 +17,26 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+type WebSocketJsonRpcProviderOptions struct {
+	MaxRequestSize int64         // max bytes of a message from client, 0 means no limit
+	WriteTimeout   time.Duration // max time to write a message to client, the connection is closed when timeout. 0 means no limit
+}
+
 type WebSocketJsonRpcProvider struct {
 	endpoint      string
 	websocketPath string
+	options       *WebSocketJsonRpcProviderOptions
 	rpcProcessor  RpcProviderProcessor
 }
 
-func NewWebSocketJsonRpcProvider(endpoint string, websocketPath string) *WebSocketJsonRpcProvider {
+func NewWebSocketJsonRpcProvider(endpoint string, websocketPath string, options *WebSocketJsonRpcProviderOptions) *WebSocketJsonRpcProvider {
+	if options == nil {
+		options = &WebSocketJsonRpcProviderOptions{}
+	}
 	return &WebSocketJsonRpcProvider{
 		endpoint:      endpoint,
 		websocketPath: websocketPath,
+		options:       options,
 		rpcProcessor:  nil,
 	}
 }
@@ -69,9 +80,19 @@ func (provider *WebSocketJsonRpcProvider) asyncWatchMessagesToConnection(ctx con
 				if pack == nil {
 					return
 				}
+				if provider.options.WriteTimeout > 0 {
+					_ = c.SetWriteDeadline(time.Now().Add(provider.options.WriteTimeout))
+				}
 				err := c.WriteMessage(pack.MessageType, pack.Message)
 				if err != nil {
-					log.Println("write websocket frame error", err)
+					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+						slowClientWriteTimeoutCounter.Inc()
+						log.Warnf("write to slow client %s timeout, disconnecting", connSession.Info.Id)
+					} else {
+						log.Println("write websocket frame error", err)
+					}
+					// close the connection so the reading loop ends, instead of leaving responses queued forever
+					_ = c.Close()
 					return
 				}
 			default:
@@ -85,7 +106,10 @@ func (provider *WebSocketJsonRpcProvider) watchConnectionMessages(ctx context.Co
 	for {
 		mt, message, err := c.ReadMessage()
 		if err != nil {
-			if !utils.IsClosedOrGoingAwayCloseError(err) {
+			if err == websocket.ErrReadLimit {
+				requestTooLargeCounter.Inc()
+				log.Warnf("message from %s exceeds max request size %d, disconnecting", connSession.Info.Id, provider.options.MaxRequestSize)
+			} else if !utils.IsClosedOrGoingAwayCloseError(err) {
 				log.Warn("read from source connection error:", err)
 			}
 			break
@@ -129,7 +153,14 @@ func (provider *WebSocketJsonRpcProvider) serverHandler(w http.ResponseWriter, r
 		return
 	}
 	defer c.Close()
+	if provider.options.MaxRequestSize > 0 {
+		c.SetReadLimit(provider.options.MaxRequestSize)
+	}
 	connSession := rpc.NewConnectionSession()
+	connSession.RequestConnection = c
+	// the ResponseWriter is hijacked by websocket upgrader, so only the upgrade request is exposed to middlewares
+	connSession.HttpRequest = r
+	fillConnectionInfo(connSession, r, rpc.PROVIDER_WEBSOCKET, provider.endpoint)
 	defer connSession.Close()
 	defer provider.rpcProcessor.OnConnectionClosed(connSession)
 	if connErr := provider.rpcProcessor.NotifyNewConnection(connSession); connErr != nil {
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+const (
+	attrLimitsClientIp rpc.AttributeKey = "limits.client_ip" // client ip counted by the connection limiter
+	attrLimitsInflight rpc.AttributeKey = "limits.inflight"  // *int64 of in-flight requests of the connection
+)
+
+var (
+	connectionsRejectedCounter = metrics.NewCounter("jsonrpc_proxy_limit_connections_rejected_total",
+		"connections rejected by max_connections")
+	connectionsPerIpRejectedCounter = metrics.NewCounter("jsonrpc_proxy_limit_connections_per_ip_rejected_total",
+		"connections rejected by max_connections_per_ip")
+	inflightRejectedCounter = metrics.NewCounter("jsonrpc_proxy_limit_inflight_rejected_total",
+		"requests rejected by max_inflight_requests_per_connection")
+	responseTooLargeCounter = metrics.NewCounter("jsonrpc_proxy_limit_response_too_large_total",
+		"responses replaced by error because of max_response_size")
+	slowClientDisconnectedCounter = metrics.NewCounter("jsonrpc_proxy_limit_slow_client_disconnected_total",
+		"slow clients disconnected")
+	slowClientDroppedCounter = metrics.NewCounter("jsonrpc_proxy_limit_slow_client_dropped_total",
+		"responses dropped because of slow clients")
+)
+
+func init() {
+	metrics.MustRegister(connectionsRejectedCounter, connectionsPerIpRejectedCounter, inflightRejectedCounter,
+		responseTooLargeCounter, slowClientDisconnectedCounter, slowClientDroppedCounter)
+}
+
+/**
+ * connectionLimiter counts connections and in-flight requests to enforce the limits config
+ */
+type connectionLimiter struct {
+	limits           config.LimitsConfig
+	lock             sync.Mutex
+	connections      int64
+	connectionsPerIp map[string]int64
+}
+
+func newConnectionLimiter() *connectionLimiter {
+	return &connectionLimiter{
+		connectionsPerIp: make(map[string]int64),
+	}
+}
+
+// acquireConnection count the new connection, returns error if exceeding the connection limits
+func (limiter *connectionLimiter) acquireConnection(connSession *rpc.ConnectionSession) error {
+	clientIp := pluginsCommon.GetClientIp(connSession)
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if limiter.limits.MaxConnections > 0 && limiter.connections >= limiter.limits.MaxConnections {
+		connectionsRejectedCounter.Inc()
+		return rpc.NewConnectionRejectedError(http.StatusServiceUnavailable, rpc.RPC_LIMIT_EXCEEDED,
+			fmt.Sprintf("too many connections, max %d", limiter.limits.MaxConnections))
+	}
+	if limiter.limits.MaxConnectionsPerIp > 0 && limiter.connectionsPerIp[clientIp] >= limiter.limits.MaxConnectionsPerIp {
+		connectionsPerIpRejectedCounter.Inc()
+		return rpc.NewConnectionRejectedError(http.StatusTooManyRequests, rpc.RPC_LIMIT_EXCEEDED,
+			fmt.Sprintf("too many connections from %s, max %d", clientIp, limiter.limits.MaxConnectionsPerIp))
+	}
+	limiter.connections++
+	limiter.connectionsPerIp[clientIp]++
+	connSession.Attributes.Set(attrLimitsClientIp, clientIp)
+	connSession.Attributes.Set(attrLimitsInflight, new(int64))
+	return nil
+}
+
+// releaseConnection uncount the connection, returns false if it was not counted
+func (limiter *connectionLimiter) releaseConnection(connSession *rpc.ConnectionSession) bool {
+	clientIp, ok := connSession.Attributes.GetString(attrLimitsClientIp)
+	if !ok {
+		return false
+	}
+	connSession.Attributes.Delete(attrLimitsClientIp)
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.connections--
+	limiter.connectionsPerIp[clientIp]--
+	if limiter.connectionsPerIp[clientIp] <= 0 {
+		delete(limiter.connectionsPerIp, clientIp)
+	}
+	return true
+}
+
+func (limiter *connectionLimiter) openConnections() int64 {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.connections
+}
+
+func inflightOfConnection(connSession *rpc.ConnectionSession) *int64 {
+	value, ok := connSession.Attributes.Get(attrLimitsInflight)
+	if !ok {
+		return nil
+	}
+	inflight, _ := value.(*int64)
+	return inflight
+}
+
+// acquireRequest count the new in-flight request of the connection, returns false if exceeding the limit
+func (limiter *connectionLimiter) acquireRequest(connSession *rpc.ConnectionSession) bool {
+	inflight := inflightOfConnection(connSession)
+	if inflight == nil {
+		return true
+	}
+	count := atomic.AddInt64(inflight, 1)
+	maxInflight := limiter.limits.MaxInflightRequestsPerConnection
+	if maxInflight > 0 && count > maxInflight {
+		atomic.AddInt64(inflight, -1)
+		inflightRejectedCounter.Inc()
+		return false
+	}
+	return true
+}
+
+func (limiter *connectionLimiter) releaseRequest(connSession *rpc.ConnectionSession) {
+	if inflight := inflightOfConnection(connSession); inflight != nil {
+		atomic.AddInt64(inflight, -1)
+	}
+}
+
+func (limiter *connectionLimiter) slowClientTimeout() time.Duration {
+	return time.Duration(limiter.limits.SlowClientTimeoutMillis) * time.Millisecond
+}
+
+// collectors returns the gauges of configured limits
+func (limiter *connectionLimiter) collectors() []metrics.Collector {
+	limitGauge := func(name string, help string, value int64) metrics.Collector {
+		return metrics.NewGaugeFunc(name, help, func() float64 {
+			return float64(value)
+		})
+	}
+	limits := limiter.limits
+	return []metrics.Collector{
+		limitGauge("jsonrpc_proxy_limit_max_request_size", "configured max_request_size, 0 means no limit", limits.MaxRequestSize),
+		limitGauge("jsonrpc_proxy_limit_max_response_size", "configured max_response_size, 0 means no limit", limits.MaxResponseSize),
+		limitGauge("jsonrpc_proxy_limit_max_connections", "configured max_connections, 0 means no limit", limits.MaxConnections),
+		limitGauge("jsonrpc_proxy_limit_max_connections_per_ip", "configured max_connections_per_ip, 0 means no limit", limits.MaxConnectionsPerIp),
+		limitGauge("jsonrpc_proxy_limit_max_inflight_requests_per_connection",
+			"configured max_inflight_requests_per_connection, 0 means no limit", limits.MaxInflightRequestsPerConnection),
+		limitGauge("jsonrpc_proxy_limit_slow_client_timeout_ms", "configured slow_client_timeout_ms, 0 means no limit", limits.SlowClientTimeoutMillis),
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/plugin"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func mockRpcConnection(remoteAddr string) *rpc.ConnectionSession {
+	connSession := rpc.NewConnectionSession()
+	connSession.Info.RemoteAddr = remoteAddr
+	return connSession
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	limiter := newConnectionLimiter()
+	limiter.limits = config.LimitsConfig{
+		MaxConnections:                   3,
+		MaxConnectionsPerIp:              2,
+		MaxInflightRequestsPerConnection: 1,
+	}
+	conn1 := mockRpcConnection("1.1.1.1:1000")
+	conn2 := mockRpcConnection("1.1.1.1:1001")
+	assert.True(t, limiter.acquireConnection(conn1) == nil)
+	assert.True(t, limiter.acquireConnection(conn2) == nil)
+	assert.True(t, limiter.acquireConnection(mockRpcConnection("1.1.1.1:1002")) != nil)
+	assert.True(t, limiter.acquireConnection(mockRpcConnection("2.2.2.2:1000")) == nil)
+	assert.True(t, limiter.acquireConnection(mockRpcConnection("3.3.3.3:1000")) != nil)
+	assert.Equal(t, int64(3), limiter.openConnections())
+
+	limiter.releaseConnection(conn1)
+	limiter.releaseConnection(conn1)
+	assert.Equal(t, int64(2), limiter.openConnections())
+	assert.True(t, limiter.acquireConnection(mockRpcConnection("1.1.1.1:1003")) == nil)
+
+	assert.True(t, limiter.acquireRequest(conn2))
+	assert.False(t, limiter.acquireRequest(conn2))
+	limiter.releaseRequest(conn2)
+	assert.True(t, limiter.acquireRequest(conn2))
+}
+
+func TestWriteRpcResponseLimits(t *testing.T) {
+	server := NewProxyServer(nil)
+	server.SetLimits(config.LimitsConfig{MaxResponseSize: 64})
+	connSession := rpc.NewConnectionSession()
+	server.writeRpcResponse(connSession, rpc.NewJSONRpcResponse(1, "small", nil))
+	pack := <-connSession.RequestConnectionWriteChan
+	assert.Contains(t, string(pack.Message), "small")
+
+	server.writeRpcResponse(connSession, rpc.NewJSONRpcResponse(2, string(make([]byte, 100)), nil))
+	pack = <-connSession.RequestConnectionWriteChan
+	assert.Contains(t, string(pack.Message), "response too large")
+}
+
+// connectionCountingMiddleware counts OnConnection calls, and rejects connections if {err} is set
+type connectionCountingMiddleware struct {
+	plugin.MiddlewareAdapter
+	connections int
+	err         error
+}
+
+func (m *connectionCountingMiddleware) Name() string {
+	return "connection_counting"
+}
+
+func (m *connectionCountingMiddleware) OnStart() error {
+	return nil
+}
+
+func (m *connectionCountingMiddleware) OnConnection(session *rpc.ConnectionSession) error {
+	m.connections++
+	return m.err
+}
+
+func (m *connectionCountingMiddleware) OnConnectionClosed(session *rpc.ConnectionSession) error {
+	return nil
+}
+
+func (m *connectionCountingMiddleware) OnWebSocketFrame(session *rpc.JSONRpcRequestSession, messageType int, message []byte) error {
+	return nil
+}
+
+func (m *connectionCountingMiddleware) OnRpcRequest(session *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+func (m *connectionCountingMiddleware) OnRpcResponse(session *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+func (m *connectionCountingMiddleware) ProcessRpcRequest(session *rpc.JSONRpcRequestSession) error {
+	return nil
+}
+
+// responseWrittenMiddleware keeps the sessions of responses written
+type responseWrittenMiddleware struct {
+	connectionCountingMiddleware
+	written []*rpc.JSONRpcRequestSession
+}
+
+func (m *responseWrittenMiddleware) OnRpcResponseWritten(session *rpc.JSONRpcRequestSession) {
+	m.written = append(m.written, session)
+}
+
+func TestOnRpcRequestInflightLimit(t *testing.T) {
+	server := NewProxyServer(nil)
+	server.SetLimits(config.LimitsConfig{MaxInflightRequestsPerConnection: 1})
+	m := &responseWrittenMiddleware{}
+	server.MiddlewareChain.Append(m)
+	connSession := mockRpcConnection("1.1.1.1:1000")
+	assert.True(t, server.limiter.acquireConnection(connSession) == nil)
+	assert.True(t, server.limiter.acquireRequest(connSession))
+
+	// responses of rejected requests are seen by middlewares as written, eg. for statistic and access logs
+	rpcSession := rpc.NewJSONRpcRequestSession(connSession)
+	rpcSession.Request = &rpc.JSONRpcRequest{Id: 1, Method: "eth_blockNumber"}
+	assert.True(t, server.OnRpcRequest(connSession, rpcSession) == nil)
+	pack := <-connSession.RequestConnectionWriteChan
+	assert.Contains(t, string(pack.Message), "too many in-flight requests")
+	assert.Equal(t, 1, len(m.written))
+	assert.Equal(t, rpc.RPC_LIMIT_EXCEEDED, m.written[0].Response.Error.Code)
+	assert.False(t, m.written[0].ResponseWrittenAt.IsZero())
+}
+
+func TestNotifyNewConnectionLimits(t *testing.T) {
+	server := NewProxyServer(nil)
+	server.SetLimits(config.LimitsConfig{MaxConnections: 1})
+	m := &connectionCountingMiddleware{}
+	server.MiddlewareChain.Append(m)
+
+	conn1 := mockRpcConnection("1.1.1.1:1000")
+	assert.True(t, server.NotifyNewConnection(conn1) == nil)
+	// rejected before middlewares, eg. before upstream connections are created
+	err := server.NotifyNewConnection(mockRpcConnection("2.2.2.2:1000"))
+	rejectedErr, ok := err.(*rpc.ConnectionRejectedError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, rejectedErr.HttpStatus)
+	assert.Equal(t, 1, m.connections)
+
+	// the slot of connections rejected by middlewares is released
+	assert.True(t, server.OnConnectionClosed(conn1) == nil)
+	m.err = errors.New("rejected")
+	assert.True(t, server.NotifyNewConnection(mockRpcConnection("3.3.3.3:1000")) != nil)
+	assert.Equal(t, int64(0), server.limiter.openConnections())
+	m.err = nil
+	assert.True(t, server.NotifyNewConnection(mockRpcConnection("4.4.4.4:1000")) == nil)
+}
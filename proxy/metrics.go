@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+const (
+	// methods out of the first maxMethodLabels distinct methods are counted as otherMethodLabel,
+	// so clients sending random method names can't blow up the metrics
+	maxMethodLabels  = 500
+	otherMethodLabel = "other"
+	noUpstreamLabel  = "none" // responses not from any upstream, eg. cached or rejected by middlewares
+
+	requestStatusOk    = "ok"
+	requestStatusError = "error"
+)
+
+var (
+	rpcRequestsCounter = metrics.NewCounterVec("jsonrpc_proxy_rpc_requests_total",
+		"rpc requests responded, by method, upstream and status(ok or error)", "method", "upstream", "status")
+	rpcRequestDuration = metrics.NewHistogramVec("jsonrpc_proxy_rpc_request_duration_seconds",
+		"latency of rpc requests from received to responded", metrics.DefBuckets, "method")
+	inflightRequestsGauge = metrics.NewGauge("jsonrpc_proxy_inflight_requests",
+		"rpc requests received but not responded yet")
+	openConnectionsGauge = metrics.NewGaugeVec("jsonrpc_proxy_open_connections",
+		"open client connections by provider", "provider")
+)
+
+func init() {
+	metrics.MustRegister(rpcRequestsCounter, rpcRequestDuration, inflightRequestsGauge, openConnectionsGauge)
+}
+
+var methodLabels = &methodLabelSet{methods: make(map[string]struct{})}
+
+// methodLabelSet limits the count of distinct method labels
+type methodLabelSet struct {
+	lock    sync.RWMutex
+	methods map[string]struct{}
+}
+
+func (s *methodLabelSet) label(method string) string {
+	s.lock.RLock()
+	_, ok := s.methods[method]
+	s.lock.RUnlock()
+	if ok {
+		return method
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok = s.methods[method]; ok {
+		return method
+	}
+	if len(s.methods) >= maxMethodLabels {
+		return otherMethodLabel
+	}
+	s.methods[method] = struct{}{}
+	return method
+}
+
+// observeRpcResponse record the request metrics after the response of rpcSession is ready
+func observeRpcResponse(rpcSession *rpc.JSONRpcRequestSession) {
+	method := otherMethodLabel
+	if rpcSession.Request != nil {
+		method = methodLabels.label(rpcSession.Request.Method)
+	}
+	upstream := rpcSession.TargetServer
+	if len(upstream) < 1 || rpcSession.ResponseSetByCache {
+		upstream = noUpstreamLabel
+	}
+	status := requestStatusOk
+	if rpcSession.Response == nil || rpcSession.Response.Error != nil {
+		status = requestStatusError
+	}
+	rpcRequestsCounter.WithLabelValues(method, upstream, status).Inc()
+	rpcRequestDuration.WithLabelValues(method).Observe(time.Since(rpcSession.ReceivedAt).Seconds())
+}
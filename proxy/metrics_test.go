@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+)
+
+func TestMethodLabelSet(t *testing.T) {
+	labels := &methodLabelSet{methods: make(map[string]struct{})}
+	for i := 0; i < maxMethodLabels; i++ {
+		assert.Equal(t, "method"+strconv.Itoa(i), labels.label("method"+strconv.Itoa(i)))
+	}
+	assert.Equal(t, otherMethodLabel, labels.label("randomMethod"))
+	assert.Equal(t, "method0", labels.label("method0"))
+}
+
+func TestObserveRpcResponse(t *testing.T) {
+	rpcSession := rpc.NewJSONRpcRequestSession(mockRpcConnection("1.1.1.1:1000"))
+	rpcSession.Request = &rpc.JSONRpcRequest{Id: 1, Method: "testObservedMethod"}
+	rpcSession.TargetServer = "ws://127.0.0.1:3000"
+	rpcSession.Response = rpc.NewJSONRpcResponse(1, "ok", nil)
+	observeRpcResponse(rpcSession)
+	rpcSession.Response = rpc.NewJSONRpcResponse(1, nil, rpc.NewJSONRpcResponseError(rpc.RPC_INTERNAL_ERROR, "error", nil))
+	observeRpcResponse(rpcSession)
+	rpcSession.ResponseSetByCache = true
+	rpcSession.Response = rpc.NewJSONRpcResponse(1, "ok", nil)
+	observeRpcResponse(rpcSession)
+
+	assert.Equal(t, float64(1), rpcRequestsCounter.WithLabelValues("testObservedMethod", "ws://127.0.0.1:3000", requestStatusOk).Value())
+	assert.Equal(t, float64(1), rpcRequestsCounter.WithLabelValues("testObservedMethod", "ws://127.0.0.1:3000", requestStatusError).Value())
+	assert.Equal(t, float64(1), rpcRequestsCounter.WithLabelValues("testObservedMethod", noUpstreamLabel, requestStatusOk).Value())
+	assert.Equal(t, uint64(3), rpcRequestDuration.WithLabelValues("testObservedMethod").Count())
+}
@@ -1,12 +1,17 @@
 package proxy
 
 import (
+	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/zoowii/jsonrpc_proxygo/config"
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
 	"github.com/zoowii/jsonrpc_proxygo/plugin"
 	"github.com/zoowii/jsonrpc_proxygo/providers"
 	"github.com/zoowii/jsonrpc_proxygo/registry"
 	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
 	"github.com/zoowii/jsonrpc_proxygo/utils"
+	"time"
 )
 
 var log = utils.GetLogger("server")
@@ -18,6 +23,7 @@ type ProxyServer struct {
 	MiddlewareChain *plugin.MiddlewareChain
 	Provider        providers.RpcProvider
 	Registry        registry.Registry
+	limiter         *connectionLimiter
 }
 
 /**
@@ -27,19 +33,46 @@ func NewProxyServer(provider providers.RpcProvider) *ProxyServer {
 	server := &ProxyServer{
 		MiddlewareChain: plugin.NewMiddlewareChain(),
 		Provider:        provider,
+		limiter:         newConnectionLimiter(),
 	}
 	return server
 }
 
+// SetLimits set the limits of connections and messages, should be called before Start
+func (server *ProxyServer) SetLimits(limits config.LimitsConfig) {
+	server.limiter.limits = limits
+}
+
 func (server *ProxyServer) StartMiddlewares() error {
 	return server.MiddlewareChain.OnStart()
 }
 
-func (server *ProxyServer) NotifyNewConnection(connSession *rpc.ConnectionSession) error {
-	return server.MiddlewareChain.OnConnection(connSession)
+// StopMiddlewares notify middlewares the server is shutting down
+func (server *ProxyServer) StopMiddlewares() error {
+	return server.MiddlewareChain.OnStop()
+}
+
+func (server *ProxyServer) NotifyNewConnection(connSession *rpc.ConnectionSession) (err error) {
+	// checked before middlewares, so rejected connections don't take resources like upstream connections.
+	// the client ip is resolved first, eg. by ip_acl plugin behind trusted proxies
+	server.MiddlewareChain.ResolveClientIp(connSession)
+	err = server.limiter.acquireConnection(connSession)
+	if err != nil {
+		return
+	}
+	err = server.MiddlewareChain.OnConnection(connSession)
+	if err != nil {
+		server.limiter.releaseConnection(connSession)
+		return
+	}
+	openConnectionsGauge.WithLabelValues(connSession.Info.ProviderType).Inc()
+	return
 }
 
 func (server *ProxyServer) OnConnectionClosed(connSession *rpc.ConnectionSession) error {
+	if server.limiter.releaseConnection(connSession) {
+		openConnectionsGauge.WithLabelValues(connSession.Info.ProviderType).Dec()
+	}
 	// must ensure middleware chain not change after calling OnConnection,
 	// otherwise some removed middlewares may not call OnConnectionClosed
 	return server.MiddlewareChain.OnConnectionClosed(connSession)
@@ -50,14 +83,90 @@ func (server *ProxyServer) OnRawRequestMessage(connSession *rpc.ConnectionSessio
 	return server.MiddlewareChain.OnWebSocketFrame(rpcSession, messageType, message)
 }
 
+// writeToConnection queue the message to the client connection.
+// if the client is too slow to consume the queue in slow_client_timeout_ms, the message is dropped or the connection is closed
+func (server *ProxyServer) writeToConnection(connSession *rpc.ConnectionSession, pack *rpc.MessagePack) {
+	writeChan := connSession.RequestConnectionWriteChan
+	if writeChan == nil {
+		return
+	}
+	timeout := server.limiter.slowClientTimeout()
+	if timeout <= 0 {
+		writeChan <- pack
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case writeChan <- pack:
+	case <-timer.C:
+		if server.limiter.limits.SlowClientPolicy == config.SLOW_CLIENT_POLICY_DROP || connSession.RequestConnection == nil {
+			slowClientDroppedCounter.Inc()
+			log.Warnf("slow client %s, response dropped", connSession.Info.Id)
+			return
+		}
+		slowClientDisconnectedCounter.Inc()
+		log.Warnf("slow client %s, disconnecting", connSession.Info.Id)
+		_ = connSession.RequestConnection.Close()
+	}
+}
+
+// writeRpcResponse returns the bytes of the response message written, 0 if failed to encode
+func (server *ProxyServer) writeRpcResponse(connSession *rpc.ConnectionSession, rpcRes *rpc.JSONRpcResponse) (written int) {
+	resBytes, err := rpc.EncodeJSONRPCResponse(rpcRes)
+	if err != nil {
+		log.Error("encodeJSONRPCResponse err", err)
+		return
+	}
+	maxResponseSize := server.limiter.limits.MaxResponseSize
+	if maxResponseSize > 0 && int64(len(resBytes)) > maxResponseSize {
+		responseTooLargeCounter.Inc()
+		log.Warnf("response of request %d too large(%d bytes)", rpcRes.Id, len(resBytes))
+		errRes := rpc.NewJSONRpcResponse(rpcRes.Id, nil,
+			rpc.NewJSONRpcResponseError(rpc.RPC_LIMIT_EXCEEDED, fmt.Sprintf("response too large, max %d bytes", maxResponseSize), nil))
+		if resBytes, err = rpc.EncodeJSONRPCResponse(errRes); err != nil {
+			log.Error("encodeJSONRPCResponse err", err)
+			return
+		}
+	}
+	server.writeToConnection(connSession, rpc.NewMessagePack(websocket.TextMessage, resBytes))
+	return len(resBytes)
+}
+
 func (server *ProxyServer) OnRpcRequest(connSession *rpc.ConnectionSession, rpcSession *rpc.JSONRpcRequestSession) (err error) {
+	startRequestSpan(connSession, rpcSession)
+	if !server.limiter.acquireRequest(connSession) {
+		maxInflight := server.limiter.limits.MaxInflightRequestsPerConnection
+		rpcSession.Response = rpc.NewJSONRpcResponse(rpcSession.Request.Id, nil,
+			rpc.NewJSONRpcResponseError(rpc.RPC_LIMIT_EXCEEDED, fmt.Sprintf("too many in-flight requests, max %d", maxInflight), nil))
+		observeRpcResponse(rpcSession)
+		rpcSession.ResponseBytes = server.writeRpcResponse(connSession, rpcSession.Response)
+		server.MiddlewareChain.OnRpcResponseWritten(rpcSession)
+		endRequestSpan(rpcSession)
+		return
+	}
+	inflightRequestsGauge.Inc()
+	stageSpan := startStageSpan(rpcSession, "on_rpc_request")
 	err = server.MiddlewareChain.OnJSONRpcRequest(rpcSession)
+	stageSpan.End()
 	if err != nil {
+		inflightRequestsGauge.Dec()
+		observeRpcResponse(rpcSession)
+		endRequestSpan(rpcSession)
+		server.limiter.releaseRequest(connSession)
 		log.Warn("OnRpcRequest error", err)
 		return
 	}
 	go func() {
+		defer server.limiter.releaseRequest(connSession)
+		defer func() {
+			inflightRequestsGauge.Dec()
+			observeRpcResponse(rpcSession)
+			endRequestSpan(rpcSession)
+		}()
+		stageSpan := startStageSpan(rpcSession, "process_rpc_request")
 		err = server.MiddlewareChain.ProcessJSONRpcRequest(rpcSession)
+		stageSpan.End()
 		if err != nil {
 			log.Warn("ProcessRpcRequest error", err)
 			return
@@ -67,17 +176,17 @@ func (server *ProxyServer) OnRpcRequest(connSession *rpc.ConnectionSession, rpcS
 			log.Error("empty jsonrpc response, maybe no valid middleware added")
 			return
 		}
+		stageSpan = startStageSpan(rpcSession, "on_rpc_response")
 		err = server.MiddlewareChain.OnJSONRpcResponse(rpcSession)
+		stageSpan.End()
 		if err != nil {
 			log.Warn("OnRpcResponse error", err)
 			return
 		}
-		resBytes, err := rpc.EncodeJSONRPCResponse(rpcRes)
-		if err != nil {
-			log.Error("encodeJSONRPCResponse err", err)
-			return
-		}
-		connSession.RequestConnectionWriteChan <- rpc.NewMessagePack(websocket.TextMessage, resBytes)
+		stageSpan = startStageSpan(rpcSession, "write_response")
+		rpcSession.ResponseBytes = server.writeRpcResponse(connSession, rpcRes)
+		stageSpan.End()
+		server.MiddlewareChain.OnRpcResponseWritten(rpcSession)
 	}()
 	return
 }
@@ -90,11 +199,19 @@ func (server *ProxyServer) Start() {
 		log.Fatalln("please set provider to ProxyServer before start")
 		return
 	}
+	for _, c := range server.limiter.collectors() {
+		if err := metrics.Register(c); err != nil {
+			log.Warn("register metric error", err)
+		}
+	}
 	server.Provider.SetRpcProcessor(server)
 	log.Fatal(server.Provider.ListenAndServe())
 }
 
 func (server *ProxyServer) Close() {
+	if err := tracing.Shutdown(); err != nil {
+		log.Warn("shutdown tracing error", err)
+	}
 	if server.Registry != nil {
 		server.Registry.Close()
 		server.Registry = nil
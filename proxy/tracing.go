@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	pluginsCommon "github.com/zoowii/jsonrpc_proxygo/plugins/common"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
+)
+
+// startRequestSpan start the server span of the request from when it's received.
+// traceparent header of http requests is honored, so the request joins the client's trace
+func startRequestSpan(connSession *rpc.ConnectionSession, rpcSession *rpc.JSONRpcRequestSession) {
+	var parent tracing.SpanContext
+	info := connSession.Info
+	if info != nil && info.ProviderType == rpc.PROVIDER_HTTP {
+		if sc, ok := tracing.ParseTraceparent(info.Headers.Get(tracing.TraceparentHeader)); ok {
+			parent = sc
+		}
+	}
+	method := rpcSession.Request.Method
+	span := tracing.StartSpanAt(method, tracing.SPAN_KIND_SERVER, parent, rpcSession.ReceivedAt)
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.method", method)
+	span.SetAttribute("rpc.jsonrpc.request_id", rpcSession.Request.Id)
+	span.SetAttribute("net.peer.ip", pluginsCommon.GetClientIp(connSession))
+	if info != nil {
+		span.SetAttribute("jsonrpc_proxy.provider", info.ProviderType)
+		span.SetAttribute("jsonrpc_proxy.connection_id", info.Id)
+	}
+	rpcSession.Span = span
+}
+
+// startStageSpan start a child span of the request span for a stage of the middleware chain
+func startStageSpan(rpcSession *rpc.JSONRpcRequestSession, stage string) *tracing.Span {
+	if rpcSession.Span == nil {
+		return nil
+	}
+	return tracing.StartSpan(stage, tracing.SPAN_KIND_INTERNAL, rpcSession.Span.SpanContext())
+}
+
+// endRequestSpan end the request span with the response's status
+func endRequestSpan(rpcSession *rpc.JSONRpcRequestSession) {
+	span := rpcSession.Span
+	if span == nil {
+		return
+	}
+	res := rpcSession.Response
+	switch {
+	case res == nil:
+		span.SetError("no response")
+	case res.Error != nil:
+		span.SetAttribute("rpc.jsonrpc.error_code", int64(res.Error.Code))
+		span.SetError(res.Error.Message)
+	}
+	if len(rpcSession.TargetServer) > 0 {
+		span.SetAttribute("jsonrpc_proxy.upstream", rpcSession.TargetServer)
+	}
+	span.SetAttribute("jsonrpc_proxy.cached", rpcSession.ResponseSetByCache)
+	span.End()
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zoowii/jsonrpc_proxygo/rpc"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
+)
+
+func TestStartRequestSpan(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	newSession := func(providerType string) *rpc.JSONRpcRequestSession {
+		connSession := mockRpcConnection("1.1.1.1:1000")
+		connSession.Info.ProviderType = providerType
+		connSession.Info.Headers.Set(tracing.TraceparentHeader, traceparent)
+		rpcSession := rpc.NewJSONRpcRequestSession(connSession)
+		rpcSession.Request = &rpc.JSONRpcRequest{Id: 1, Method: "eth_call"}
+		startRequestSpan(connSession, rpcSession)
+		return rpcSession
+	}
+	// traceparent of http clients is honored
+	httpSession := newSession(rpc.PROVIDER_HTTP)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", httpSession.Span.SpanContext().TraceId.String())
+	assert.Equal(t, "00f067aa0ba902b7", httpSession.Span.ParentSpanId.String())
+	stage := startStageSpan(httpSession, "on_rpc_request")
+	assert.Equal(t, httpSession.Span.SpanContext().SpanId, stage.ParentSpanId)
+
+	wsSession := newSession(rpc.PROVIDER_WEBSOCKET)
+	assert.NotEqual(t, "4bf92f3577b34da6a3ce929d0e0e4736", wsSession.Span.SpanContext().TraceId.String())
+	assert.False(t, wsSession.Span.ParentSpanId.IsValid())
+}
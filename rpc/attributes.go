@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// AttributeKey is the key of a value in Attributes
+type AttributeKey string
+
+const (
+	ATTR_SELECTED_UPSTREAM_TARGET AttributeKey = "upstream.selected_target" // string, upstream target endpoint selected for the connection
+	ATTR_CLIENT_IP                AttributeKey = "client.ip"                // string, real client ip resolved by ip_acl plugin
+	ATTR_JWT_SUBJECT              AttributeKey = "auth.jwt_subject"         // string, subject of the JWT whose signature is verified by an auth plugin
+)
+
+// Attributes is a concurrent safe key-value bag shared by middlewares in a connection session.
+// middlewares should declare their keys as AttributeKey constants and read values by the typed getters
+type Attributes struct {
+	lock   sync.RWMutex
+	values map[AttributeKey]interface{}
+}
+
+func NewAttributes() *Attributes {
+	return &Attributes{
+		values: make(map[AttributeKey]interface{}),
+	}
+}
+
+func (attrs *Attributes) Set(key AttributeKey, value interface{}) {
+	attrs.lock.Lock()
+	defer attrs.lock.Unlock()
+	attrs.values[key] = value
+}
+
+func (attrs *Attributes) Get(key AttributeKey) (value interface{}, ok bool) {
+	attrs.lock.RLock()
+	defer attrs.lock.RUnlock()
+	value, ok = attrs.values[key]
+	return
+}
+
+func (attrs *Attributes) Has(key AttributeKey) bool {
+	_, ok := attrs.Get(key)
+	return ok
+}
+
+func (attrs *Attributes) Delete(key AttributeKey) {
+	attrs.lock.Lock()
+	defer attrs.lock.Unlock()
+	delete(attrs.values, key)
+}
+
+// GetString returns the string value of {key}, ok is false when not found or value is not string
+func (attrs *Attributes) GetString(key AttributeKey) (result string, ok bool) {
+	value, found := attrs.Get(key)
+	if !found {
+		return
+	}
+	result, ok = value.(string)
+	return
+}
+
+func (attrs *Attributes) GetInt64(key AttributeKey) (result int64, ok bool) {
+	value, found := attrs.Get(key)
+	if !found {
+		return
+	}
+	result, ok = value.(int64)
+	return
+}
+
+func (attrs *Attributes) GetBool(key AttributeKey) (result bool, ok bool) {
+	value, found := attrs.Get(key)
+	if !found {
+		return
+	}
+	result, ok = value.(bool)
+	return
+}
+
+func (attrs *Attributes) GetTime(key AttributeKey) (result time.Time, ok bool) {
+	value, found := attrs.Get(key)
+	if !found {
+		return
+	}
+	result, ok = value.(time.Time)
+	return
+}
@@ -1,18 +1,47 @@
 package rpc
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
 
 const (
+	RPC_INVALID_PARAMS = -32602 // standard jsonrpc 2.0 invalid params error
+
 	RPC_INTERNAL_ERROR = 10001
 
 	RPC_UPSTREAM_CONNECTION_CLOSED_ERROR = 50001
 	RPC_UPSTREAM_TIMEOUT_ERROR           = 50002
 
 	RPC_DISABLED_RPC_METHOD = 60001
+	RPC_ACCESS_DENIED       = 60002
+	RPC_LIMIT_EXCEEDED      = 60003
 
 	RPC_RESPONSE_TIMEOUT_ERROR = 70001
 )
 
+// ConnectionRejectedError is returned by OnConnection of middlewares rejecting the connection,
+// http providers respond it with HttpStatus and a jsonrpc error of Code
+type ConnectionRejectedError struct {
+	HttpStatus int
+	Code       int
+	Message    string
+}
+
+func NewConnectionRejectedError(httpStatus int, code int, message string) *ConnectionRejectedError {
+	return &ConnectionRejectedError{
+		HttpStatus: httpStatus,
+		Code:       code,
+		Message:    message,
+	}
+}
+
+func (e *ConnectionRejectedError) Error() string {
+	return e.Message
+}
+
 type JSONRpcRequest struct {
 	Id      uint64      `json:"id"`
 	JSONRpc string      `json:"jsonrpc,omitempty"`
@@ -20,12 +49,20 @@ type JSONRpcRequest struct {
 	Params  interface{} `json:"params,omitempty"`
 }
 
+// DecodeJSONRPCRequest decode the request keeping numbers in params as json.Number,
+// so big integers and long decimals are forwarded and compared without precision loss
 func DecodeJSONRPCRequest(message []byte) (req *JSONRpcRequest, err error) {
 	req = new(JSONRpcRequest)
-	err = json.Unmarshal(message, &req)
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	err = decoder.Decode(&req)
 	if err != nil {
 		return
 	}
+	if _, tokenErr := decoder.Token(); tokenErr != io.EOF {
+		err = errors.New("invalid character after top-level value of jsonrpc request")
+		return
+	}
 	return
 }
 
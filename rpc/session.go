@@ -1,8 +1,15 @@
 package rpc
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/zoowii/jsonrpc_proxygo/tracing"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 type JSONRpcRequestBundle struct {
@@ -33,7 +40,53 @@ func NewMessagePack(messageType int, message []byte) *MessagePack {
 	}
 }
 
+const (
+	PROVIDER_WEBSOCKET = "websocket"
+	PROVIDER_HTTP      = "http"
+	PROVIDER_INTERNAL  = "internal" // connections created by middlewares themselves
+)
+
+// ConnectionInfo is the metadata of a client connection, filled by the provider before OnConnection
+type ConnectionInfo struct {
+	Id           string               // unique id of the connection in this process, also unique across restarts
+	RemoteAddr   string               // peer address, maybe a proxy. use ATTR_CLIENT_IP for the real client ip
+	LocalAddr    string               // local address which accepted the connection
+	Headers      http.Header          // http headers of the request(the upgrade request of websocket)
+	TLS          *tls.ConnectionState // nil if not tls connection
+	ProviderType string               // PROVIDER_WEBSOCKET, PROVIDER_HTTP, etc.
+	ListenerName string               // name of the listener, the provider endpoint by default
+	ConnectedAt  time.Time
+}
+
+var (
+	connectionIdPrefix = newConnectionIdPrefix()
+	connectionIdSeq    uint64
+)
+
+func newConnectionIdPrefix() string {
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(prefix)
+}
+
+func nextConnectionId() string {
+	return fmt.Sprintf("%s-%d", connectionIdPrefix, atomic.AddUint64(&connectionIdSeq, 1))
+}
+
+func NewConnectionInfo() *ConnectionInfo {
+	return &ConnectionInfo{
+		Id:          nextConnectionId(),
+		Headers:     http.Header{},
+		ConnectedAt: time.Now(),
+	}
+}
+
 type ConnectionSession struct {
+	Info       *ConnectionInfo
+	Attributes *Attributes // values shared by middlewares in the connection, see AttributeKey
+
 	RequestConnection          *websocket.Conn
 	HttpResponse               http.ResponseWriter
 	HttpRequest                *http.Request
@@ -47,7 +100,6 @@ type ConnectionSession struct {
 	// same base middleware shared fields
 
 	// upstream middleware shared fields in connection session
-	SelectedUpstreamTarget       *string
 	UpstreamTargetConnection     *websocket.Conn
 	UpstreamTargetConnectionDone chan struct{}
 	UpstreamRpcRequestsChan      chan *JSONRpcRequestBundle
@@ -64,6 +116,8 @@ func (connSession *ConnectionSession) Close() {
 
 func NewConnectionSession() *ConnectionSession {
 	return &ConnectionSession{
+		Info:                       NewConnectionInfo(),
+		Attributes:                 NewAttributes(),
 		RequestConnectionWriteChan: make(chan *MessagePack, 1000),
 		ConnectionDone:             make(chan struct{}),
 		RpcRequestsMap:             make(map[uint64]chan *JSONRpcResponse),
@@ -82,19 +136,52 @@ type JSONRpcRequestSession struct {
 
 	// cache middleware shared fields
 	ResponseSetByCache bool
+	ResponseStale      bool // the response set by cache is expired and being refreshed
+	CacheMissed        bool // the request is cacheable but not found in cache
 
 	// before_cache middleware shared fields
-	MethodNameForCache *string // only used to find cache in cache middleware
+	MethodNameForCache *string     // only used to find cache in cache middleware
+	ParamsForCache     interface{} // params used in cache key instead of the request params if not nil
 
 	// selected upstream target server url
 	TargetServer string
+
+	// timestamps of the request's stages, zero if the stage is not reached(eg. no upstream call for cached responses)
+	ReceivedAt        time.Time // received from the client
+	UpstreamSentAt    time.Time // sent to the upstream target
+	UpstreamRecvAt    time.Time // response received from the upstream target
+	ResponseWrittenAt time.Time // response written to the client connection
+
+	// bytes of the response message written to the client, 0 if not written
+	ResponseBytes int
+
+	// server span of the request set by the proxy server, nil for requests sent by middlewares themselves
+	Span *tracing.Span
 }
 
 func NewJSONRpcRequestSession(conn *ConnectionSession) *JSONRpcRequestSession {
 	return &JSONRpcRequestSession{
 		Conn:               conn,
+		Parameters:         make(map[string]interface{}),
 		ResponseSetByCache: false,
+		ReceivedAt:         time.Now(),
+	}
+}
+
+// Latency returns the duration from received to the response written, 0 if not written yet
+func (requestSession *JSONRpcRequestSession) Latency() time.Duration {
+	if requestSession.ResponseWrittenAt.IsZero() {
+		return 0
+	}
+	return requestSession.ResponseWrittenAt.Sub(requestSession.ReceivedAt)
+}
+
+// UpstreamLatency returns the duration from sent to the upstream to its response received, 0 if no upstream response
+func (requestSession *JSONRpcRequestSession) UpstreamLatency() time.Duration {
+	if requestSession.UpstreamSentAt.IsZero() || requestSession.UpstreamRecvAt.IsZero() {
+		return 0
 	}
+	return requestSession.UpstreamRecvAt.Sub(requestSession.UpstreamSentAt)
 }
 
 func (requestSession *JSONRpcRequestSession) FillRpcRequest(request *JSONRpcRequest, requestBytes []byte) {
@@ -0,0 +1,32 @@
+package rpc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewConnectionSessionInfo(t *testing.T) {
+	sess1 := NewConnectionSession()
+	sess2 := NewConnectionSession()
+	assert.True(t, len(sess1.Info.Id) > 0)
+	assert.NotEqual(t, sess1.Info.Id, sess2.Info.Id)
+	assert.False(t, sess1.Info.ConnectedAt.IsZero())
+}
+
+func TestAttributes(t *testing.T) {
+	attrs := NewAttributes()
+	_, ok := attrs.GetString(ATTR_SELECTED_UPSTREAM_TARGET)
+	assert.False(t, ok)
+
+	attrs.Set(ATTR_SELECTED_UPSTREAM_TARGET, "ws://127.0.0.1:3000")
+	target, ok := attrs.GetString(ATTR_SELECTED_UPSTREAM_TARGET)
+	assert.True(t, ok)
+	assert.Equal(t, "ws://127.0.0.1:3000", target)
+
+	// typed getter of another type fails
+	_, ok = attrs.GetInt64(ATTR_SELECTED_UPSTREAM_TARGET)
+	assert.False(t, ok)
+
+	attrs.Delete(ATTR_SELECTED_UPSTREAM_TARGET)
+	assert.False(t, attrs.Has(ATTR_SELECTED_UPSTREAM_TARGET))
+}
@@ -1,3 +1,6 @@
+-- schema of the mysql metric store, for reference only.
+-- tables are created and upgraded by the migrations embedded in the binary(plugins/statistic/migrations.go) when the store starts
+
 CREATE TABLE `request_span` (
   `id` BIGINT NOT NULL,
   `annotation` VARCHAR(50) NULL COMMENT 'cs/sr/ss/cr',
@@ -8,6 +11,10 @@ CREATE TABLE `request_span` (
   `rpc_response_error` TEXT NULL,
   `rpc_response_result` TEXT NULL,
   `target_server` TEXT NULL,
+  `received_at` TIMESTAMP(6) NULL COMMENT 'received from the client',
+  `upstream_sent_at` TIMESTAMP(6) NULL COMMENT 'sent to the upstream',
+  `upstream_received_at` TIMESTAMP(6) NULL COMMENT 'response received from the upstream',
+  `response_written_at` TIMESTAMP(6) NULL COMMENT 'response written to the client',
   `log_time` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `create_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `update_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
@@ -27,6 +34,8 @@ CREATE TABLE `service_log` (
   `service_name` VARCHAR(100) NOT NULL,
   `url` TEXT NOT NULL,
   `down_time` TIMESTAMP NULL,
+  `up_time` TIMESTAMP NULL,
+  `reason` VARCHAR(50) NULL COMMENT 'deregistered/registered/health_check_failed/health_check_passed',
   `create_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `update_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`));
@@ -53,3 +62,45 @@ ADD INDEX `service_health_idx_service_name` (`service_name` ASC);
 ALTER TABLE `service_health`
 ADD UNIQUE INDEX `service_health_idx_service_url` (`service_url` ASC);
 ;
+
+CREATE TABLE `metric_rollup` (
+  `resolution` VARCHAR(10) NOT NULL COMMENT 'minute/hour/day',
+  `dimension` VARCHAR(20) NOT NULL COMMENT 'method/upstream',
+  `dimension_key` VARCHAR(255) NOT NULL COMMENT 'method name or upstream url',
+  `bucket_time` BIGINT NOT NULL COMMENT 'unix seconds of the bucket start',
+  `calls` BIGINT NOT NULL DEFAULT 0,
+  `errors` BIGINT NOT NULL DEFAULT 0,
+  `latency_sum_ms` DOUBLE PRECISION NOT NULL DEFAULT 0,
+  `le_5` BIGINT NOT NULL DEFAULT 0,
+  `le_10` BIGINT NOT NULL DEFAULT 0,
+  `le_25` BIGINT NOT NULL DEFAULT 0,
+  `le_50` BIGINT NOT NULL DEFAULT 0,
+  `le_100` BIGINT NOT NULL DEFAULT 0,
+  `le_250` BIGINT NOT NULL DEFAULT 0,
+  `le_500` BIGINT NOT NULL DEFAULT 0,
+  `le_1000` BIGINT NOT NULL DEFAULT 0,
+  `le_2500` BIGINT NOT NULL DEFAULT 0,
+  `le_5000` BIGINT NOT NULL DEFAULT 0,
+  `le_inf` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`resolution`, `dimension`, `dimension_key`, `bucket_time`),
+  INDEX `metric_rollup_idx_resolution_time` (`resolution`, `bucket_time`));
+
+CREATE TABLE `client_usage` (
+  `day` VARCHAR(10) NOT NULL COMMENT 'yyyy-mm-dd in UTC',
+  `client_type` VARCHAR(20) NOT NULL COMMENT 'api_key/jwt_subject/ip',
+  `client` VARCHAR(255) NOT NULL,
+  `method` VARCHAR(100) NOT NULL COMMENT 'empty of rate limit denials',
+  `calls` BIGINT NOT NULL DEFAULT 0,
+  `errors` BIGINT NOT NULL DEFAULT 0,
+  `bytes_in` BIGINT NOT NULL DEFAULT 0,
+  `bytes_out` BIGINT NOT NULL DEFAULT 0,
+  `rate_limit_denials` BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (`day`, `client_type`, `client`, `method`),
+  INDEX `client_usage_idx_client` (`client_type`, `client`, `day`));
+
+-- upgrade request_span created by older versions
+-- ALTER TABLE `request_span`
+-- ADD COLUMN `received_at` TIMESTAMP(6) NULL COMMENT 'received from the client' AFTER `target_server`,
+-- ADD COLUMN `upstream_sent_at` TIMESTAMP(6) NULL COMMENT 'sent to the upstream' AFTER `received_at`,
+-- ADD COLUMN `upstream_received_at` TIMESTAMP(6) NULL COMMENT 'response received from the upstream' AFTER `upstream_sent_at`,
+-- ADD COLUMN `response_written_at` TIMESTAMP(6) NULL COMMENT 'response written to the client' AFTER `upstream_received_at`;
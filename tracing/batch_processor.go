@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zoowii/jsonrpc_proxygo/metrics"
+	"github.com/zoowii/jsonrpc_proxygo/utils"
+)
+
+var log = utils.GetLogger("tracing")
+
+var (
+	droppedSpansCounter = metrics.NewCounter("jsonrpc_proxy_tracing_dropped_spans_total",
+		"spans dropped because the export queue is full")
+	exportErrorsCounter = metrics.NewCounter("jsonrpc_proxy_tracing_export_errors_total",
+		"failed exports of span batches")
+)
+
+func init() {
+	metrics.MustRegister(droppedSpansCounter, exportErrorsCounter)
+}
+
+/**
+ * BatchSpanProcessor queues ended spans and exports them in batches in background, spans are dropped if the queue is full
+ */
+type BatchSpanProcessor struct {
+	exporter      SpanExporter
+	batchSize     int
+	flushInterval time.Duration
+
+	queue        chan *Span
+	stopCh       chan struct{}
+	stoppedCh    chan struct{}
+	shutdownOnce sync.Once
+}
+
+func NewBatchSpanProcessor(exporter SpanExporter, batchSize int, flushInterval time.Duration, queueSize int) *BatchSpanProcessor {
+	if batchSize <= 0 {
+		batchSize = 512
+	}
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+	if queueSize < batchSize {
+		queueSize = batchSize * 4
+	}
+	p := &BatchSpanProcessor{
+		exporter:      exporter,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan *Span, queueSize),
+		stopCh:        make(chan struct{}),
+		stoppedCh:     make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *BatchSpanProcessor) OnEnd(span *Span) {
+	select {
+	case p.queue <- span:
+	default:
+		droppedSpansCounter.Inc()
+	}
+}
+
+func (p *BatchSpanProcessor) export(batch []*Span) {
+	if len(batch) < 1 {
+		return
+	}
+	if err := p.exporter.ExportSpans(batch); err != nil {
+		exportErrorsCounter.Inc()
+		log.Warnf("export %d spans error %s", len(batch), err.Error())
+	}
+}
+
+func (p *BatchSpanProcessor) loop() {
+	defer close(p.stoppedCh)
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, p.batchSize)
+	flush := func() {
+		p.export(batch)
+		batch = make([]*Span, 0, p.batchSize)
+	}
+	for {
+		select {
+		case span := <-p.queue:
+			batch = append(batch, span)
+			if len(batch) >= p.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-p.stopCh:
+			// drain the queued spans before stopped
+			for {
+				select {
+				case span := <-p.queue:
+					batch = append(batch, span)
+					if len(batch) >= p.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown export the queued spans and stop the background goroutine
+func (p *BatchSpanProcessor) Shutdown() error {
+	p.shutdownOnce.Do(func() {
+		close(p.stopCh)
+	})
+	<-p.stoppedCh
+	return nil
+}
@@ -0,0 +1,115 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader is the W3C trace context header propagated to and from http peers
+const TraceparentHeader = "traceparent"
+
+const traceFlagSampled = 0x01
+
+type TraceId [16]byte
+
+type SpanId [8]byte
+
+func (id TraceId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceId) IsValid() bool {
+	return id != TraceId{}
+}
+
+func (id SpanId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanId) IsValid() bool {
+	return id != SpanId{}
+}
+
+// fallbackIdSeq makes ids unique if crypto/rand fails
+var fallbackIdSeq uint64
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err == nil {
+		return
+	}
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().UnixNano())^atomic.AddUint64(&fallbackIdSeq, 1))
+}
+
+func NewTraceId() (id TraceId) {
+	for !id.IsValid() {
+		randomBytes(id[:])
+	}
+	return
+}
+
+func NewSpanId() (id SpanId) {
+	for !id.IsValid() {
+		randomBytes(id[:])
+	}
+	return
+}
+
+// SpanContext identifies a span in a trace, it's propagated to child spans and remote peers
+type SpanContext struct {
+	TraceId TraceId
+	SpanId  SpanId
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceId.IsValid() && sc.SpanId.IsValid()
+}
+
+// Traceparent returns the W3C traceparent header value of the span context
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags |= traceFlagSampled
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceId.String(), sc.SpanId.String(), flags)
+}
+
+func decodeHexId(value string, out []byte) bool {
+	if len(value) != hex.EncodedLen(len(out)) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(out, []byte(value))
+	return err == nil
+}
+
+// ParseTraceparent parses the W3C traceparent header value, returns false if it's invalid
+func ParseTraceparent(value string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return
+	}
+	version := parts[0]
+	// version ff is invalid, and only version 00 has exactly 4 parts
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return
+	}
+	var versionByte [1]byte
+	var flags [1]byte
+	if !decodeHexId(version, versionByte[:]) || !decodeHexId(parts[3], flags[:]) {
+		return
+	}
+	if !decodeHexId(parts[1], sc.TraceId[:]) || !decodeHexId(parts[2], sc.SpanId[:]) {
+		return
+	}
+	if !sc.IsValid() {
+		return
+	}
+	sc.Sampled = flags[0]&traceFlagSampled != 0
+	ok = true
+	return
+}
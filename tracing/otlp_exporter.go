@@ -0,0 +1,169 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SpanExporter sends spans to a tracing backend
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+/**
+ * OtlpHttpExporter exports spans to an OpenTelemetry collector by OTLP/HTTP with JSON encoding
+ */
+type OtlpHttpExporter struct {
+	url         string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+}
+
+// NewOtlpHttpExporter create exporter posting to {url}, eg. http://127.0.0.1:4318/v1/traces
+func NewOtlpHttpExporter(url string, serviceName string, headers map[string]string, timeout time.Duration) *OtlpHttpExporter {
+	return &OtlpHttpExporter{
+		url:         url,
+		serviceName: serviceName,
+		headers:     headers,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
+
+// types of OTLP JSON encoding, see opentelemetry-proto/opentelemetry/proto/collector/trace/v1
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is encoded as string in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportTraceServiceRequest struct {
+	ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpValueOf(value interface{}) otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	}
+	s := fmt.Sprintf("%v", value)
+	return otlpAnyValue{StringValue: &s}
+}
+
+func toOtlpSpan(span *Span) *otlpSpan {
+	endTime, attributes, statusError, statusMessage := span.snapshot()
+	result := &otlpSpan{
+		TraceId:           span.Context.TraceId.String(),
+		SpanId:            span.Context.SpanId.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(endTime.UnixNano(), 10),
+	}
+	if span.ParentSpanId.IsValid() {
+		result.ParentSpanId = span.ParentSpanId.String()
+	}
+	for key, value := range attributes {
+		result.Attributes = append(result.Attributes, otlpKeyValue{Key: key, Value: otlpValueOf(value)})
+	}
+	if statusError {
+		result.Status = otlpStatus{Code: 2, Message: statusMessage}
+	}
+	return result
+}
+
+func (e *OtlpHttpExporter) encode(spans []*Span) ([]byte, error) {
+	scopeSpans := &otlpScopeSpans{}
+	scopeSpans.Scope.Name = "jsonrpc_proxygo"
+	for _, span := range spans {
+		scopeSpans.Spans = append(scopeSpans.Spans, toOtlpSpan(span))
+	}
+	resourceSpans := &otlpResourceSpans{ScopeSpans: []*otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpValueOf(e.serviceName)}}
+	return json.Marshal(&otlpExportTraceServiceRequest{ResourceSpans: []*otlpResourceSpans{resourceSpans}})
+}
+
+func (e *OtlpHttpExporter) ExportSpans(spans []*Span) (err error) {
+	if len(spans) < 1 {
+		return
+	}
+	body, err := e.encode(spans)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		err = fmt.Errorf("otlp collector responds status %d", res.StatusCode)
+		return
+	}
+	return
+}
@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// span kinds, same values as OTLP
+const (
+	SPAN_KIND_INTERNAL SpanKind = 1
+	SPAN_KIND_SERVER   SpanKind = 2
+	SPAN_KIND_CLIENT   SpanKind = 3
+)
+
+/**
+ * Span is a timed operation of a trace. methods of nil *Span do nothing, so callers needn't check whether tracing is on
+ */
+type Span struct {
+	tracer *Tracer
+
+	Name         string
+	Kind         SpanKind
+	Context      SpanContext
+	ParentSpanId SpanId // invalid if the span is root
+	StartTime    time.Time
+
+	lock          sync.Mutex
+	endTime       time.Time
+	attributes    map[string]interface{}
+	statusError   bool
+	statusMessage string
+}
+
+// SpanContext returns the context of the span, invalid if span is nil
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// SetAttribute set a string, bool, int64 or float64 attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+}
+
+// SetError mark the span failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statusError = true
+	s.statusMessage = message
+}
+
+// End finish the span and export it if sampled, only the first call works
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+func (s *Span) EndAt(endTime time.Time) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if !s.endTime.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.endTime = endTime
+	s.lock.Unlock()
+	if s.Context.Sampled && s.tracer != nil {
+		s.tracer.onEnd(s)
+	}
+}
+
+// snapshot returns the fields changed after started, safe to read while the span is being modified
+func (s *Span) snapshot() (endTime time.Time, attributes map[string]interface{}, statusError bool, statusMessage string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	attributes = make(map[string]interface{}, len(s.attributes))
+	for k, v := range s.attributes {
+		attributes[k] = v
+	}
+	return s.endTime, attributes, s.statusError, s.statusMessage
+}
+
+/**
+ * Tracer starts spans and sends the ended spans to its processor
+ */
+type Tracer struct {
+	processor SpanProcessor // nil means spans are not exported
+}
+
+// SpanProcessor receives ended spans, eg. BatchSpanProcessor exporting spans in batches
+type SpanProcessor interface {
+	OnEnd(span *Span)
+	Shutdown() error
+}
+
+func NewTracer(processor SpanProcessor) *Tracer {
+	return &Tracer{
+		processor: processor,
+	}
+}
+
+// StartSpanAt start a span at {startTime}, it's a child span of {parent} if parent is valid, otherwise a root span of a new trace
+func (t *Tracer) StartSpanAt(name string, kind SpanKind, parent SpanContext, startTime time.Time) *Span {
+	span := &Span{
+		tracer:    t,
+		Name:      name,
+		Kind:      kind,
+		StartTime: startTime,
+	}
+	if parent.IsValid() {
+		span.Context = SpanContext{TraceId: parent.TraceId, SpanId: NewSpanId(), Sampled: parent.Sampled}
+		span.ParentSpanId = parent.SpanId
+	} else {
+		span.Context = SpanContext{TraceId: NewTraceId(), SpanId: NewSpanId(), Sampled: true}
+	}
+	return span
+}
+
+func (t *Tracer) StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	return t.StartSpanAt(name, kind, parent, time.Now())
+}
+
+func (t *Tracer) onEnd(span *Span) {
+	if t.processor != nil {
+		t.processor.OnEnd(span)
+	}
+}
+
+// Shutdown export the remaining spans and stop the processor
+func (t *Tracer) Shutdown() error {
+	if t.processor == nil {
+		return nil
+	}
+	return t.processor.Shutdown()
+}
+
+var (
+	defaultTracerLock sync.RWMutex
+	defaultTracer     = NewTracer(nil) // ids are generated but spans are not exported until tracing is configured
+)
+
+// SetDefaultTracer replace the tracer used by the proxy server and middlewares
+func SetDefaultTracer(t *Tracer) {
+	defaultTracerLock.Lock()
+	defer defaultTracerLock.Unlock()
+	defaultTracer = t
+}
+
+func DefaultTracer() *Tracer {
+	defaultTracerLock.RLock()
+	defer defaultTracerLock.RUnlock()
+	return defaultTracer
+}
+
+func StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+	return DefaultTracer().StartSpan(name, kind, parent)
+}
+
+func StartSpanAt(name string, kind SpanKind, parent SpanContext, startTime time.Time) *Span {
+	return DefaultTracer().StartSpanAt(name, kind, parent, startTime)
+}
+
+func Shutdown() error {
+	return DefaultTracer().Shutdown()
+}
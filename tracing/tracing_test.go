@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceparent(t *testing.T) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceId.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanId.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	sc, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.True(t, ok)
+	assert.False(t, sc.Sampled)
+
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		_, ok = ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+	// future versions may have more fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+}
+
+func TestExportSpansToCollector(t *testing.T) {
+	var lock sync.Mutex
+	var received []*otlpSpan
+	var serviceName string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &otlpExportTraceServiceRequest{}
+		assert.Nil(t, json.Unmarshal(body, req))
+		lock.Lock()
+		defer lock.Unlock()
+		for _, resourceSpans := range req.ResourceSpans {
+			serviceName = *resourceSpans.Resource.Attributes[0].Value.StringValue
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				received = append(received, scopeSpans.Spans...)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	exporter := NewOtlpHttpExporter(collector.URL+"/v1/traces", "test_proxy", map[string]string{"X-Token": "secret"}, time.Second)
+	tracer := NewTracer(NewBatchSpanProcessor(exporter, 10, time.Hour, 100))
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server := tracer.StartSpan("eth_call", SPAN_KIND_SERVER, parent)
+	server.SetAttribute("rpc.method", "eth_call")
+	client := tracer.StartSpan("upstream eth_call", SPAN_KIND_CLIENT, server.SpanContext())
+	client.SetError("upstream timeout")
+	client.End()
+	client.End() // ended only once
+	server.End()
+	// spans of not sampled traces are not exported
+	notSampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	tracer.StartSpan("eth_blockNumber", SPAN_KIND_SERVER, notSampled).End()
+	assert.Nil(t, tracer.Shutdown())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, "test_proxy", serviceName)
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, "upstream eth_call", received[0].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", received[0].TraceId)
+	assert.Equal(t, server.SpanContext().SpanId.String(), received[0].ParentSpanId)
+	assert.Equal(t, SPAN_KIND_CLIENT, received[0].Kind)
+	assert.Equal(t, 2, received[0].Status.Code)
+	assert.Equal(t, "00f067aa0ba902b7", received[1].ParentSpanId)
+	assert.Equal(t, "rpc.method", received[1].Attributes[0].Key)
+	assert.Equal(t, "eth_call", *received[1].Attributes[0].Value.StringValue)
+}
+
+func TestNilSpan(t *testing.T) {
+	var span *Span
+	span.SetAttribute("key", "value")
+	span.SetError("error")
+	span.End()
+	assert.False(t, span.SpanContext().IsValid())
+	root := NewTracer(nil).StartSpan("root", SPAN_KIND_INTERNAL, span.SpanContext())
+	assert.True(t, root.SpanContext().IsValid())
+	assert.False(t, root.ParentSpanId.IsValid())
+}
@@ -0,0 +1,477 @@
+package utils
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	EVICTION_LRU = "lru"
+	EVICTION_LFU = "lfu"
+)
+
+// estimated memory used by an entry besides its key and value
+const boundedCacheEntryOverhead = 96
+
+// min interval of scanning all entries for expired ones when the cache is full,
+// expired entries are also removed lazily when read or chosen to evict
+const boundedCacheExpiredScanInterval = time.Second
+
+type boundedCacheEntry struct {
+	key        string
+	group      string
+	value      []byte
+	size       int64
+	expiration int64 // unix nano, 0 means never expire
+	hits       int64
+	accessSeq  uint64 // increased on every access, the order of LRU
+	element    *list.Element
+	heapIndex  int
+}
+
+func (e *boundedCacheEntry) expired(now int64) bool {
+	return e.expiration > 0 && now > e.expiration
+}
+
+// evictionList orders entries of a group, peek returns the next entry to evict
+type evictionList interface {
+	push(e *boundedCacheEntry)
+	touch(e *boundedCacheEntry)
+	remove(e *boundedCacheEntry)
+	peek() *boundedCacheEntry
+	// peekExcept returns the next entry to evict other than {skip}
+	peekExcept(skip *boundedCacheEntry) *boundedCacheEntry
+}
+
+type lruList struct {
+	entries *list.List
+}
+
+func (l *lruList) push(e *boundedCacheEntry) {
+	e.element = l.entries.PushBack(e)
+}
+
+func (l *lruList) touch(e *boundedCacheEntry) {
+	l.entries.MoveToBack(e.element)
+}
+
+func (l *lruList) remove(e *boundedCacheEntry) {
+	l.entries.Remove(e.element)
+	e.element = nil
+}
+
+func (l *lruList) peek() *boundedCacheEntry {
+	front := l.entries.Front()
+	if front == nil {
+		return nil
+	}
+	return front.Value.(*boundedCacheEntry)
+}
+
+func (l *lruList) peekExcept(skip *boundedCacheEntry) *boundedCacheEntry {
+	for element := l.entries.Front(); element != nil; element = element.Next() {
+		if e := element.Value.(*boundedCacheEntry); e != skip {
+			return e
+		}
+	}
+	return nil
+}
+
+// lfuHeap is a min heap of entries by hits, least recently used first in the same hits
+type lfuHeap []*boundedCacheEntry
+
+func lfuLess(a *boundedCacheEntry, b *boundedCacheEntry) bool {
+	if a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.accessSeq < b.accessSeq
+}
+
+func (h lfuHeap) Len() int           { return len(h) }
+func (h lfuHeap) Less(i, j int) bool { return lfuLess(h[i], h[j]) }
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*boundedCacheEntry)
+	e.heapIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.heapIndex = -1
+	*h = old[:n-1]
+	return e
+}
+
+type lfuList struct {
+	entries lfuHeap
+}
+
+func (l *lfuList) push(e *boundedCacheEntry) {
+	heap.Push(&l.entries, e)
+}
+
+func (l *lfuList) touch(e *boundedCacheEntry) {
+	heap.Fix(&l.entries, e.heapIndex)
+}
+
+func (l *lfuList) remove(e *boundedCacheEntry) {
+	heap.Remove(&l.entries, e.heapIndex)
+}
+
+func (l *lfuList) peek() *boundedCacheEntry {
+	if len(l.entries) < 1 {
+		return nil
+	}
+	return l.entries[0]
+}
+
+func (l *lfuList) peekExcept(skip *boundedCacheEntry) *boundedCacheEntry {
+	if len(l.entries) < 1 || l.entries[0] != skip {
+		return l.peek()
+	}
+	// the next min of the heap is one of the children of the root
+	var result *boundedCacheEntry
+	for i := 1; i <= 2 && i < len(l.entries); i++ {
+		if result == nil || lfuLess(l.entries[i], result) {
+			result = l.entries[i]
+		}
+	}
+	return result
+}
+
+type boundedCacheGroup struct {
+	entries  evictionList
+	count    int64
+	bytes    int64
+	maxBytes int64 // 0 means no quota
+}
+
+type BoundedCacheOptions struct {
+	MaxItems      int64            // 0 means no limit
+	MaxBytes      int64            // 0 means no limit
+	Eviction      string           // EVICTION_LRU(default) or EVICTION_LFU
+	GroupMaxBytes map[string]int64 // memory quota of groups
+	GroupOfKey    func(key string) string
+}
+
+// BoundedCacheGroupStats is the usage of a group in BoundedCache
+type BoundedCacheGroupStats struct {
+	Entries  int64 `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+type BoundedCacheStats struct {
+	Entries     int64                              `json:"entries"`
+	Bytes       int64                              `json:"bytes"`
+	MaxItems    int64                              `json:"max_items"`
+	MaxBytes    int64                              `json:"max_bytes"`
+	Eviction    string                             `json:"eviction"`
+	Hits        int64                              `json:"hits"`
+	Misses      int64                              `json:"misses"`
+	Evictions   int64                              `json:"evictions"`
+	Expirations int64                              `json:"expirations"`
+	Groups      map[string]*BoundedCacheGroupStats `json:"groups"`
+}
+
+/**
+ * BoundedCache is a bytes cache limited by item count and memory bytes.
+ * entries are evicted by LRU or LFU policy, and groups(eg. rpc methods) can have their own memory quotas
+ */
+type BoundedCache struct {
+	options   BoundedCacheOptions
+	mu        sync.Mutex
+	items     map[string]*boundedCacheEntry
+	groups    map[string]*boundedCacheGroup
+	count     int64
+	bytes     int64
+	accessSeq uint64
+
+	lastExpiredScan int64 // unix nano
+
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+}
+
+func NewBoundedCache(options BoundedCacheOptions) *BoundedCache {
+	if options.Eviction != EVICTION_LFU {
+		options.Eviction = EVICTION_LRU
+	}
+	return &BoundedCache{
+		options: options,
+		items:   make(map[string]*boundedCacheEntry),
+		groups:  make(map[string]*boundedCacheGroup),
+	}
+}
+
+func (c *BoundedCache) groupOfKey(key string) string {
+	if c.options.GroupOfKey == nil {
+		return ""
+	}
+	return c.options.GroupOfKey(key)
+}
+
+func (c *BoundedCache) getGroup(name string) *boundedCacheGroup {
+	group, ok := c.groups[name]
+	if ok {
+		return group
+	}
+	group = &boundedCacheGroup{
+		maxBytes: c.options.GroupMaxBytes[name],
+	}
+	if c.options.Eviction == EVICTION_LFU {
+		group.entries = &lfuList{}
+	} else {
+		group.entries = &lruList{entries: list.New()}
+	}
+	c.groups[name] = group
+	return group
+}
+
+func (c *BoundedCache) less(a *boundedCacheEntry, b *boundedCacheEntry) bool {
+	if c.options.Eviction == EVICTION_LFU {
+		return lfuLess(a, b)
+	}
+	return a.accessSeq < b.accessSeq
+}
+
+func (c *BoundedCache) removeEntry(e *boundedCacheEntry) {
+	group := c.groups[e.group]
+	group.entries.remove(e)
+	group.count--
+	group.bytes -= e.size
+	if group.count <= 0 {
+		delete(c.groups, e.group)
+	}
+	delete(c.items, e.key)
+	c.count--
+	c.bytes -= e.size
+}
+
+// victim returns the next entry to evict among all groups other than {skip}
+func (c *BoundedCache) victim(skip *boundedCacheEntry) *boundedCacheEntry {
+	var result *boundedCacheEntry
+	for _, group := range c.groups {
+		candidate := group.entries.peekExcept(skip)
+		if candidate != nil && (result == nil || c.less(candidate, result)) {
+			result = candidate
+		}
+	}
+	return result
+}
+
+func (c *BoundedCache) deleteExpired(now int64) {
+	for _, e := range c.items {
+		if e.expired(now) {
+			c.removeEntry(e)
+			c.expirations++
+		}
+	}
+}
+
+// evict remove the entry to free space, counted as an expiration if it's expired already
+func (c *BoundedCache) evict(e *boundedCacheEntry, now int64) {
+	c.removeEntry(e)
+	if e.expired(now) {
+		c.expirations++
+	} else {
+		c.evictions++
+	}
+}
+
+func (c *BoundedCache) overLimits() bool {
+	return (c.options.MaxItems > 0 && c.count > c.options.MaxItems) ||
+		(c.options.MaxBytes > 0 && c.bytes > c.options.MaxBytes)
+}
+
+// Set add or replace the value of key. ttl <= 0 means never expire.
+// the new entry is never chosen to evict for itself.
+// returns false if the value is larger than the memory limit of the cache or its group
+func (c *BoundedCache) Set(key string, value []byte, ttl time.Duration) bool {
+	groupName := c.groupOfKey(key)
+	size := int64(len(key)+len(value)) + boundedCacheEntryOverhead
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.items[key]; ok {
+		c.removeEntry(old)
+	}
+	group := c.getGroup(groupName)
+	if (c.options.MaxBytes > 0 && size > c.options.MaxBytes) || (group.maxBytes > 0 && size > group.maxBytes) {
+		if group.count <= 0 {
+			delete(c.groups, groupName)
+		}
+		return false
+	}
+	c.accessSeq++
+	e := &boundedCacheEntry{
+		key:       key,
+		group:     groupName,
+		value:     value,
+		size:      size,
+		accessSeq: c.accessSeq,
+	}
+	if ttl > 0 {
+		e.expiration = time.Now().Add(ttl).UnixNano()
+	}
+	group.entries.push(e)
+	group.count++
+	group.bytes += size
+	c.items[key] = e
+	c.count++
+	c.bytes += size
+
+	now := time.Now().UnixNano()
+	for group.maxBytes > 0 && group.bytes > group.maxBytes {
+		victim := group.entries.peekExcept(e)
+		if victim == nil {
+			c.removeEntry(e)
+			return false
+		}
+		c.evict(victim, now)
+	}
+	if c.overLimits() && now-c.lastExpiredScan >= int64(boundedCacheExpiredScanInterval) {
+		c.lastExpiredScan = now
+		c.deleteExpired(now)
+	}
+	for c.overLimits() {
+		victim := c.victim(e)
+		if victim == nil {
+			c.removeEntry(e)
+			return false
+		}
+		c.evict(victim, now)
+	}
+	return true
+}
+
+func (c *BoundedCache) Get(key string) (value []byte, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.items[key]
+	if !found {
+		c.misses++
+		return
+	}
+	if e.expired(time.Now().UnixNano()) {
+		c.removeEntry(e)
+		c.expirations++
+		c.misses++
+		return
+	}
+	c.hits++
+	c.accessSeq++
+	e.accessSeq = c.accessSeq
+	e.hits++
+	c.groups[e.group].entries.touch(e)
+	return e.value, true
+}
+
+func (c *BoundedCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeEntry(e)
+	}
+}
+
+// DeleteExpired remove all expired entries
+func (c *BoundedCache) DeleteExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleteExpired(time.Now().UnixNano())
+}
+
+func (c *BoundedCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*boundedCacheEntry)
+	c.groups = make(map[string]*boundedCacheGroup)
+	c.count = 0
+	c.bytes = 0
+}
+
+// BoundedCacheEntryInfo is the snapshot of an entry in BoundedCache
+type BoundedCacheEntryInfo struct {
+	Key        string
+	Group      string
+	Value      []byte
+	Size       int64
+	Expiration int64 // unix nano, 0 means never expire
+	Hits       int64
+}
+
+// Entries returns at most {limit} unexpired entries whose keys are matched, limit <= 0 means no limit.
+// hits of entries are not changed
+func (c *BoundedCache) Entries(match func(key string) bool, limit int) (result []*BoundedCacheEntryInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UnixNano()
+	for key, e := range c.items {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if e.expired(now) || (match != nil && !match(key)) {
+			continue
+		}
+		result = append(result, &BoundedCacheEntryInfo{
+			Key:        key,
+			Group:      e.group,
+			Value:      e.value,
+			Size:       e.size,
+			Expiration: e.expiration,
+			Hits:       e.hits,
+		})
+	}
+	return
+}
+
+// DeleteMatched remove entries whose keys are matched, returns the count removed
+func (c *BoundedCache) DeleteMatched(match func(key string) bool) (count int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.items {
+		if match(key) {
+			c.removeEntry(e)
+			count++
+		}
+	}
+	return
+}
+
+func (c *BoundedCache) Stats() *BoundedCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := &BoundedCacheStats{
+		Entries:     c.count,
+		Bytes:       c.bytes,
+		MaxItems:    c.options.MaxItems,
+		MaxBytes:    c.options.MaxBytes,
+		Eviction:    c.options.Eviction,
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+		Groups:      make(map[string]*BoundedCacheGroupStats),
+	}
+	for name, group := range c.groups {
+		result.Groups[name] = &BoundedCacheGroupStats{
+			Entries:  group.count,
+			Bytes:    group.bytes,
+			MaxBytes: group.maxBytes,
+		}
+	}
+	return result
+}
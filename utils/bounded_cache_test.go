@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func groupByPrefix(key string) string {
+	return strings.Split(key, ":")[0]
+}
+
+func TestBoundedCacheLRU(t *testing.T) {
+	c := NewBoundedCache(BoundedCacheOptions{MaxItems: 2, GroupOfKey: groupByPrefix})
+	c.Set("a:1", []byte("1"), 0)
+	c.Set("b:2", []byte("2"), 0)
+	_, ok := c.Get("a:1")
+	assert.True(t, ok)
+	c.Set("a:3", []byte("3"), 0)
+	_, ok = c.Get("b:2")
+	assert.False(t, ok)
+	_, ok = c.Get("a:1")
+	assert.True(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(2), stats.Entries)
+	assert.Equal(t, int64(1), stats.Evictions)
+	assert.Equal(t, int64(2), stats.Groups["a"].Entries)
+	assert.Nil(t, stats.Groups["b"])
+}
+
+func TestBoundedCacheLFUAndQuota(t *testing.T) {
+	entrySize := int64(len("a:1")+10) + boundedCacheEntryOverhead
+	c := NewBoundedCache(BoundedCacheOptions{
+		MaxBytes:      entrySize * 3,
+		Eviction:      EVICTION_LFU,
+		GroupOfKey:    groupByPrefix,
+		GroupMaxBytes: map[string]int64{"b": entrySize},
+	})
+	value := make([]byte, 10)
+	c.Set("a:1", value, 0)
+	c.Set("a:2", value, 0)
+	c.Get("a:1")
+	c.Get("a:1")
+	c.Get("a:2")
+	c.Set("a:3", value, 0)
+	c.Set("a:4", value, 0) // a:3 is the least frequently used
+	_, ok := c.Get("a:3")
+	assert.False(t, ok)
+
+	// the quota of group b only evicts entries of b
+	c.Set("b:1", value, 0)
+	c.Set("b:2", value, 0)
+	_, ok = c.Get("b:1")
+	assert.False(t, ok)
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Groups["b"].Entries)
+	assert.True(t, stats.Bytes <= entrySize*3)
+	assert.False(t, c.Set("b:3", make([]byte, 1000), 0))
+}
+
+func TestBoundedCacheExpiration(t *testing.T) {
+	c := NewBoundedCache(BoundedCacheOptions{})
+	c.Set("k", []byte("v"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, ok := c.Get("k")
+	assert.False(t, ok)
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Expirations)
+	assert.Equal(t, int64(0), stats.Bytes)
+}
+
+func TestBoundedCacheKeepsNewEntry(t *testing.T) {
+	c := NewBoundedCache(BoundedCacheOptions{MaxItems: 2, Eviction: EVICTION_LFU})
+	c.Set("a", []byte("1"), 0)
+	c.Set("b", []byte("2"), 0)
+	c.Get("a")
+	c.Get("b")
+	// the new entry has no hits, but it's not evicted for itself
+	assert.True(t, c.Set("c", []byte("3"), 0))
+	_, ok := c.Get("c")
+	assert.True(t, ok)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), c.Stats().Entries)
+
+	// expired entries are removed before evicting unexpired ones
+	c = NewBoundedCache(BoundedCacheOptions{MaxItems: 2})
+	c.Set("x", []byte("1"), time.Millisecond)
+	c.Set("y", []byte("2"), 0)
+	time.Sleep(5 * time.Millisecond)
+	assert.True(t, c.Set("z", []byte("3"), 0))
+	_, ok = c.Get("y")
+	assert.True(t, ok)
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Expirations)
+	assert.Equal(t, int64(0), stats.Evictions)
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IpNetList is a list of CIDR ranges. single ip addresses are stored as /32 or /128 ranges
+type IpNetList []*net.IPNet
+
+// ParseIpNetList parse items like "10.0.0.0/8", "192.168.1.1" or "::1" to IpNetList
+func ParseIpNetList(items []string) (result IpNetList, err error) {
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if len(item) < 1 {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			_, ipNet, parseErr := net.ParseCIDR(item)
+			if parseErr != nil {
+				err = parseErr
+				return
+			}
+			result = append(result, ipNet)
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			err = fmt.Errorf("invalid ip address %s", item)
+			return
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 32
+		}
+		result = append(result, &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		})
+	}
+	return
+}
+
+// Contains check whether {ip} is in any range of the list
+func (list IpNetList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range list {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostOfAddr returns the ip of address like "127.0.0.1:1234" or "[::1]:1234"
+func HostOfAddr(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
+
+// ResolveClientIp find the real client ip of a http request.
+// X-Forwarded-For and X-Real-IP headers are only used when the peer {remoteAddr} is a trusted proxy,
+// and X-Forwarded-For is walked from right to left so a client can't forge its address by prepending items
+func ResolveClientIp(remoteAddr string, header http.Header, trustedProxies IpNetList) net.IP {
+	peerIp := HostOfAddr(remoteAddr)
+	if peerIp == nil || len(trustedProxies) < 1 || !trustedProxies.Contains(peerIp) || header == nil {
+		return peerIp
+	}
+	var forwarded []string
+	for _, value := range header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if len(item) > 0 {
+				forwarded = append(forwarded, item)
+			}
+		}
+	}
+	if len(forwarded) > 0 {
+		var leftmost net.IP
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			ip := HostOfAddr(forwarded[i])
+			if ip == nil {
+				// malformed item, can't trust anything before it
+				break
+			}
+			leftmost = ip
+			if !trustedProxies.Contains(ip) {
+				return ip
+			}
+		}
+		if leftmost != nil {
+			return leftmost
+		}
+		return peerIp
+	}
+	if realIp := HostOfAddr(strings.TrimSpace(header.Get("X-Real-IP"))); realIp != nil {
+		return realIp
+	}
+	return peerIp
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseJsonPath split json path like "0.to", "$.to", "$[0].to" or "params[1]" to tokens.
+// the leading "$" and "params" are optional and both mean the rpc params
+func ParseJsonPath(path string) []string {
+	path = strings.TrimSpace(path)
+	path = strings.TrimPrefix(path, "$")
+	if strings.HasPrefix(path, "params") && (len(path) == len("params") || path[len("params")] == '.' || path[len("params")] == '[') {
+		path = path[len("params"):]
+	}
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+	var tokens []string
+	for _, token := range strings.Split(path, ".") {
+		if len(token) > 0 {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// JsonPathGet get value by json path from value decoded by encoding/json.
+// number tokens index arrays, other tokens are object keys
+func JsonPathGet(value interface{}, path string) (result interface{}, ok bool) {
+	return JsonPathGetByTokens(value, ParseJsonPath(path))
+}
+
+func JsonPathGetByTokens(value interface{}, tokens []string) (result interface{}, ok bool) {
+	current := value
+	for _, token := range tokens {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, found := v[token]
+			if !found {
+				return
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(v) {
+				return
+			}
+			current = v[index]
+		default:
+			return
+		}
+	}
+	result = current
+	ok = true
+	return
+}
+
+// JsonPathDeleteByTokens remove the object field at tokens of value in place,
+// array elements are set to null to keep positions of others
+func JsonPathDeleteByTokens(value interface{}, tokens []string) {
+	if len(tokens) < 1 {
+		return
+	}
+	parent, ok := JsonPathGetByTokens(value, tokens[:len(tokens)-1])
+	if !ok {
+		return
+	}
+	last := tokens[len(tokens)-1]
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		delete(v, last)
+	case []interface{}:
+		index, err := strconv.Atoi(last)
+		if err == nil && index >= 0 && index < len(v) {
+			v[index] = nil
+		}
+	}
+}
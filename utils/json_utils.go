@@ -1,6 +1,11 @@
 package utils
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
 
 func JsonDumpsToStringSilently(value interface{}, defaultValue string) string {
 	b, err := json.Marshal(value)
@@ -9,3 +14,118 @@ func JsonDumpsToStringSilently(value interface{}, defaultValue string) string {
 	}
 	return string(b)
 }
+
+// DecodeJsonUseNumber decode json keeping numbers as json.Number, so big integers don't lose precision
+func DecodeJsonUseNumber(data []byte) (result interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&result)
+	return
+}
+
+// numbers with more digits than this are formatted in exponent notation, eg. 1e+200
+const maxPlainJsonNumberDigits = 100
+
+// normalizeJsonNumber format numbers with the same value to the same text, eg. 1.0, 1e0 and 1 => 1.
+// the literal is rewritten by its digits and exponent without converting to float64,
+// so numbers differing beyond float64 precision keep different texts
+func normalizeJsonNumber(n json.Number) json.Number {
+	literal := string(n)
+	negative := strings.HasPrefix(literal, "-")
+	literal = strings.TrimPrefix(literal, "-")
+	var exponent int64
+	if index := strings.IndexAny(literal, "eE"); index >= 0 {
+		e, err := strconv.ParseInt(literal[index+1:], 10, 32)
+		if err != nil {
+			return n
+		}
+		exponent = e
+		literal = literal[:index]
+	}
+	// the value is digits * 10^exponent
+	digits := literal
+	if index := strings.IndexByte(literal, '.'); index >= 0 {
+		digits = literal[:index] + literal[index+1:]
+		exponent -= int64(len(literal) - index - 1)
+	}
+	if len(digits) < 1 || strings.TrimLeft(digits, "0123456789") != "" {
+		return n
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if len(digits) < 1 {
+		return "0"
+	}
+	trimmed := strings.TrimRight(digits, "0")
+	exponent += int64(len(digits) - len(trimmed))
+	digits = trimmed
+
+	var builder strings.Builder
+	if negative {
+		builder.WriteByte('-')
+	}
+	digitsCount := int64(len(digits))
+	switch {
+	case exponent >= 0 && digitsCount+exponent <= maxPlainJsonNumberDigits:
+		builder.WriteString(digits)
+		builder.WriteString(strings.Repeat("0", int(exponent)))
+	case exponent < 0 && -exponent < maxPlainJsonNumberDigits && digitsCount <= maxPlainJsonNumberDigits:
+		if digitsCount > -exponent {
+			builder.WriteString(digits[:digitsCount+exponent])
+			builder.WriteByte('.')
+			builder.WriteString(digits[digitsCount+exponent:])
+		} else {
+			builder.WriteString("0.")
+			builder.WriteString(strings.Repeat("0", int(-exponent-digitsCount)))
+			builder.WriteString(digits)
+		}
+	default:
+		builder.WriteString(digits[:1])
+		if digitsCount > 1 {
+			builder.WriteByte('.')
+			builder.WriteString(digits[1:])
+		}
+		builder.WriteString("e")
+		builder.WriteString(strconv.FormatInt(exponent+digitsCount-1, 10))
+	}
+	return json.Number(builder.String())
+}
+
+func normalizeJsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		return normalizeJsonNumber(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeJsonValue(v[i])
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeJsonValue(item)
+		}
+	}
+	return value
+}
+
+// CanonicalJsonValue returns a deep copy of value decoded by encoding/json with normalized numbers
+func CanonicalJsonValue(value interface{}) (result interface{}, err error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	if result, err = DecodeJsonUseNumber(data); err != nil {
+		return
+	}
+	result = normalizeJsonValue(result)
+	return
+}
+
+// CanonicalJson encode value with sorted object keys and normalized numbers,
+// semantically identical values have the same encoding
+func CanonicalJson(value interface{}) (result []byte, err error) {
+	canonical, err := CanonicalJsonValue(value)
+	if err != nil {
+		return
+	}
+	// encoding/json sorts map keys
+	return json.Marshal(canonical)
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalJson(t *testing.T) {
+	a, err := DecodeJsonUseNumber([]byte(`{"to": "0x01", "value": 1.0, "data": {"b": [1e2, 2], "a": null}}`))
+	assert.True(t, err == nil)
+	b, err := DecodeJsonUseNumber([]byte(`{"data": {"a": null, "b": [100, 2.00]}, "value": 1, "to": "0x01"}`))
+	assert.True(t, err == nil)
+	aBytes, err := CanonicalJson(a)
+	assert.True(t, err == nil)
+	bBytes, err := CanonicalJson(b)
+	assert.True(t, err == nil)
+	assert.Equal(t, `{"data":{"a":null,"b":[100,2]},"to":"0x01","value":1}`, string(aBytes))
+	assert.Equal(t, string(aBytes), string(bBytes))
+
+	bigValues, err := CanonicalJson([]interface{}{map[string]interface{}{"n": 1.5}, uint64(12345678901234567890)})
+	assert.True(t, err == nil)
+	assert.Equal(t, `[{"n":1.5},12345678901234567890]`, string(bigValues))
+}
+
+func TestCanonicalJsonNumbers(t *testing.T) {
+	canonical := func(literal string) string {
+		value, err := DecodeJsonUseNumber([]byte(literal))
+		assert.True(t, err == nil)
+		result, err := CanonicalJson(value)
+		assert.True(t, err == nil)
+		return string(result)
+	}
+	assert.Equal(t, "0", canonical("-0.00e5"))
+	assert.Equal(t, "-120", canonical("-1.2e2"))
+	assert.Equal(t, "0.0015", canonical("15e-4"))
+	assert.Equal(t, "1.5e-200", canonical("0.15e-199"))
+	assert.Equal(t, "1e200", canonical("1000e197"))
+	// differ beyond float64 precision
+	assert.Equal(t, "12345678901234567891", canonical("12345678901234567891"))
+	assert.NotEqual(t, canonical("12345678901234567890"), canonical("12345678901234567891"))
+	assert.Equal(t, "0.10000000000000000001", canonical("0.100000000000000000010"))
+	assert.NotEqual(t, canonical("0.1"), canonical("0.10000000000000000001"))
+	uint256Max := "115792089237316195423570985008687907853269984665640564039457584007913129639935"
+	assert.Equal(t, uint256Max, canonical(uint256Max+".000"))
+}
+
+func TestJsonPathDelete(t *testing.T) {
+	value, err := DecodeJsonUseNumber([]byte(`[{"to": "0x01", "nonce": "0x5"}, "latest"]`))
+	assert.True(t, err == nil)
+	JsonPathDeleteByTokens(value, ParseJsonPath("0.nonce"))
+	JsonPathDeleteByTokens(value, ParseJsonPath("1"))
+	JsonPathDeleteByTokens(value, ParseJsonPath("2.missing"))
+	result, err := CanonicalJson(value)
+	assert.True(t, err == nil)
+	assert.Equal(t, `[{"to":"0x01"},null]`, string(result))
+}
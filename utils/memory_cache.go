@@ -238,6 +238,13 @@ func (c *MemoryCache) Increment(k string, n int64) error {
 	return nil
 }
 
+// Delete an item from the cache. Does nothing if the key is not in the cache.
+func (c *MemoryCache) Delete(k string) {
+	c.mu.Lock()
+	delete(c.items, k)
+	c.mu.Unlock()
+}
+
 // Delete all items from the cache.
 func (c *MemoryCache) Flush() {
 	c.mu.Lock()
@@ -7,3 +7,39 @@ func StringOrElse(val1 string, val2 string) string {
 	}
 	return val2
 }
+
+// GlobMatch check whether {s} matches the glob {pattern} like redis key patterns.
+// '*' matches any characters, '?' matches one character and '\' escapes the next character
+func GlobMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) < 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if GlobMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) < 1 {
+				return false
+			}
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) < 1 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) < 1
+}
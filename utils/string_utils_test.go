@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobMatch(t *testing.T) {
+	assert.True(t, GlobMatch("cache_rpc_eth_call$*", `cache_rpc_eth_call$[{"to":"0x01"},"latest"]`))
+	assert.False(t, GlobMatch("cache_rpc_eth_call$*", `cache_rpc_eth_callMany$[]`))
+	assert.True(t, GlobMatch("*", ""))
+	assert.True(t, GlobMatch("a?c*", "abcdef"))
+	assert.False(t, GlobMatch("a?c", "ac"))
+	assert.True(t, GlobMatch(`a\*c`, "a*c"))
+	assert.False(t, GlobMatch(`a\*c`, "abc"))
+}